@@ -37,10 +37,12 @@ type Federation struct {
   ns NameService
   grapher *grapher.Grapher
   queues map[string]*queue
+  pool *connPool
 }
 
 func NewFederation(userid, domain string, port int, mux *http.ServeMux, ns NameService, store store.BlobStore) *Federation {
   fed := &Federation{userID: userid, ns: ns, store: store, domain: domain, queues: make(map[string]*queue)}
+  fed.pool = newConnPool(DefaultMaxConnsPerPeer, DefaultIdleTimeout)
   f := func(w http.ResponseWriter, req *http.Request) {
     fed.handleRequest(w, req)
   }
@@ -53,11 +55,22 @@ func (self *Federation) SetGrapher(grapher *grapher.Grapher) {
   self.grapher = grapher
 }
 
+// Limits the number of connections which are kept open to the same remote server.
+// Connections which have been idle for idleTimeout nanoseconds are closed. Zero keeps them open.
+func (self *Federation) SetConnectionLimits(maxPerPeer int, idleTimeout int64) {
+  self.pool.setLimits(maxPerPeer, idleTimeout)
+}
+
+// Closes the connections to the remote servers. Afterwards, forwards and downloads fail.
+func (self *Federation) Close() {
+  self.pool.close()
+}
+
 func (self *Federation) getQueue(domain string) chan<- queueEntry {
   self.mutex.Lock()
   q, ok := self.queues[domain]
   if !ok {
-    ch := make(chan queueEntry)
+    ch := make(chan queueEntry, queueBuffer)
     q = newQueue(self, domain, ch)
     self.queues[domain] = q
   }
@@ -65,7 +78,11 @@ func (self *Federation) getQueue(domain string) chan<- queueEntry {
   return q.channel
 }
 
-func (self *Federation) Forward(blobref string, users []string) {  
+func (self *Federation) Forward(blobref string, users []string, priority ...int) {  
+  prio := grapher.Priority_Interactive
+  if len(priority) > 0 {
+    prio = priority[0]
+  }
   // Determine the servers that have to be informed
   urls := make(map[string]vec.StringVector)
   for _, user := range users {
@@ -93,7 +110,7 @@ func (self *Federation) Forward(blobref string, users []string) {
 
   for url, urlUsers := range urls {
     q := self.getQueue(url)
-    q <- queueEntry{urlUsers, blobref}
+    q <- queueEntry{users: urlUsers, blobref: blobref, priority: prio}
   }
 }
 
@@ -218,6 +235,39 @@ func (self *Federation) DownloadPermaNode(permission_blobref string) os.Error {
   return nil
 }
 
+// Downloads the current frontier of the perma node from the user 'from' and all blobs
+// which are not yet in the local store.
+func (self *Federation) PullPermaNode(perma_blobref string, from string) os.Error {
+  rawurl, err := self.ns.Lookup(from)
+  if err != nil {
+    return err
+  }
+  frontier, err := self.downloadFrontier(rawurl, perma_blobref)
+  if err != nil {
+    return err
+  }
+  return self.downloadMissingBlobs(rawurl, frontier)
+}
+
+// Like downloadBlobsRecursively, but stops at blobs which are already in the store.
+// Their dependencies must have been stored before.
+func (self *Federation) downloadMissingBlobs(rawurl string, blobrefs []string) (err os.Error) {
+  seen := make(map[string]bool)
+  for i := 0; i < len(blobrefs); i++ {
+    blobref := blobrefs[i]
+    if seen[blobref] || self.store.HasBlobs([]string{blobref})[0] {
+      continue
+    }
+    seen[blobref] = true
+    dependencies, err := self.downloadBlob(rawurl, blobref)
+    if err != nil {
+      return err
+    }
+    blobrefs = append(blobrefs, dependencies...)
+  }
+  return
+}
+
 // Downloads a permanode and all blobs up-to and including the frontier blobs.
 func (self *Federation) downloadBlobsRecursively(rawurl string, blobrefs []string) (err os.Error) {
   for i := 0; i < len(blobrefs); i++ {
@@ -237,19 +287,12 @@ type depSchema struct {
 
 func (self *Federation) downloadBlob(rawurl, blobref string) (dependencies []string, err os.Error) {
   // Get the blob
-  var client http.Client
-  req, err := client.Get(rawurl + "?blobref=" + http.URLEscape(blobref))
-  if err != nil {
-    return nil, err
-  }
   // TODO: Improve for large files
-  blob, err := ioutil.ReadAll(req.Body)
+  blob, err := self.pool.do("GET", rawurl + "?blobref=" + http.URLEscape(blobref), "", nil)
   if err != nil {
-    log.Printf("Error reading request body")
     return nil, err
   }
   log.Printf("Downloaded %v\n", string(blob))
-  req.Body.Close()
   self.store.StoreBlob(blob, "")
   // Check whether the retrieved blob is a schema blob
   mimetype := grapher.MimeType(blob)
@@ -267,18 +310,11 @@ func (self *Federation) downloadBlob(rawurl, blobref string) (dependencies []str
 
 func (self *Federation) downloadFrontier(rawurl string, blobref string) (frontier []string, err os.Error) {
   // Get the blob
-  var client http.Client
-  req, err := client.Get(rawurl + "?frontier=" + http.URLEscape(blobref))
+  blob, err := self.pool.do("GET", rawurl + "?frontier=" + http.URLEscape(blobref), "", nil)
   if err != nil {
     return nil, err
   }
   // Process the returned value
-  blob, err := ioutil.ReadAll(req.Body)
-  if err != nil {
-    log.Printf("Error reading request body")
-    return nil, err
-  }
-  req.Body.Close()
   err = json.Unmarshal(blob, &frontier)
   if err != nil {
     log.Printf("Malformed frontier response: %v\n", err)
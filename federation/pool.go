@@ -0,0 +1,238 @@
+package lightwavefed
+
+import (
+  "http"
+  "bufio"
+  "bytes"
+  "io/ioutil"
+  "net"
+  "os"
+  "strings"
+  "sync"
+  "time"
+  "fmt"
+)
+
+// -----------------------------------------------------
+// Connection pool
+//
+// Forwards and downloads reuse persistent connections to the remote servers instead
+// of dialing a new connection per request. Connections are pooled by peer, i.e. by the
+// host and port of the URL returned by the NameService.
+// At most maxPerPeer connections are open to the same peer. A request which finds
+// all of them busy waits until one is returned to the pool.
+// Connections which have not been used for idleTimeout nanoseconds are closed.
+// An idleTimeout of zero keeps idle connections open until the pool is closed.
+
+const (
+  DefaultMaxConnsPerPeer = 4
+  DefaultIdleTimeout = 60000000000
+)
+
+type pooledConn struct {
+  conn *http.ClientConn
+  // The time in nanoseconds when the connection has been returned to the pool
+  lastUsed int64
+}
+
+type peerConns struct {
+  // The connections which are currently not used by any request
+  idle []*pooledConn
+  // The number of open connections, including the idle ones
+  open int
+  // Signaled whenever a connection is returned to the pool or closed
+  cond *sync.Cond
+}
+
+type connPool struct {
+  mutex sync.Mutex
+  peers map[string]*peerConns
+  maxPerPeer int
+  idleTimeout int64
+  closed bool
+}
+
+func newConnPool(maxPerPeer int, idleTimeout int64) *connPool {
+  pool := &connPool{peers: make(map[string]*peerConns), maxPerPeer: maxPerPeer, idleTimeout: idleTimeout}
+  go pool.evict()
+  return pool
+}
+
+// Changes the limits of the pool. Connections which are already open are not affected.
+// An idleTimeout of zero disables the eviction of idle connections.
+func (self *connPool) setLimits(maxPerPeer int, idleTimeout int64) {
+  self.mutex.Lock()
+  self.maxPerPeer = maxPerPeer
+  self.idleTimeout = idleTimeout
+  for _, p := range self.peers {
+    p.cond.Broadcast()
+  }
+  self.mutex.Unlock()
+}
+
+// Sends a request to the peer and returns the body of the response.
+// A request which fails on a reused connection is repeated once on a new connection,
+// because the remote server may have closed the connection in the meantime.
+func (self *connPool) do(method, rawurl, contentType string, body []byte) (result []byte, err os.Error) {
+  url, err := http.ParseURL(rawurl)
+  if err != nil {
+    return nil, err
+  }
+  peer := url.Host
+  if strings.Index(peer, ":") == -1 {
+    peer += ":80"
+  }
+  for attempt := 0; attempt < 2; attempt++ {
+    pc, reused, err := self.get(peer)
+    if err != nil {
+      return nil, err
+    }
+    var req *http.Request
+    if body != nil {
+      req, err = http.NewRequest(method, rawurl, bytes.NewBuffer(body))
+    } else {
+      req, err = http.NewRequest(method, rawurl, nil)
+    }
+    if err != nil {
+      self.put(peer, pc, true)
+      return nil, err
+    }
+    if contentType != "" {
+      req.Header.Set("Content-Type", contentType)
+    }
+    resp, err := pc.conn.Do(req)
+    if err != nil {
+      self.put(peer, pc, false)
+      if reused {
+	continue
+      }
+      return nil, err
+    }
+    result, err = ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    self.put(peer, pc, err == nil && !resp.Close)
+    if err != nil {
+      return nil, err
+    }
+    if resp.StatusCode != 200 {
+      return nil, os.NewError(fmt.Sprintf("Request to %v failed with status %v", rawurl, resp.Status))
+    }
+    return result, nil
+  }
+  return nil, os.NewError("Failed sending request to " + rawurl)
+}
+
+// Returns an idle connection to the peer or dials a new one if the limit permits.
+// Otherwise blocks until a connection is returned to the pool.
+func (self *connPool) get(peer string) (pc *pooledConn, reused bool, err os.Error) {
+  self.mutex.Lock()
+  p, ok := self.peers[peer]
+  if !ok {
+    p = &peerConns{cond: sync.NewCond(&self.mutex)}
+    self.peers[peer] = p
+  }
+  for {
+    if self.closed {
+      self.mutex.Unlock()
+      return nil, false, os.NewError("Connection pool has been closed")
+    }
+    if len(p.idle) > 0 {
+      pc = p.idle[len(p.idle) - 1]
+      p.idle = p.idle[:len(p.idle) - 1]
+      self.mutex.Unlock()
+      return pc, true, nil
+    }
+    if p.open < self.maxPerPeer {
+      break
+    }
+    p.cond.Wait()
+  }
+  p.open++
+  self.mutex.Unlock()
+  c, err := net.Dial("tcp", peer)
+  if err != nil {
+    self.mutex.Lock()
+    p.open--
+    p.cond.Signal()
+    self.mutex.Unlock()
+    return nil, false, err
+  }
+  return &pooledConn{conn: http.NewClientConn(c, bufio.NewReader(c))}, false, nil
+}
+
+// Returns a connection to the pool. If reuse is false, the connection is closed instead.
+func (self *connPool) put(peer string, pc *pooledConn, reuse bool) {
+  self.mutex.Lock()
+  p := self.peers[peer]
+  if reuse && !self.closed {
+    pc.lastUsed = time.Nanoseconds()
+    p.idle = append(p.idle, pc)
+  } else {
+    pc.conn.Close()
+    p.open--
+  }
+  p.cond.Signal()
+  self.mutex.Unlock()
+}
+
+// Periodically closes the connections which have been idle for too long.
+func (self *connPool) evict() {
+  for {
+    self.mutex.Lock()
+    timeout := self.idleTimeout
+    self.mutex.Unlock()
+    // Eviction is disabled? Check again later whether it has been enabled in the meantime
+    if timeout <= 0 {
+      timeout = DefaultIdleTimeout
+    }
+    time.Sleep(timeout / 2)
+    if !self.evictIdle() {
+      return
+    }
+  }
+}
+
+// Closes the connections which have been idle for too long.
+// Returns false if the pool has been closed.
+func (self *connPool) evictIdle() bool {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if self.closed {
+    return false
+  }
+  if self.idleTimeout <= 0 {
+    return true
+  }
+  now := time.Nanoseconds()
+  for peer, p := range self.peers {
+    idle := []*pooledConn{}
+    for _, pc := range p.idle {
+      if now - pc.lastUsed >= self.idleTimeout {
+	pc.conn.Close()
+	p.open--
+      } else {
+	idle = append(idle, pc)
+      }
+    }
+    p.idle = idle
+    if p.open == 0 {
+      self.peers[peer] = nil, false
+    }
+  }
+  return true
+}
+
+// Closes all idle connections. Connections which are in use are closed when they are returned.
+func (self *connPool) close() {
+  self.mutex.Lock()
+  self.closed = true
+  for _, p := range self.peers {
+    for _, pc := range p.idle {
+      pc.conn.Close()
+      p.open--
+    }
+    p.idle = nil
+    p.cond.Broadcast()
+  }
+  self.mutex.Unlock()
+}
@@ -0,0 +1,102 @@
+package lightwavefed
+
+import (
+  "testing"
+  "http"
+  "net"
+  "os"
+  "sync"
+  "time"
+)
+
+// Counts the connections accepted by the test server
+type countingListener struct {
+  net.Listener
+  mutex sync.Mutex
+  count int
+}
+
+func (self *countingListener) Accept() (c net.Conn, err os.Error) {
+  c, err = self.Listener.Accept()
+  if err == nil {
+    self.mutex.Lock()
+    self.count++
+    self.mutex.Unlock()
+  }
+  return
+}
+
+// Returns the number of accepted connections
+func (self *countingListener) connections() int {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return self.count
+}
+
+func TestConnectionPool(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  cl := &countingListener{Listener: l}
+  defer cl.Close()
+  go http.Serve(cl, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    w.Write([]byte("ok"))
+  }))
+
+  pool := newConnPool(2, DefaultIdleTimeout)
+  defer pool.close()
+  rawurl := "http://" + l.Addr().String() + "/fed"
+  for i := 0; i < 5; i++ {
+    result, err := pool.do("POST", rawurl, "application/octet-stream", []byte("blob"))
+    if err != nil {
+      t.Fatal(err.String())
+    }
+    if string(result) != "ok" {
+      t.Fatalf("Unexpected response %v", string(result))
+    }
+  }
+  if n := cl.connections(); n != 1 {
+    t.Fatalf("Sequential requests should reuse one connection, but %v were opened", n)
+  }
+
+  // Concurrent requests do not open more connections than permitted
+  done := make(chan bool)
+  for i := 0; i < 10; i++ {
+    go func() {
+      _, err := pool.do("GET", rawurl, "", nil)
+      if err != nil {
+	t.Error(err.String())
+      }
+      done <- true
+    }()
+  }
+  for i := 0; i < 10; i++ {
+    <-done
+  }
+  if n := cl.connections(); n > 2 {
+    t.Fatalf("At most 2 connections should be open, but %v were opened", n)
+  }
+
+  // Without an idle timeout, idle connections are kept open
+  pool.setLimits(2, 0)
+  time.Sleep(2000000)
+  pool.evictIdle()
+  pool.mutex.Lock()
+  _, ok := pool.peers[l.Addr().String()]
+  pool.mutex.Unlock()
+  if !ok {
+    t.Fatal("Idle connections must not be closed without an idle timeout")
+  }
+
+  // Idle connections are evicted
+  pool.setLimits(2, 1000000)
+  time.Sleep(2000000)
+  pool.evictIdle()
+  pool.mutex.Lock()
+  _, ok = pool.peers[l.Addr().String()]
+  pool.mutex.Unlock()
+  if ok {
+    t.Fatal("Idle connections should have been closed")
+  }
+}
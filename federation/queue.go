@@ -0,0 +1,83 @@
+package lightwavefed
+
+import (
+  grapher "lightwavegrapher"
+  vec "container/vector"
+  "log"
+)
+
+// The number of entries a queue accepts before Forward blocks
+const queueBuffer = 1000
+
+type queueEntry struct {
+  users vec.StringVector
+  blobref string
+  priority int
+}
+
+// A queue sends blobs to one remote server.
+// Interactive blobs overtake bulk blobs that are still waiting to be sent.
+type queue struct {
+  fed *Federation
+  rawurl string
+  channel chan queueEntry
+  interactive []queueEntry
+  bulk []queueEntry
+}
+
+func newQueue(fed *Federation, rawurl string, ch chan queueEntry) *queue {
+  q := &queue{fed: fed, rawurl: rawurl, channel: ch}
+  go q.run()
+  return q
+}
+
+func (self *queue) run() {
+  for {
+    // Nothing to send? Then wait for the next entry
+    if len(self.interactive) == 0 && len(self.bulk) == 0 {
+      self.push(<-self.channel)
+    }
+    // Fetch all entries that arrived in the meantime
+    self.drain()
+    var e queueEntry
+    if len(self.interactive) > 0 {
+      e = self.interactive[0]
+      self.interactive = self.interactive[1:]
+    } else {
+      e = self.bulk[0]
+      self.bulk = self.bulk[1:]
+    }
+    self.send(e)
+  }
+}
+
+func (self *queue) drain() {
+  for {
+    select {
+    case e := <-self.channel:
+      self.push(e)
+    default:
+      return
+    }
+  }
+}
+
+func (self *queue) push(e queueEntry) {
+  if e.priority == grapher.Priority_Bulk {
+    self.bulk = append(self.bulk, e)
+  } else {
+    self.interactive = append(self.interactive, e)
+  }
+}
+
+func (self *queue) send(e queueEntry) {
+  blob, err := self.fed.store.GetBlob(e.blobref)
+  if err != nil {
+    log.Printf("Err: Cannot forward unknown blob %v\n", e.blobref)
+    return
+  }
+  _, err = self.fed.pool.do("POST", self.rawurl, "application/octet-stream", blob)
+  if err != nil {
+    log.Printf("Err: Failed forwarding %v to %v: %v\n", e.blobref, self.rawurl, err)
+  }
+}
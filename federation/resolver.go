@@ -0,0 +1,94 @@
+package lightwavefed
+
+import (
+  "fmt"
+  "net"
+  "os"
+  "strings"
+)
+
+// -----------------------------------------------------
+// Domain resolution
+//
+// Users are addressed as 'user@domain'. The domain tells which server hosts the user,
+// but not how to reach it over the network. A DomainResolver maps a domain to the
+// network address of its server. Tests and demos use a StaticResolver, real deployments
+// publish SRV records of the form '_lightwave._tcp.domain' and use an SRVResolver.
+
+// The service name used in SRV records
+const SRVService = "lightwave"
+
+type DomainResolver interface {
+  // Returns a string of the form "hostname:port" or "IP-address:port".
+  Resolve(domain string) (addr string, err os.Error)
+}
+
+// Returns the domain part of a user ID of the form 'user@domain'.
+func UserDomain(userid string) (domain string, err os.Error) {
+  i := strings.LastIndex(userid, "@")
+  if i == -1 || i == len(userid) - 1 {
+    return "", os.NewError("Malformed user ID " + userid)
+  }
+  return userid[i+1:], nil
+}
+
+// Returns the network address of the server hosting the user.
+func ResolveUser(resolver DomainResolver, userid string) (addr string, err os.Error) {
+  domain, err := UserDomain(userid)
+  if err != nil {
+    return "", err
+  }
+  return resolver.Resolve(domain)
+}
+
+// Maps domains to fixed addresses. Meant for tests and demos.
+type StaticResolver map[string]string
+
+func (self StaticResolver) Resolve(domain string) (addr string, err os.Error) {
+  addr, ok := self[domain]
+  if !ok {
+    return "", os.NewError("Unknown domain " + domain)
+  }
+  return addr, nil
+}
+
+// Looks up the SRV records of the domain for the service SRVService over TCP.
+// The record with the best priority is used.
+type SRVResolver struct {
+  // If not zero, domains without SRV records resolve to the domain itself at this port,
+  // i.e. the address is looked up via A-records when connecting.
+  DefaultPort int
+}
+
+func (self *SRVResolver) Resolve(domain string) (addr string, err os.Error) {
+  _, addrs, err := net.LookupSRV(SRVService, "tcp", domain)
+  if err != nil || len(addrs) == 0 {
+    if self.DefaultPort != 0 {
+      return fmt.Sprintf("%v:%v", domain, self.DefaultPort), nil
+    }
+    if err == nil {
+      err = os.NewError("No SRV record for domain " + domain)
+    }
+    return "", err
+  }
+  // LookupSRV sorts the records by priority and weight
+  return fmt.Sprintf("%v:%v", strings.TrimRight(addrs[0].Target, "."), addrs[0].Port), nil
+}
+
+// Implements the NameService interface on top of a DomainResolver.
+// Users are reached via HTTP at the '/fed' path of the server hosting their domain.
+type resolverNameService struct {
+  resolver DomainResolver
+}
+
+func NewResolverNameService(resolver DomainResolver) NameService {
+  return &resolverNameService{resolver: resolver}
+}
+
+func (self *resolverNameService) Lookup(userid string) (url string, err os.Error) {
+  addr, err := ResolveUser(self.resolver, userid)
+  if err != nil {
+    return "", err
+  }
+  return fmt.Sprintf("http://%v/fed", addr), nil
+}
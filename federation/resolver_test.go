@@ -0,0 +1,22 @@
+package lightwavefed
+
+import (
+  "testing"
+)
+
+func TestStaticResolver(t *testing.T) {
+  resolver := StaticResolver{"alice": "localhost:8181", "bob": "localhost:8282"}
+  if addr, err := ResolveUser(resolver, "b@bob"); err != nil || addr != "localhost:8282" {
+    t.Fatalf("Wrong address %v: %v", addr, err)
+  }
+  if _, err := ResolveUser(resolver, "c@charly"); err == nil {
+    t.Fatal("Expected an error for an unknown domain")
+  }
+  if _, err := ResolveUser(resolver, "alice"); err == nil {
+    t.Fatal("Expected an error for a malformed user ID")
+  }
+  ns := NewResolverNameService(resolver)
+  if url, err := ns.Lookup("a@alice"); err != nil || url != "http://localhost:8181/fed" {
+    t.Fatalf("Wrong URL %v: %v", url, err)
+  }
+}
@@ -0,0 +1,825 @@
+package lightwavefed
+
+import (
+  idx "lightwaveidx"
+  store "lightwavestore"
+  "bufio"
+  "crypto/rand"
+  "encoding/binary"
+  "github.com/agl/ed25519"
+  "io"
+  "json"
+  "log"
+  "net"
+  "os"
+  "sync"
+  "time"
+)
+
+// -----------------------------------------------------
+// TCP federation
+//
+// Connects the indexers of users hosted on different servers. Each server listens on a TCP port.
+// The server of a user is found by resolving the domain part of the user ID with a DomainResolver.
+// All messages are frames of the form
+//   <kind: 1 byte> <length: 4 bytes> <blobref> <length: 4 bytes> <data>
+// where the lengths are in big-endian byte order.
+// When a connection has been accepted, the server sends a challenge frame carrying a random nonce.
+// The client answers with a hello frame carrying its user ID as blobref and the ed25519 signature
+// of the nonce and the domain of the server which it dialed as data. Servers close connections of users
+// whose signature is bad or names another domain, such that a server cannot relay the challenge of
+// another server to its clients and log in there on their behalf.
+// Without a KeyRing the claimed user ID cannot be verified. Hence such a federation accepts forwarded
+// blobs, which are checked by the indexer, but neither serves nor issues downloads, requests and fetches.
+// Forwarded blobs are queued per remote server, i.e. per domain. The sender goroutine of the server
+// resolves the domain when it connects, such that forwarding never waits for DNS lookups.
+// While a server is unreachable the blobs remain queued and the connection is retried after a backoff which doubles with every failed attempt.
+// A download asks the server of a user for all blobs of a perma node. The server streams them
+// in dependency order as blob frames followed by an end frame, provided that the user may read
+// the perma node. Otherwise it answers with an error frame.
+// A user who accepted an invitation fetches the blobs on which the invitation depends one by one
+// from the server of the inviter, following the dependencies until the local store has them all.
+
+const (
+  // Sent by the server on a new connection. The data is a random nonce
+  tcpChallenge = iota + 1
+  // Answers the challenge. The blobref is the user ID, the data is the signature of the nonce and the server domain
+  tcpHello
+  // A blob for the receiver
+  tcpBlob
+  // Asks for all blobs of the perma node named by the blobref
+  tcpDownload
+  // Like tcpDownload, but includes the children of the perma node recursively
+  tcpDownloadSubtree
+  // Asks for a single blob. Only answered if the blob is available
+  tcpRequest
+  // Asks for a single blob. Answered by a blob frame or an error frame
+  tcpFetch
+  // Terminates the answer to a download
+  tcpEnd
+  // Terminates the answer to a failed download. The data is the error message
+  tcpError
+)
+
+const (
+  // The port used for domains without SRV records
+  DefaultTCPPort = 8282
+  // The delay in nanoseconds before the first attempt to reconnect to an unreachable server
+  DefaultMinBackoff = 100000000
+  // The maximum delay in nanoseconds between two attempts to connect to an unreachable server
+  DefaultMaxBackoff = 60000000000
+  // Longer blobrefs or blobs are rejected
+  maxFrameLength = 64 << 20
+  nonceSize = 32
+)
+
+var (
+  ErrNoIndexer = os.NewError("No indexer has been set")
+  ErrNoKeyRing = os.NewError("Downloads require a KeyRing")
+)
+
+// Signatures of nonces carry this prefix. Since schema blobs start with '{',
+// a server cannot trick a client into signing a blob instead of a nonce.
+const helloPrefix = "lightwave-tcp-hello\n"
+
+// Returns the message signed by a hello, i.e. the prefix, the domain of the server and the nonce
+func helloMessage(domain string, nonce []byte) []byte {
+  return append([]byte(helloPrefix + domain + "\n"), nonce...)
+}
+
+type tcpFrame struct {
+  kind byte
+  blobref string
+  data []byte
+}
+
+// Implements the Federation interface of the indexer on top of TCP
+type TCPFederation struct {
+  listener net.Listener
+  keyRing idx.KeyRing
+  indexer *idx.Indexer
+  mutex sync.Mutex
+  resolver DomainResolver
+  // The keys are the domains of remote servers
+  peers map[string]*tcpPeer
+  minBackoff int64
+  maxBackoff int64
+  closed bool
+}
+
+// The connection to a remote server and the frames queued for it
+type tcpPeer struct {
+  fed *TCPFederation
+  // The domain of the server, which the hello names. It is resolved whenever the peer connects
+  domain string
+  mutex sync.Mutex
+  // Signaled when a frame is queued or the peer is closed
+  cond *sync.Cond
+  // Blob frames carry no data. The blob is loaded from the store when it is sent
+  queue []*tcpFrame
+  // nil while not connected
+  conn net.Conn
+  closed bool
+}
+
+// Listens for connections of other servers on listenAddr, for example ":8282".
+// The keyring authenticates the users of connecting servers and must hold the private key of the local user.
+// It may be nil, in which case connecting users are not authenticated and no blobs are downloaded, see ErrNoKeyRing.
+// By default domains are resolved by an SRVResolver falling back to DefaultTCPPort, see SetResolver.
+func NewTCPFederation(listenAddr string, keyring idx.KeyRing) (*TCPFederation, os.Error) {
+  l, err := net.Listen("tcp", listenAddr)
+  if err != nil {
+    return nil, err
+  }
+  fed := &TCPFederation{listener: l, keyRing: keyring, resolver: &SRVResolver{DefaultPort: DefaultTCPPort}, peers: make(map[string]*tcpPeer), minBackoff: DefaultMinBackoff, maxBackoff: DefaultMaxBackoff}
+  go fed.accept()
+  return fed, nil
+}
+
+func (self *TCPFederation) SetIndexer(indexer *idx.Indexer) {
+  self.indexer = indexer
+}
+
+func (self *TCPFederation) SetResolver(resolver DomainResolver) {
+  self.mutex.Lock()
+  self.resolver = resolver
+  self.mutex.Unlock()
+}
+
+// Changes the delays in nanoseconds between attempts to connect to an unreachable server.
+func (self *TCPFederation) SetBackoff(min, max int64) {
+  self.mutex.Lock()
+  self.minBackoff = min
+  self.maxBackoff = max
+  self.mutex.Unlock()
+}
+
+// Returns the address on which the federation listens
+func (self *TCPFederation) Addr() net.Addr {
+  return self.listener.Addr()
+}
+
+// Stops listening and closes the connections to the remote servers. Queued blobs are discarded.
+func (self *TCPFederation) Close() {
+  self.mutex.Lock()
+  self.closed = true
+  peers := []*tcpPeer{}
+  for _, p := range self.peers {
+    peers = append(peers, p)
+  }
+  self.mutex.Unlock()
+  self.listener.Close()
+  for _, p := range peers {
+    p.close()
+  }
+}
+
+func (self *TCPFederation) Forward(blobref string, users []string) {
+  self.ForwardBatch([]string{blobref}, users)
+}
+
+// Queues all blobs for each server at once. The domains are resolved by the sender goroutines of the
+// servers, hence ForwardBatch does not block on DNS lookups.
+func (self *TCPFederation) ForwardBatch(blobrefs []string, users []string) {
+  frames := make([]*tcpFrame, len(blobrefs))
+  for i, blobref := range blobrefs {
+    frames[i] = &tcpFrame{kind: tcpBlob, blobref: blobref}
+  }
+  for _, domain := range self.userDomains(users) {
+    self.peer(domain).push(frames...)
+  }
+}
+
+// Fetches the perma node to which the permission invites the local user and all blobs on which
+// the permission depends from the server of the inviting user.
+func (self *TCPFederation) DownloadPermaNode(permission_blobref string) os.Error {
+  if self.keyRing == nil {
+    return ErrNoKeyRing
+  }
+  blob, err := self.indexer.Store().GetBlob(permission_blobref)
+  if err != nil {
+    return err
+  }
+  var schema invitationSchema
+  if err = json.Unmarshal(blob, &schema); err != nil {
+    return err
+  }
+  return self.fetchClosure(schema.Signer, append([]string{schema.PermaNode, permission_blobref}, schema.Dependencies...))
+}
+
+// Downloads the perma node and its children from the server of the owner of the perma node.
+func (self *TCPFederation) DownloadSubtree(perma_blobref string) os.Error {
+  owner, err := self.indexer.OwnerOf(perma_blobref)
+  if err != nil {
+    return err
+  }
+  return self.download(tcpDownloadSubtree, perma_blobref, owner)
+}
+
+func (self *TCPFederation) PullPermaNode(perma_blobref string, from string) os.Error {
+  return self.download(tcpDownload, perma_blobref, from)
+}
+
+// Asks all servers to which blobs have been forwarded for the blob.
+func (self *TCPFederation) RequestBlob(blobref string) {
+  if self.keyRing == nil {
+    log.Printf("Err: Cannot request %v: %v\n", blobref, ErrNoKeyRing)
+    return
+  }
+  self.mutex.Lock()
+  peers := []*tcpPeer{}
+  for _, p := range self.peers {
+    peers = append(peers, p)
+  }
+  self.mutex.Unlock()
+  for _, p := range peers {
+    p.push(&tcpFrame{kind: tcpRequest, blobref: blobref})
+  }
+}
+
+// Returns the distinct domains of the users. The local user is skipped.
+func (self *TCPFederation) userDomains(users []string) (domains []string) {
+  seen := make(map[string]bool)
+  for _, user := range users {
+    if self.indexer != nil && user == self.indexer.UserID() {
+      continue
+    }
+    domain, err := UserDomain(user)
+    if err != nil {
+      log.Printf("Err: Cannot resolve the server of %v: %v\n", user, err)
+      continue
+    }
+    if !seen[domain] {
+      seen[domain] = true
+      domains = append(domains, domain)
+    }
+  }
+  return
+}
+
+func (self *TCPFederation) peer(domain string) *tcpPeer {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  p, ok := self.peers[domain]
+  if !ok {
+    p = &tcpPeer{fed: self, domain: domain, closed: self.closed}
+    p.cond = sync.NewCond(&p.mutex)
+    self.peers[domain] = p
+    go p.run()
+  }
+  return p
+}
+
+// Returns the delay before the next attempt to connect, given the previous delay
+func (self *TCPFederation) nextBackoff(backoff int64) int64 {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if backoff == 0 {
+    return self.minBackoff
+  }
+  backoff *= 2
+  if backoff > self.maxBackoff {
+    backoff = self.maxBackoff
+  }
+  return backoff
+}
+
+// -----------------------------------------------------
+// Client side
+
+// Connects to the server of the domain and authenticates the local user.
+// The returned reader must be used to read from the connection.
+func (self *TCPFederation) dial(domain, addr string) (c net.Conn, r *bufio.Reader, err os.Error) {
+  if c, err = net.Dial("tcp", addr); err != nil {
+    return nil, nil, err
+  }
+  r = bufio.NewReader(c)
+  challenge, err := readFrame(r)
+  if err == nil && challenge.kind != tcpChallenge {
+    err = os.NewError("Expected a challenge from " + addr)
+  }
+  var sig []byte
+  if err == nil {
+    sig, err = self.signNonce(domain, challenge.data)
+  }
+  if err == nil {
+    err = writeFrame(c, &tcpFrame{kind: tcpHello, blobref: self.indexer.UserID(), data: sig})
+  }
+  if err != nil {
+    c.Close()
+    return nil, nil, err
+  }
+  return c, r, nil
+}
+
+// Signs the nonce sent by the server of the domain. Without a KeyRing the signature is empty
+func (self *TCPFederation) signNonce(domain string, nonce []byte) ([]byte, os.Error) {
+  if self.keyRing == nil {
+    return nil, nil
+  }
+  key := self.keyRing.PrivateKey(self.indexer.UserID())
+  if key == nil {
+    return nil, idx.ErrNoPrivateKey
+  }
+  sig := ed25519.Sign(key, helloMessage(domain, nonce))
+  return sig[:], nil
+}
+
+// Asks the server of the user 'from' for the blobs of the perma node and stores them.
+// Blobs which are already in the store are skipped.
+func (self *TCPFederation) download(kind byte, perma_blobref, from string) os.Error {
+  if self.keyRing == nil {
+    return ErrNoKeyRing
+  }
+  domain, addr, err := self.resolveUser(from)
+  if err != nil {
+    return err
+  }
+  c, r, err := self.dial(domain, addr)
+  if err != nil {
+    return err
+  }
+  defer c.Close()
+  if err = writeFrame(c, &tcpFrame{kind: kind, blobref: perma_blobref}); err != nil {
+    return err
+  }
+  for err == nil {
+    var f *tcpFrame
+    if f, err = readFrame(r); err != nil {
+      break
+    }
+    switch f.kind {
+    case tcpBlob:
+      self.storeBlob(f.blobref, f.data)
+    case tcpEnd:
+      return nil
+    case tcpError:
+      err = os.NewError(string(f.data))
+    default:
+      err = os.NewError("Unexpected frame in the download from " + addr)
+    }
+  }
+  return err
+}
+
+// Fetches the blobs from the server of the user 'from' and follows their dependencies and perma nodes
+// transitively. The parent of a perma node and the blobs reached from it are optional, since the local user
+// may not be allowed to read the parent. Failing to fetch them does not abort the fetch. Each blob is visited once, hence cycles do not matter. Blobs which are already in the
+// local store are not fetched, but their dependencies are followed, since they may still be missing.
+// The fetched blobs are stored in the order in which they arrive. Blobs arriving before their
+// dependencies wait in the indexer.
+func (self *TCPFederation) fetchClosure(from string, blobrefs []string) os.Error {
+  domain, addr, err := self.resolveUser(from)
+  if err != nil {
+    return err
+  }
+  var c net.Conn
+  var r *bufio.Reader
+  defer func() {
+    if c != nil {
+      c.Close()
+    }
+  }()
+  s := self.indexer.Store()
+  seen := make(map[string]bool)
+  // The blobs passed in and those reached from them without passing a perma node
+  required := make(map[string]bool)
+  for _, blobref := range blobrefs {
+    required[blobref] = true
+  }
+  for i := 0; i < len(blobrefs); i++ {
+    blobref := blobrefs[i]
+    if blobref == "" || seen[blobref] {
+      continue
+    }
+    seen[blobref] = true
+    blob, err := s.GetBlob(blobref)
+    if err != nil {
+      // Connect lazily, since all blobs may be present already
+      if c == nil {
+	if c, r, err = self.dial(domain, addr); err != nil {
+	  return err
+	}
+      }
+      if blob, err = fetch(c, r, blobref); err != nil {
+	if required[blobref] {
+	  return err
+	}
+	log.Printf("Skipping optional blob %v: %v\n", blobref, err)
+	continue
+      }
+      self.storeBlob(blobref, blob)
+    }
+    var schema struct {
+      Type string "type"
+      PermaNode string "perma"
+      Dependencies []string "dep"
+    }
+    if idx.MimeType(blob) != "application/x-lightwave-schema" || json.Unmarshal(blob, &schema) != nil {
+      continue
+    }
+    next := append([]string{schema.PermaNode}, schema.Dependencies...)
+    // The perma field of a child perma node names its parent, the dependencies belong to the parent as well
+    if required[blobref] && schema.Type != "permanode" {
+      for _, b := range next {
+	required[b] = true
+      }
+    }
+    blobrefs = append(blobrefs, next...)
+  }
+  return nil
+}
+
+// Returns the domain of the user and the network address of its server
+func (self *TCPFederation) resolveUser(userid string) (domain, addr string, err os.Error) {
+  self.mutex.Lock()
+  resolver := self.resolver
+  self.mutex.Unlock()
+  if domain, err = UserDomain(userid); err != nil {
+    return "", "", err
+  }
+  if addr, err = resolver.Resolve(domain); err != nil {
+    return "", "", err
+  }
+  return domain, addr, nil
+}
+
+// Asks the server for a single blob and waits for the answer
+func fetch(c net.Conn, r io.Reader, blobref string) ([]byte, os.Error) {
+  if err := writeFrame(c, &tcpFrame{kind: tcpFetch, blobref: blobref}); err != nil {
+    return nil, err
+  }
+  f, err := readFrame(r)
+  if err != nil {
+    return nil, err
+  }
+  switch {
+  case f.kind == tcpError:
+    return nil, os.NewError(string(f.data))
+  case f.kind != tcpBlob || f.blobref != blobref:
+    return nil, os.NewError("Unexpected answer when fetching " + blobref)
+  case store.NewBlobRef(f.data) != blobref:
+    return nil, os.NewError("Fetched blob does not match its blobref " + blobref)
+  }
+  return f.data, nil
+}
+
+// Stores a blob received from another server unless it is known already
+func (self *TCPFederation) storeBlob(blobref string, blob []byte) {
+  if self.indexer == nil {
+    log.Printf("Err: Received blob %v before the indexer has been set\n", blobref)
+    return
+  }
+  if store.NewBlobRef(blob) != blobref {
+    log.Printf("Err: Received blob does not match its blobref %v\n", blobref)
+    return
+  }
+  s := self.indexer.Store()
+  if s.HasBlobs([]string{blobref})[0] {
+    return
+  }
+  log.Printf("Received blob %v via federation\n", blobref)
+  if _, err := s.StoreBlob(blob, blobref); err != nil {
+    log.Printf("Err: Storing blob %v: %v\n", blobref, err)
+  }
+}
+
+func (self *tcpPeer) push(f ...*tcpFrame) {
+  self.mutex.Lock()
+  self.queue = append(self.queue, f...)
+  self.cond.Signal()
+  self.mutex.Unlock()
+}
+
+func (self *tcpPeer) pop() {
+  self.mutex.Lock()
+  self.queue = self.queue[1:]
+  self.mutex.Unlock()
+}
+
+func (self *tcpPeer) close() {
+  self.mutex.Lock()
+  self.closed = true
+  c := self.conn
+  self.conn = nil
+  self.cond.Broadcast()
+  self.mutex.Unlock()
+  if c != nil {
+    c.Close()
+  }
+}
+
+// Sends the queued frames in order. A frame is removed from the queue once it has been written.
+// While the server is unreachable the frames remain queued.
+func (self *tcpPeer) run() {
+  backoff := int64(0)
+  for {
+    self.mutex.Lock()
+    for len(self.queue) == 0 && !self.closed {
+      self.cond.Wait()
+    }
+    if self.closed {
+      self.mutex.Unlock()
+      return
+    }
+    f := self.queue[0]
+    c := self.conn
+    self.mutex.Unlock()
+    if f.kind == tcpBlob && f.data == nil {
+      blob, err := self.fed.indexer.Store().GetBlob(f.blobref)
+      if err != nil {
+	log.Printf("Err: Cannot forward unknown blob %v\n", f.blobref)
+	self.pop()
+	continue
+      }
+      f = &tcpFrame{kind: tcpBlob, blobref: f.blobref, data: blob}
+    }
+    if c == nil {
+      var err os.Error
+      if c, err = self.connect(); err != nil {
+	backoff = self.fed.nextBackoff(backoff)
+	log.Printf("Err: Cannot reach %v, retrying in %vms: %v\n", self.domain, backoff / 1000000, err)
+	time.Sleep(backoff)
+	continue
+      }
+      backoff = 0
+    }
+    if err := writeFrame(c, f); err != nil {
+      log.Printf("Err: Sending to %v failed: %v\n", self.domain, err)
+      self.disconnect(c)
+      continue
+    }
+    self.pop()
+  }
+}
+
+func (self *tcpPeer) connect() (net.Conn, os.Error) {
+  self.fed.mutex.Lock()
+  resolver := self.fed.resolver
+  self.fed.mutex.Unlock()
+  addr, err := resolver.Resolve(self.domain)
+  if err != nil {
+    return nil, err
+  }
+  c, r, err := self.fed.dial(self.domain, addr)
+  if err != nil {
+    return nil, err
+  }
+  self.mutex.Lock()
+  if self.closed {
+    self.mutex.Unlock()
+    c.Close()
+    return nil, os.NewError("Federation has been closed")
+  }
+  self.conn = c
+  self.mutex.Unlock()
+  go self.read(c, r)
+  return c, nil
+}
+
+// Stores the blobs which the server sends in answer to requests until the connection fails.
+func (self *tcpPeer) read(c net.Conn, r io.Reader) {
+  for {
+    f, err := readFrame(r)
+    if err != nil {
+      break
+    }
+    if f.kind != tcpBlob {
+      log.Printf("Err: Unexpected frame of kind %v from %v\n", f.kind, self.domain)
+      break
+    }
+    self.fed.storeBlob(f.blobref, f.data)
+  }
+  self.disconnect(c)
+}
+
+func (self *tcpPeer) disconnect(c net.Conn) {
+  self.mutex.Lock()
+  if self.conn == c {
+    self.conn = nil
+  }
+  self.mutex.Unlock()
+  c.Close()
+}
+
+// -----------------------------------------------------
+// Server side
+
+func (self *TCPFederation) accept() {
+  for {
+    c, err := self.listener.Accept()
+    if err != nil {
+      self.mutex.Lock()
+      closed := self.closed
+      self.mutex.Unlock()
+      if !closed {
+	log.Printf("Err: Accepting federation connections failed: %v\n", err)
+      }
+      return
+    }
+    go self.serve(c)
+  }
+}
+
+// Authenticates the remote user and handles its frames until the connection is closed.
+func (self *TCPFederation) serve(c net.Conn) {
+  defer c.Close()
+  nonce := make([]byte, nonceSize)
+  if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+    log.Printf("Err: Failed reading random numbers: %v\n", err)
+    return
+  }
+  if err := writeFrame(c, &tcpFrame{kind: tcpChallenge, data: nonce}); err != nil {
+    return
+  }
+  r := bufio.NewReader(c)
+  hello, err := readFrame(r)
+  if err != nil || hello.kind != tcpHello {
+    log.Printf("Err: Federation connection from %v without hello\n", c.RemoteAddr())
+    return
+  }
+  if !self.verifyHello(hello.blobref, nonce, hello.data) {
+    log.Printf("Err: Federation connection from %v failed to authenticate %v\n", c.RemoteAddr(), hello.blobref)
+    return
+  }
+  for {
+    f, err := readFrame(r)
+    if err != nil {
+      if err != os.EOF {
+	log.Printf("Err: Reading from %v failed: %v\n", hello.blobref, err)
+      }
+      return
+    }
+    switch f.kind {
+    case tcpBlob:
+      self.storeBlob(f.blobref, f.data)
+    case tcpDownload, tcpDownloadSubtree, tcpFetch:
+      // The user has not been authenticated
+      if self.keyRing == nil {
+	err = writeFrame(c, &tcpFrame{kind: tcpError, blobref: f.blobref, data: []byte(ErrNoKeyRing.String())})
+      } else if f.kind == tcpFetch {
+	err = self.serveFetch(hello.blobref, f.blobref, c)
+      } else {
+	err = self.serveDownload(hello.blobref, f.blobref, f.kind == tcpDownloadSubtree, c)
+      }
+    case tcpRequest:
+      if self.keyRing != nil {
+	err = self.serveRequest(hello.blobref, f.blobref, c)
+      }
+    default:
+      err = os.NewError("Unexpected frame")
+    }
+    if err != nil {
+      log.Printf("Err: Serving %v failed: %v\n", hello.blobref, err)
+      return
+    }
+  }
+}
+
+// Checks that the user signed the nonce for the domain of the local user, i.e. for this server.
+func (self *TCPFederation) verifyHello(userid string, nonce, sig []byte) bool {
+  if self.keyRing == nil {
+    return true
+  }
+  if self.indexer == nil {
+    return false
+  }
+  domain, err := UserDomain(self.indexer.UserID())
+  if err != nil {
+    return false
+  }
+  key := self.keyRing.PublicKey(userid)
+  if key == nil || len(sig) != ed25519.SignatureSize {
+    return false
+  }
+  var s [ed25519.SignatureSize]byte
+  copy(s[:], sig)
+  return ed25519.Verify(key, helloMessage(domain, nonce), &s)
+}
+
+// Streams all blobs of the perma node to the user, followed by an end frame.
+// With 'subtree', the blobs of all children which the user may read follow, recursively.
+// An error is sent to the user if the user may not read the perma node.
+func (self *TCPFederation) serveDownload(userid, perma_blobref string, subtree bool, w io.Writer) os.Error {
+  err := self.checkRead(userid, perma_blobref)
+  permas := []string{perma_blobref}
+  for i := 0; err == nil && i < len(permas); i++ {
+    if i > 0 && self.checkRead(userid, permas[i]) != nil {
+      continue
+    }
+    err = self.indexer.ExportBlobs(permas[i], func(blobref string, blob []byte) os.Error {
+      return writeFrame(w, &tcpFrame{kind: tcpBlob, blobref: blobref, data: blob})
+    })
+    if subtree {
+      permas = append(permas, self.indexer.Children(permas[i])...)
+    }
+  }
+  if err != nil {
+    log.Printf("Err: Download of %v by %v failed: %v\n", perma_blobref, userid, err)
+    return writeFrame(w, &tcpFrame{kind: tcpError, blobref: perma_blobref, data: []byte(err.String())})
+  }
+  return writeFrame(w, &tcpFrame{kind: tcpEnd, blobref: perma_blobref})
+}
+
+// Sends the blob to the user if the user may read it.
+// Other blobs are not answered, since other servers may have them.
+func (self *TCPFederation) serveRequest(userid, blobref string, w io.Writer) os.Error {
+  blob, err := self.readableBlob(userid, blobref)
+  if err != nil {
+    return nil
+  }
+  return writeFrame(w, &tcpFrame{kind: tcpBlob, blobref: blobref, data: blob})
+}
+
+// Sends the blob to the user if the user may read it. Otherwise an error frame is sent.
+func (self *TCPFederation) serveFetch(userid, blobref string, w io.Writer) os.Error {
+  blob, err := self.readableBlob(userid, blobref)
+  if err != nil {
+    log.Printf("Err: Fetch of %v by %v failed: %v\n", blobref, userid, err)
+    return writeFrame(w, &tcpFrame{kind: tcpError, blobref: blobref, data: []byte(err.String())})
+  }
+  return writeFrame(w, &tcpFrame{kind: tcpBlob, blobref: blobref, data: blob})
+}
+
+// Returns the blob if it is a perma node or belongs to a perma node which the user may read.
+// Binary blobs are not returned.
+func (self *TCPFederation) readableBlob(userid, blobref string) ([]byte, os.Error) {
+  if self.indexer == nil {
+    return nil, ErrNoIndexer
+  }
+  blob, err := self.indexer.Store().GetBlob(blobref)
+  if err != nil {
+    return nil, err
+  }
+  var schema struct {
+    Type string "type"
+    PermaNode string "perma"
+  }
+  if err = json.Unmarshal(blob, &schema); err != nil {
+    return nil, idx.ErrPermissionDenied
+  }
+  perma_blobref := schema.PermaNode
+  // The perma field of a child perma node names its parent
+  if schema.Type == "permanode" {
+    perma_blobref = blobref
+  }
+  if err = self.checkRead(userid, perma_blobref); err != nil {
+    return nil, err
+  }
+  return blob, nil
+}
+
+func (self *TCPFederation) checkRead(userid, perma_blobref string) os.Error {
+  if self.indexer == nil {
+    return ErrNoIndexer
+  }
+  return self.indexer.CheckRead(userid, perma_blobref)
+}
+
+// -----------------------------------------------------
+// Framing
+
+// Writes the frame with a single call, such that frames written concurrently do not interleave
+func writeFrame(w io.Writer, f *tcpFrame) os.Error {
+  buf := make([]byte, 9 + len(f.blobref) + len(f.data))
+  buf[0] = f.kind
+  binary.BigEndian.PutUint32(buf[1:5], uint32(len(f.blobref)))
+  copy(buf[5:], f.blobref)
+  binary.BigEndian.PutUint32(buf[5 + len(f.blobref):], uint32(len(f.data)))
+  copy(buf[9 + len(f.blobref):], f.data)
+  _, err := w.Write(buf)
+  return err
+}
+
+func readFrame(r io.Reader) (f *tcpFrame, err os.Error) {
+  var kind [1]byte
+  if _, err = io.ReadFull(r, kind[:]); err != nil {
+    return nil, err
+  }
+  blobref, err := readChunk(r)
+  if err != nil {
+    return nil, err
+  }
+  data, err := readChunk(r)
+  if err != nil {
+    return nil, err
+  }
+  return &tcpFrame{kind: kind[0], blobref: string(blobref), data: data}, nil
+}
+
+// Reads a length followed by that many bytes
+func readChunk(r io.Reader) ([]byte, os.Error) {
+  var l [4]byte
+  if _, err := io.ReadFull(r, l[:]); err != nil {
+    return nil, err
+  }
+  length := binary.BigEndian.Uint32(l[:])
+  if length > maxFrameLength {
+    return nil, os.NewError("Frame too long")
+  }
+  b := make([]byte, length)
+  if _, err := io.ReadFull(r, b); err != nil {
+    return nil, err
+  }
+  return b, nil
+}
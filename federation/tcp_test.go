@@ -0,0 +1,360 @@
+package lightwavefed
+
+import (
+  idx "lightwaveidx"
+  ot "lightwaveot"
+  store "lightwavestore"
+  "bufio"
+  "bytes"
+  "crypto/rand"
+  "github.com/agl/ed25519"
+  "json"
+  "net"
+  "os"
+  "testing"
+  "time"
+)
+
+// Waits up to five seconds for the condition to become true
+func waitFor(t *testing.T, what string, cond func() bool) {
+  for i := 0; i < 500; i++ {
+    if cond() {
+      return
+    }
+    time.Sleep(10000000)
+  }
+  t.Fatal("Timeout waiting for " + what)
+}
+
+func TestFraming(t *testing.T) {
+  var buf bytes.Buffer
+  frames := []*tcpFrame{&tcpFrame{kind: tcpBlob, blobref: "abc", data: []byte("Hello")}, &tcpFrame{kind: tcpEnd, blobref: "xyz"}}
+  for _, f := range frames {
+    if err := writeFrame(&buf, f); err != nil {
+      t.Fatal(err)
+    }
+  }
+  for _, f := range frames {
+    g, err := readFrame(&buf)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if g.kind != f.kind || g.blobref != f.blobref || string(g.data) != string(f.data) {
+      t.Fatalf("Wrong frame %v", g)
+    }
+  }
+  if _, err := readFrame(&buf); err == nil {
+    t.Fatal("Expected an error at the end of the stream")
+  }
+}
+
+// Returns a keyring holding new keys of the users
+func testKeyRing(t *testing.T, users ...string) *idx.SimpleKeyRing {
+  keyring := idx.NewSimpleKeyRing()
+  for _, user := range users {
+    pub, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+      t.Fatal(err)
+    }
+    keyring.AddPublicKey(user, pub)
+    keyring.AddPrivateKey(user, priv)
+  }
+  return keyring
+}
+
+// Two users on different servers share a perma node over a loopback TCP connection
+func TestTCPFederation(t *testing.T) {
+  keyring := testKeyRing(t, "a@alice", "b@bob")
+  fedA, err := NewTCPFederation("127.0.0.1:0", keyring)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fedA.Close()
+  fedB, err := NewTCPFederation("127.0.0.1:0", keyring)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fedB.Close()
+  resolver := StaticResolver{"alice": fedA.Addr().String(), "bob": fedB.Addr().String()}
+  fedA.SetResolver(resolver)
+  fedB.SetResolver(resolver)
+  alice := idx.NewIndexerWithOptions("a@alice", store.NewSimpleBlobStore(), fedA, idx.IndexerOptions{KeyRing: keyring})
+  bob := idx.NewIndexerWithOptions("b@bob", store.NewSimpleBlobStore(), fedB, idx.IndexerOptions{KeyRing: keyring})
+
+  perma, err := alice.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  keep, err := alice.CreateKeepBlob(perma, "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice.WaitIdle()
+  invite, err := alice.CreatePermissionBlob(perma, []string{keep}, "b@bob", idx.Perm_Read | idx.Perm_Write, 0, idx.PermAction_Invite)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // The invitation is forwarded to the server of bob
+  waitFor(t, "the invitation", func() bool {
+    return len(bob.Invitations()) == 1
+  })
+  if bob.Invitations()[0].BlobRef != invite {
+    t.Fatalf("Wrong invitation %v", bob.Invitations()[0])
+  }
+  // Accepting the invitation downloads the perma node from the server of alice
+  if _, err = bob.CreateKeepBlob(perma, invite); err != nil {
+    t.Fatal(err)
+  }
+  waitFor(t, "the keep of bob", func() bool {
+    return alice.Keeps(perma)["b@bob"] != ""
+  })
+  var op ot.Operation
+  if err = json.Unmarshal([]byte(`{"$t":["Hello"]}`), &op); err != nil {
+    t.Fatal(err)
+  }
+  mut, err := alice.CreateMutationBlob(perma, ot.Mutation{Operation: op, Site: "site1", Dependencies: []string{invite}})
+  if err != nil {
+    t.Fatal(err)
+  }
+  // The mutation is forwarded to bob, who follows the perma node now
+  waitFor(t, "the mutation", func() bool {
+    _, ok := bob.DependencyGraph(perma)[mut]
+    return ok
+  })
+}
+
+// Accepting an invitation fetches the history on which the invitation depends from the inviter
+func TestDownloadPermaNode(t *testing.T) {
+  keyring := testKeyRing(t, "a@alice", "b@bob")
+  fedA, err := NewTCPFederation("127.0.0.1:0", keyring)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fedA.Close()
+  fedB, err := NewTCPFederation("127.0.0.1:0", keyring)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fedB.Close()
+  resolver := StaticResolver{"alice": fedA.Addr().String(), "bob": fedB.Addr().String()}
+  fedA.SetResolver(resolver)
+  fedB.SetResolver(resolver)
+  alice := idx.NewIndexer("a@alice", store.NewSimpleBlobStore(), fedA, 0)
+  bob := idx.NewIndexer("b@bob", store.NewSimpleBlobStore(), fedB, 0)
+
+  perma, err := alice.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  dep, err := alice.CreateKeepBlob(perma, "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Alice writes a history of mutations before inviting bob
+  muts := []string{}
+  for _, text := range []string{`{"$t":["Hello"]}`, `{"$t":[{"$s":5}, " World"]}`, `{"$t":[{"$s":11}, "!"]}`} {
+    var op ot.Operation
+    if err = json.Unmarshal([]byte(text), &op); err != nil {
+      t.Fatal(err)
+    }
+    if dep, err = alice.CreateMutationBlob(perma, ot.Mutation{Operation: op, Site: "site1", Dependencies: []string{dep}}); err != nil {
+      t.Fatal(err)
+    }
+    muts = append(muts, dep)
+  }
+  alice.WaitIdle()
+  invite, err := alice.CreatePermissionBlob(perma, []string{dep}, "b@bob", idx.Perm_Read, 0, idx.PermAction_Invite)
+  if err != nil {
+    t.Fatal(err)
+  }
+  waitFor(t, "the invitation", func() bool {
+    return len(bob.Invitations()) == 1
+  })
+  if _, err = bob.CreateKeepBlob(perma, invite); err != nil {
+    t.Fatal(err)
+  }
+  waitFor(t, "the history", func() bool {
+    graph := bob.DependencyGraph(perma)
+    for _, mut := range muts {
+      if _, ok := graph[mut]; !ok {
+	return false
+      }
+    }
+    return true
+  })
+  if !bob.IsSynced(perma) {
+    t.Fatal("The perma node is not synced")
+  }
+}
+
+// Without a KeyRing the claimed user cannot be verified, hence nothing is downloaded
+func TestDownloadRequiresKeyRing(t *testing.T) {
+  fed, err := NewTCPFederation("127.0.0.1:0", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fed.Close()
+  fed.SetResolver(StaticResolver{"alice": "127.0.0.1:1"})
+  idx.NewIndexer("b@bob", store.NewSimpleBlobStore(), fed, 0)
+  if err = fed.PullPermaNode("perma", "a@alice"); err != ErrNoKeyRing {
+    t.Fatalf("Expected ErrNoKeyRing, got %v", err)
+  }
+}
+
+// A user invited to a child perma node can download it without being allowed to read its parent
+func TestDownloadChildPermaNode(t *testing.T) {
+  keyring := testKeyRing(t, "a@alice", "b@bob")
+  fedA, err := NewTCPFederation("127.0.0.1:0", keyring)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fedA.Close()
+  fedB, err := NewTCPFederation("127.0.0.1:0", keyring)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fedB.Close()
+  resolver := StaticResolver{"alice": fedA.Addr().String(), "bob": fedB.Addr().String()}
+  fedA.SetResolver(resolver)
+  fedB.SetResolver(resolver)
+  alice := idx.NewIndexer("a@alice", store.NewSimpleBlobStore(), fedA, 0)
+  bob := idx.NewIndexer("b@bob", store.NewSimpleBlobStore(), fedB, 0)
+
+  parent, err := alice.CreatePermaBlob("application/x-test-folder")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = alice.CreateKeepBlob(parent, ""); err != nil {
+    t.Fatal(err)
+  }
+  alice.WaitIdle()
+  perma, err := alice.CreateChildPermaBlob(parent, "application/x-test-file", false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  dep, err := alice.CreateKeepBlob(perma, "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  var op ot.Operation
+  if err = json.Unmarshal([]byte(`{"$t":["Hello"]}`), &op); err != nil {
+    t.Fatal(err)
+  }
+  mut, err := alice.CreateMutationBlob(perma, ot.Mutation{Operation: op, Site: "site1", Dependencies: []string{dep}})
+  if err != nil {
+    t.Fatal(err)
+  }
+  alice.WaitIdle()
+  invite, err := alice.CreatePermissionBlob(perma, []string{mut}, "b@bob", idx.Perm_Read, 0, idx.PermAction_Invite)
+  if err != nil {
+    t.Fatal(err)
+  }
+  waitFor(t, "the invitation", func() bool {
+    return len(bob.Invitations()) == 1
+  })
+  if _, err = bob.CreateKeepBlob(perma, invite); err != nil {
+    t.Fatal(err)
+  }
+  waitFor(t, "the history", func() bool {
+    _, ok := bob.DependencyGraph(perma)[mut]
+    return ok
+  })
+  if bob.Store().HasBlobs([]string{parent})[0] {
+    t.Fatal("bob must not have received the parent")
+  }
+}
+
+// A malicious server passes the challenge of another server on to a client which dialed it
+// and replays the hello of the client to the other server. The other server rejects it.
+func TestRelayedHelloIsRejected(t *testing.T) {
+  keyring := testKeyRing(t, "a@alice", "b@bob")
+  fedA, err := NewTCPFederation("127.0.0.1:0", keyring)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fedA.Close()
+  fedB, err := NewTCPFederation("127.0.0.1:0", keyring)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fedB.Close()
+  idx.NewIndexer("a@alice", store.NewSimpleBlobStore(), fedA, 0)
+  idx.NewIndexer("b@bob", store.NewSimpleBlobStore(), fedB, 0)
+  mallory, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer mallory.Close()
+
+  // Mallory obtains a challenge from the server of alice
+  h, err := net.Dial("tcp", fedA.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close()
+  hr := bufio.NewReader(h)
+  challenge, err := readFrame(hr)
+  if err != nil || challenge.kind != tcpChallenge {
+    t.Fatalf("Expected a challenge: %v", err)
+  }
+  // bob dials the server of mallory, which passes the challenge on
+  go func() {
+    if c, _, err := fedB.dial("mallory", mallory.Addr().String()); err == nil {
+      c.Close()
+    }
+  }()
+  v, err := mallory.Accept()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer v.Close()
+  if err = writeFrame(v, challenge); err != nil {
+    t.Fatal(err)
+  }
+  hello, err := readFrame(bufio.NewReader(v))
+  if err != nil || hello.kind != tcpHello || hello.blobref != "b@bob" {
+    t.Fatalf("Expected a hello of bob: %v", err)
+  }
+  // Mallory replays the hello to the server of alice and tries to fetch a blob as bob
+  if err = writeFrame(h, hello); err != nil {
+    t.Fatal(err)
+  }
+  writeFrame(h, &tcpFrame{kind: tcpFetch, blobref: "unknown"})
+  if f, err := readFrame(hr); err == nil {
+    t.Fatalf("The relayed hello has been accepted, got a frame of kind %v", f.kind)
+  }
+}
+
+// Blocks every resolution until it is released
+type blockingResolver struct {
+  release chan bool
+}
+
+func (self *blockingResolver) Resolve(domain string) (addr string, err os.Error) {
+  <-self.release
+  return "", os.NewError("Unknown domain " + domain)
+}
+
+// Forwarding does not wait for the resolution of the domains
+func TestForwardDoesNotResolve(t *testing.T) {
+  fed, err := NewTCPFederation("127.0.0.1:0", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fed.Close()
+  resolver := &blockingResolver{release: make(chan bool)}
+  defer close(resolver.release)
+  fed.SetResolver(resolver)
+  idx.NewIndexer("a@alice", store.NewSimpleBlobStore(), fed, 0)
+
+  done := make(chan bool)
+  go func() {
+    fed.ForwardBatch([]string{"blob1", "blob2"}, []string{"b@bob", "c@charly"})
+    done <- true
+  }()
+  select {
+  case <-done:
+  case <-time.After(5e9):
+    t.Fatal("ForwardBatch blocks on the resolution of the domains")
+  }
+}
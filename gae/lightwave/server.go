@@ -81,6 +81,8 @@ func init() {
   http.HandleFunc("/", handleFrontPage)
   http.HandleFunc("/private/submit", handleSubmit)
   http.HandleFunc("/private/open", handleOpen)
+  http.HandleFunc("/public/open", handlePublicOpen)
+  http.HandleFunc("/public/schema", handleSchema)
   http.HandleFunc("/private/close", handleClose)
   http.HandleFunc("/private/listpermas", handleListPermas)
   http.HandleFunc("/private/listinbox", handleListInbox)
@@ -223,12 +225,22 @@ func handleOpen(w http.ResponseWriter, r *http.Request) {
     g := grapher.NewGrapher(userid, schema, s, s, nil)
     s.SetGrapher(g)
     ch := newChannelAPI(c, s, userid, sessionid, true, g)
-    perma, err = g.Repeat(req.Perma, req.From)
+    // The frontier serves as precondition for conditional writes
+    var frontier []string
+    perma, frontier, err = g.RepeatWithFrontier(req.Perma, req.From)
     if err != nil {
       sendError(w, r, "Failed opening")
       return
     }
-    fmt.Fprintf(w, `{"ok":true, "blobs":[%v]}`, strings.Join(ch.messageBuffer, ","))
+    if frontier == nil {
+      frontier = []string{}
+    }
+    f, err := json.Marshal(frontier)
+    if err != nil {
+      sendError(w, r, "Internal server error")
+      return
+    }
+    fmt.Fprintf(w, `{"ok":true, "blobs":[%v], "frontier":%v}`, strings.Join(ch.messageBuffer, ","), string(f))
   } else {
     fmt.Fprint(w, `{"ok":true, "blobs":[]}`)
   }
@@ -248,6 +260,49 @@ func handleOpen(w http.ResponseWriter, r *http.Request) {
   }
 }
 
+// Sends the content of a public perma node to an anonymous reader.
+// No session is required and the reader does not become a follower of the perma node.
+func handlePublicOpen(w http.ResponseWriter, r *http.Request) {
+  c := appengine.NewContext(r)
+  // Read the request body
+  jreq, err := ioutil.ReadAll(r.Body)
+  if err != nil {
+    http.Error(w, "Error reading request body", http.StatusInternalServerError)
+    return
+  }
+  r.Body.Close()
+  // Parse request
+  var req openCloseRequest
+  err = json.Unmarshal(jreq, &req)
+  if err != nil {
+    sendError(w, r, "Malformed JSON")
+    return
+  }
+  // Only public perma nodes can be read without a session
+  s := newStore(c)
+  data, err := s.GetPermaNode(req.Perma)
+  if err != nil {
+    sendError(w, r, "Unknown perma node")
+    return
+  }
+  perma := grapher.NewPermaNode(nil)
+  perma.FromMap(req.Perma, data)
+  if !perma.IsPublic() {
+    sendError(w, r, "Perma node is not public")
+    return
+  }
+  // Repeat all blobs from this document
+  g := grapher.NewGrapher("", schema, s, s, nil)
+  s.SetGrapher(g)
+  ch := newChannelAPI(c, s, "", "", true, g)
+  _, err = g.Repeat(req.Perma, req.From)
+  if err != nil {
+    sendError(w, r, "Failed opening")
+    return
+  }
+  fmt.Fprintf(w, `{"ok":true, "blobs":[%v]}`, strings.Join(ch.messageBuffer, ","))
+}
+
 func handleClose(w http.ResponseWriter, r *http.Request) {
   c := appengine.NewContext(r)
   userid, sessionid, err := getSession(c, r)
@@ -325,6 +380,12 @@ func handleSubmit(w http.ResponseWriter, r *http.Request) {
   
 //  log.Printf("Received: %v", string(blob))
   node, e := g.HandleClientBlob(blob)
+  if e == grapher.ErrFrontierChanged {
+    // The client must fetch the new frontier and retry
+    w.WriteHeader(http.StatusConflict)
+    fmt.Fprintf(w, `{"ok":false, "conflict":true, "error":"%v"}`, e.String())
+    return
+  }
   if e != nil {
     fmt.Fprintf(w, `{"ok":false, "error":"%v"}`, e.String())
     return
@@ -359,6 +420,16 @@ func sendError(w http.ResponseWriter, r *http.Request, msg string) {
   fmt.Fprintf(w, `{"ok":false, "error":"%v"}`, msg)
 }
 
+// Describes the schema of all documents, such that clients know how to construct valid mutations
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+  msg, err := schema.MarshalJSON()
+  if err != nil {
+    sendError(w, r, err.String())
+    return
+  }
+  fmt.Fprint(w, string(msg))
+}
+
 func handleListPermas(w http.ResponseWriter, r *http.Request) {
   c := appengine.NewContext(r)
   userid, _, err := getSession(c, r)
@@ -67,6 +67,34 @@ func (self *store) GetBlob(blobref string) (blob []byte, err os.Error) {
   return b.data, nil
 }
 
+func (self *store) GetBlobsByRef(blobrefs []string) (blobs map[string][]byte, err os.Error) {
+  keys := make([]*datastore.Key, len(blobrefs))
+  for i, blobref := range blobrefs {
+    keys[i] = datastore.NewKey("blob", blobref, 0, nil)
+  }
+  dst := make([]blobStruct, len(blobrefs))
+  err = datastore.GetMulti(self.c, keys, dst)
+  blobs = make(map[string][]byte)
+  // Some blobs are missing? Other errors are passed on
+  if multi, ok := err.(datastore.ErrMulti); ok {
+    for i, e := range multi {
+      if e == nil {
+	blobs[blobrefs[i]] = dst[i].data
+      } else if e != datastore.ErrNoSuchEntity {
+	return nil, e
+      }
+    }
+    return blobs, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  for i, b := range dst {
+    blobs[blobrefs[i]] = b.data
+  }
+  return blobs, nil
+}
+
 // ------------------------------------------------------------------
 // Graph Store
 
@@ -0,0 +1,57 @@
+package lightwavegrapher
+
+// -----------------------------------------------------
+// Conflicts
+//
+// Most transformations merge concurrent mutations such that no change is lost.
+// Transformations with last-writer-wins semantics instead keep only one of two
+// concurrent values. Transformers report such conflicts to the grapher, which
+// signals them to the API layer once the mutation has been applied.
+// This allows clients to show "your change has been overwritten" instead of silently dropping data.
+
+// API layers can implement this interface to learn about conflicts.
+type ConflictAPI interface {
+  // This function is called after the mutation which caused the conflict has been applied
+  Signal_Conflict(perma PermaNode, conflict *Conflict)
+}
+
+type Conflict struct {
+  PermaBlobRef string
+  EntityBlobRef string
+  Field string
+  // The blobref of the mutation whose value has been applied and its value
+  Winner string
+  WinnerValue interface{}
+  // The blobref of the mutation whose value has been discarded or overridden and its value
+  Loser string
+  LoserValue interface{}
+}
+
+// Reports a conflict which the transformer resolved by discarding or overriding a value.
+// The conflict is signaled to the API layer if the mutation being transformed is applied.
+// Transformers are called while the grapher is locked, hence this function does not lock
+// and must only be called from within a Transformer.
+func (self *Grapher) ReportConflict(conflict *Conflict) {
+  self.conflicts = append(self.conflicts, conflict)
+}
+
+// Signals the conflicts reported while transforming the mutation. Must be called while holding the mutex.
+func (self *Grapher) signalConflicts(perma *permaNode, mut *mutationNode) {
+  conflicts := self.conflicts
+  self.conflicts = nil
+  api, ok := self.api.(ConflictAPI)
+  if !ok {
+    return
+  }
+  for _, c := range conflicts {
+    // Local mutations are transformed before their blobref is known
+    if c.Winner == "Z" {
+      c.Winner = mut.BlobRef()
+    }
+    if c.Loser == "Z" {
+      c.Loser = mut.BlobRef()
+    }
+    conflict := c
+    self.signal(func() { api.Signal_Conflict(perma, conflict) })
+  }
+}
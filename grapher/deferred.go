@@ -0,0 +1,60 @@
+package lightwavegrapher
+
+import (
+  "log"
+  "os"
+  "time"
+)
+
+// -----------------------------------------------------
+// Deferred blobs
+//
+// A schema blob whose timestamp is too far ahead of the local clock is not applied, see SetMaxClockSkew.
+// Instead, a DeferredBlobError is delivered on the channel returned by Errors and the blob is
+// read from the store and handled again once the local clock has caught up, but at least every maxDeferDelay.
+// If it is deferred again, another retry is scheduled. Callers of StoreBlobAndWait keep waiting
+// until the blob has been applied. Close cancels the scheduled retries.
+
+// Wrapped in a DeferredBlobError when the timestamp of a blob exceeds the maximum clock skew
+var ErrClockSkew = os.NewError("Timestamp of the blob is too far in the future")
+
+// Deferred blobs are retried at least this often (in nanoseconds)
+const maxDeferDelay = 3600e9
+
+// Reports that a blob has not been applied for now and will be handled again later
+type DeferredBlobError struct {
+  BlobRef string
+  // Nanoseconds until the blob is handled again
+  Delay int64
+  Err os.Error
+}
+
+func (self *DeferredBlobError) String() string {
+  return "Deferred blob " + self.BlobRef + ": " + self.Err.String()
+}
+
+// Handles the blob again once the local clock has caught up with its timestamp.
+// The caller must hold the mutex
+func (self *Grapher) deferClockSkewedBlob(schema *superSchema, blobref string) {
+  delay := (schema.Time - self.maxClockSkew - time.Seconds() + 1) * 1e9
+  if delay < 0 {
+    delay = 0
+  } else if delay > maxDeferDelay {
+    delay = maxDeferDelay
+  }
+  log.Printf("Err: Deferring blob %v for %v seconds: %v\n", blobref, delay / 1e9, ErrClockSkew)
+  self.reportError(&DeferredBlobError{BlobRef: blobref, Delay: delay, Err: ErrClockSkew})
+  go func() {
+    select {
+    case <-self.done:
+      return
+    case <-time.After(delay):
+    }
+    blob, err := self.store.GetBlob(blobref)
+    if err != nil {
+      log.Printf("Err: Failed reading deferred blob %v: %v\n", blobref, err)
+      return
+    }
+    self.HandleBlob(blob, blobref)
+  }()
+}
@@ -0,0 +1,165 @@
+package lightwavegrapher
+
+import (
+  "os"
+)
+
+// -----------------------------------------------------
+// DocBuilder
+//
+// A DocBuilder collects the initial content of a new perma node,
+// i.e. entities and initial field values. See CreatePermaBlobWithContent.
+
+type DocBuilder struct {
+  entities []*EntityBuilder
+}
+
+type EntityBuilder struct {
+  mimeType string
+  content []byte
+  fields []builderField
+}
+
+type builderField struct {
+  field string
+  operation []byte
+}
+
+// Adds an entity to the document. Use the returned EntityBuilder to set initial field values.
+func (self *DocBuilder) AddEntity(mimeType string, content []byte) *EntityBuilder {
+  e := &EntityBuilder{mimeType: mimeType, content: content}
+  self.entities = append(self.entities, e)
+  return e
+}
+
+// Adds a mutation of the field. The operation is encoded as in CreateMutationBlob.
+func (self *EntityBuilder) SetField(field string, operation []byte) *EntityBuilder {
+  self.fields = append(self.fields, builderField{field, operation})
+  return self
+}
+
+// Checks the content against the schema before any blob is created.
+func (self *DocBuilder) validate(schema *Schema, mimeType string) os.Error {
+  fileSchema, ok := schema.FileSchemas[mimeType]
+  if !ok {
+    return os.NewError("Unknown document mime type")
+  }
+  for _, e := range self.entities {
+    entitySchema, ok := fileSchema.EntitySchemas[e.mimeType]
+    if !ok {
+      return os.NewError("Unknown entity mime type")
+    }
+    for _, f := range e.fields {
+      if _, ok := entitySchema.FieldSchemas[f.field]; !ok {
+	return os.NewError("Unknown field")
+      }
+    }
+  }
+  return nil
+}
+
+// Creates a perma node, the keep of the local user and the initial content in one call.
+// The init function populates the document. It is called before any blob is created,
+// hence a document that does not conform to the schema is rejected as a whole.
+// The blobs are created in the order of their dependencies and atomically, i.e. the graph store,
+// the API and the federation see either the complete document or nothing at all.
+func (self *Grapher) CreatePermaBlobWithContent(mimeType string, init func(*DocBuilder)) (perma_blobref string, err os.Error) {
+  builder := &DocBuilder{}
+  if init != nil {
+    init(builder)
+  }
+  if err = builder.validate(self.schema, mimeType); err != nil {
+    return "", err
+  }
+  self.lock()
+  defer self.unlock()
+  // The nodes are written to a buffer which is committed once all blobs have been created
+  gstore := self.gstore
+  tx := newTxGraphStore()
+  self.gstore = tx
+  perma_blobref, err = self.createContent(mimeType, builder)
+  self.gstore = gstore
+  if err == nil {
+    err = tx.commit(gstore)
+  }
+  if err != nil {
+    // Nobody learns about a document which has not been created completely
+    self.signals = nil
+    return "", err
+  }
+  return perma_blobref, nil
+}
+
+// Creates the blobs of a new perma node. The caller must hold the mutex
+func (self *Grapher) createContent(mimeType string, builder *DocBuilder) (perma_blobref string, err os.Error) {
+  node, err := self.createPermaBlob(mimeType)
+  if err != nil {
+    return "", err
+  }
+  perma_blobref = node.BlobRef()
+  if _, err = self.createKeepBlob(perma_blobref, ""); err != nil {
+    return "", err
+  }
+  // Entities are positioned in the order in which they have been added to the builder
+  after := ""
+  for _, e := range builder.entities {
+    entity, err := self.createEntityBlob(perma_blobref, after, e.mimeType, e.content)
+    if err != nil {
+      return "", err
+    }
+    if after, err = self.placementAfter(perma_blobref, entity.BlobRef()); err != nil {
+      return "", err
+    }
+    for _, f := range e.fields {
+      perma, err := self.permaNode(perma_blobref)
+      if err != nil {
+	return "", err
+      }
+      if _, err = self.createMutationBlob(perma_blobref, entity.BlobRef(), f.field, f.operation, perma.SequenceNumber(), false); err != nil {
+	return "", err
+      }
+    }
+  }
+  return perma_blobref, nil
+}
+
+// -----------------------------------------------------
+// txGraphStore
+//
+// A txGraphStore buffers all writes of a new perma node in memory.
+// Since the perma node is new, nothing about it is in the underlying graph store yet,
+// hence all reads can be served from the buffer. The writes are replayed by commit.
+
+type txGraphStore struct {
+  *SimpleGraphStore
+  writes []func(GraphStore) os.Error
+}
+
+func newTxGraphStore() *txGraphStore {
+  return &txGraphStore{SimpleGraphStore: NewSimpleGraphStore()}
+}
+
+func (self *txGraphStore) StoreNode(perma_blobref string, blobref string, data map[string]interface{}, perma_data map[string]interface{}) os.Error {
+  self.writes = append(self.writes, func(gstore GraphStore) os.Error { return gstore.StoreNode(perma_blobref, blobref, data, perma_data) })
+  return self.SimpleGraphStore.StoreNode(perma_blobref, blobref, data, perma_data)
+}
+
+func (self *txGraphStore) StorePermaNode(perma_blobref string, data map[string]interface{}) os.Error {
+  self.writes = append(self.writes, func(gstore GraphStore) os.Error { return gstore.StorePermaNode(perma_blobref, data) })
+  return self.SimpleGraphStore.StorePermaNode(perma_blobref, data)
+}
+
+func (self *txGraphStore) Enqueue(perma_blobref string, blobref string, dependencies []string) os.Error {
+  self.writes = append(self.writes, func(gstore GraphStore) os.Error { return gstore.Enqueue(perma_blobref, blobref, dependencies) })
+  return self.SimpleGraphStore.Enqueue(perma_blobref, blobref, dependencies)
+}
+
+// Writes the buffered nodes to the graph store in the order in which they have been stored
+func (self *txGraphStore) commit(gstore GraphStore) os.Error {
+  for _, write := range self.writes {
+    if err := write(gstore); err != nil {
+      return err
+    }
+  }
+  return nil
+}
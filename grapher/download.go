@@ -0,0 +1,79 @@
+package lightwavegrapher
+
+import (
+  "log"
+  "os"
+  "time"
+)
+
+// -----------------------------------------------------
+// Downloading perma nodes
+//
+// When the local user accepts an invitation issued on another domain, the perma node
+// is downloaded via federation. Failed downloads are retried with exponential backoff.
+// If the last attempt fails, a DownloadError is delivered on the channel returned by Errors.
+// The keep of the local user keeps waiting for the permission, hence it is applied
+// if the permission arrives later on by other means.
+
+const (
+  DefaultDownloadAttempts = 5
+  // Nanoseconds to wait before the first retry. The delay doubles with every retry.
+  DefaultDownloadBackoff = 1000000000
+)
+
+// Reports that a perma node could not be downloaded
+type DownloadError struct {
+  PermissionBlobRef string
+  Attempts int
+  Err os.Error
+}
+
+func (self *DownloadError) String() string {
+  return "Failed downloading the perma node of permission " + self.PermissionBlobRef + ": " + self.Err.String()
+}
+
+// Sets how often a download is attempted and how many nanoseconds to wait before the first retry.
+// The defaults are DefaultDownloadAttempts and DefaultDownloadBackoff.
+func (self *Grapher) SetDownloadRetry(attempts int, backoff int64) {
+  self.lock()
+  defer self.unlock()
+  self.downloadAttempts = attempts
+  self.downloadBackoff = backoff
+}
+
+// Cancels pending download retries and the retries of deferred blobs. Downloads which are in progress are not interrupted.
+func (self *Grapher) Close() {
+  self.lock()
+  defer self.unlock()
+  if !self.closed {
+    self.closed = true
+    close(self.done)
+  }
+}
+
+// Downloads the perma node to which the permission belongs and retries on failure.
+// Runs in its own goroutine.
+func (self *Grapher) download(permission_blobref string) {
+  self.lock()
+  attempts, backoff := self.downloadAttempts, self.downloadBackoff
+  self.unlock()
+  var err os.Error
+  for i := 1; i <= attempts; i++ {
+    if err = self.fed.DownloadPermaNode(permission_blobref); err == nil {
+      return
+    }
+    log.Printf("Err: Download of permission %v failed (attempt %v of %v): %v\n", permission_blobref, i, attempts, err)
+    if i == attempts {
+      break
+    }
+    select {
+    case <-self.done:
+      return
+    case <-time.After(backoff):
+    }
+    backoff *= 2
+  }
+  if err != nil {
+    self.reportError(&DownloadError{PermissionBlobRef: permission_blobref, Attempts: attempts, Err: err})
+  }
+}
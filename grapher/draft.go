@@ -0,0 +1,169 @@
+package lightwavegrapher
+
+import (
+  "os"
+  "sort"
+)
+
+// -----------------------------------------------------
+// Drafts
+//
+// A draft is a mutation of the local user which is applied locally but not forwarded
+// to the followers of the perma node until it is published.
+// Drafts are recorded in the perma node and hence survive a restart of the grapher.
+// Besides the frontier, a perma node keeps the published frontier which leaves out the drafts.
+// All other blobs of the local user depend on the published frontier only, such that followers
+// can apply them while the drafts are unpublished. A draft may depend on earlier drafts.
+// The local user cannot create ordinary mutations of a perma node with unpublished drafts,
+// because their operations would depend on the content of the drafts. Further drafts are possible.
+
+// Returned when creating an ordinary mutation of a perma node which has unpublished drafts
+var ErrUnpublishedDrafts = os.NewError("The perma node has unpublished drafts")
+
+// Like CreateMutationBlob, but the mutation is not forwarded until it is published.
+func (self *Grapher) CreateDraftMutationBlob(perma_blobref string, entity_blobref string, field string, operation []byte, applyAtSeqNumber int64) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  return self.createMutationBlob(perma_blobref, entity_blobref, field, operation, applyAtSeqNumber, true)
+}
+
+// Returns true if the blob is a draft of the perma node which has not yet been published.
+func (self *Grapher) IsDraft(perma_blobref string, blobref string) bool {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil || perma == nil {
+    return false
+  }
+  return perma.isDraft(blobref)
+}
+
+// Returns the unpublished drafts of the perma node in the order in which they have been applied.
+func (self *Grapher) Drafts(perma_blobref string) (blobrefs []string, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if perma == nil {
+    return nil, os.NewError("Unknown perma node")
+  }
+  return append([]string{}, perma.drafts...), nil
+}
+
+type draftList []OTNode
+
+func (self draftList) Len() int {
+  return len(self)
+}
+
+func (self draftList) Less(i, j int) bool {
+  return self[i].SequenceNumber() < self[j].SequenceNumber()
+}
+
+func (self draftList) Swap(i, j int) {
+  self[i], self[j] = self[j], self[i]
+}
+
+// Publishes drafts of the perma node and forwards them to the followers.
+// The drafts are forwarded in the order in which they have been applied.
+// A draft which depends on another draft must be published in the same batch
+// or after the other draft. Either all drafts of the batch are published or none.
+func (self *Grapher) Publish(perma_blobref string, blobrefs []string) os.Error {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return err
+  }
+  if perma == nil {
+    return os.NewError("Unknown perma node")
+  }
+  batch := make(map[string]bool)
+  for _, blobref := range blobrefs {
+    batch[blobref] = true
+  }
+  // Check the complete batch before changing anything
+  var drafts draftList
+  for blobref, _ := range batch {
+    if !perma.isDraft(blobref) {
+      return os.NewError("Blob " + blobref + " is not a draft")
+    }
+    m, err := self.gstore.GetOTNodeByBlobRef(perma_blobref, blobref)
+    if err != nil {
+      return err
+    }
+    if m == nil {
+      return os.NewError("Draft " + blobref + " has not been applied")
+    }
+    node := self.otNodeFromMap(perma_blobref, m)
+    for _, dep := range node.Dependencies() {
+      if perma.isDraft(dep) && !batch[dep] {
+	return os.NewError("Draft " + blobref + " depends on the unpublished draft " + dep)
+      }
+    }
+    drafts = append(drafts, node)
+  }
+  sort.Sort(drafts)
+  for _, node := range drafts {
+    perma.published.AddBlob(node.BlobRef(), node.Dependencies())
+  }
+  remaining := []string{}
+  for _, blobref := range perma.drafts {
+    if !batch[blobref] {
+      remaining = append(remaining, blobref)
+    }
+  }
+  perma.drafts = remaining
+  if err = self.gstore.StorePermaNode(perma_blobref, perma.ToMap()); err != nil {
+    return err
+  }
+  if self.fed == nil {
+    return nil
+  }
+  users := perma.followersWithPermission(Perm_Read)
+  if len(users) == 0 {
+    return nil
+  }
+  for _, node := range drafts {
+    blobref := node.BlobRef()
+    self.signal(func() { self.fed.Forward(blobref, users) })
+  }
+  return nil
+}
+
+// Returns true if the blob is an unpublished draft of the perma node
+func (self *permaNode) isDraft(blobref string) bool {
+  for _, d := range self.drafts {
+    if d == blobref {
+      return true
+    }
+  }
+  return false
+}
+
+// Updates the published frontier after a blob has been applied. Drafts are left out.
+func (self *permaNode) publishBlob(blobref string, deps []string) {
+  if self.grapher.drafting == blobref {
+    self.drafts = append(self.drafts, blobref)
+    return
+  }
+  self.published.AddBlob(blobref, deps)
+}
+
+func (self *permaNode) draftsToMap(m map[string]interface{}) {
+  m["pf"] = self.published.IDs()
+  m["d"] = append([]string{}, self.drafts...)
+}
+
+func (self *permaNode) draftsFromMap(m map[string]interface{}) {
+  // Perma nodes stored before drafts existed have published everything
+  f, ok := m["pf"]
+  if !ok {
+    self.published.FromIDs(self.frontier.IDs())
+    return
+  }
+  self.published.FromIDs(f.([]string))
+  self.drafts = m["d"].([]string)
+}
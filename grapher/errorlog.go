@@ -0,0 +1,179 @@
+package lightwavegrapher
+
+import (
+  "log"
+  "os"
+  "sync"
+  store "lightwavestore"
+)
+
+// -----------------------------------------------------
+// Background errors
+//
+// Errors which occur in the background are kept in a ring buffer and delivered to subscribers.
+// Reporting an error never blocks: when the buffer is full the oldest error is dropped, and
+// when a subscriber does not keep up, the oldest error waiting on its channel is dropped.
+// Batch consumers poll RecentErrors, live consumers read Errors or SubscribeErrors.
+
+// The number of errors kept by default
+const DefaultErrorCapacity = 32
+
+// Returned when setting a negative capacity
+var ErrNegativeCapacity = os.NewError("Capacity must not be negative")
+
+type errorLog struct {
+  mutex sync.Mutex
+  // A ring buffer. The oldest error is at index 'start'
+  ring []os.Error
+  start int
+  count int
+  // The number of errors which have been dropped from the ring
+  dropped int64
+  subscribers []chan os.Error
+}
+
+func newErrorLog(capacity int) *errorLog {
+  return &errorLog{ring: make([]os.Error, capacity)}
+}
+
+func (self *errorLog) setCapacity(capacity int) os.Error {
+  if capacity < 0 {
+    return ErrNegativeCapacity
+  }
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  ring := make([]os.Error, capacity)
+  // Keep the most recent errors
+  skip := 0
+  if self.count > capacity {
+    skip = self.count - capacity
+    self.dropped += int64(skip)
+  }
+  for i := skip; i < self.count; i++ {
+    ring[i - skip] = self.ring[(self.start + i) % len(self.ring)]
+  }
+  self.ring = ring
+  self.start = 0
+  self.count -= skip
+  return nil
+}
+
+func (self *errorLog) add(err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if len(self.ring) > 0 {
+    if self.count == len(self.ring) {
+      self.start = (self.start + 1) % len(self.ring)
+      self.count--
+      self.dropped++
+    }
+    self.ring[(self.start + self.count) % len(self.ring)] = err
+    self.count++
+  }
+  for _, c := range self.subscribers {
+    self.deliver(c, err)
+  }
+}
+
+// Sends the error on the channel. If the channel is full, the oldest error on it is dropped.
+func (self *errorLog) deliver(c chan os.Error, err os.Error) {
+  send := func() bool {
+    select {
+    case c <- err:
+      return true
+    default:
+    }
+    return false
+  }
+  drop := func() bool {
+    select {
+    case old := <-c:
+      log.Printf("Err: Dropping error because nobody reads the error channel: %v\n", old)
+      return true
+    default:
+    }
+    return false
+  }
+  if !store.SendDroppingOldest(send, drop) {
+    log.Printf("Err: Dropping error because nobody reads the error channel: %v\n", err)
+  }
+}
+
+func (self *errorLog) recent(n int) []os.Error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if n > self.count || n < 0 {
+    n = self.count
+  }
+  result := make([]os.Error, n)
+  for i := 0; i < n; i++ {
+    result[i] = self.ring[(self.start + self.count - n + i) % len(self.ring)]
+  }
+  return result
+}
+
+func (self *errorLog) subscribe() <-chan os.Error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  buffer := len(self.ring)
+  if buffer == 0 {
+    buffer = 1
+  }
+  c := make(chan os.Error, buffer)
+  self.subscribers = append(self.subscribers, c)
+  return c
+}
+
+func (self *errorLog) unsubscribe(ch <-chan os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  for i, c := range self.subscribers {
+    if (<-chan os.Error)(c) == ch {
+      close(c)
+      self.subscribers = append(self.subscribers[:i], self.subscribers[i+1:]...)
+      return
+    }
+  }
+}
+
+// Returns the channel on which errors are reported that occur in the background,
+// for example when the perma node of an accepted invitation could not be downloaded.
+// If the channel is not read, the oldest errors on it are dropped.
+func (self *Grapher) Errors() <-chan os.Error {
+  return self.errors
+}
+
+// Returns a new channel on which all errors are reported which occur from now on.
+// Like Errors, but each subscriber receives every error.
+func (self *Grapher) SubscribeErrors() <-chan os.Error {
+  return self.errorLog.subscribe()
+}
+
+// Closes a channel returned by SubscribeErrors.
+func (self *Grapher) UnsubscribeErrors(ch <-chan os.Error) {
+  self.errorLog.unsubscribe(ch)
+}
+
+// Returns up to n of the most recent errors, the oldest first. A negative n returns all kept errors.
+func (self *Grapher) RecentErrors(n int) []os.Error {
+  return self.errorLog.recent(n)
+}
+
+// Sets how many recent errors are kept. The default is DefaultErrorCapacity.
+// Channels returned by SubscribeErrors afterwards buffer that many errors, too.
+// Returns ErrNegativeCapacity if the capacity is negative.
+func (self *Grapher) SetErrorCapacity(capacity int) os.Error {
+  return self.errorLog.setCapacity(capacity)
+}
+
+// Returns the number of errors which have been dropped from the ring buffer because
+// more errors occurred than it can hold. These are no longer returned by RecentErrors.
+func (self *Grapher) DroppedErrors() int64 {
+  self.errorLog.mutex.Lock()
+  defer self.errorLog.mutex.Unlock()
+  return self.errorLog.dropped
+}
+
+func (self *Grapher) reportError(err os.Error) {
+  self.errorLog.add(err)
+}
@@ -17,6 +17,8 @@ const (
   OTNode_DelEntity
   OTNode_Mutation
   OTNode_Perma
+  OTNode_MoveEntity
+  OTNode_Meta
 )
 
 // All nodes must implement this interface
@@ -48,6 +50,9 @@ type EntityNode interface {
   OTNode
   Content() []byte
   MimeType() string
+  // The blobref of the placement after which the entity has been inserted.
+  // An empty string denotes the beginning of the file.
+  After() string
 }
 
 type entityNode struct {
@@ -58,6 +63,7 @@ type entityNode struct {
   dependencies []string
   seqNumber int64
   mimeType string
+  after string
 }
 
 func (self *entityNode) BlobRef() string {
@@ -96,6 +102,10 @@ func (self *entityNode) MimeType() string {
   return self.mimeType
 }
 
+func (self *entityNode) After() string {
+  return self.after
+}
+
 func (self *entityNode) ToMap() map[string]interface{} {
   m := make(map[string]interface{})
   m["k"] = int64(OTNode_Entity)
@@ -105,6 +115,7 @@ func (self *entityNode) ToMap() map[string]interface{} {
   m["seq"] = self.seqNumber
   m["c"] = self.content
   m["mt"] = self.mimeType;
+  m["a"] = self.after
   return m
 }
 
@@ -118,6 +129,9 @@ func (self *entityNode) FromMap(permaBlobRef string, m map[string]interface{}) {
   self.content = m["c"].([]byte)
   self.seqNumber = m["seq"].(int64)
   self.mimeType = m["mt"].(string)
+  if a, ok := m["a"]; ok {
+    self.after = a.(string)
+  }
 }
 
 type DelEntityNode interface {
@@ -319,6 +333,54 @@ type mutationNode struct {
   seqNumber int64
   field string
   time int64
+  // Only for mutations of several fields. The names of the fields in ascending order.
+  // In this case 'field' is empty and 'operation' is not used.
+  fields []string
+  // Only for mutations of several fields. The keys are field names. The values are operations like 'operation'.
+  operations map[string]interface{}
+}
+
+// Returns one mutation per field. Each has the blobref, dependencies and sequence number of the original mutation.
+// A mutation of a single field returns itself.
+func (self *mutationNode) parts() []*mutationNode {
+  if len(self.fields) == 0 {
+    return []*mutationNode{self}
+  }
+  result := make([]*mutationNode, len(self.fields))
+  for i, field := range self.fields {
+    result[i] = self.part(field)
+  }
+  return result
+}
+
+// Returns the mutation of the field or nil if the mutation does not touch the field.
+func (self *mutationNode) part(field string) *mutationNode {
+  if len(self.fields) == 0 {
+    if field != self.field {
+      return nil
+    }
+    return self
+  }
+  op, ok := self.operations[field]
+  if !ok {
+    return nil
+  }
+  p := *self
+  p.field = field
+  p.operation = op
+  p.fields = nil
+  p.operations = nil
+  return &p
+}
+
+// Takes over the operations of the parts after they have been transformed.
+func (self *mutationNode) setParts(parts []*mutationNode) {
+  if len(self.fields) == 0 {
+    return
+  }
+  for _, p := range parts {
+    self.operations[p.field] = p.operation
+  }
 }
 
 func (self *mutationNode) BlobRef() string {
@@ -370,22 +432,40 @@ func (self *mutationNode) ToMap() map[string]interface{} {
   m["k"] = int64(OTNode_Mutation)
   m["b"] = self.mutationBlobRef
   m["s"] = self.mutationSigner
-  switch self.operation.(type) {
-  case []byte:
-    m["op"] = self.operation.([]byte)
-  case json.Marshaler:
-    bytes, e := self.operation.(json.Marshaler).MarshalJSON()
+  if len(self.fields) > 0 {
+    // The operations are stored as one JSON object mapping field names to operations
+    ops := make(map[string]*json.RawMessage)
+    for field, op := range self.operations {
+      msg, e := operationToJSON(op)
+      if e != nil {
+	panic("Failed marshaling")
+      }
+      ops[field] = &msg
+    }
+    bytes, e := json.Marshal(ops)
     if e != nil {
       panic("Failed marshaling")
     }
     m["op"] = bytes
-  default:
-    panic("Cannot serialize")
+    m["f"] = self.fields
+  } else {
+    switch self.operation.(type) {
+    case []byte:
+      m["op"] = self.operation.([]byte)
+    case json.Marshaler:
+      bytes, e := self.operation.(json.Marshaler).MarshalJSON()
+      if e != nil {
+	panic("Failed marshaling")
+      }
+      m["op"] = bytes
+    default:
+      panic("Cannot serialize")
+    }
+    m["f"] = self.field
   }
   m["e"] = self.entityBlobRef
   m["dep"] = self.dependencies
   m["seq"] = self.seqNumber
-  m["f"] = self.field
   if self.time != 0 {
     m["tm"] = self.time;
   }
@@ -396,13 +476,26 @@ func (self *mutationNode) FromMap(permaBlobRef string, m map[string]interface{})
   self.permaBlobRef = permaBlobRef
   self.mutationBlobRef = m["b"].(string)
   self.mutationSigner = m["s"].(string)
-  self.operation = m["op"].([]byte)
   if d, ok := m["dep"]; ok {
     self.dependencies = d.([]string)
   }
   self.entityBlobRef = m["e"].(string)
   self.seqNumber = m["seq"].(int64)
-  self.field = m["f"].(string)
+  switch m["f"].(type) {
+  case string:
+    self.field = m["f"].(string)
+    self.operation = m["op"].([]byte)
+  case []string:
+    self.fields = m["f"].([]string)
+    var ops map[string]*json.RawMessage
+    if err := json.Unmarshal(m["op"].([]byte), &ops); err != nil {
+      panic("Malformed operations")
+    }
+    self.operations = make(map[string]interface{})
+    for field, op := range ops {
+      self.operations[field] = []byte(*op)
+    }
+  }
   if d, ok := m["tm"]; ok {
     self.time = d.(int64)
   }
@@ -485,6 +578,9 @@ type PermaNode interface {
   Followers() []string
   Users() []string
   SequenceNumber() int64
+  IsPublic() bool
+  Title() string
+  Tags() []string
 }
 
 type permaNode struct {
@@ -498,12 +594,22 @@ type permaNode struct {
   updates map[string]int64
   // The current frontier
   frontier ot.Frontier
+  // The frontier without the unpublished drafts, see draft.go
+  published ot.Frontier
+  // The unpublished drafts of the local user in the order in which they have been applied
+  drafts []string
   seqNumber int64
   mimeType string
+  // Metadata, see meta.go
+  title string
+  titleStamp metaStamp
+  tags map[string]*tagState
+  // The lengths of string fields, see length.go
+  lengths map[string]int64
 }
 
 func NewPermaNode(grapher *Grapher) *permaNode {
-  return &permaNode{grapher: grapher, frontier: make(ot.Frontier), permissions: make(map[string]int), updates: make(map[string]int64) }
+  return &permaNode{grapher: grapher, frontier: make(ot.Frontier), published: make(ot.Frontier), permissions: make(map[string]int), updates: make(map[string]int64), tags: make(map[string]*tagState), lengths: make(map[string]int64) }
 }
 
 func (self *permaNode) ToMap() map[string]interface{} {
@@ -529,6 +635,9 @@ func (self *permaNode) ToMap() map[string]interface{} {
   m["p1"] = p1
   m["p2"] = p2
   m["mt"] = self.mimeType
+  self.metaToMap(m)
+  self.lengthsToMap(m)
+  self.draftsToMap(m)
   return m
 }
 
@@ -547,6 +656,9 @@ func (self *permaNode) FromMap(permaBlobRef string, m map[string]interface{}) {
     self.updates[p1[i]] = int64(u[i])
   }
   self.mimeType = m["mt"].(string)
+  self.metaFromMap(m)
+  self.lengthsFromMap(m)
+  self.draftsFromMap(m)
 }
 
 // abstractNode interface
@@ -613,11 +725,19 @@ func (self *permaNode) Users() (users []string) {
     if allowed == 0 || allowed == Perm_Keep { // No permission at all (except havin created a keep)?
       continue
     }
+    if userid == PublicUser {
+      continue
+    }
     users = append(users, userid)
   }
   return
 }
 
+// Returns true if anonymous readers may read the perma node.
+func (self *permaNode) IsPublic() bool {
+  return self.permissions[PublicUser] & Perm_Read == Perm_Read
+}
+
 func (self *permaNode) hasKeep(userid string) bool {
   return self.hasPermission(userid, Perm_Keep)
 }
@@ -644,7 +764,9 @@ func (self *permaNode) hasPermission(userid string, mask int) (ok bool) {
 
 // If deps is not empty, then the node could not be applied because it depends on
 // blobs that have not yet been applied.
-func (self *permaNode) apply(newnode OTNode, transformer Transformer) (deps []string, err os.Error) {
+// For mutations, the keys of 'transformers' are the fields of the mutation.
+// Fields without a transformer are not transformed.
+func (self *permaNode) apply(newnode OTNode, transformers map[string]Transformer) (deps []string, err os.Error) {
   deps, err = self.grapher.gstore.HasOTNodes(self.BlobRef(), []string{newnode.BlobRef()})
   if len(deps) == 0 {
     log.Printf("ALREADY APPLIED")
@@ -662,10 +784,17 @@ func (self *permaNode) apply(newnode OTNode, transformer Transformer) (deps []st
       log.Printf("Referenced entity is missing. It should have been in the dependencies")
       return nil, os.NewError("Mutation references an invalid entity")
     }
-    err = self.applyMutation(mut, transformer)
+    err = self.applyMutation(mut, transformers)
+  } else if move, ok := newnode.(*moveEntityNode); ok {
+    deps, err = self.grapher.gstore.HasOTNodes(self.BlobRef(), []string{move.EntityBlobRef()})
+    if len(deps) != 0 {
+      log.Printf("Referenced entity is missing. It should have been in the dependencies")
+      return nil, os.NewError("Move references an invalid entity")
+    }
   }
 
   self.frontier.AddBlob(newnode.BlobRef(), newnode.Dependencies())
+  self.publishBlob(newnode.BlobRef(), newnode.Dependencies())
   newnode.SetSequenceNumber(self.seqNumber)
   // Ignore if the user issued a keep node
   if _, ok := newnode.(*keepNode); !ok {
@@ -744,8 +873,14 @@ func (self *permaNode) applyPermission(newnode *permissionNode) (err os.Error) {
   return
 }
 
-func (self *permaNode) applyMutation(newnode *mutationNode, transformer Transformer) (err os.Error) {
-  if transformer == nil {
+// The operation of each field is transformed independently. If any transformation fails,
+// the mutation is left untouched, hence a mutation of several fields is applied either completely or not at all.
+func (self *permaNode) applyMutation(newnode *mutationNode, transformers map[string]Transformer) (err os.Error) {
+  transform := false
+  for _, t := range transformers {
+    transform = transform || t != nil
+  }
+  if !transform {
     return
   }
   // Find out how far back we have to go in history to find a common anchor point for transformation
@@ -776,14 +911,22 @@ func (self *permaNode) applyMutation(newnode *mutationNode, transformer Transfor
   for c, _ := range prune {
     concurrent = append(concurrent, c)
   }
-  ch, err := self.grapher.getMutationsAscending(self.blobref, newnode.EntityBlobRef(), newnode.Field(), self.SequenceNumber() - rollback, self.SequenceNumber())
-  if err != nil {
-    return err
-  }
-  err = transformer.TransformMutation(newnode, ch, concurrent)
-  if err != nil {
-    return err
+  parts := newnode.parts()
+  for _, part := range parts {
+    transformer := transformers[part.Field()]
+    if transformer == nil {
+      continue
+    }
+    ch, err := self.grapher.getMutationsAscending(self.blobref, newnode.EntityBlobRef(), part.Field(), self.SequenceNumber() - rollback, self.SequenceNumber())
+    if err != nil {
+      return err
+    }
+    err = transformer.TransformMutation(part, ch, concurrent)
+    if err != nil {
+      return err
+    }
   }
+  newnode.setParts(parts)
   return
 }
 
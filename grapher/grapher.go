@@ -6,12 +6,15 @@ import (
   "log"
   "os"
   "time"
-  "rand"
+  store "lightwavestore"
+  "io"
   "fmt"
   "strings"
   "strconv"
+  "sort"
   "crypto/sha256"
   "encoding/hex"
+  "sync"
 )
 
 // --------------------------------------------------
@@ -47,7 +50,7 @@ type superSchema struct {
 */
 
 type superSchema struct {
-  // Allowed value are "permanode", "mutation", "permission", "keep", "entity", "delentity"
+  // Allowed value are "permanode", "mutation", "permission", "keep", "entity", "delentity", "moveentity", "meta"
   Type    string `json:"type"`
   Time    int64 `json:"t"`
   Signer string `json:"signer"`
@@ -69,8 +72,15 @@ type superSchema struct {
   Operation *json.RawMessage `json:"op"`
   Entity string `json:"entity"`
   Field string `json:"field"`
+  // Only for mutations of several fields. Replaces "field" and "op"
+  Fields map[string]*json.RawMessage `json:"fields"`
+  After string `json:"after"`
   
   Content *json.RawMessage `json:"content"`
+
+  Title *string `json:"title"`
+  AddTags []string `json:"addtags"`
+  RemoveTags []string `json:"removetags"`
 }
 
 // -----------------------------------------------------
@@ -86,24 +96,75 @@ const (
   Perm_Keep
 )
 
+// A permission granted to this wildcard user makes a perma node public.
+// Anonymous readers may read a public perma node if the wildcard user has the Perm_Read bit.
+// All other bits of the wildcard user are ignored, i.e. writing still requires a permission for the signer.
+// The wildcard user never follows a perma node and invitations are not forwarded to it.
+const PublicUser = "*"
+
+// The number of seconds by which the timestamp of a schema blob may be ahead of the local clock
+// unless SetMaxClockSkew says otherwise. One day is ample for the grapher, which only needs to stop
+// blobs from the far future from winning every last-writer-wins decision.
+const DefaultMaxClockSkew = 24 * 60 * 60
+
+// -----------------------------------------------------
+// Forwarding priorities
+
+const (
+  // Blobs that must reach the other users immediately, for example fresh mutations
+  Priority_Interactive = iota
+  // Blobs of the history that are sent to catch up with a new follower
+  Priority_Bulk
+)
+
 
 // ------------------------------------------------------
 // Interfaces
  
 type Federation interface {
   SetGrapher(indexer *Grapher)
-  Forward(blobref string, users []string)
+  // The optional priority is one of the Priority_xxx constants.
+  // The default is Priority_Interactive.
+  Forward(blobref string, users []string, priority ...int)
   DownloadPermaNode(permission_blobref string) os.Error
 }
 
-// The transformer as seen by the Grapher
+// The transformer as seen by the Grapher.
+//
+// Clients apply their mutations optimistically, i.e. immediately and before the grapher
+// has seen them. Hence a mutation may have been created against an outdated state of the document.
+// The rollback channel delivers the mutations on the same entity and field which the grapher
+// has applied but which the new mutation did not yet account for, in the order in which they have been applied.
+// The transformer must read the channel until it is closed and transform the new mutation such
+// that it can be applied after the rolled back mutations. The transformed operation is stored
+// in the mutation via SetOperation.
+// Clients in turn transform their unacknowledged mutations against every mutation they receive
+// from the grapher, just like p2p_client does. This way both sides converge.
+// Transformers which discard or override a concurrent value report this via ReportConflict.
 type Transformer interface {
+  // Transforms a mutation received from another site. The rollback channel delivers all mutations
+  // applied since the latest common ancestor. The blobrefs in 'concurrent' denote those rolled back mutations
+  // that are not in the history of the new mutation and must be pruned before transforming.
+  // Use LookupMutation to resolve them to their operations.
+  // This function is called when a mutation blob is handled, i.e. when it arrives via the blob store or federation.
   TransformMutation(mutation MutationNode, rollback <-chan MutationNode, concurrent []string) os.Error
+  // Transforms a mutation created by a local client. The rollback channel delivers all mutations
+  // applied since the sequence number at which the client applied the mutation optimistically.
+  // This function is called by CreateMutationBlob and CreateMultiFieldMutationBlob before the blob is created.
+  // The created blob depends on all blobs applied so far, hence TransformMutation has nothing to roll back when it is handled.
   TransformClientMutation(mutation_input MutationNode, rollback <-chan MutationNode) os.Error
   Kind() int
   DataType() int
 }
 
+// Transformers can implement this interface to support reading fields at a past frontier, see FieldValueAt.
+type Pruner interface {
+  // The mutations are in the order in which they have been applied. The keys of 'prune' are the blobrefs
+  // of mutations which must be removed. The remaining mutations must be changed as if the pruned
+  // mutations had never been applied. Returns the remaining mutations in the same order.
+  PruneMutations(mutations []MutationNode, prune map[string]bool) (result []MutationNode, err os.Error)
+}
+
 // The API layer as seen by the Grapher
 type API interface {
   // This function is called when an invitation has been received.
@@ -126,6 +187,8 @@ type API interface {
 type BlobStore interface {
   StoreBlob(blob []byte, blobref string) (finalBlobRef string, err os.Error)
   GetBlob(blobref string) (blob []byte, err os.Error)
+  // Retrieves several blobs at once. Unknown blobs are missing in the result
+  GetBlobsByRef(blobrefs []string) (blobs map[string][]byte, err os.Error)
 }
 
 type GraphStore interface {
@@ -154,13 +217,43 @@ type Grapher struct {
   transformers map[string]Transformer
   api API
   schema *Schema
+  // The keys are perma blobrefs. The values are channels of subscribed patch streams.
+  patchStreams map[string][]chan []byte
+  streamMutex sync.Mutex
+  // Guards the graph store and the OT state of all perma nodes.
+  // Blobs are processed by the dispatch goroutine of the blob store while
+  // applications read the graph concurrently.
+  mutex sync.Mutex
+  // Callbacks into the API and federation which have been queued while holding the mutex.
+  signals []func()
+  // The blobref of the draft which is being applied by CreateDraftMutationBlob, see draft.go
+  drafting string
+  // Blobs with a timestamp further in the future (in seconds) are deferred. Zero disables the check
+  maxClockSkew int64
+  // Callers of StoreBlobAndWait. The keys are blobrefs
+  waiters map[string][]chan os.Error
+  // Retry policy for downloads of perma nodes. The backoff is in nanoseconds
+  downloadAttempts int
+  downloadBackoff int64
+  // Errors which occurred in the background
+  errorLog *errorLog
+  // The subscription returned by Errors
+  errors <-chan os.Error
+  // Closed by Close to cancel pending retries
+  done chan bool
+  closed bool
+  // Produces the random field of new permanodes
+  random *store.RandomSource
+  // Conflicts reported by transformers for the mutation being transformed
+  conflicts []*Conflict
 }
 
 // Creates a new indexer for the specified user based on the blob store.
 // The indexer calls the federation object to send messages to other users.
 // Federation may be nil as well.
-func NewGrapher(userid string, schema *Schema, store BlobStore, gstore GraphStore, fed Federation) *Grapher {
-  idx := &Grapher{userID: userid, store: store, gstore: gstore, fed: fed, schema: schema, transformers: make(map[string]Transformer)}
+func NewGrapher(userid string, schema *Schema, blobstore BlobStore, gstore GraphStore, fed Federation) *Grapher {
+  idx := &Grapher{userID: userid, store: blobstore, gstore: gstore, fed: fed, schema: schema, transformers: make(map[string]Transformer), patchStreams: make(map[string][]chan []byte), maxClockSkew: DefaultMaxClockSkew, waiters: make(map[string][]chan os.Error), downloadAttempts: DefaultDownloadAttempts, downloadBackoff: DefaultDownloadBackoff, errorLog: newErrorLog(DefaultErrorCapacity), done: make(chan bool), random: store.NewRandomSource()}
+  idx.errors = idx.errorLog.subscribe()
   if fed != nil {
     fed.SetGrapher(idx)
   }
@@ -176,7 +269,46 @@ func (self *Grapher) SetAPI(api API) {
   self.api = api
 }
 
+// Defers blobs whose timestamp is more than 'seconds' ahead of the local clock, see DeferredBlobError.
+// Otherwise such a blob would win every last-writer-wins decision, for example on metadata.
+// Zero disables the check. The default is DefaultMaxClockSkew.
+func (self *Grapher) SetMaxClockSkew(seconds int64) {
+  self.lock()
+  defer self.unlock()
+  self.maxClockSkew = seconds
+}
+
+// Sets the source and the number of random bytes which make new permanodes unique.
+// A nil source selects crypto/rand. The default length is store.DefaultRandomLength.
+func (self *Grapher) SetRandom(source io.Reader, length int) {
+  self.random.Set(source, length)
+}
+
+func (self *Grapher) lock() {
+  self.mutex.Lock()
+}
+
+// Releases the mutex and then invokes all queued callbacks.
+// Callbacks run outside of the critical section, hence they may call back into the grapher.
+func (self *Grapher) unlock() {
+  signals := self.signals
+  self.signals = nil
+  // Conflicts of mutations which have not been applied are dropped
+  self.conflicts = nil
+  self.mutex.Unlock()
+  for _, f := range signals {
+    f()
+  }
+}
+
+// Queues a callback until the mutex is released. Must be called while holding the mutex.
+func (self *Grapher) signal(f func()) {
+  self.signals = append(self.signals, f)
+}
+
 func (self *Grapher) Frontier(blobref string) (frontier []string, err os.Error) {
+  self.lock()
+  defer self.unlock()
   p, err := self.permaNode(blobref)
   if err != nil {
     return nil, err
@@ -184,7 +316,15 @@ func (self *Grapher) Frontier(blobref string) (frontier []string, err os.Error)
   return p.frontier.IDs(), nil
 }
 
+// Describes the schema of the grapher as JSON, such that clients know how to construct valid mutations.
+// See Schema.MarshalJSON.
+func (self *Grapher) DescribeSchema() ([]byte, os.Error) {
+  return self.schema.MarshalJSON()
+}
+
 func (self *Grapher) Followers(blobref string) (users []string, err os.Error) {
+  self.lock()
+  defer self.unlock()
   p, err := self.permaNode(blobref)
   if err != nil {
     return nil, err
@@ -192,6 +332,43 @@ func (self *Grapher) Followers(blobref string) (users []string, err os.Error) {
   return p.Followers(), nil
 }
 
+// Describes a mutation in the history of an entity
+type MutationInfo struct {
+  BlobRef string
+  Signer string
+  Field string
+  // Seconds since the epoch as specified by the signer. Zero if unknown
+  Time int64
+  SequenceNumber int64
+}
+
+// Returns the mutations applied to the entity in the order in which they have been applied,
+// which is a causal order. Returns nil if the perma node is unknown.
+func (self *Grapher) EntityHistory(perma_blobref, entity_blobref string) (history []MutationInfo) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil || perma == nil {
+    return nil
+  }
+  ch, err := self.getOTNodesAscending(perma_blobref, 0, perma.SequenceNumber())
+  if err != nil {
+    log.Printf("Err: Failed reading the history: %v\n", err)
+    return nil
+  }
+  for n := range ch {
+    mut, ok := n.(*mutationNode)
+    if !ok || mut.EntityBlobRef() != entity_blobref {
+      continue
+    }
+    // A mutation of several fields yields one entry per field
+    for _, part := range mut.parts() {
+      history = append(history, MutationInfo{BlobRef: part.BlobRef(), Signer: part.Signer(), Field: part.Field(), Time: part.Time(), SequenceNumber: part.SequenceNumber()})
+    }
+  }
+  return
+}
+
 func (self *Grapher) permaNode(blobref string) (perma *permaNode, err os.Error) {
   m, err := self.gstore.GetPermaNode(blobref)
   if err != nil || m == nil {
@@ -205,20 +382,26 @@ func (self *Grapher) permaNode(blobref string) (perma *permaNode, err os.Error)
   return p, nil  
 }
 
-func (self *Grapher) transformer(perma PermaNode, entity EntityNode, field string) (t Transformer, err os.Error) {
+// Returns the schema of the field of the entity. Fields which are not declared in the schema are unknown.
+func (self *Grapher) fieldSchema(perma PermaNode, entity EntityNode, field string) (fieldSchema *FieldSchema, err os.Error) {
   fileSchema, ok := self.schema.FileSchemas[perma.MimeType()]
   if !ok {
-    err = os.NewError("Unknown document mime type")
-    return
+    return nil, os.NewError("Unknown document mime type")
   }
   entitySchema, ok := fileSchema.EntitySchemas[entity.MimeType()]
   if !ok {
-    err = os.NewError("Unknown entity mime type")
-    return
+    return nil, os.NewError("Unknown entity mime type")
   }
-  fieldSchema, ok := entitySchema.FieldSchemas[field]
+  fieldSchema, ok = entitySchema.FieldSchemas[field]
   if !ok {
-    err = os.NewError("Unknown field")
+    return nil, os.NewError("Unknown field")
+  }
+  return
+}
+
+func (self *Grapher) transformer(perma PermaNode, entity EntityNode, field string) (t Transformer, err os.Error) {
+  fieldSchema, err := self.fieldSchema(perma, entity, field)
+  if err != nil {
     return
   }
   if fieldSchema.Transformation == TransformationNone {
@@ -258,6 +441,30 @@ func (self *Grapher) permission(perma_blobref string, blobref string) (permissio
   return p, nil  
 }
 
+// Returns the mutation as it has been applied, i.e. already transformed.
+// Returns nil if the blob has not been applied or is not a mutation.
+// Transformers use this to resolve the blobrefs passed in 'concurrent'.
+// Transformers are called while the grapher is locked, hence this function does not lock
+// and must only be called from within a Transformer.
+// For a mutation of several fields, Field() is empty and Operation() is nil.
+// The rollback channel of the transformer delivers such mutations reduced to the field being transformed.
+func (self *Grapher) LookupMutation(perma_blobref string, blobref string) (mut MutationNode, err os.Error) {
+  m, err := self.gstore.GetOTNodeByBlobRef(perma_blobref, blobref)
+  if err != nil || m == nil || m["k"].(int64) != OTNode_Mutation {
+    return nil, err
+  }
+  return self.mutationNodeFromMap(perma_blobref, m), nil
+}
+
+// Like LookupMutation, but for permissions.
+func (self *Grapher) LookupPermission(perma_blobref string, blobref string) (perm PermissionNode, err os.Error) {
+  p, err := self.permission(perma_blobref, blobref)
+  if err != nil || p == nil {
+    return nil, err
+  }
+  return p, nil
+}
+
 func (self *Grapher) enqueue(perma_blobref, blobref string, deps []string) os.Error {
   return self.gstore.Enqueue(perma_blobref, blobref, deps)
 }
@@ -270,6 +477,9 @@ func (self *Grapher) decodeNode(schema *superSchema, blobref string) (result int
   if schema.Signer == "" {
     return nil, os.NewError("Missing signer")
   }
+  if self.maxClockSkew > 0 && schema.Time > time.Seconds() + self.maxClockSkew {
+    return nil, ErrClockSkew
+  }
   switch schema.Type {
   case "keep":
     if schema.PermaNode == "" {
@@ -292,7 +502,22 @@ func (self *Grapher) decodeNode(schema *superSchema, blobref string) (result int
     if schema.Content == nil {
       return nil, os.NewError("Entity must have some content")
     }
-    n := &entityNode{entityBlobRef: blobref, entitySigner: schema.Signer, permaBlobRef: schema.PermaNode, dependencies: schema.Dependencies, mimeType: schema.MimeType, content: []byte(*schema.Content)}
+    n := &entityNode{entityBlobRef: blobref, entitySigner: schema.Signer, permaBlobRef: schema.PermaNode, dependencies: schema.Dependencies, mimeType: schema.MimeType, content: []byte(*schema.Content), after: schema.After}
+    return n, nil
+  case "moveentity":
+    if schema.PermaNode == "" {
+      return nil, os.NewError("Missing perma in moveentity")
+    }
+    if schema.Entity == "" {
+      return nil, os.NewError("Move is lacking an entity")
+    }
+    n := &moveEntityNode{moveBlobRef: blobref, moveSigner: schema.Signer, entityBlobRef: schema.Entity, permaBlobRef: schema.PermaNode, dependencies: schema.Dependencies, after: schema.After, time: schema.Time}
+    return n, nil
+  case "meta":
+    if schema.PermaNode == "" {
+      return nil, os.NewError("Missing perma in meta")
+    }
+    n := &metaNode{metaBlobRef: blobref, metaSigner: schema.Signer, permaBlobRef: schema.PermaNode, dependencies: schema.Dependencies, title: schema.Title, addTags: schema.AddTags, removeTags: schema.RemoveTags, time: schema.Time}
     return n, nil
   case "delentity":
     if schema.PermaNode == "" {
@@ -304,19 +529,37 @@ func (self *Grapher) decodeNode(schema *superSchema, blobref string) (result int
     n := &delEntityNode{delBlobRef: blobref, delSigner: schema.Signer, entityBlobRef: schema.Entity, permaBlobRef: schema.PermaNode, dependencies: schema.Dependencies}
     return n, nil
   case "mutation":
-    if schema.Operation == nil {
-      return nil, os.NewError("Mutation is lacking an operation")
-    }
     if schema.Entity == "" {
       return nil, os.NewError("Mutation is lacking an entity")
     }
-    if schema.Field == "" {
-      return nil, os.NewError("Mutation is lacking a field")
-    }
     if schema.PermaNode == "" {
       return nil, os.NewError("Missing perma in mutation")
     }
-    n := &mutationNode{mutationSigner: schema.Signer, permaBlobRef: schema.PermaNode, mutationBlobRef: blobref, dependencies: schema.Dependencies, operation: []byte(*schema.Operation), entityBlobRef: schema.Entity, field: schema.Field, time: schema.Time}
+    n := &mutationNode{mutationSigner: schema.Signer, permaBlobRef: schema.PermaNode, mutationBlobRef: blobref, dependencies: schema.Dependencies, entityBlobRef: schema.Entity, time: schema.Time}
+    // A mutation of several fields?
+    if len(schema.Fields) > 0 {
+      if schema.Field != "" || schema.Operation != nil {
+	return nil, os.NewError("Mutation must not have both a field and several fields")
+      }
+      n.operations = make(map[string]interface{})
+      for field, op := range schema.Fields {
+	if field == "" || op == nil {
+	  return nil, os.NewError("Mutation is lacking a field or an operation")
+	}
+	n.fields = append(n.fields, field)
+	n.operations[field] = []byte(*op)
+      }
+      sort.Strings(n.fields)
+      return n, nil
+    }
+    if schema.Operation == nil {
+      return nil, os.NewError("Mutation is lacking an operation")
+    }
+    if schema.Field == "" {
+      return nil, os.NewError("Mutation is lacking a field")
+    }
+    n.operation = []byte(*schema.Operation)
+    n.field = schema.Field
     return n, nil
   case "permission":
     if schema.User == "" {
@@ -348,8 +591,14 @@ func (self *Grapher) decodeNode(schema *superSchema, blobref string) (result int
   return nil, os.NewError("Unknown schema type: " + schema.Type)
 }
 
-// Invoked from the blob store
+// Invoked from the blob store. Implements the BlobStoreListener interface
 func (self *Grapher) HandleBlob(blob []byte, blobref string) (err os.Error) {
+  self.lock()
+  defer self.unlock()
+  return self.handleBlob(blob, blobref)
+}
+
+func (self *Grapher) handleBlob(blob []byte, blobref string) (err os.Error) {
   var perma *permaNode
   // First, determine the mimetype
   mimetype := MimeType(blob)
@@ -359,12 +608,18 @@ func (self *Grapher) HandleBlob(blob []byte, blobref string) (err os.Error) {
     err = json.Unmarshal(blob, &schema)
     if err != nil {
       log.Printf("Err: Malformed schema blob: %v\n", err)
+      self.complete(blobref, err)
       return err
     }
     var node AbstractNode
     if perma, node, err = self.handleSchemaBlob(&schema, blobref); node == nil || err != nil {
+      // If both are nil, the blob is waiting for other blobs or has been deferred and has not yet been processed
+      if err != nil {
+	self.complete(blobref, err)
+      }
       return err
     }
+    self.complete(blobref, nil)
   } else {
     // TODO: Handle ordinary binary blobs
     panic("Unsupported blob type")
@@ -375,19 +630,31 @@ func (self *Grapher) HandleBlob(blob []byte, blobref string) (err os.Error) {
   if err != nil {
     return err
   }
+  if len(deps) == 0 {
+    return nil
+  }
+  blobs, err := self.store.GetBlobsByRef(deps)
+  if err != nil {
+    log.Printf("Err: Failed retrieving blobs: %v\n", err)
+    return nil
+  }
   for _, dep := range deps {
-    b, err := self.store.GetBlob(dep)
-    if err != nil {
-      log.Printf("Err: Failed retrieving blob: %v\n", err)
+    b, ok := blobs[dep]
+    if !ok {
+      log.Printf("Err: Failed retrieving blob %v\n", dep)
       continue
     }
-    self.HandleBlob(b, dep)
+    self.handleBlob(b, dep)
   }
   return nil;
 }
 
 func (self *Grapher) handleSchemaBlob(schema *superSchema, blobref string) (perma *permaNode, node AbstractNode, err os.Error) {
   newnode, err := self.decodeNode(schema, blobref)
+  if err == ErrClockSkew {
+    self.deferClockSkewedBlob(schema, blobref)
+    return nil, nil, nil
+  }
   if err != nil {
     log.Printf("Err: Schema blob is not valid: %v\n", err)
     return nil, nil, err
@@ -422,25 +689,46 @@ func (self *Grapher) handleSchemaBlob(schema *superSchema, blobref string) (perm
       //self.enqueue(perma.BlobRef(), blobref, inv.Dependencies())
       //return
     } else if keep, ok := newnode.(*keepNode); ok {
-      processed := self.checkKeep(perma, keep)
+      var processed bool
+      if processed, err = self.checkKeep(perma, keep); err != nil {
+	return nil, nil, err
+      }
+      // The keep waits for its permission
       if !processed {
-	return
+	return nil, nil, nil
       }
     }
-    var transformer Transformer
+    var transformers map[string]Transformer
     if mut, ok := newnode.(*mutationNode); ok {
       entity, err := self.entity(perma.BlobRef(), mut.EntityBlobRef())
       if err != nil {
 	return nil, nil, err
       }
-      transformer, err = self.transformer(perma, entity, mut.Field())
-      if err != nil {
-	return nil, nil, err
+      if entity == nil {
+	log.Printf("Err: Mutation of an unknown entity\nblobref=%v\n", blobref)
+	return nil, nil, os.NewError("Unknown entity")
+      }
+      transformers = make(map[string]Transformer)
+      for _, part := range mut.parts() {
+	// The field must be declared in the schema and the operation must suit its type
+	fieldSchema, err := self.fieldSchema(perma, entity, part.Field())
+	if err == nil {
+	  err = fieldSchema.checkOperation(part.Operation())
+	}
+	if err != nil {
+	  log.Printf("Err: Mutation of field %v rejected: %v\nblobref=%v\n", part.Field(), err, blobref)
+	  return nil, nil, err
+	}
+	transformers[part.Field()], err = self.transformer(perma, entity, part.Field())
+	if err != nil {
+	  return nil, nil, err
+	}
       }
     }
-    deps, err := perma.apply(newnode.(OTNode), transformer)
+    deps, err := perma.apply(newnode.(OTNode), transformers)
     if err != nil {
       log.Printf("Err: applying blob failed: %v\nblobref=%v\n", err, blobref)
+      self.conflicts = nil
       return nil, nil, err
     }
     // The blob could not be applied because of unresolved dependencies?
@@ -460,6 +748,10 @@ func (self *Grapher) handleSchemaBlob(schema *superSchema, blobref string) (perm
       processed = self.handleEntity(perma, newnode.(*entityNode))
     } else if _, ok := newnode.(*delEntityNode); ok {
       processed = self.handleDelEntity(perma, newnode.(*delEntityNode))
+    } else if _, ok := newnode.(*moveEntityNode); ok {
+      processed = self.handleMoveEntity(perma, newnode.(*moveEntityNode))
+    } else if _, ok := newnode.(*metaNode); ok {
+      processed = self.handleMeta(perma, newnode.(*metaNode))
     }
     
     // Store to persistent storage
@@ -468,17 +760,18 @@ func (self *Grapher) handleSchemaBlob(schema *superSchema, blobref string) (perm
       self.gstore.StoreNode(perma.BlobRef(), newnode.(OTNode).BlobRef(), newnode.(OTNode).ToMap(), perma_data)
       self.gstore.StorePermaNode(perma.BlobRef(), perma_data)
       log.Printf("Grapher processed blob %v at %v\n", node.BlobRef(), self.userID)
+      self.emitPatch(perma.BlobRef(), newnode.(OTNode))
     }
   default:
     log.Printf("Err: Unknown blob type\n")
     return nil, nil, os.NewError("Unknown blob type")
   }
 
-  // Forward the blob to all followers
-  if self.fed != nil && node.Signer() == self.userID {
+  // Forward the blob to all followers unless it is a draft
+  if self.fed != nil && node.Signer() == self.userID && !perma.isDraft(blobref) {
     users := perma.followersWithPermission(Perm_Read)
     if len(users) > 0 {
-      self.fed.Forward(blobref, users)
+      self.signal(func() { self.fed.Forward(blobref, users) })
     }
   }
   return perma, node, nil
@@ -489,27 +782,35 @@ func (self *Grapher) handleInvitation(perma *permaNode, perm *permissionNode) {
 //  self.openInvitations[perma.BlobRef()] = perm.BlobRef()
   // Signal to the next layer that an invitation has been received
   if self.api != nil {
-    self.api.Signal_ReceivedInvitation(perma, perm)
+    self.signal(func() { self.api.Signal_ReceivedInvitation(perma, perm) })
   }
 }
 
+// A mutation of several fields is signaled as one mutation per field
 func (self *Grapher) handleMutation(perma *permaNode, mut *mutationNode) bool {
+  self.signalConflicts(perma, mut)
+  for _, part := range mut.parts() {
+    perma.updateLength(part)
+  }
   if self.api != nil {
-    self.api.Blob_Mutation(perma, mut)
+    for _, part := range mut.parts() {
+      p := part
+      self.signal(func() { self.api.Blob_Mutation(perma, p) })
+    }
   }
   return true
 }
 
 func (self *Grapher) handleEntity(perma *permaNode, entity *entityNode) bool {
   if self.api != nil {
-    self.api.Blob_Entity(perma, entity)
+    self.signal(func() { self.api.Blob_Entity(perma, entity) })
   }
   return true
 }
 
 func (self *Grapher) handleDelEntity(perma *permaNode, delentity *delEntityNode) bool {
   if self.api != nil {
-    self.api.Blob_DeleteEntity(perma, delentity)
+    self.signal(func() { self.api.Blob_DeleteEntity(perma, delentity) })
   }
   return true
 }
@@ -524,39 +825,42 @@ func (self *Grapher) handlePermission(perma *permaNode, perm *permissionNode) bo
     // Add the invitation to remember that this user has been invited.
 //    perma.pendingInvitations[perm.User] = perm.BlobRef()
     // Forward the invitation to the user being invited
-    if self.fed != nil && perm.Signer() == self.userID {
-      self.fed.Forward(perm.BlobRef(), []string{perm.User})
-      // Forward the permanode to the invited user as well
-      self.fed.Forward(perma.BlobRef(), []string{perm.User})
+    if self.fed != nil && perm.Signer() == self.userID && perm.User != PublicUser {
+      self.signal(func() {
+	self.fed.Forward(perm.BlobRef(), []string{perm.User})
+	// Forward the permanode to the invited user as well
+	self.fed.Forward(perma.BlobRef(), []string{perm.User})
+      })
     }
   default:
     panic("Unknown action type")
   }
   if self.api != nil {
-    self.api.Blob_Permission(perma, perm)
+    self.signal(func() { self.api.Blob_Permission(perma, perm) })
   }  
   return true
 }
 
-func (self *Grapher) checkKeep(perma *permaNode, keep *keepNode) bool {
+func (self *Grapher) checkKeep(perma *permaNode, keep *keepNode) (processed bool, err os.Error) {
   log.Printf("Check keep for %v", keep.Signer())
   // The signer of the keep is not the signer of the permanode?
   // In this case he must present a valid invitation
   if keep.Signer() == perma.Signer() {
-    return true
+    return true, nil
   }
   
   if keep.permissionBlobRef == "" {
-    log.Printf("Err: Keep on a foreign permanode is missing a reference to a permission blob")
-    return false
+    err = os.NewError("Keep on a foreign permanode is missing a reference to a permission blob")
+    log.Printf("Err: %v\n", err)
+    return false, err
   }
     
-  var err os.Error
   perm, err := self.permission(perma.BlobRef(), keep.permissionBlobRef)
   // Not an invitation?
   if err != nil {
-    log.Printf("Err: Keep references a permission that is something else or malformed")
-    return false
+    err = os.NewError("Keep references a permission that is something else or malformed")
+    log.Printf("Err: %v\n", err)
+    return false, err
   }
   // Permission has not yet been received or processed? -> enqueue
   if perm == nil {
@@ -564,30 +868,33 @@ func (self *Grapher) checkKeep(perma *permaNode, keep *keepNode) bool {
     self.enqueue(perma.BlobRef(), keep.BlobRef(), []string{keep.permissionBlobRef})
     // The user accepted the invitation?
     if keep.Signer() == self.userID {
-      // Both users are on the different domains? -> Download the nodes
-      if domain(keep.Signer()) != domain(self.userID) {
+      // The perma node has been created on a different domain? -> Download the nodes.
+      // The keep is signed by the local user, hence comparing the domain of its signer with
+      // the local domain never triggers a download. The signer of the perma node decides instead.
+      if domain(perma.Signer()) != domain(self.userID) {
 	if self.fed != nil {
-	  go self.fed.DownloadPermaNode(keep.permissionBlobRef)
+	  go self.download(keep.permissionBlobRef)
 	} else {
 	  log.Printf("Err: Cannot accept invitation from remote user when federation is turned off")
 	}
       }
     }
-    return false
+    return false, nil
   }
   // TODO: Is the permission still valid or has it been overruled?
   
   // The invitation has indeed been issued for the user who issued the keep? If not -> error
   if perm.User != keep.Signer() {
-    log.Printf("Err: Keep references an invitation targeted at a different user")
-    return false
+    err = os.NewError("Keep references an invitation targeted at a different user")
+    log.Printf("Err: %v\n", err)
+    return false, err
   }
   
   // The user accepted the invitation?
   if self.api != nil {
-    self.api.Signal_AcceptedInvitation(perma, perm, keep)
+    self.signal(func() { self.api.Signal_AcceptedInvitation(perma, perm, keep) })
   }
-  return true
+  return true, nil
 }
 
 func (self *Grapher) handleKeep(perma *permaNode, keep *keepNode) bool {
@@ -608,9 +915,9 @@ func (self *Grapher) handleKeep(perma *permaNode, keep *keepNode) bool {
   // Signal the keep to the application
   if self.api != nil {
     if perm != nil {
-      self.api.Blob_Keep(perma, perm, keep)
+      self.signal(func() { self.api.Blob_Keep(perma, perm, keep) })
     } else {
-      self.api.Blob_Keep(perma, nil, keep)
+      self.signal(func() { self.api.Blob_Keep(perma, nil, keep) })
     }
   }
   
@@ -618,7 +925,7 @@ func (self *Grapher) handleKeep(perma *permaNode, keep *keepNode) bool {
   if perm != nil && perm.User == self.userID {
     // Send the keep (which accepts the invitation) to the signer of the invitation
     if self.fed != nil && keep.Signer() != self.userID {
-      self.fed.Forward(keep.BlobRef(), []string{keep.Signer()})
+      self.signal(func() { self.fed.Forward(keep.BlobRef(), []string{keep.Signer()}) })
     }
 //    self.openInvitations[perma.BlobRef()] = "", false
     log.Printf("The local user accepted the invitation\nREF=%v\n", keep.BlobRef())
@@ -634,8 +941,10 @@ func (self *Grapher) handleKeep(perma *permaNode, keep *keepNode) bool {
 	ch, _ := self.getOTNodesDescending(perma.BlobRef())
 	for history_node := range ch {
 	  if !h.SubstituteBlob(history_node.BlobRef(), history_node.Dependencies()) {
-	    // Send nodes created by the local user
-	    if history_node.Signer() == self.userID {
+	    // Send nodes created by the local user, except for drafts
+	    if perma.isDraft(history_node.BlobRef()) {
+	      // Do nothing by intention
+	    } else if history_node.Signer() == self.userID {
 	      forwards = append(forwards, history_node.BlobRef())
               // Send keeps that rely on a permission given by the local user
 	    } else if k, ok := history_node.(*keepNode); ok && k.permissionBlobRef != "" {
@@ -649,9 +958,11 @@ func (self *Grapher) handleKeep(perma *permaNode, keep *keepNode) bool {
 	  }
 	}
       }
-      for _, f := range forwards {
-	self.fed.Forward(f, []string{keep.Signer()})
-      }
+      self.signal(func() {
+	for _, f := range forwards {
+	  self.fed.Forward(f, []string{keep.Signer()}, Priority_Bulk)
+	}
+      })
     }
   }    
   return true
@@ -668,10 +979,13 @@ func (self *Grapher) getMutationsAscending(perma_blobref string, entity_blobref
     return nil, err
   }
   
+  // Mutations of several fields are reduced to the requested field
   c := make(chan MutationNode)
   f := func() {
     for data := range ch2 {
-      c <- self.mutationNodeFromMap(perma_blobref, data)
+      m := &mutationNode{}
+      m.FromMap(perma_blobref, data)
+      c <- m.part(field)
     }
     close(c)
   }
@@ -738,6 +1052,14 @@ func (self *Grapher) otNodeFromMap(perma_blobref string, data map[string]interfa
     e := &delEntityNode{}
     e.FromMap(perma_blobref, data)
     return e
+  case OTNode_MoveEntity:
+    m := &moveEntityNode{}
+    m.FromMap(perma_blobref, data)
+    return m
+  case OTNode_Meta:
+    m := &metaNode{}
+    m.FromMap(perma_blobref, data)
+    return m
   default:
     panic("Malformed data")
   }
@@ -758,6 +1080,33 @@ func (self *Grapher) mutationNodeFromMap(perma_blobref string, data map[string]i
 
 // Interface towards the API
 func (self *Grapher) Repeat(perma_blobref string, startWithSeqNumber int64) (perma PermaNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  p, err := self.repeat(perma_blobref, startWithSeqNumber)
+  if err != nil {
+    return nil, err
+  }
+  return p, nil
+}
+
+// Like Repeat, but returns the frontier of the perma node as well.
+// The frontier matches the repeated blobs, because both are read while holding the mutex.
+// Clients can use it as precondition of conditional writes, see CreateMutationBlobAtFrontier.
+func (self *Grapher) RepeatWithFrontier(perma_blobref string, startWithSeqNumber int64) (perma PermaNode, frontier []string, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  p, err := self.repeat(perma_blobref, startWithSeqNumber)
+  if err != nil {
+    return nil, nil, err
+  }
+  if p == nil {
+    return nil, nil, os.NewError("Unknown perma node")
+  }
+  return p, p.frontier.IDs(), nil
+}
+
+// The caller must hold the mutex
+func (self *Grapher) repeat(perma_blobref string, startWithSeqNumber int64) (perma *permaNode, err os.Error) {
   perma, err = self.permaNode(perma_blobref)
   if err != nil {
     return nil, err
@@ -770,8 +1119,10 @@ func (self *Grapher) Repeat(perma_blobref string, startWithSeqNumber int64) (per
   for n := range ch {
     switch n.(type) {
     case *mutationNode:
-      mut := n.(*mutationNode)
-      self.api.Blob_Mutation(perma, mut)
+      for _, part := range n.(*mutationNode).parts() {
+	mut := part
+	self.signal(func() { self.api.Blob_Mutation(perma, mut) })
+      }
     case *keepNode:
       keep := n.(*keepNode)
       var perm PermissionNode = nil
@@ -782,16 +1133,26 @@ func (self *Grapher) Repeat(perma_blobref string, startWithSeqNumber int64) (per
 	  return nil, err
         }
       }
-      self.api.Blob_Keep(perma, perm, keep)
+      self.signal(func() { self.api.Blob_Keep(perma, perm, keep) })
     case *permissionNode:
       perm := n.(*permissionNode)
-      self.api.Blob_Permission(perma, perm)
+      self.signal(func() { self.api.Blob_Permission(perma, perm) })
     case *entityNode:
       e := n.(*entityNode)
-      self.api.Blob_Entity(perma, e)
+      self.signal(func() { self.api.Blob_Entity(perma, e) })
     case *delEntityNode:
       e := n.(*delEntityNode)
-      self.api.Blob_DeleteEntity(perma, e)
+      self.signal(func() { self.api.Blob_DeleteEntity(perma, e) })
+    case *moveEntityNode:
+      m := n.(*moveEntityNode)
+      if api, ok := self.api.(OrderAPI); ok {
+	self.signal(func() { api.Blob_MoveEntity(perma, m) })
+      }
+    case *metaNode:
+      m := n.(*metaNode)
+      if api, ok := self.api.(MetaAPI); ok {
+	self.signal(func() { api.Blob_Meta(perma, m) })
+      }
     default:
       panic("Unknown blob type")
     }
@@ -800,8 +1161,19 @@ func (self *Grapher) Repeat(perma_blobref string, startWithSeqNumber int64) (per
 }
 
 func (self *Grapher) CreatePermaBlob(mimeType string) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  return self.createPermaBlob(mimeType)
+}
+
+// The caller must hold the mutex
+func (self *Grapher) createPermaBlob(mimeType string) (node AbstractNode, err os.Error) {
+  random, err := self.random.Next()
+  if err != nil {
+    return nil, err
+  }
   // Create the JSON to compute the hash
-  permaJson := map[string]interface{}{ "signer": self.userID, "random":fmt.Sprintf("%v", rand.Int63()), "mimeType":mimeType}
+  permaJson := map[string]interface{}{ "signer": self.userID, "random":random, "mimeType":mimeType}
   permaBlob, err := json.Marshal(permaJson)
   if err != nil {
     panic(err.String())
@@ -813,7 +1185,7 @@ func (self *Grapher) CreatePermaBlob(mimeType string) (node AbstractNode, err os
   var schema superSchema
   schema.Type = "permanode"
   schema.Signer = self.userID
-  schema.Random = fmt.Sprintf("%v", rand.Int63())
+  schema.Random = random
   schema.MimeType = mimeType
   _, node, err = self.handleSchemaBlob(&schema, permaBlobRef)
   return
@@ -821,6 +1193,13 @@ func (self *Grapher) CreatePermaBlob(mimeType string) (node AbstractNode, err os
 
 // The parameter 'permission_blobref' may be empty if the keep is from the same user that created the permaNode
 func (self *Grapher) CreateKeepBlob(perma_blobref, permission_blobref string) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  return self.createKeepBlob(perma_blobref, permission_blobref)
+}
+
+// The caller must hold the mutex
+func (self *Grapher) createKeepBlob(perma_blobref, permission_blobref string) (node AbstractNode, err os.Error) {
   // Create a keep on the permaNode.
   keepJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref}
   if permission_blobref != "" {
@@ -847,15 +1226,47 @@ func (self *Grapher) CreateKeepBlob(perma_blobref, permission_blobref string) (n
   return
 }
 
+// Creates an entity at the beginning of the file.
 func (self *Grapher) CreateEntityBlob(perma_blobref string, mimeType string, content []byte) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  // The entity is appended after the last entity of the file
+  entities, placements, err := self.entityOrder(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  after := ""
+  if len(entities) > 0 {
+    after = placements[entities[len(entities) - 1]]
+  }
+  return self.createEntityBlob(perma_blobref, after, mimeType, content)
+}
+
+// Creates an entity that is positioned directly after the entity 'after_entity'.
+// If 'after_entity' is empty, the entity is positioned at the beginning of the file.
+func (self *Grapher) CreateEntityBlobAfter(perma_blobref string, after_entity string, mimeType string, content []byte) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  after, err := self.placementAfter(perma_blobref, after_entity)
+  if err != nil {
+    return nil, err
+  }
+  return self.createEntityBlob(perma_blobref, after, mimeType, content)
+}
+
+// Creates an entity which is placed after the placement 'after'. The caller must hold the mutex
+func (self *Grapher) createEntityBlob(perma_blobref string, after string, mimeType string, content []byte) (node AbstractNode, err os.Error) {
   perma, e := self.permaNode(perma_blobref)
   if e != nil {
     err = e
     return
   }  
   c := json.RawMessage(content)
-  deps := perma.frontier.IDs()
+  deps := perma.published.IDs()
   entityJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "content": &c, "dep": deps, "mimetype": mimeType}
+  if after != "" {
+    entityJson["after"] = after
+  }
   entityBlob, err := json.Marshal(entityJson)
   if err != nil {
     panic(err.String())
@@ -871,11 +1282,14 @@ func (self *Grapher) CreateEntityBlob(perma_blobref string, mimeType string, con
   schema.Content = &c
   schema.MimeType = mimeType
   schema.Dependencies = deps
+  schema.After = after
   _, node, err = self.handleSchemaBlob(&schema, entityBlobRef)
   return
 }
 
 func (self *Grapher) CreateDeleteEntityBlob(perma_blobref string, entity_blobref string) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
   perma, e := self.permaNode(perma_blobref)
   if e != nil {
     err = e
@@ -886,7 +1300,7 @@ func (self *Grapher) CreateDeleteEntityBlob(perma_blobref string, entity_blobref
     err = e
     return
   }
-  deps := perma.frontier.IDs()
+  deps := perma.published.IDs()
   entityJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "entity": entity_blobref, "dep": deps}
   entityBlob, err := json.Marshal(entityJson)
   if err != nil {
@@ -906,6 +1320,8 @@ func (self *Grapher) CreateDeleteEntityBlob(perma_blobref string, entity_blobref
 }
 
 func (self *Grapher) CreatePermissionBlob(perma_blobref string, applyAtSeqNumber int64, userid string, allow int, deny int, action int) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
   perma, e := self.permaNode(perma_blobref)
   if e != nil {
     err = e
@@ -921,11 +1337,7 @@ func (self *Grapher) CreatePermissionBlob(perma_blobref string, applyAtSeqNumber
   if err != nil {
     return
   }
-  frontier, e := self.Frontier(perma_blobref)
-  if e != nil {
-    err = e
-    return
-  }
+  frontier := perma.published.IDs()
   // Create JSON to compute the blobref
   permJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": frontier, "user": permNode.User, "allow":permNode.Allow, "deny": permNode.Deny}
   switch action {
@@ -960,11 +1372,57 @@ func (self *Grapher) CreatePermissionBlob(perma_blobref string, applyAtSeqNumber
 }
 
 func (self *Grapher) CreateMutationBlob(perma_blobref string, entity_blobref string, field string, operation []byte, applyAtSeqNumber int64) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  return self.createMutationBlob(perma_blobref, entity_blobref, field, operation, applyAtSeqNumber, false)
+}
+
+// Returned by CreateMutationBlobAtFrontier if other blobs have been applied to the perma node in the meantime
+var ErrFrontierChanged = os.NewError("The frontier of the perma node has changed")
+
+// Creates a mutation only if the frontier of the perma node still consists of exactly the blobrefs in 'frontier'.
+// Otherwise the mutation is not created and ErrFrontierChanged is returned. The client can then fetch
+// the new state, rebase its change and try again. This offers optimistic concurrency to clients which
+// do not implement OT. The frontier after a successful write consists of the new mutation only.
+func (self *Grapher) CreateMutationBlobAtFrontier(perma_blobref string, entity_blobref string, field string, operation []byte, frontier []string) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if perma == nil {
+    return nil, os.NewError("Unknown perma node")
+  }
+  if len(perma.drafts) > 0 {
+    return nil, ErrUnpublishedDrafts
+  }
+  if len(perma.frontier) != len(frontier) {
+    return nil, ErrFrontierChanged
+  }
+  for _, blobref := range frontier {
+    if !perma.frontier[blobref] {
+      return nil, ErrFrontierChanged
+    }
+  }
+  // Nothing is concurrent to the mutation, hence it applies at the current sequence number
+  return self.createMutationBlob(perma_blobref, entity_blobref, field, operation, perma.SequenceNumber(), false)
+}
+
+func (self *Grapher) createMutationBlob(perma_blobref string, entity_blobref string, field string, operation []byte, applyAtSeqNumber int64, draft bool) (node AbstractNode, err os.Error) {
   perma, e := self.permaNode(perma_blobref)
   if e != nil {
     err = e
     return
   }
+  if perma == nil {
+    err = os.NewError("Unknown perma node")
+    return
+  }
+  if !draft && len(perma.drafts) > 0 {
+    err = ErrUnpublishedDrafts
+    return
+  }
   entity, e := self.entity(perma.BlobRef(), entity_blobref)
   if e != nil {
     err = e
@@ -997,7 +1455,7 @@ func (self *Grapher) CreateMutationBlob(perma_blobref string, entity_blobref str
     }
   }
   deps := perma.frontier.IDs()
-  mutJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": deps, "entity":entity_blobref, "field":field}
+  mutJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": deps, "entity":entity_blobref, "field":field, "t": m.time}
   var msg json.RawMessage
   switch m.operation.(type) {
   case ot.StringOperation:
@@ -1030,6 +1488,92 @@ func (self *Grapher) CreateMutationBlob(perma_blobref string, entity_blobref str
   schema2.Entity = entity_blobref
   schema2.Field = field
   schema2.Operation = &msg
+  schema2.Time = m.time
+  if draft {
+    self.drafting = mutBlobRef
+  }
+  _, node, err = self.handleSchemaBlob(&schema2, mutBlobRef)
+  self.drafting = ""
+  return
+}
+
+// Creates a mutation which changes several fields of the entity atomically.
+// The keys of 'operations' are field names. The operation of each field is transformed
+// independently, just like the operation passed to CreateMutationBlob.
+func (self *Grapher) CreateMultiFieldMutationBlob(perma_blobref string, entity_blobref string, operations map[string][]byte, applyAtSeqNumber int64) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  if len(operations) == 0 {
+    return nil, os.NewError("Mutation is lacking an operation")
+  }
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if perma == nil {
+    return nil, os.NewError("Unknown perma node")
+  }
+  if len(perma.drafts) > 0 {
+    return nil, ErrUnpublishedDrafts
+  }
+  entity, err := self.entity(perma.BlobRef(), entity_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if entity == nil {
+    return nil, os.NewError("Unknown entity")
+  }
+  m := &mutationNode{permaBlobRef: perma_blobref, mutationBlobRef: "Z", mutationSigner: self.userID, entityBlobRef: entity_blobref, time: time.Seconds(), operations: make(map[string]interface{})}
+  for field, op := range operations {
+    m.fields = append(m.fields, field)
+    m.operations[field] = op
+  }
+  sort.Strings(m.fields)
+  // Update the operations such that they can be applied after all currently applied operations
+  parts := m.parts()
+  for _, part := range parts {
+    transformer, err := self.transformer(perma, entity, part.Field())
+    if err != nil {
+      return nil, err
+    }
+    if transformer == nil {
+      continue
+    }
+    ch, err := self.getMutationsAscending(perma.BlobRef(), entity_blobref, part.Field(), applyAtSeqNumber, perma.SequenceNumber())
+    if err != nil {
+      return nil, err
+    }
+    if err = transformer.TransformClientMutation(part, ch); err != nil {
+      return nil, err
+    }
+  }
+  fields := make(map[string]*json.RawMessage)
+  for _, part := range parts {
+    msg, err := operationToJSON(part.Operation())
+    if err != nil {
+      return nil, err
+    }
+    fields[part.Field()] = &msg
+  }
+  deps := perma.frontier.IDs()
+  mutJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": deps, "entity":entity_blobref, "fields":fields, "t": m.time}
+  schema, err := json.Marshal(mutJson)
+  if err != nil {
+    panic(err.String())
+  }
+  mutBlob := []byte(`{"type":"mutation",`)
+  mutBlob = append(mutBlob, schema[1:]...)
+  log.Printf("Storing mut %v\n", string(mutBlob))
+  mutBlobRef := newBlobRef(mutBlob)
+  // Process it
+  var schema2 superSchema
+  schema2.Type = "mutation"
+  schema2.Signer = self.userID
+  schema2.PermaNode = perma_blobref
+  schema2.Dependencies = deps
+  schema2.Entity = entity_blobref
+  schema2.Fields = fields
+  schema2.Time = m.time
   _, node, err = self.handleSchemaBlob(&schema2, mutBlobRef)
   return
 }
@@ -1053,6 +1597,17 @@ type clientSuperSchema struct {
   Operation *json.RawMessage "op"
   Entity string "entity"
   Field string "field"
+  // Only for mutations of several fields. Replaces "field" and "op"
+  Fields map[string]*json.RawMessage "fields"
+  // The entity after which an entity is positioned
+  After string "after"
+  // Only for mutations. If present, the mutation is only created if the frontier of the perma node
+  // consists of these blobrefs. See CreateMutationBlobAtFrontier
+  Frontier []string "frontier"
+
+  Title *string "title"
+  AddTags []string "addtags"
+  RemoveTags []string "removetags"
   
   Content *json.RawMessage "content"
 }
@@ -1077,7 +1632,9 @@ func (self *Grapher) HandleClientBlob(blob []byte) (node AbstractNode, err os.Er
   case "keep":
     var permissionBlobRef string
     if schema.Permission != "" {
+      self.lock()
       data, err := self.gstore.GetOTNodeByBlobRef(schema.PermaNode, schema.Permission)
+      self.unlock()
       if err != nil {
 	log.Printf("Unable to find permission %v, %v", schema.PermaNode, schema.Permission)
 	return nil, err
@@ -1095,15 +1652,33 @@ func (self *Grapher) HandleClientBlob(blob []byte) (node AbstractNode, err os.Er
     }
     return
   case "mutation":
-    if schema.Operation == nil {
-      return nil, os.NewError("Mutation is lacking an operation")
-    }
     if schema.Entity == "" {
       return nil, os.NewError("Mutation is lacking an entity")
     }
+    if len(schema.Fields) > 0 {
+      if schema.Frontier != nil {
+	return nil, os.NewError("A frontier precondition is not supported for mutations of several fields")
+      }
+      operations := make(map[string][]byte)
+      for field, op := range schema.Fields {
+	if op == nil {
+	  return nil, os.NewError("Mutation is lacking an operation")
+	}
+	operations[field] = []byte(*op)
+      }
+      node, err = self.CreateMultiFieldMutationBlob(schema.PermaNode, schema.Entity, operations, schema.ApplyAt)
+      return
+    }
+    if schema.Operation == nil {
+      return nil, os.NewError("Mutation is lacking an operation")
+    }
     if schema.Field == "" {
       return nil, os.NewError("Mutation is lacking a field")
     }
+    if schema.Frontier != nil {
+      node, err = self.CreateMutationBlobAtFrontier(schema.PermaNode, schema.Entity, schema.Field, []byte(*schema.Operation), schema.Frontier)
+      return
+    }
     node, err = self.CreateMutationBlob(schema.PermaNode, schema.Entity, schema.Field, []byte(*schema.Operation), schema.ApplyAt)
     return
   case "delentity":
@@ -1116,7 +1691,16 @@ func (self *Grapher) HandleClientBlob(blob []byte) (node AbstractNode, err os.Er
     if schema.MimeType == "" {
       return nil, os.NewError("Entity is lacking a mimetype")
     }
-    node, err = self.CreateEntityBlob(schema.PermaNode, schema.MimeType, []byte(*schema.Content))
+    node, err = self.CreateEntityBlobAfter(schema.PermaNode, schema.After, schema.MimeType, []byte(*schema.Content))
+    return
+  case "moveentity":
+    if schema.Entity == "" {
+      return nil, os.NewError("Move is lacking an entity")
+    }
+    node, err = self.CreateMoveEntityBlob(schema.PermaNode, schema.Entity, schema.After)
+    return
+  case "meta":
+    node, err = self.CreateMetaBlob(schema.PermaNode, schema.Title, schema.AddTags, schema.RemoveTags)
     return
   case "permission":
     var action int
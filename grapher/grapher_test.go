@@ -6,16 +6,28 @@ import (
   "fmt"
   "log"
   "os"
+  "sync"
   "time"
 )
 
 var schema = &Schema{ FileSchemas: map[string]*FileSchema {
     "application/x-test-file": &FileSchema{ EntitySchemas: map[string]*EntitySchema {
 	"application/x-test-entity": &EntitySchema { FieldSchemas: map[string]*FieldSchema {
-	    "text": &FieldSchema{ Type: TypeString, ElementType: TypeNone, Transformation: TransformationMerge } } } } } } }
+	    "text": &FieldSchema{ Type: TypeString, ElementType: TypeNone, Transformation: TransformationMerge },
+	    "title": &FieldSchema{ Type: TypeString, ElementType: TypeNone, Transformation: TransformationMerge } } } } } } }
 
 type dummyTransformer struct {
   grapher *Grapher
+  // The blobrefs delivered via the rollback channel of the last call
+  rollback []string
+  concurrent []string
+  // The concurrent mutations as resolved via LookupMutation
+  resolved []MutationNode
+  // If true, the mutations on the rollback channel of client mutations are reported
+  // as conflicts which they win against the client mutation
+  conflicts bool
+  // The blobrefs pruned by the last call to PruneMutations
+  pruned []string
 }
 
 func newDummyTransformer(grapher *Grapher) Transformer {
@@ -34,19 +46,57 @@ func (self *dummyTransformer) DataType() int {
 
 // Interface towards the Grapher
 func (self *dummyTransformer) TransformClientMutation(mutation MutationNode, rollback <-chan MutationNode) (err os.Error) {
+  self.rollback = nil
+  self.concurrent = nil
+  for m := range rollback {
+    self.rollback = append(self.rollback, m.BlobRef())
+    if self.conflicts {
+      self.grapher.ReportConflict(&Conflict{PermaBlobRef: m.PermaBlobRef(), EntityBlobRef: m.EntityBlobRef(), Field: m.Field(), Winner: m.BlobRef(), Loser: mutation.BlobRef()})
+    }
+  }
   return
 }
 
 // Interface towards the Grapher
 func (self *dummyTransformer) TransformMutation(mutation MutationNode, rollback <-chan MutationNode, concurrent []string) (err os.Error) {
+  self.rollback = nil
+  self.concurrent = concurrent
+  for m := range rollback {
+    self.rollback = append(self.rollback, m.BlobRef())
+  }
+  self.resolved = nil
+  for _, c := range concurrent {
+    m, err := self.grapher.LookupMutation(mutation.PermaBlobRef(), c)
+    if err != nil {
+      return err
+    }
+    if m != nil {
+      self.resolved = append(self.resolved, m)
+    }
+  }
+  return
+}
+
+// Interface towards the Grapher. Drops the pruned mutations without changing the others
+func (self *dummyTransformer) PruneMutations(mutations []MutationNode, prune map[string]bool) (result []MutationNode, err os.Error) {
+  self.pruned = nil
+  for _, m := range mutations {
+    if prune[m.BlobRef()] {
+      self.pruned = append(self.pruned, m.BlobRef())
+    } else {
+      result = append(result, m)
+    }
+  }
   return
 }
 
 type dummyFederation struct {
+  forwarded []string
 }
 
-func (self *dummyFederation) Forward(blobref string, users []string) {
+func (self *dummyFederation) Forward(blobref string, users []string, priority ...int) {
   log.Printf("Forwarding %v to %v\n", blobref, users) 
+  self.forwarded = append(self.forwarded, blobref)
 }
 
 func (self *dummyFederation) SetGrapher(idx *Grapher) {
@@ -70,7 +120,7 @@ func TestPermanode(t *testing.T) {
   s.StoreBlob(blob1, blobref1)
   s.StoreBlob(blob2, blobref2)
   
-  time.Sleep(1000000000 * 2)
+  grapher.WaitIdle()
 
   perma, err := grapher.permaNode(blobref1)
   if perma == nil || err != nil {
@@ -97,7 +147,7 @@ func TestPermanode2(t *testing.T) {
   s.StoreBlob(blob2, blobref2)  
   s.StoreBlob(blob1, blobref1)
   
-  time.Sleep(1000000000 * 2)
+  grapher.WaitIdle()
 
   perma, err := grapher.permaNode(blobref1)
   if perma == nil || err != nil {
@@ -145,7 +195,7 @@ func TestPermanode3(t *testing.T) {
   s.StoreBlob(blob5, blobref5)
   s.StoreBlob(blob7, blobref7)
   
-  time.Sleep(1000000000 * 2)
+  grapher.WaitIdle()
 
   perma, err := grapher.permaNode(blobref1)
   if perma == nil || err != nil {
@@ -202,3 +252,1135 @@ func TestPermanode3(t *testing.T) {
     t.Fatal("Wrong users")
   }
 }
+
+func TestPublicPermaNode(t *testing.T) {
+  perma := NewPermaNode(nil)
+  perma.signer = "a@b"
+  if perma.IsPublic() {
+    t.Fatal("Perma node must not be public")
+  }
+  perma.permissions[PublicUser] = Perm_Read | Perm_Write
+  if !perma.IsPublic() {
+    t.Fatal("Perma node must be public")
+  }
+  if len(perma.Users()) != 0 {
+    t.Fatalf("The wildcard user must not be listed as a user: %v", perma.Users())
+  }
+  if perma.hasPermission("foo@bar", Perm_Write) {
+    t.Fatal("Public perma nodes must not be writable by everyone")
+  }
+}
+
+func TestEntityOrder(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{})
+  s.AddListener(grapher)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "mimetype":"application/x-test-file", "random":"perma1abc"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `"}`)
+  blobref1b := store.NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":"", "dep":["` + blobref1b + `"]}`)
+  blobref2 := store.NewBlobRef(blob2)
+  // Two concurrent entities inserted after the first one
+  blob3 := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":"", "after":"` + blobref2 + `", "dep":["` + blobref2 + `"]}`)
+  blobref3 := store.NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"entity", "signer":"foo@bar", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":"", "after":"` + blobref2 + `", "dep":["` + blobref2 + `"]}`)
+  blobref4 := store.NewBlobRef(blob4)
+
+  s.StoreBlob(blob1, blobref1)
+  s.StoreBlob(blob1b, blobref1b)
+  s.StoreBlob(blob2, blobref2)
+  s.StoreBlob(blob4, blobref4)
+  s.StoreBlob(blob3, blobref3)
+
+  grapher.WaitIdle()
+
+  first, second := blobref3, blobref4
+  if first < second {
+    first, second = second, first
+  }
+  order, err := grapher.EntityOrder(blobref1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(order) != 3 || order[0] != blobref2 || order[1] != first || order[2] != second {
+    t.Fatalf("Wrong entity order: %v", order)
+  }
+
+  // Insert a new entity after the first one. It is positioned before the concurrently inserted entities
+  node, err := grapher.CreateEntityBlobAfter(blobref1, blobref2, "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  order, _ = grapher.EntityOrder(blobref1)
+  if len(order) != 4 || order[0] != blobref2 || order[1] != node.BlobRef() || order[2] != first || order[3] != second {
+    t.Fatalf("Wrong entity order after insert: %v", order)
+  }
+
+  // Move the first entity to the end
+  if _, err = grapher.CreateMoveEntityBlob(blobref1, blobref2, second); err != nil {
+    t.Fatal(err)
+  }
+  order, _ = grapher.EntityOrder(blobref1)
+  if len(order) != 4 || order[0] != node.BlobRef() || order[1] != first || order[2] != second || order[3] != blobref2 {
+    t.Fatalf("Wrong entity order after move: %v", order)
+  }
+}
+
+func TestRollback(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  transformer := newDummyTransformer(grapher).(*dummyTransformer)
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.CreateKeepBlob(perma.BlobRef(), ""); err != nil {
+    t.Fatal(err)
+  }
+  entity, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  p, _ := grapher.permaNode(perma.BlobRef())
+  seq := p.SequenceNumber()
+
+  // The client applied the mutation optimistically at 'seq'. Nothing must be rolled back
+  mut1, err := grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["Hello"]}`), seq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(transformer.rollback) != 0 {
+    t.Fatalf("Unexpected rollback: %v", transformer.rollback)
+  }
+  // Another client did not yet see 'mut1'
+  mut2, err := grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["World"]}`), seq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(transformer.rollback) != 1 || transformer.rollback[0] != mut1.BlobRef() {
+    t.Fatalf("Expected a rollback of the first mutation: %v", transformer.rollback)
+  }
+
+  // A mutation from another site which is concurrent to both mutations
+  blob := []byte(`{"type":"mutation", "signer":"x@y", "perma":"` + perma.BlobRef() + `", "dep":["` + entity.BlobRef() + `"], "op":{"$t":["Olla"]}, "entity":"` + entity.BlobRef() + `", "field":"text"}`)
+  if err = grapher.HandleBlob(blob, store.NewBlobRef(blob)); err != nil {
+    t.Fatal(err)
+  }
+  if len(transformer.rollback) != 2 || transformer.rollback[0] != mut1.BlobRef() || transformer.rollback[1] != mut2.BlobRef() {
+    t.Fatalf("Expected a rollback of both mutations: %v", transformer.rollback)
+  }
+  if len(transformer.concurrent) != 2 {
+    t.Fatalf("Expected two concurrent mutations: %v", transformer.concurrent)
+  }
+  if len(transformer.resolved) != 2 || transformer.resolved[0].Operation() == nil || transformer.resolved[1].Operation() == nil {
+    t.Fatalf("Could not resolve the concurrent mutations: %v", transformer.resolved)
+  }
+}
+
+func TestEntityHistory(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  newDummyTransformer(grapher)
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.CreateKeepBlob(perma.BlobRef(), ""); err != nil {
+    t.Fatal(err)
+  }
+  entity1, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  entity2, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  seq := func() int64 {
+    p, _ := grapher.permaNode(perma.BlobRef())
+    return p.SequenceNumber()
+  }
+  mut1, err := grapher.CreateMutationBlob(perma.BlobRef(), entity1.BlobRef(), "text", []byte(`{"$t":["Hello"]}`), seq())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.CreateMutationBlob(perma.BlobRef(), entity2.BlobRef(), "text", []byte(`{"$t":["Other"]}`), seq()); err != nil {
+    t.Fatal(err)
+  }
+  mut3, err := grapher.CreateMutationBlob(perma.BlobRef(), entity1.BlobRef(), "text", []byte(`{"$s":5, "$t":[" World"]}`), seq())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  history := grapher.EntityHistory(perma.BlobRef(), entity1.BlobRef())
+  if len(history) != 2 || history[0].BlobRef != mut1.BlobRef() || history[1].BlobRef != mut3.BlobRef() {
+    t.Fatalf("Wrong history: %v", history)
+  }
+  if history[0].Signer != "a@b" || history[0].Field != "text" || history[0].SequenceNumber >= history[1].SequenceNumber {
+    t.Fatalf("Wrong mutation info: %v", history[0])
+  }
+  if grapher.EntityHistory("unknown", entity1.BlobRef()) != nil {
+    t.Fatal("Expected no history for an unknown perma node")
+  }
+}
+
+func TestDescribeSchema(t *testing.T) {
+  grapher := NewGrapher("a@b", schema, store.NewSimpleBlobStore(), NewSimpleGraphStore(), nil)
+  desc, err := grapher.DescribeSchema()
+  if err != nil {
+    t.Fatal(err)
+  }
+  expected := `{"files":{"application/x-test-file":{"entities":{"application/x-test-entity":{"fields":{"text":{"type":"string","elementType":"none","transformation":"merge"},"title":{"type":"string","elementType":"none","transformation":"merge"}}}}}}}`
+  if string(desc) != expected {
+    t.Fatalf("Wrong schema description: %v", string(desc))
+  }
+}
+
+func TestMultiFieldMutation(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  transformer := newDummyTransformer(grapher).(*dummyTransformer)
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.CreateKeepBlob(perma.BlobRef(), ""); err != nil {
+    t.Fatal(err)
+  }
+  entity, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  p, _ := grapher.permaNode(perma.BlobRef())
+  seq := p.SequenceNumber()
+  mut1, err := grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["Hello"]}`), seq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Both fields are changed at once. The operation on 'text' must be transformed against 'mut1'
+  mut2, err := grapher.CreateMultiFieldMutationBlob(perma.BlobRef(), entity.BlobRef(), map[string][]byte{"text": []byte(`{"$t":["World"]}`), "title": []byte(`{"$t":["Greeting"]}`)}, seq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  history := grapher.EntityHistory(perma.BlobRef(), entity.BlobRef())
+  if len(history) != 3 || history[0].BlobRef != mut1.BlobRef() || history[1].BlobRef != mut2.BlobRef() || history[2].BlobRef != mut2.BlobRef() {
+    t.Fatalf("Wrong history: %v", history)
+  }
+  if history[1].Field != "text" || history[2].Field != "title" || history[1].SequenceNumber != history[2].SequenceNumber {
+    t.Fatalf("Expected one mutation with two fields: %v", history)
+  }
+
+  // A mutation from another site on one of the fields sees the part of the mutation concerning this field
+  blob := []byte(`{"type":"mutation", "signer":"x@y", "perma":"` + perma.BlobRef() + `", "dep":["` + entity.BlobRef() + `"], "op":{"$t":["Olla"]}, "entity":"` + entity.BlobRef() + `", "field":"title"}`)
+  if err = grapher.HandleBlob(blob, store.NewBlobRef(blob)); err != nil {
+    t.Fatal(err)
+  }
+  if len(transformer.rollback) != 1 || transformer.rollback[0] != mut2.BlobRef() {
+    t.Fatalf("Expected a rollback of the mutation with two fields: %v", transformer.rollback)
+  }
+
+  // No field is changed if one of them is invalid
+  p, _ = grapher.permaNode(perma.BlobRef())
+  seq = p.SequenceNumber()
+  if _, err = grapher.CreateMultiFieldMutationBlob(perma.BlobRef(), entity.BlobRef(), map[string][]byte{"text": []byte(`{"$t":["!"]}`), "unknown": []byte(`{"$t":["?"]}`)}, seq); err == nil {
+    t.Fatal("Expected an error for an unknown field")
+  }
+  p, _ = grapher.permaNode(perma.BlobRef())
+  if p.SequenceNumber() != seq {
+    t.Fatal("A mutation with an invalid field has been applied")
+  }
+}
+
+type conflictAPI struct {
+  conflicts []*Conflict
+}
+
+func (self *conflictAPI) Signal_ReceivedInvitation(perma PermaNode, permission PermissionNode) {
+}
+
+func (self *conflictAPI) Signal_AcceptedInvitation(perma PermaNode, perm PermissionNode, keep KeepNode) {
+}
+
+func (self *conflictAPI) Blob_Keep(perma PermaNode, perm PermissionNode, keep KeepNode) {
+}
+
+func (self *conflictAPI) Blob_Mutation(perma PermaNode, mut MutationNode) {
+}
+
+func (self *conflictAPI) Blob_Permission(perma PermaNode, permission PermissionNode) {
+}
+
+func (self *conflictAPI) Blob_Entity(perma PermaNode, entity EntityNode) {
+}
+
+func (self *conflictAPI) Blob_DeleteEntity(perma PermaNode, entity DelEntityNode) {
+}
+
+func (self *conflictAPI) Signal_Conflict(perma PermaNode, conflict *Conflict) {
+  self.conflicts = append(self.conflicts, conflict)
+}
+
+func TestConflict(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  transformer := newDummyTransformer(grapher).(*dummyTransformer)
+  transformer.conflicts = true
+  api := &conflictAPI{}
+  grapher.SetAPI(api)
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.CreateKeepBlob(perma.BlobRef(), ""); err != nil {
+    t.Fatal(err)
+  }
+  entity, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  p, _ := grapher.permaNode(perma.BlobRef())
+  seq := p.SequenceNumber()
+  mut1, err := grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["Hello"]}`), seq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(api.conflicts) != 0 {
+    t.Fatalf("Unexpected conflicts: %v", api.conflicts)
+  }
+  // The second mutation has been created without knowing the first one
+  mut2, err := grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["World"]}`), seq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(api.conflicts) != 1 {
+    t.Fatalf("Expected one conflict: %v", api.conflicts)
+  }
+  c := api.conflicts[0]
+  if c.PermaBlobRef != perma.BlobRef() || c.EntityBlobRef != entity.BlobRef() || c.Field != "text" || c.Winner != mut1.BlobRef() || c.Loser != mut2.BlobRef() {
+    t.Fatalf("Wrong conflict: %v", c)
+  }
+}
+
+func TestRecentErrors(t *testing.T) {
+  grapher := NewGrapher("a@b", schema, store.NewSimpleBlobStore(), NewSimpleGraphStore(), nil)
+  if err := grapher.SetErrorCapacity(-1); err != ErrNegativeCapacity {
+    t.Fatalf("Expected ErrNegativeCapacity: %v", err)
+  }
+  grapher.SetErrorCapacity(2)
+  ch := grapher.SubscribeErrors()
+  // Nobody reads the channels, but reporting errors must not block
+  for i := 0; i < 40; i++ {
+    grapher.reportError(os.NewError(fmt.Sprintf("e%v", i)))
+  }
+  errs := grapher.RecentErrors(5)
+  if len(errs) != 2 || errs[0].String() != "e38" || errs[1].String() != "e39" {
+    t.Fatalf("Expected the two most recent errors: %v", errs)
+  }
+  if errs = grapher.RecentErrors(1); len(errs) != 1 || errs[0].String() != "e39" {
+    t.Fatalf("Expected the most recent error: %v", errs)
+  }
+  if dropped := grapher.DroppedErrors(); dropped != 38 {
+    t.Fatalf("Expected 38 dropped errors, got %v", dropped)
+  }
+  if err := <-ch; err.String() != "e38" {
+    t.Fatalf("Wrong error on the subscription: %v", err)
+  }
+  // The channel returned by Errors keeps the most recent errors of its larger buffer
+  if err := <-grapher.Errors(); err.String() != fmt.Sprintf("e%v", 40 - DefaultErrorCapacity) {
+    t.Fatalf("Wrong error on the error channel: %v", err)
+  }
+  grapher.UnsubscribeErrors(ch)
+  if _, ok := <-ch; ok {
+    t.Fatal("Expected the channel to be closed")
+  }
+}
+
+func TestFieldLength(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  newDummyTransformer(grapher)
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.CreateKeepBlob(perma.BlobRef(), ""); err != nil {
+    t.Fatal(err)
+  }
+  entity, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  p, _ := grapher.permaNode(perma.BlobRef())
+  if _, err = grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["Hello World"]}`), p.SequenceNumber()); err != nil {
+    t.Fatal(err)
+  }
+  if l, err := grapher.FieldLength(perma.BlobRef(), entity.BlobRef(), "text"); err != nil || l != 11 {
+    t.Fatalf("Wrong length %v: %v", l, err)
+  }
+  p, _ = grapher.permaNode(perma.BlobRef())
+  if _, err = grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":[{"$s":5}, {"$d":6}, "!"]}`), p.SequenceNumber()); err != nil {
+    t.Fatal(err)
+  }
+  if l, err := grapher.FieldLength(perma.BlobRef(), entity.BlobRef(), "text"); err != nil || l != 6 {
+    t.Fatalf("Wrong length %v: %v", l, err)
+  }
+  if v, err := grapher.FieldValue(perma.BlobRef(), entity.BlobRef(), "text"); err != nil || v != "Hello!" {
+    t.Fatalf("Wrong value %v: %v", v, err)
+  }
+  if l, err := grapher.FieldLength(perma.BlobRef(), entity.BlobRef(), "title"); err != nil || l != 0 {
+    t.Fatalf("Wrong length of an untouched field %v: %v", l, err)
+  }
+  if _, err = grapher.FieldLength("unknown", entity.BlobRef(), "text"); err == nil {
+    t.Fatal("Expected an error for an unknown perma node")
+  }
+}
+
+func TestFieldValueAt(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  transformer := newDummyTransformer(grapher).(*dummyTransformer)
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.CreateKeepBlob(perma.BlobRef(), ""); err != nil {
+    t.Fatal(err)
+  }
+  entity, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  p, _ := grapher.permaNode(perma.BlobRef())
+  mut1, err := grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["Hello"]}`), p.SequenceNumber())
+  if err != nil {
+    t.Fatal(err)
+  }
+  frontier1, _ := grapher.Frontier(perma.BlobRef())
+  p, _ = grapher.permaNode(perma.BlobRef())
+  mut2, err := grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":[{"$s":5}, " World"]}`), p.SequenceNumber())
+  if err != nil {
+    t.Fatal(err)
+  }
+  frontier2, _ := grapher.Frontier(perma.BlobRef())
+  // A mutation from another site which is concurrent to both mutations
+  blob := []byte(`{"type":"mutation", "signer":"x@y", "perma":"` + perma.BlobRef() + `", "dep":["` + entity.BlobRef() + `"], "op":{"$t":["Olla"]}, "entity":"` + entity.BlobRef() + `", "field":"text"}`)
+  blobref := store.NewBlobRef(blob)
+  if err = grapher.HandleBlob(blob, blobref); err != nil {
+    t.Fatal(err)
+  }
+
+  if v, err := grapher.FieldValueAt(perma.BlobRef(), entity.BlobRef(), "text", frontier1); err != nil || v != "Hello" {
+    t.Fatalf("Wrong value at the first frontier %v: %v", v, err)
+  }
+  // The concurrent mutation has been applied after the frontier and is simply left out
+  if v, err := grapher.FieldValueAt(perma.BlobRef(), entity.BlobRef(), "text", frontier2); err != nil || v != "Hello World" {
+    t.Fatalf("Wrong value at the second frontier %v: %v", v, err)
+  }
+  if transformer.pruned != nil {
+    t.Fatalf("Nothing must be pruned: %v", transformer.pruned)
+  }
+  // Both local mutations have been applied before the concurrent one and must be pruned
+  if v, err := grapher.FieldValueAt(perma.BlobRef(), entity.BlobRef(), "text", []string{blobref}); err != nil || v != "Olla" {
+    t.Fatalf("Wrong value at the concurrent frontier %v: %v", v, err)
+  }
+  if len(transformer.pruned) != 2 || transformer.pruned[0] != mut1.BlobRef() || transformer.pruned[1] != mut2.BlobRef() {
+    t.Fatalf("Expected the local mutations to be pruned: %v", transformer.pruned)
+  }
+  if _, err = grapher.FieldValueAt(perma.BlobRef(), entity.BlobRef(), "text", []string{"unknown"}); err == nil {
+    t.Fatal("Expected an error for an unknown blob in the frontier")
+  }
+}
+
+func TestMeta(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  keep, err := grapher.CreateKeepBlob(perma.BlobRef(), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.SetTitle(perma.BlobRef(), "Draft"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.SetTags(perma.BlobRef(), []string{"todo", "work"}, nil); err != nil {
+    t.Fatal(err)
+  }
+
+  // Two concurrent changes. The later one wins no matter in which order they arrive
+  now := time.Seconds()
+  blob1 := []byte(`{"type":"meta", "signer":"x@y", "perma":"` + perma.BlobRef() + `", "dep":["` + keep.BlobRef() + `"], "t":` + fmt.Sprintf("%v", now + 200) + `, "title":"Final", "removetags":["todo"]}`)
+  blob2 := []byte(`{"type":"meta", "signer":"u@v", "perma":"` + perma.BlobRef() + `", "dep":["` + keep.BlobRef() + `"], "t":` + fmt.Sprintf("%v", now + 100) + `, "title":"Old", "addtags":["todo", "home"]}`)
+  if err = grapher.HandleBlob(blob1, store.NewBlobRef(blob1)); err != nil {
+    t.Fatal(err)
+  }
+  if err = grapher.HandleBlob(blob2, store.NewBlobRef(blob2)); err != nil {
+    t.Fatal(err)
+  }
+
+  p, _ := grapher.permaNode(perma.BlobRef())
+  if p.Title() != "Final" {
+    t.Fatalf("Wrong title: %v", p.Title())
+  }
+  tags := p.Tags()
+  if len(tags) != 2 || tags[0] != "home" || tags[1] != "work" {
+    t.Fatalf("Wrong tags: %v", tags)
+  }
+}
+
+func TestDraft(t *testing.T) {
+  fed := &dummyFederation{}
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, fed)
+  newDummyTransformer(grapher)
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.CreateKeepBlob(perma.BlobRef(), ""); err != nil {
+    t.Fatal(err)
+  }
+  entity, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  p, _ := grapher.permaNode(perma.BlobRef())
+  draft1, err := grapher.CreateDraftMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["Hello"]}`), p.SequenceNumber())
+  if err != nil {
+    t.Fatal(err)
+  }
+  p, _ = grapher.permaNode(perma.BlobRef())
+  draft2, err := grapher.CreateDraftMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":[{"$s":5}, " World"]}`), p.SequenceNumber())
+  if err != nil {
+    t.Fatal(err)
+  }
+  forwarded := len(fed.forwarded)
+  for _, f := range fed.forwarded {
+    if f == draft1.BlobRef() || f == draft2.BlobRef() {
+      t.Fatal("Drafts must not be forwarded")
+    }
+  }
+  // Ordinary mutations would depend on the content of the drafts
+  p, _ = grapher.permaNode(perma.BlobRef())
+  if _, err = grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["!"]}`), p.SequenceNumber()); err != ErrUnpublishedDrafts {
+    t.Fatalf("Expected ErrUnpublishedDrafts: %v", err)
+  }
+  // Other blobs do not depend on the drafts
+  entity2, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, dep := range entity2.(OTNode).Dependencies() {
+    if dep == draft1.BlobRef() || dep == draft2.BlobRef() {
+      t.Fatal("A blob must not depend on unpublished drafts")
+    }
+  }
+  forwarded = len(fed.forwarded)
+  // The drafts survive a restart of the grapher
+  grapher2 := NewGrapher("a@b", schema, s, sg, nil)
+  if drafts, _ := grapher2.Drafts(perma.BlobRef()); len(drafts) != 2 || drafts[0] != draft1.BlobRef() || drafts[1] != draft2.BlobRef() {
+    t.Fatalf("Drafts have not been persisted: %v", drafts)
+  }
+
+  // The second draft depends on the first one
+  if err = grapher.Publish(perma.BlobRef(), []string{draft2.BlobRef()}); err == nil {
+    t.Fatal("Expected an error when publishing a draft without its dependency")
+  }
+  // A batch with a blob which is not a draft is not published at all
+  if err = grapher.Publish(perma.BlobRef(), []string{draft1.BlobRef(), entity2.BlobRef()}); err == nil {
+    t.Fatal("Expected an error when publishing a blob which is not a draft")
+  }
+  if !grapher.IsDraft(perma.BlobRef(), draft1.BlobRef()) || !grapher.IsDraft(perma.BlobRef(), draft2.BlobRef()) {
+    t.Fatal("Drafts must not be published after an error")
+  }
+  if len(fed.forwarded) != forwarded {
+    t.Fatal("Drafts must not be forwarded after an error")
+  }
+  if err = grapher.Publish(perma.BlobRef(), []string{draft2.BlobRef(), draft1.BlobRef()}); err != nil {
+    t.Fatal(err)
+  }
+  if len(fed.forwarded) != forwarded + 2 || fed.forwarded[forwarded] != draft1.BlobRef() || fed.forwarded[forwarded + 1] != draft2.BlobRef() {
+    t.Fatalf("Drafts have not been forwarded in order: %v", fed.forwarded)
+  }
+  if grapher.IsDraft(perma.BlobRef(), draft1.BlobRef()) {
+    t.Fatal("Published blob is still a draft")
+  }
+  // Once published, new blobs depend on the drafts again
+  p, _ = grapher.permaNode(perma.BlobRef())
+  if _, err = grapher.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":[{"$s":11}, "!"]}`), p.SequenceNumber()); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestStoreBlobAndWait(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{})
+  s.AddListener(grapher)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "mimetype":"application/x-test-file"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `"}`)
+  blobref1b := store.NewBlobRef(blob1b)
+
+  // The keep must wait for the perma node
+  ch := make(chan os.Error)
+  go func() {
+    ch <- grapher.StoreBlobAndWait(blob1b, blobref1b, 0)
+  }()
+  if err := grapher.StoreBlobAndWait(blob1, blobref1, 0); err != nil {
+    t.Fatal(err)
+  }
+  if err := <-ch; err != nil {
+    t.Fatal(err)
+  }
+  perma, err := grapher.permaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  if !perma.hasKeep("a@b") {
+    t.Fatal("Missing a keep for a@b")
+  }
+
+  // A rejected blob reports the error
+  blob2 := []byte(`{"type":"keep", "perma":"` + blobref1 + `"}`)
+  if err := grapher.StoreBlobAndWait(blob2, "", 0); err == nil {
+    t.Fatal("Expected an error for a blob without signer")
+  }
+
+  // A keep of another user without an invitation is rejected
+  blob3 := []byte(`{"type":"keep", "signer":"x@y", "perma":"` + blobref1 + `"}`)
+  if err := grapher.StoreBlobAndWait(blob3, "", 5e9); err == nil || err == ErrWaitTimeout {
+    t.Fatalf("Expected the rejection of the keep: %v", err)
+  }
+
+  // A blob waiting for an unknown blob times out
+  blob4 := []byte(`{"type":"keep", "signer":"a@b", "perma":"unknown"}`)
+  if err := grapher.StoreBlobAndWait(blob4, "", 1e6); err != ErrWaitTimeout {
+    t.Fatalf("Expected a timeout: %v", err)
+  }
+  grapher.lock()
+  waiters := len(grapher.waiters)
+  grapher.unlock()
+  if waiters != 0 {
+    t.Fatal("The waiter has not been removed after the timeout")
+  }
+}
+
+func TestFrontierPrecondition(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  newDummyTransformer(grapher)
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.CreateKeepBlob(perma.BlobRef(), ""); err != nil {
+    t.Fatal(err)
+  }
+  entity, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  frontier, err := grapher.Frontier(perma.BlobRef())
+  if err != nil {
+    t.Fatal(err)
+  }
+  mut1, err := grapher.CreateMutationBlobAtFrontier(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["Hello"]}`), frontier)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // The frontier is outdated now
+  if _, err = grapher.CreateMutationBlobAtFrontier(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["Hi"]}`), frontier); err != ErrFrontierChanged {
+    t.Fatalf("Expected a conflict, got %v", err)
+  }
+  // Retry with the new frontier
+  if _, err = grapher.CreateMutationBlobAtFrontier(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":[{"$s":5}, "!"]}`), []string{mut1.BlobRef()}); err != nil {
+    t.Fatal(err)
+  }
+  if v, err := grapher.FieldValue(perma.BlobRef(), entity.BlobRef(), "text"); err != nil || v != "Hello!" {
+    t.Fatalf("Wrong value %v: %v", v, err)
+  }
+}
+
+func TestSQLiteGraphStore(t *testing.T) {
+  path := fmt.Sprintf("%v/lightwave-graph-%v.db", os.TempDir(), os.Getpid())
+  defer os.Remove(path)
+  sg, err := NewSQLiteGraphStore(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  s := store.NewSimpleBlobStore()
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{})
+  s.AddListener(grapher)
+  newDummyTransformer(grapher)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "mimetype":"application/x-test-file", "random":"perma1abc"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `"}`)
+  blobref1b := store.NewBlobRef(blob1b)
+  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":"", "dep":["` + blobref1b + `"]}`)
+  blobref1c := store.NewBlobRef(blob1c)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$t":["Hello World"]}, "entity":"` + blobref1c + `", "field":"text"}`)
+  blobref2 := store.NewBlobRef(blob2)
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0}`)
+  blobref5 := store.NewBlobRef(blob5)
+  blob7 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref5 + `", "perma":"` + blobref1 + `"}`)
+  blobref7 := store.NewBlobRef(blob7)
+
+  s.StoreBlob(blob1, blobref1)
+  s.StoreBlob(blob1b, blobref1b)
+  s.StoreBlob(blob1c, blobref1c)
+  s.StoreBlob(blob2, blobref2)
+  s.StoreBlob(blob5, blobref5)
+  s.StoreBlob(blob7, blobref7)
+  grapher.WaitIdle()
+  grapher.Close()
+  if err = sg.Close(); err != nil {
+    t.Fatal(err)
+  }
+
+  // Reopen the database
+  sg, err = NewSQLiteGraphStore(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer sg.Close()
+  grapher = NewGrapher("a@b", schema, store.NewSimpleBlobStore(), sg, &dummyFederation{})
+  perma, err := grapher.permaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatalf("Did not find perma node: %v", err)
+  }
+  if !perma.hasKeep("a@b") || !perma.hasKeep("foo@bar") {
+    t.Fatal("Missing keeps after reopening the store")
+  }
+  if !perma.hasPermission("foo@bar", Perm_Read) || perma.hasPermission("x@y", Perm_Read) {
+    t.Fatal("Wrong permissions after reopening the store")
+  }
+  missing, err := sg.HasOTNodes(blobref1, []string{blobref1b, blobref2, "unknown"})
+  if err != nil || len(missing) != 1 || missing[0] != "unknown" {
+    t.Fatalf("Wrong missing nodes: %v %v", missing, err)
+  }
+  data, err := sg.GetOTNodeByBlobRef(blobref1, blobref2)
+  if err != nil || data == nil || data["k"].(int64) != OTNode_Mutation || data["b"].(string) != blobref2 {
+    t.Fatalf("Wrong mutation node: %v %v", data, err)
+  }
+  ch, err := sg.GetMutationsAscending(blobref1, blobref1c, "text", 0, perma.SequenceNumber())
+  if err != nil {
+    t.Fatal(err)
+  }
+  count := 0
+  for _ = range ch {
+    count++
+  }
+  if count != 1 {
+    t.Fatalf("Expected one mutation, got %v", count)
+  }
+}
+
+func TestSchemaValidation(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{})
+  s.AddListener(grapher)
+  newDummyTransformer(grapher)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "mimetype":"application/x-test-file", "random":"perma1abc"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `"}`)
+  blobref1b := store.NewBlobRef(blob1b)
+  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":"", "dep":["` + blobref1b + `"]}`)
+  blobref1c := store.NewBlobRef(blob1c)
+  // The field is not declared in the schema
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$t":["Hello"]}, "entity":"` + blobref1c + `", "field":"color"}`)
+  blobref2 := store.NewBlobRef(blob2)
+  // A merged string field is not overwritten by a value
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":42, "entity":"` + blobref1c + `", "field":"text"}`)
+  blobref3 := store.NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$t":["Hello"]}, "entity":"` + blobref1c + `", "field":"text"}`)
+  blobref4 := store.NewBlobRef(blob4)
+
+  for _, blob := range [][]byte{blob1, blob1b, blob1c, blob2, blob3, blob4} {
+    s.StoreBlob(blob, store.NewBlobRef(blob))
+  }
+  grapher.WaitIdle()
+
+  missing, err := sg.HasOTNodes(blobref1, []string{blobref2, blobref3, blobref4})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(missing) != 2 || missing[0] != blobref2 || missing[1] != blobref3 {
+    t.Fatalf("Wrong mutations have been applied: %v", missing)
+  }
+}
+
+func TestCheckOperation(t *testing.T) {
+  tests := []struct {
+    field FieldSchema
+    op string
+    ok bool
+  }{
+    {FieldSchema{Type: TypeString, Transformation: TransformationMerge}, `{"$t":["a"]}`, true},
+    {FieldSchema{Type: TypeString, Transformation: TransformationMerge}, `"a"`, false},
+    {FieldSchema{Type: TypeString, Transformation: TransformationLatest}, `"a"`, true},
+    {FieldSchema{Type: TypeInt, Transformation: TransformationLatest}, `42`, true},
+    {FieldSchema{Type: TypeInt, Transformation: TransformationLatest}, `4.2`, false},
+    {FieldSchema{Type: TypeInt, Transformation: TransformationLatest}, `{"$t":["a"]}`, false},
+    {FieldSchema{Type: TypeFloat, Transformation: TransformationLatest}, `4.2`, true},
+    {FieldSchema{Type: TypeFloat, Transformation: TransformationLatest}, `true`, false},
+    {FieldSchema{Type: TypeBool, Transformation: TransformationLatest}, `true`, true},
+    {FieldSchema{Type: TypeBool, Transformation: TransformationLatest}, `"true"`, false},
+    {FieldSchema{Type: TypeBool, Transformation: TransformationLatest}, `null`, true},
+    {FieldSchema{Type: TypeInt, Transformation: TransformationAdd}, `{"$n":-3}`, true},
+    {FieldSchema{Type: TypeInt, Transformation: TransformationAdd}, `{"$n":1.5}`, false},
+    {FieldSchema{Type: TypeInt, Transformation: TransformationAdd}, `3`, false},
+    {FieldSchema{Type: TypeInt, Transformation: TransformationLatest}, `{"$n":3}`, false},
+  }
+  for _, test := range tests {
+    if err := test.field.checkOperation([]byte(test.op)); (err == nil) != test.ok {
+      t.Fatalf("Wrong result for %v on type %v: %v", test.op, test.field.Type, err)
+    }
+  }
+}
+
+func TestPatchStreamDoesNotBlock(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  s.AddListener(grapher)
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  ch, err := grapher.SubscribePatches(perma.BlobRef())
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Nobody reads the channel, but emitting patches must not block
+  title := "Title"
+  for i := 0; i <= patchStreamBuffer; i++ {
+    grapher.emitPatch(perma.BlobRef(), &metaNode{permaBlobRef: perma.BlobRef(), metaSigner: "a@b", title: &title, seqNumber: int64(i)})
+  }
+  count := 0
+  for _ = range ch {
+    count++
+  }
+  // The snapshot and the patches which fit into the buffer have been delivered
+  if count != patchStreamBuffer {
+    t.Fatalf("Wrong number of messages before the stream has been closed: %v", count)
+  }
+}
+
+func TestRepeatWithFrontier(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  newDummyTransformer(grapher)
+  grapher.SetAPI(&conflictAPI{})
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  keep, err := grapher.CreateKeepBlob(perma.BlobRef(), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  p, frontier, err := grapher.RepeatWithFrontier(perma.BlobRef(), 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if p.BlobRef() != perma.BlobRef() {
+    t.Fatalf("Wrong perma node %v", p.BlobRef())
+  }
+  if len(frontier) != 1 || frontier[0] != keep.BlobRef() {
+    t.Fatalf("Wrong frontier %v", frontier)
+  }
+  if _, _, err = grapher.RepeatWithFrontier("unknown", 0); err == nil {
+    t.Fatal("Expected an error for an unknown perma node")
+  }
+}
+
+// Fails the first 'failures' downloads and reports the number of each attempt on 'calls'
+type failingFederation struct {
+  dummyFederation
+  failures int
+  mutex sync.Mutex
+  attempts int
+  calls chan int
+  // If not nil, the first attempt returns only after a value has been received
+  release chan bool
+}
+
+func newFailingFederation(failures int) *failingFederation {
+  return &failingFederation{failures: failures, calls: make(chan int, 10)}
+}
+
+func (self *failingFederation) DownloadPermaNode(permission_blobref string) os.Error {
+  self.mutex.Lock()
+  self.attempts++
+  n := self.attempts
+  self.mutex.Unlock()
+  self.calls <- n
+  if n == 1 && self.release != nil {
+    <-self.release
+  }
+  if n <= self.failures {
+    return os.NewError("Server unreachable")
+  }
+  return nil
+}
+
+// Waits for the next download attempt
+func waitForAttempt(t *testing.T, fed *failingFederation) int {
+  select {
+  case n := <-fed.calls:
+    return n
+  case <-time.After(5e9):
+    t.Fatal("The download has not been attempted")
+  }
+  return 0
+}
+
+func TestDownloadRetry(t *testing.T) {
+  // A keep of the local user on a perma node from another domain, whose invitation has not yet arrived
+  perma := []byte(`{"type":"permanode", "signer":"x@y", "mimetype":"application/x-test-file", "random":"perma1abc"}`)
+  permaref := store.NewBlobRef(perma)
+  keep := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + permaref + `", "permission":"perm1"}`)
+
+  fed := newFailingFederation(2)
+  grapher := NewGrapher("a@b", schema, store.NewSimpleBlobStore(), NewSimpleGraphStore(), fed)
+  grapher.SetDownloadRetry(3, 1000)
+  grapher.HandleBlob(perma, permaref)
+  grapher.HandleBlob(keep, store.NewBlobRef(keep))
+  for i := 1; i <= 3; i++ {
+    if n := waitForAttempt(t, fed); n != i {
+      t.Fatalf("Expected attempt %v, got %v", i, n)
+    }
+  }
+  // The third attempt succeeded
+  select {
+  case err := <-grapher.Errors():
+    t.Fatalf("Unexpected error: %v", err)
+  default:
+  }
+
+  // All attempts fail
+  fed = newFailingFederation(5)
+  grapher = NewGrapher("a@b", schema, store.NewSimpleBlobStore(), NewSimpleGraphStore(), fed)
+  grapher.SetDownloadRetry(3, 1000)
+  grapher.HandleBlob(perma, permaref)
+  grapher.HandleBlob(keep, store.NewBlobRef(keep))
+  var err os.Error
+  select {
+  case err = <-grapher.Errors():
+  case <-time.After(5e9):
+    t.Fatal("The failed download has not been reported")
+  }
+  // The error is reported after the last attempt
+  if derr, ok := err.(*DownloadError); !ok || derr.PermissionBlobRef != "perm1" || derr.Attempts != 3 || len(fed.calls) != 3 {
+    t.Fatalf("Expected a download error after three attempts: %v", err)
+  }
+
+  // Closing the grapher cancels the retries
+  fed = newFailingFederation(5)
+  fed.release = make(chan bool)
+  grapher = NewGrapher("a@b", schema, store.NewSimpleBlobStore(), NewSimpleGraphStore(), fed)
+  grapher.SetDownloadRetry(3, 10000000)
+  grapher.HandleBlob(perma, permaref)
+  grapher.HandleBlob(keep, store.NewBlobRef(keep))
+  waitForAttempt(t, fed)
+  // The first attempt fails after the grapher has been closed
+  grapher.Close()
+  fed.release <- true
+  select {
+  case n := <-fed.calls:
+    t.Fatalf("Attempt %v after closing the grapher", n)
+  case <-time.After(100000000):
+  }
+}
+
+func TestAppendEntity(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  newDummyTransformer(grapher)
+
+  perma, err := grapher.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = grapher.CreateKeepBlob(perma.BlobRef(), ""); err != nil {
+    t.Fatal(err)
+  }
+  var entities []string
+  for i := 0; i < 3; i++ {
+    entity, err := grapher.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+    if err != nil {
+      t.Fatal(err)
+    }
+    entities = append(entities, entity.BlobRef())
+  }
+  // Entities are appended in the order in which they have been created
+  order, err := grapher.EntityOrder(perma.BlobRef())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(order) != 3 || order[0] != entities[0] || order[1] != entities[1] || order[2] != entities[2] {
+    t.Fatalf("Wrong entity order: %v", order)
+  }
+
+  // A move carries the time at which it has been created
+  before := time.Seconds()
+  move, err := grapher.CreateMoveEntityBlob(perma.BlobRef(), entities[2], "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  m, err := sg.GetOTNodeByBlobRef(perma.BlobRef(), move.BlobRef())
+  if err != nil || m == nil {
+    t.Fatalf("Move has not been stored: %v", err)
+  }
+  if tm := grapher.otNodeFromMap(perma.BlobRef(), m).Time(); tm < before || tm > time.Seconds() {
+    t.Fatalf("Wrong time of the move: %v", tm)
+  }
+}
+
+// Records the blobs announced to the API
+type recordingAPI struct {
+  conflictAPI
+  entities []string
+  mutations []string
+}
+
+func (self *recordingAPI) Blob_Entity(perma PermaNode, entity EntityNode) {
+  self.entities = append(self.entities, entity.BlobRef())
+}
+
+func (self *recordingAPI) Blob_Mutation(perma PermaNode, mut MutationNode) {
+  self.mutations = append(self.mutations, mut.BlobRef())
+}
+
+func TestCreatePermaBlobWithContent(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  newDummyTransformer(grapher)
+  api := &recordingAPI{}
+  grapher.SetAPI(api)
+
+  perma_blobref, err := grapher.CreatePermaBlobWithContent("application/x-test-file", func(doc *DocBuilder) {
+    doc.AddEntity("application/x-test-entity", []byte(`""`)).SetField("title", []byte(`{"$t":["Hello"]}`))
+    doc.AddEntity("application/x-test-entity", []byte(`""`)).SetField("text", []byte(`{"$t":["World"]}`)).SetField("title", []byte(`{"$t":["Again"]}`))
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if perma, err := sg.GetPermaNode(perma_blobref); perma == nil || err != nil {
+    t.Fatalf("Perma node has not been committed: %v", err)
+  }
+  // Entities are in the order in which they have been added
+  order, err := grapher.EntityOrder(perma_blobref)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(order) != 2 || len(api.entities) != 2 || order[0] != api.entities[0] || order[1] != api.entities[1] {
+    t.Fatalf("Wrong entities: %v %v", order, api.entities)
+  }
+  if h := grapher.EntityHistory(perma_blobref, order[0]); len(h) != 1 || h[0].Field != "title" {
+    t.Fatalf("Wrong history of the first entity: %v", h)
+  }
+  if h := grapher.EntityHistory(perma_blobref, order[1]); len(h) != 2 || h[0].Field != "text" || h[1].Field != "title" {
+    t.Fatalf("Wrong history of the second entity: %v", h)
+  }
+  if len(api.mutations) != 3 {
+    t.Fatalf("Wrong number of announced mutations: %v", api.mutations)
+  }
+
+  // A document which does not conform to the schema creates nothing
+  api.entities = nil
+  api.mutations = nil
+  _, err = grapher.CreatePermaBlobWithContent("application/x-test-file", func(doc *DocBuilder) {
+    doc.AddEntity("application/x-test-entity", []byte(`""`)).SetField("unknown", []byte(`{"$t":["x"]}`))
+  })
+  if err == nil {
+    t.Fatal("Expected an error for an unknown field")
+  }
+  // An operation which is rejected after the perma node and the entity have been created
+  // leaves no trace either
+  _, err = grapher.CreatePermaBlobWithContent("application/x-test-file", func(doc *DocBuilder) {
+    doc.AddEntity("application/x-test-entity", []byte(`""`)).SetField("text", []byte(`"not an operation"`))
+  })
+  if err == nil {
+    t.Fatal("Expected an error for a malformed operation")
+  }
+  if len(sg.graphs) != 1 {
+    t.Fatalf("A failed document has been stored: %v perma nodes", len(sg.graphs))
+  }
+  if len(api.entities) != 0 || len(api.mutations) != 0 {
+    t.Fatalf("A failed document has been announced: %v %v", api.entities, api.mutations)
+  }
+}
+
+func TestClockSkewedBlobIsDeferred(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{})
+  s.AddListener(grapher)
+  grapher.SetMaxClockSkew(1)
+  defer grapher.Close()
+
+  // The blob is two seconds ahead of the local clock
+  blob1 := []byte(fmt.Sprintf(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "mimetype":"application/x-test-file", "t":%v}`, time.Seconds() + 2))
+  blobref1 := store.NewBlobRef(blob1)
+  s.StoreBlob(blob1, blobref1)
+  grapher.WaitIdle()
+
+  var err os.Error
+  select {
+  case err = <-grapher.Errors():
+  case <-time.After(5e9):
+    t.Fatal("The deferred blob has not been reported")
+  }
+  if derr, ok := err.(*DeferredBlobError); !ok || derr.BlobRef != blobref1 || derr.Err != ErrClockSkew {
+    t.Fatalf("Expected a deferred blob error: %v", err)
+  }
+  // The blob is applied once the local clock has caught up
+  for i := 0; ; i++ {
+    grapher.lock()
+    perma, err := grapher.permaNode(blobref1)
+    grapher.unlock()
+    if err != nil {
+      t.Fatal(err)
+    }
+    if perma != nil {
+      break
+    }
+    if i == 100 {
+      t.Fatal("The deferred blob has not been retried")
+    }
+    time.Sleep(1e8)
+  }
+}
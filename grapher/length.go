@@ -0,0 +1,106 @@
+package lightwavegrapher
+
+import (
+  "json"
+  "os"
+)
+
+// -----------------------------------------------------
+// Field lengths
+//
+// The grapher does not materialize the content of fields. Instead it tracks the length
+// of string fields incrementally: each applied string operation adds the length of the
+// inserted strings and subtracts the number of deleted characters.
+// Lengths are measured in the same units as the positions of string operations.
+// Editors can use them to clamp cursor positions without fetching the text.
+
+func lengthKey(entity_blobref, field string) string {
+  return entity_blobref + "/" + field
+}
+
+func (self *permaNode) lengthsToMap(m map[string]interface{}) {
+  keys := []string{}
+  lengths := []int64{}
+  for key, l := range self.lengths {
+    keys = append(keys, key)
+    lengths = append(lengths, l)
+  }
+  m["lk"] = keys
+  m["lv"] = lengths
+}
+
+func (self *permaNode) lengthsFromMap(m map[string]interface{}) {
+  // Perma nodes stored before lengths were tracked have none
+  if _, ok := m["lk"]; !ok {
+    return
+  }
+  keys := m["lk"].([]string)
+  lengths := m["lv"].([]int64)
+  for i := 0; i < len(keys); i++ {
+    self.lengths[keys[i]] = lengths[i]
+  }
+}
+
+// Returns the current length of a string field.
+// Fields which have never been mutated have length zero.
+func (self *Grapher) FieldLength(perma_blobref, entity_blobref, field string) (length int, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return 0, err
+  }
+  if perma == nil {
+    return 0, os.NewError("Unknown perma node")
+  }
+  return int(perma.lengths[lengthKey(entity_blobref, field)]), nil
+}
+
+// Updates the length of the mutated field if the mutation is a string operation.
+// The mutation must already be transformed.
+func (self *permaNode) updateLength(mut MutationNode) {
+  delta, ok := stringLengthDelta(mut.Operation())
+  if !ok {
+    return
+  }
+  self.lengths[lengthKey(mut.EntityBlobRef(), mut.Field())] += delta
+}
+
+// Returns the change in length caused by a string operation of the form {"$t":["insert", {"$s":n}, {"$d":n}]}.
+// Returns false if the operation is no string operation.
+func stringLengthDelta(operation interface{}) (delta int64, ok bool) {
+  t, ok := stringOpElements(operation)
+  if !ok {
+    return 0, false
+  }
+  for _, x := range t {
+    switch x.(type) {
+    case string:
+      delta += int64(len(x.(string)))
+    case map[string]interface{}:
+      if d, isDelete := x.(map[string]interface{})["$d"].(float64); isDelete {
+	delta -= int64(d)
+      }
+    }
+  }
+  return delta, true
+}
+
+// Returns the elements of a string operation, which is either encoded as JSON or already decoded.
+// Returns false if the operation is no string operation.
+func stringOpElements(operation interface{}) (elements []interface{}, ok bool) {
+  op := operation
+  if b, isBytes := operation.([]byte); isBytes {
+    var v interface{}
+    if err := json.Unmarshal(b, &v); err != nil {
+      return nil, false
+    }
+    op = v
+  }
+  m, ok := op.(map[string]interface{})
+  if !ok {
+    return nil, false
+  }
+  elements, ok = m["$t"].([]interface{})
+  return
+}
@@ -0,0 +1,279 @@
+package lightwavegrapher
+
+import (
+  "json"
+  "log"
+  "os"
+  "sort"
+  "time"
+)
+
+// -----------------------------------------------------
+// Metadata
+//
+// Besides its content, a perma node carries a title and a set of tags.
+// Metadata is changed with meta blobs. These do not take part in operational transformation.
+// Instead, the title and each tag are last-writer-wins registers. A meta blob wins over another one
+// if it has a later time or, if both times are equal, a larger blobref.
+// Hence all sites converge no matter in which order they receive the meta blobs.
+
+type MetaNode interface {
+  OTNode
+  // Returns nil if the title is not changed by this node
+  Title() *string
+  AddedTags() []string
+  RemovedTags() []string
+}
+
+// Optional interface of an API that wants to learn about changed metadata.
+type MetaAPI interface {
+  Blob_Meta(perma PermaNode, meta MetaNode)
+}
+
+type metaNode struct {
+  permaBlobRef string
+  metaBlobRef string
+  metaSigner string
+  title *string
+  addTags []string
+  removeTags []string
+  dependencies []string
+  seqNumber int64
+  time int64
+}
+
+func (self *metaNode) BlobRef() string {
+  return self.metaBlobRef
+}
+
+func (self *metaNode) Signer() string {
+  return self.metaSigner
+}
+
+func (self *metaNode) PermaBlobRef() string {
+  return self.permaBlobRef
+}
+
+func (self *metaNode) Title() *string {
+  return self.title
+}
+
+func (self *metaNode) AddedTags() []string {
+  return self.addTags
+}
+
+func (self *metaNode) RemovedTags() []string {
+  return self.removeTags
+}
+
+func (self *metaNode) Dependencies() []string {
+  return self.dependencies
+}
+
+func (self *metaNode) SetSequenceNumber(seq int64) {
+  self.seqNumber = seq
+}
+
+func (self *metaNode) SequenceNumber() int64 {
+  return self.seqNumber
+}
+
+func (self *metaNode) Time() int64 {
+  return self.time
+}
+
+func (self *metaNode) ToMap() map[string]interface{} {
+  m := make(map[string]interface{})
+  m["k"] = int64(OTNode_Meta)
+  m["b"] = self.metaBlobRef
+  m["s"] = self.metaSigner
+  if self.title != nil {
+    m["ti"] = *self.title
+  }
+  m["ta"] = self.addTags
+  m["tr"] = self.removeTags
+  m["dep"] = self.dependencies
+  m["seq"] = self.seqNumber
+  m["t"] = self.time
+  return m
+}
+
+func (self *metaNode) FromMap(permaBlobRef string, m map[string]interface{}) {
+  self.permaBlobRef = permaBlobRef
+  self.metaBlobRef = m["b"].(string)
+  self.metaSigner = m["s"].(string)
+  if t, ok := m["ti"]; ok {
+    title := t.(string)
+    self.title = &title
+  }
+  if t, ok := m["ta"]; ok {
+    self.addTags = t.([]string)
+  }
+  if t, ok := m["tr"]; ok {
+    self.removeTags = t.([]string)
+  }
+  if d, ok := m["dep"]; ok {
+    self.dependencies = d.([]string)
+  }
+  self.seqNumber = m["seq"].(int64)
+  self.time = m["t"].(int64)
+}
+
+// Identifies the meta blob that last changed the title or a tag
+type metaStamp struct {
+  time int64
+  blobref string
+}
+
+func (self metaStamp) before(other metaStamp) bool {
+  if self.time != other.time {
+    return self.time < other.time
+  }
+  return self.blobref < other.blobref
+}
+
+type tagState struct {
+  present bool
+  stamp metaStamp
+}
+
+// Applies the changes of the meta node to the title and tags of the perma node
+func (self *permaNode) applyMeta(meta *metaNode) {
+  stamp := metaStamp{meta.Time(), meta.BlobRef()}
+  if meta.title != nil && self.titleStamp.before(stamp) {
+    self.title = *meta.title
+    self.titleStamp = stamp
+  }
+  set := func(tag string, present bool) {
+    if s, ok := self.tags[tag]; ok && !s.stamp.before(stamp) {
+      return
+    }
+    self.tags[tag] = &tagState{present, stamp}
+  }
+  for _, tag := range meta.addTags {
+    set(tag, true)
+  }
+  for _, tag := range meta.removeTags {
+    set(tag, false)
+  }
+}
+
+func (self *permaNode) Title() string {
+  return self.title
+}
+
+// Returns the tags of the perma node in alphabetical order
+func (self *permaNode) Tags() (tags []string) {
+  tags = []string{}
+  for tag, s := range self.tags {
+    if s.present {
+      tags = append(tags, tag)
+    }
+  }
+  sort.Strings(tags)
+  return
+}
+
+func (self *permaNode) metaToMap(m map[string]interface{}) {
+  m["ti"] = self.title
+  m["tit"] = self.titleStamp.time
+  m["tib"] = self.titleStamp.blobref
+  names := []string{}
+  present := []int64{}
+  times := []int64{}
+  blobrefs := []string{}
+  for tag, s := range self.tags {
+    names = append(names, tag)
+    if s.present {
+      present = append(present, 1)
+    } else {
+      present = append(present, 0)
+    }
+    times = append(times, s.stamp.time)
+    blobrefs = append(blobrefs, s.stamp.blobref)
+  }
+  m["tg"] = names
+  m["tgp"] = present
+  m["tgt"] = times
+  m["tgb"] = blobrefs
+}
+
+func (self *permaNode) metaFromMap(m map[string]interface{}) {
+  // Perma nodes stored before metadata existed have none
+  if _, ok := m["ti"]; !ok {
+    return
+  }
+  self.title = m["ti"].(string)
+  self.titleStamp = metaStamp{m["tit"].(int64), m["tib"].(string)}
+  names := m["tg"].([]string)
+  present := m["tgp"].([]int64)
+  times := m["tgt"].([]int64)
+  blobrefs := m["tgb"].([]string)
+  for i := 0; i < len(names); i++ {
+    self.tags[names[i]] = &tagState{present[i] == 1, metaStamp{times[i], blobrefs[i]}}
+  }
+}
+
+func (self *Grapher) handleMeta(perma *permaNode, meta *metaNode) bool {
+  perma.applyMeta(meta)
+  if api, ok := self.api.(MetaAPI); ok {
+    self.signal(func() { api.Blob_Meta(perma, meta) })
+  }
+  return true
+}
+
+// Changes the title of the perma node
+func (self *Grapher) SetTitle(perma_blobref string, title string) (node AbstractNode, err os.Error) {
+  return self.CreateMetaBlob(perma_blobref, &title, nil, nil)
+}
+
+// Adds and removes tags of the perma node. Either list may be empty.
+func (self *Grapher) SetTags(perma_blobref string, add []string, remove []string) (node AbstractNode, err os.Error) {
+  return self.CreateMetaBlob(perma_blobref, nil, add, remove)
+}
+
+// Creates a meta blob. The title is not changed if it is nil.
+func (self *Grapher) CreateMetaBlob(perma_blobref string, title *string, add []string, remove []string) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  perma, e := self.permaNode(perma_blobref)
+  if e != nil {
+    err = e
+    return
+  }
+  if perma == nil {
+    err = os.NewError("Unknown perma node")
+    return
+  }
+  deps := perma.published.IDs()
+  t := time.Seconds()
+  metaJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": deps, "t": t}
+  if title != nil {
+    metaJson["title"] = *title
+  }
+  if len(add) > 0 {
+    metaJson["addtags"] = add
+  }
+  if len(remove) > 0 {
+    metaJson["removetags"] = remove
+  }
+  metaBlob, err := json.Marshal(metaJson)
+  if err != nil {
+    panic(err.String())
+  }
+  metaBlob = append([]byte(`{"type":"meta",`), metaBlob[1:]...)
+  log.Printf("Storing meta %v\n", string(metaBlob))
+  metaBlobRef := newBlobRef(metaBlob)
+  // Process it
+  var schema superSchema
+  schema.Type = "meta"
+  schema.Signer = self.userID
+  schema.PermaNode = perma_blobref
+  schema.Dependencies = deps
+  schema.Time = t
+  schema.Title = title
+  schema.AddTags = add
+  schema.RemoveTags = remove
+  _, node, err = self.handleSchemaBlob(&schema, metaBlobRef)
+  return
+}
@@ -0,0 +1,274 @@
+package lightwavegrapher
+
+import (
+  "json"
+  "log"
+  "os"
+  "sort"
+  "time"
+)
+
+// -----------------------------------------------------
+// Entity ordering
+//
+// The entities of a file form a sequence, for example the paragraphs of a page.
+// Each entity blob and each moveentity blob is a placement. A placement names another
+// placement in its "after" property. The entity is positioned directly after the entity
+// placed there, or at the beginning of the file if "after" is empty.
+// Placements are never removed. Hence, they remain valid anchors even if the entity
+// placed there has been moved or deleted in the meantime.
+//
+// Placements form a tree. The order of the entities is the pre-order traversal of this tree.
+// Placements with the same anchor are sorted such that causally later placements come first and
+// concurrent placements are sorted by blobref. If an entity has been placed more than once, the
+// causally latest placement wins. This way all sites converge on the same order without
+// transforming the placements against each other.
+
+type MoveEntityNode interface {
+  OTNode
+  EntityBlobRef() string
+  // The blobref of the placement after which the entity is positioned
+  After() string
+}
+
+// Optional interface of an API that wants to learn about moved entities.
+type OrderAPI interface {
+  Blob_MoveEntity(perma PermaNode, move MoveEntityNode)
+}
+
+type moveEntityNode struct {
+  permaBlobRef string
+  moveBlobRef string
+  entityBlobRef string
+  moveSigner string
+  after string
+  dependencies []string
+  seqNumber int64
+  time int64
+}
+
+func (self *moveEntityNode) BlobRef() string {
+  return self.moveBlobRef
+}
+
+func (self *moveEntityNode) Signer() string {
+  return self.moveSigner
+}
+
+func (self *moveEntityNode) EntityBlobRef() string {
+  return self.entityBlobRef
+}
+
+func (self *moveEntityNode) After() string {
+  return self.after
+}
+
+func (self *moveEntityNode) PermaBlobRef() string {
+  return self.permaBlobRef
+}
+
+func (self *moveEntityNode) Dependencies() []string {
+  return self.dependencies
+}
+
+func (self *moveEntityNode) SetSequenceNumber(seq int64) {
+  self.seqNumber = seq
+}
+
+func (self *moveEntityNode) SequenceNumber() int64 {
+  return self.seqNumber
+}
+
+func (self *moveEntityNode) Time() int64 {
+  return self.time
+}
+
+func (self *moveEntityNode) ToMap() map[string]interface{} {
+  m := make(map[string]interface{})
+  m["k"] = int64(OTNode_MoveEntity)
+  m["b"] = self.moveBlobRef
+  m["s"] = self.moveSigner
+  m["e"] = self.entityBlobRef
+  m["a"] = self.after
+  m["dep"] = self.dependencies
+  m["seq"] = self.seqNumber
+  m["t"] = self.time
+  return m
+}
+
+func (self *moveEntityNode) FromMap(permaBlobRef string, m map[string]interface{}) {
+  self.permaBlobRef = permaBlobRef
+  self.moveBlobRef = m["b"].(string)
+  self.moveSigner = m["s"].(string)
+  self.entityBlobRef = m["e"].(string)
+  self.after = m["a"].(string)
+  if d, ok := m["dep"]; ok {
+    self.dependencies = d.([]string)
+  }
+  self.seqNumber = m["seq"].(int64)
+  // Moves stored before they carried a timestamp have none
+  if t, ok := m["t"]; ok {
+    self.time = t.(int64)
+  }
+}
+
+type placement struct {
+  blobref string
+  entity string
+  after string
+  // The length of the longest dependency chain leading to this placement.
+  // A causally later placement always has a larger depth.
+  depth int
+}
+
+type placementList []*placement
+
+func (self placementList) Len() int {
+  return len(self)
+}
+
+func (self placementList) Less(i, j int) bool {
+  if self[i].depth != self[j].depth {
+    return self[i].depth > self[j].depth
+  }
+  return self[i].blobref > self[j].blobref
+}
+
+func (self placementList) Swap(i, j int) {
+  self[i], self[j] = self[j], self[i]
+}
+
+// Returns the blobrefs of all entities of the perma node which have not been deleted, in document order.
+func (self *Grapher) EntityOrder(perma_blobref string) (entities []string, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  entities, _, err = self.entityOrder(perma_blobref)
+  return
+}
+
+// Returns the ordered entities and the winning placement of each entity, including deleted entities.
+func (self *Grapher) entityOrder(perma_blobref string) (entities []string, placements map[string]string, err os.Error) {
+  ch, err := self.getOTNodesAscending(perma_blobref, 0, -1)
+  if err != nil {
+    return nil, nil, err
+  }
+  depth := make(map[string]int)
+  known := make(map[string]*placement)
+  children := make(map[string]placementList)
+  deleted := make(map[string]bool)
+  placements = make(map[string]string)
+  for n := range ch {
+    d := 0
+    for _, dep := range n.Dependencies() {
+      if depth[dep] > d {
+	d = depth[dep]
+      }
+    }
+    depth[n.BlobRef()] = d + 1
+    var p *placement
+    switch n.(type) {
+    case *entityNode:
+      p = &placement{blobref: n.BlobRef(), entity: n.BlobRef(), after: n.(*entityNode).after, depth: d + 1}
+    case *moveEntityNode:
+      m := n.(*moveEntityNode)
+      p = &placement{blobref: m.BlobRef(), entity: m.EntityBlobRef(), after: m.After(), depth: d + 1}
+    case *delEntityNode:
+      deleted[n.(*delEntityNode).EntityBlobRef()] = true
+    }
+    if p == nil {
+      continue
+    }
+    known[p.blobref] = p
+    // The causally latest placement of an entity wins
+    if win, ok := placements[p.entity]; !ok || (placementList{p, known[win]}).Less(0, 1) {
+      placements[p.entity] = p.blobref
+    }
+  }
+  for _, p := range known {
+    after := p.after
+    // Placements after an unknown anchor are positioned at the beginning
+    if _, ok := known[after]; !ok {
+      after = ""
+    }
+    children[after] = append(children[after], p)
+  }
+  var visit func(anchor string)
+  visit = func(anchor string) {
+    list := children[anchor]
+    sort.Sort(list)
+    for _, p := range list {
+      if placements[p.entity] == p.blobref && !deleted[p.entity] {
+	entities = append(entities, p.entity)
+      }
+      visit(p.blobref)
+    }
+  }
+  visit("")
+  return entities, placements, nil
+}
+
+// Returns the placement after which a new placement must be created to position
+// an entity directly after the entity 'after_entity'. An empty string denotes the beginning of the file.
+func (self *Grapher) placementAfter(perma_blobref string, after_entity string) (after string, err os.Error) {
+  if after_entity == "" {
+    return "", nil
+  }
+  _, placements, err := self.entityOrder(perma_blobref)
+  if err != nil {
+    return "", err
+  }
+  after, ok := placements[after_entity]
+  if !ok {
+    return "", os.NewError("Unknown entity " + after_entity)
+  }
+  return after, nil
+}
+
+func (self *Grapher) handleMoveEntity(perma *permaNode, move *moveEntityNode) bool {
+  if api, ok := self.api.(OrderAPI); ok {
+    self.signal(func() { api.Blob_MoveEntity(perma, move) })
+  }
+  return true
+}
+
+// Moves an entity directly after the entity 'after_entity' or to the beginning of the file if 'after_entity' is empty.
+func (self *Grapher) CreateMoveEntityBlob(perma_blobref string, entity_blobref string, after_entity string) (node AbstractNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  perma, e := self.permaNode(perma_blobref)
+  if e != nil {
+    err = e
+    return
+  }
+  _, e = self.entity(perma.BlobRef(), entity_blobref)
+  if e != nil {
+    err = e
+    return
+  }
+  after, e := self.placementAfter(perma_blobref, after_entity)
+  if e != nil {
+    err = e
+    return
+  }
+  deps := perma.published.IDs()
+  t := time.Seconds()
+  moveJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "entity": entity_blobref, "after": after, "dep": deps, "t": t}
+  moveBlob, err := json.Marshal(moveJson)
+  if err != nil {
+    panic(err.String())
+  }
+  moveBlob = append([]byte(`{"type":"moveentity",`), moveBlob[1:]...)
+  log.Printf("Storing move %v\n", string(moveBlob))
+  moveBlobRef := newBlobRef(moveBlob)
+  // Process it
+  var schema superSchema
+  schema.Type = "moveentity"
+  schema.Signer = self.userID
+  schema.PermaNode = perma_blobref
+  schema.Entity = entity_blobref
+  schema.After = after
+  schema.Dependencies = deps
+  schema.Time = t
+  _, node, err = self.handleSchemaBlob(&schema, moveBlobRef)
+  return
+}
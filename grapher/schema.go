@@ -1,5 +1,14 @@
 package lightwavegrapher
 
+import (
+  "bytes"
+  "json"
+  "math"
+  "os"
+  "sort"
+  "strconv"
+)
+
 const (
   TypeNone = iota
   TypeInt64
@@ -13,12 +22,19 @@ const (
   TypeMap
 )
 
+// Short names of the numeric types
+const (
+  TypeInt = TypeInt64
+  TypeFloat = TypeFloat64
+)
+
 const (
   TransformationNone = iota
   TransformationMerge
   TransformationLatest
   TransformationMax
   TransformationMin
+  TransformationAdd
 )
 
 type Schema struct {
@@ -41,3 +57,151 @@ type FieldSchema struct {
   ElementType int
   Transformation int
 }
+
+var typeNames = map[int]string{TypeNone: "none", TypeInt64: "int64", TypeFloat64: "float64", TypeString: "string", TypeBool: "bool", TypeBytes: "bytes", TypeEntityBlobRef: "entity", TypePermaBlobRef: "perma", TypeArray: "array", TypeMap: "map"}
+
+var transformationNames = map[int]string{TransformationNone: "none", TransformationMerge: "merge", TransformationLatest: "latest", TransformationMax: "max", TransformationMin: "min", TransformationAdd: "add"}
+
+// Describes the schema as JSON, for example
+//   {"files":{"application/x-test-file":{"entities":{"application/x-test-entity":{"fields":
+//     {"text":{"type":"string","elementType":"none","transformation":"merge"}}}}}}}
+// Keys are sorted, hence the same schema always yields the same document.
+func (self *Schema) MarshalJSON() ([]byte, os.Error) {
+  var buf bytes.Buffer
+  buf.WriteString(`{"files":{`)
+  keys := []string{}
+  for key, _ := range self.FileSchemas {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  for i, key := range keys {
+    if i > 0 {
+      buf.WriteByte(',')
+    }
+    writeJSONString(&buf, key)
+    buf.WriteByte(':')
+    self.FileSchemas[key].writeJSON(&buf)
+  }
+  buf.WriteString(`}}`)
+  return buf.Bytes(), nil
+}
+
+func (self *FileSchema) writeJSON(buf *bytes.Buffer) {
+  buf.WriteString(`{"entities":{`)
+  keys := []string{}
+  for key, _ := range self.EntitySchemas {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  for i, key := range keys {
+    if i > 0 {
+      buf.WriteByte(',')
+    }
+    writeJSONString(buf, key)
+    buf.WriteByte(':')
+    self.EntitySchemas[key].writeJSON(buf)
+  }
+  buf.WriteString(`}}`)
+}
+
+func (self *EntitySchema) writeJSON(buf *bytes.Buffer) {
+  buf.WriteString(`{"fields":{`)
+  keys := []string{}
+  for key, _ := range self.FieldSchemas {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  for i, key := range keys {
+    if i > 0 {
+      buf.WriteByte(',')
+    }
+    writeJSONString(buf, key)
+    buf.WriteByte(':')
+    f := self.FieldSchemas[key]
+    buf.WriteString(`{"type":`)
+    writeJSONString(buf, schemaName(typeNames, f.Type))
+    buf.WriteString(`,"elementType":`)
+    writeJSONString(buf, schemaName(typeNames, f.ElementType))
+    buf.WriteString(`,"transformation":`)
+    writeJSONString(buf, schemaName(transformationNames, f.Transformation))
+    buf.WriteByte('}')
+  }
+  buf.WriteString(`}}`)
+}
+
+// Checks that the operation of a mutation suits the type of the field.
+// Merged strings are mutated by string operations of the form {"$t":[...]}.
+// Other fields are overwritten by values of their type, for example 42 for a TypeInt64 field.
+// The operation null, which discards a mutation, suits every field.
+// Arrays, maps and fields without a type are not checked.
+func (self *FieldSchema) checkOperation(operation interface{}) os.Error {
+  op := operation
+  if b, ok := operation.([]byte); ok {
+    if err := json.Unmarshal(b, &op); err != nil {
+      return os.NewError("Malformed operation")
+    }
+  }
+  if op == nil {
+    return nil
+  }
+  // Concurrent additions to a counter commute, hence they are its only operation
+  if self.Transformation == TransformationAdd {
+    if self.Type != TypeInt64 || !isAddOp(op) {
+      return os.NewError("Operation does not add an integer to the field")
+    }
+    return nil
+  }
+  if _, ok := stringOpElements(op); ok {
+    if self.Type != TypeString {
+      return os.NewError("String operation on a field of type " + schemaName(typeNames, self.Type))
+    }
+    return nil
+  }
+  ok := true
+  switch self.Type {
+  case TypeString:
+    _, ok = op.(string)
+    // Concurrent values of a merged string cannot be merged
+    ok = ok && self.Transformation != TransformationMerge
+  case TypeInt64:
+    var f float64
+    f, ok = op.(float64)
+    ok = ok && f == math.Floor(f)
+  case TypeFloat64:
+    _, ok = op.(float64)
+  case TypeBool:
+    _, ok = op.(bool)
+  case TypeBytes, TypeEntityBlobRef, TypePermaBlobRef:
+    _, ok = op.(string)
+  }
+  if !ok {
+    return os.NewError("Operation does not match the field type " + schemaName(typeNames, self.Type))
+  }
+  return nil
+}
+
+// Returns true if the decoded operation is of the form {"$n":3}
+func isAddOp(op interface{}) bool {
+  m, ok := op.(map[string]interface{})
+  if !ok || len(m) != 1 {
+    return false
+  }
+  f, ok := m["$n"].(float64)
+  return ok && f == math.Floor(f)
+}
+
+// Unknown constants are described by their number
+func schemaName(names map[int]string, value int) string {
+  if name, ok := names[value]; ok {
+    return name
+  }
+  return strconv.Itoa(value)
+}
+
+func writeJSONString(buf *bytes.Buffer, str string) {
+  b, err := json.Marshal(str)
+  if err != nil {
+    panic(err.String())
+  }
+  buf.Write(b)
+}
@@ -111,7 +111,7 @@ func (self *SimpleGraphStore) GetMutationsAscending(perma_blobref string, entity
   c := make(chan map[string]interface{})
   f := func() {
     for _, data := range g.nodes[startWithSeqNumber: endSeqNumber] {
-      if data["k"].(int64) == OTNode_Mutation && data["e"].(string) == entity_blobref && data["f"].(string) == field {
+      if data["k"].(int64) == OTNode_Mutation && data["e"].(string) == entity_blobref && hasField(data, field) {
 	c <- data
       }
     }
@@ -121,6 +121,21 @@ func (self *SimpleGraphStore) GetMutationsAscending(perma_blobref string, entity
   return c, nil
 }
 
+// Mutations of several fields store a list of field names
+func hasField(data map[string]interface{}, field string) bool {
+  switch data["f"].(type) {
+  case string:
+    return data["f"].(string) == field
+  case []string:
+    for _, f := range data["f"].([]string) {
+      if f == field {
+	return true
+      }
+    }
+  }
+  return false
+}
+
 func (self *SimpleGraphStore) GetOTNodesAscending(perma_blobref string, startWithSeqNumber int64, endSeqNumber int64) (ch <-chan map[string]interface{}, err os.Error) {
   g, ok := self.graphs[perma_blobref]
   if !ok {
@@ -0,0 +1,390 @@
+package lightwavegrapher
+
+import (
+  "bytes"
+  "gob"
+  "gosqlite.googlecode.com/hg/sqlite"
+  "os"
+  "sync"
+)
+
+// ------------------------------------------------------
+// SQLite graph store
+//
+// A GraphStore which keeps the graph in an SQLite database, such that the graph survives a restart
+// of the server without replaying all blobs. Perma nodes and OT nodes are stored as gob-encoded maps,
+// which preserves the types of the values in the maps. OT nodes are indexed by the blobref of their
+// perma node. Storing an OT node and the new state of its perma node happens in one transaction.
+// The blobs waiting for other blobs are persisted as well.
+
+type SQLiteGraphStore struct {
+  conn *sqlite.Conn
+  // Guards the connection
+  mutex sync.Mutex
+}
+
+var sqliteSchema = []string{
+  "CREATE TABLE IF NOT EXISTS perma (blobref TEXT PRIMARY KEY, data BLOB NOT NULL)",
+  "CREATE TABLE IF NOT EXISTS node (perma TEXT NOT NULL, seq INTEGER NOT NULL, blobref TEXT NOT NULL, kind INTEGER NOT NULL, entity TEXT NOT NULL, data BLOB NOT NULL, PRIMARY KEY (perma, seq))",
+  "CREATE UNIQUE INDEX IF NOT EXISTS node_blobref ON node (perma, blobref)",
+  "CREATE INDEX IF NOT EXISTS node_entity ON node (perma, kind, entity, seq)",
+  // Blobs waiting for other blobs and the number of blobs they are waiting for
+  "CREATE TABLE IF NOT EXISTS pending (blobref TEXT PRIMARY KEY, perma TEXT NOT NULL, count INTEGER NOT NULL)",
+  // The keys are the missing blobs. The ids preserve the order in which blobs have been enqueued
+  "CREATE TABLE IF NOT EXISTS missing (id INTEGER PRIMARY KEY AUTOINCREMENT, dep TEXT NOT NULL, blobref TEXT NOT NULL)",
+  "CREATE INDEX IF NOT EXISTS missing_dep ON missing (dep)",
+}
+
+// Opens the database at path and creates the tables if necessary.
+func NewSQLiteGraphStore(path string) (*SQLiteGraphStore, os.Error) {
+  conn, err := sqlite.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  for _, sql := range sqliteSchema {
+    if err = conn.Exec(sql); err != nil {
+      conn.Close()
+      return nil, err
+    }
+  }
+  return &SQLiteGraphStore{conn: conn}, nil
+}
+
+func (self *SQLiteGraphStore) Close() os.Error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return self.conn.Close()
+}
+
+func encodeGraphData(data map[string]interface{}) ([]byte, os.Error) {
+  var buf bytes.Buffer
+  if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+    return nil, err
+  }
+  return buf.Bytes(), nil
+}
+
+func decodeGraphData(blob []byte) (data map[string]interface{}, err os.Error) {
+  err = gob.NewDecoder(bytes.NewBuffer(blob)).Decode(&data)
+  return
+}
+
+// Runs the query and decodes the data column of all rows. The caller must hold the mutex.
+func (self *SQLiteGraphStore) queryData(sql string, args ...interface{}) (result []map[string]interface{}, err os.Error) {
+  stmt, err := self.conn.Prepare(sql)
+  if err != nil {
+    return nil, err
+  }
+  defer stmt.Finalize()
+  if err = stmt.Exec(args...); err != nil {
+    return nil, err
+  }
+  for stmt.Next() {
+    var blob []byte
+    if err = stmt.Scan(&blob); err != nil {
+      return nil, err
+    }
+    data, err := decodeGraphData(blob)
+    if err != nil {
+      return nil, err
+    }
+    result = append(result, data)
+  }
+  return result, stmt.Error()
+}
+
+// Runs the query and returns the first column of all rows. The caller must hold the mutex.
+func (self *SQLiteGraphStore) queryStrings(sql string, args ...interface{}) (result []string, err os.Error) {
+  stmt, err := self.conn.Prepare(sql)
+  if err != nil {
+    return nil, err
+  }
+  defer stmt.Finalize()
+  if err = stmt.Exec(args...); err != nil {
+    return nil, err
+  }
+  for stmt.Next() {
+    var str string
+    if err = stmt.Scan(&str); err != nil {
+      return nil, err
+    }
+    result = append(result, str)
+  }
+  return result, stmt.Error()
+}
+
+// Returns the first column of the first row or -1 if there is no row. The caller must hold the mutex.
+func (self *SQLiteGraphStore) queryInt(sql string, args ...interface{}) (result int64, err os.Error) {
+  stmt, err := self.conn.Prepare(sql)
+  if err != nil {
+    return 0, err
+  }
+  defer stmt.Finalize()
+  if err = stmt.Exec(args...); err != nil {
+    return 0, err
+  }
+  if !stmt.Next() {
+    return -1, stmt.Error()
+  }
+  err = stmt.Scan(&result)
+  return
+}
+
+// Returns the number of OT nodes of the perma node or -1 if the perma node is unknown.
+// The caller must hold the mutex.
+func (self *SQLiteGraphStore) countNodes(perma_blobref string) (count int64, err os.Error) {
+  if count, err = self.queryInt("SELECT COUNT(*) FROM perma WHERE blobref = ?1", perma_blobref); err != nil || count == 0 {
+    return -1, err
+  }
+  return self.queryInt("SELECT COUNT(*) FROM node WHERE perma = ?1", perma_blobref)
+}
+
+// Runs f in a transaction. The caller must hold the mutex.
+func (self *SQLiteGraphStore) transaction(f func() os.Error) os.Error {
+  if err := self.conn.Exec("BEGIN"); err != nil {
+    return err
+  }
+  if err := f(); err != nil {
+    self.conn.Exec("ROLLBACK")
+    return err
+  }
+  return self.conn.Exec("COMMIT")
+}
+
+func (self *SQLiteGraphStore) StoreNode(perma_blobref string, blobref string, data map[string]interface{}, perma_data map[string]interface{}) os.Error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  blob, err := encodeGraphData(data)
+  if err != nil {
+    return err
+  }
+  perma_blob, err := encodeGraphData(perma_data)
+  if err != nil {
+    return err
+  }
+  kind, _ := data["k"].(int64)
+  entity, _ := data["e"].(string)
+  return self.transaction(func() os.Error {
+    seq, err := self.countNodes(perma_blobref)
+    if err != nil {
+      return err
+    }
+    if seq < 0 {
+      return os.NewError("Unknown perma blob")
+    }
+    if err = self.conn.Exec("INSERT INTO node (perma, seq, blobref, kind, entity, data) VALUES (?1, ?2, ?3, ?4, ?5, ?6)", perma_blobref, seq, blobref, kind, entity, blob); err != nil {
+      return err
+    }
+    return self.conn.Exec("UPDATE perma SET data = ?2 WHERE blobref = ?1", perma_blobref, perma_blob)
+  })
+}
+
+func (self *SQLiteGraphStore) StorePermaNode(perma_blobref string, data map[string]interface{}) os.Error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  blob, err := encodeGraphData(data)
+  if err != nil {
+    return err
+  }
+  return self.conn.Exec("INSERT OR REPLACE INTO perma (blobref, data) VALUES (?1, ?2)", perma_blobref, blob)
+}
+
+func (self *SQLiteGraphStore) GetPermaNode(perma_blobref string) (data map[string]interface{}, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  result, err := self.queryData("SELECT data FROM perma WHERE blobref = ?1", perma_blobref)
+  if err != nil || len(result) == 0 {
+    return nil, err
+  }
+  return result[0], nil
+}
+
+func (self *SQLiteGraphStore) HasOTNodes(perma_blobref string, blobrefs []string) (missing_blobrefs []string, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if count, err := self.countNodes(perma_blobref); err != nil || count < 0 {
+    if err == nil {
+      err = os.NewError("Unknown perma blob")
+    }
+    return nil, err
+  }
+  for _, b := range blobrefs {
+    count, err := self.queryInt("SELECT COUNT(*) FROM node WHERE perma = ?1 AND blobref = ?2", perma_blobref, b)
+    if err != nil {
+      return nil, err
+    }
+    if count == 0 {
+      missing_blobrefs = append(missing_blobrefs, b)
+    }
+  }
+  return
+}
+
+func (self *SQLiteGraphStore) GetOTNodeBySeqNumber(perma_blobref string, seqNumber int64) (data map[string]interface{}, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  count, err := self.countNodes(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if count < 0 {
+    return nil, os.NewError("Unknown perma blob")
+  }
+  if seqNumber < 0 || seqNumber >= count {
+    return nil, os.NewError("Index out of bounds")
+  }
+  result, err := self.queryData("SELECT data FROM node WHERE perma = ?1 AND seq = ?2", perma_blobref, seqNumber)
+  if err != nil || len(result) == 0 {
+    return nil, err
+  }
+  return result[0], nil
+}
+
+func (self *SQLiteGraphStore) GetOTNodeByBlobRef(perma_blobref string, blobref string) (data map[string]interface{}, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  count, err := self.countNodes(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if count < 0 {
+    return nil, os.NewError("Unknown perma blob")
+  }
+  result, err := self.queryData("SELECT data FROM node WHERE perma = ?1 AND blobref = ?2", perma_blobref, blobref)
+  if err != nil || len(result) == 0 {
+    return nil, err
+  }
+  return result[0], nil
+}
+
+// Checks the bounds like SimpleGraphStore. The caller must hold the mutex.
+func (self *SQLiteGraphStore) checkRange(perma_blobref string, startWithSeqNumber int64, endSeqNumber int64) os.Error {
+  count, err := self.countNodes(perma_blobref)
+  if err != nil {
+    return err
+  }
+  if count < 0 {
+    return os.NewError("Unknown perma blob")
+  }
+  if startWithSeqNumber < 0 || startWithSeqNumber > count {
+    return os.NewError("Index out of bounds")
+  }
+  if endSeqNumber < 0 || endSeqNumber > count {
+    return os.NewError("Index out of bounds")
+  }
+  return nil
+}
+
+// The rows are read before the channel is returned, such that the database is not
+// accessed while the caller reads the channel.
+func sendGraphData(result []map[string]interface{}) <-chan map[string]interface{} {
+  c := make(chan map[string]interface{})
+  f := func() {
+    for _, data := range result {
+      c <- data
+    }
+    close(c)
+  }
+  go f()
+  return c
+}
+
+func (self *SQLiteGraphStore) GetMutationsAscending(perma_blobref string, entity_blobref string, field string, startWithSeqNumber int64, endSeqNumber int64) (ch <-chan map[string]interface{}, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if err = self.checkRange(perma_blobref, startWithSeqNumber, endSeqNumber); err != nil {
+    return nil, err
+  }
+  result, err := self.queryData("SELECT data FROM node WHERE perma = ?1 AND kind = ?2 AND entity = ?3 AND seq >= ?4 AND seq < ?5 ORDER BY seq", perma_blobref, int64(OTNode_Mutation), entity_blobref, startWithSeqNumber, endSeqNumber)
+  if err != nil {
+    return nil, err
+  }
+  // Mutations of several fields store a list of field names, which is not a column
+  mutations := []map[string]interface{}{}
+  for _, data := range result {
+    if hasField(data, field) {
+      mutations = append(mutations, data)
+    }
+  }
+  return sendGraphData(mutations), nil
+}
+
+func (self *SQLiteGraphStore) GetOTNodesAscending(perma_blobref string, startWithSeqNumber int64, endSeqNumber int64) (ch <-chan map[string]interface{}, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if err = self.checkRange(perma_blobref, startWithSeqNumber, endSeqNumber); err != nil {
+    return nil, err
+  }
+  result, err := self.queryData("SELECT data FROM node WHERE perma = ?1 AND seq >= ?2 AND seq < ?3 ORDER BY seq", perma_blobref, startWithSeqNumber, endSeqNumber)
+  if err != nil {
+    return nil, err
+  }
+  return sendGraphData(result), nil
+}
+
+func (self *SQLiteGraphStore) GetOTNodesDescending(perma_blobref string) (ch <-chan map[string]interface{}, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  count, err := self.countNodes(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if count < 0 {
+    return nil, os.NewError("Unknown perma blob")
+  }
+  result, err := self.queryData("SELECT data FROM node WHERE perma = ?1 ORDER BY seq DESC", perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  return sendGraphData(result), nil
+}
+
+func (self *SQLiteGraphStore) Enqueue(perma_blobref string, blobref string, dependencies []string) os.Error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return self.transaction(func() os.Error {
+    // For which other blob is 'blobref' waiting?
+    for _, dep := range dependencies {
+      if err := self.conn.Exec("INSERT INTO missing (dep, blobref) VALUES (?1, ?2)", dep, blobref); err != nil {
+	return err
+      }
+    }
+    return self.conn.Exec("INSERT OR REPLACE INTO pending (blobref, perma, count) VALUES (?1, ?2, ?3)", blobref, perma_blobref, int64(len(dependencies)))
+  })
+}
+
+func (self *SQLiteGraphStore) Dequeue(perma_blobref string, waitFor string) (blobrefs []string, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  err = self.transaction(func() os.Error {
+    // Is any other blob waiting for 'waitFor'?
+    waiting, err := self.queryStrings("SELECT blobref FROM missing WHERE dep = ?1 ORDER BY id", waitFor)
+    if err != nil {
+      return err
+    }
+    if err = self.conn.Exec("DELETE FROM missing WHERE dep = ?1", waitFor); err != nil {
+      return err
+    }
+    for _, waiting_id := range waiting {
+      if err = self.conn.Exec("UPDATE pending SET count = count - 1 WHERE blobref = ?1", waiting_id); err != nil {
+	return err
+      }
+      count, err := self.queryInt("SELECT count FROM pending WHERE blobref = ?1", waiting_id)
+      if err != nil {
+	return err
+      }
+      // The waiting blob is not waiting for anything anymore -> return it
+      if count == 0 {
+	if err = self.conn.Exec("DELETE FROM pending WHERE blobref = ?1", waiting_id); err != nil {
+	  return err
+	}
+	blobrefs = append(blobrefs, waiting_id)
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return
+}
@@ -0,0 +1,197 @@
+package lightwavegrapher
+
+import (
+  "json"
+  "log"
+  "os"
+)
+
+// -----------------------------------------------------
+// Patch streams
+//
+// A patch stream delivers the content of a perma node as a sequence of compact JSON
+// messages. The first message is a snapshot of all nodes applied so far.
+// All further messages describe one applied (and already transformed) node each.
+// External renderers can tail such a stream to mirror the document without
+// understanding the blob format.
+// Emitting a patch never blocks the grapher. A renderer which falls behind by more than
+// patchStreamBuffer patches would miss patches, hence its channel is closed instead.
+// The renderer can then subscribe again to start over with a new snapshot.
+
+// The size of the channel buffer of a patch stream
+const patchStreamBuffer = 1000
+
+type patch struct {
+  Type string `json:"type"`
+  Seq int64 `json:"seq"`
+  Signer string `json:"signer,omitempty"`
+  Entity string `json:"entity,omitempty"`
+  MimeType string `json:"mimetype,omitempty"`
+  Field string `json:"field,omitempty"`
+  After string `json:"after,omitempty"`
+  Title *string `json:"title,omitempty"`
+  Tags []string `json:"tags,omitempty"`
+  RemovedTags []string `json:"removedtags,omitempty"`
+  Content *json.RawMessage `json:"content,omitempty"`
+  Operation *json.RawMessage `json:"op,omitempty"`
+  // Only for mutations of several fields. The keys are field names
+  Fields map[string]*json.RawMessage `json:"fields,omitempty"`
+}
+
+type patchSnapshot struct {
+  Type string `json:"type"`
+  PermaNode string `json:"perma"`
+  MimeType string `json:"mimetype"`
+  Seq int64 `json:"seq"`
+  Patches []*patch `json:"patches"`
+}
+
+// Subscribes to the patch stream of a perma node.
+// The first message on the channel is a snapshot of the perma node.
+func (self *Grapher) SubscribePatches(perma_blobref string) (ch <-chan []byte, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if perma == nil {
+    return nil, os.NewError("Unknown perma node")
+  }
+  snapshot := &patchSnapshot{Type: "snapshot", PermaNode: perma_blobref, MimeType: perma.MimeType(), Seq: perma.SequenceNumber(), Patches: []*patch{}}
+  nodes, err := self.getOTNodesAscending(perma_blobref, 0, perma.SequenceNumber())
+  if err != nil {
+    return nil, err
+  }
+  for n := range nodes {
+    p, e := newPatch(n)
+    if e != nil {
+      err = e
+      continue
+    }
+    if p != nil {
+      snapshot.Patches = append(snapshot.Patches, p)
+    }
+  }
+  if err != nil {
+    return nil, err
+  }
+  data, err := json.Marshal(snapshot)
+  if err != nil {
+    return nil, err
+  }
+  c := make(chan []byte, patchStreamBuffer)
+  c <- data
+  self.streamMutex.Lock()
+  self.patchStreams[perma_blobref] = append(self.patchStreams[perma_blobref], c)
+  self.streamMutex.Unlock()
+  return c, nil
+}
+
+// Closes a channel returned by SubscribePatches.
+func (self *Grapher) UnsubscribePatches(perma_blobref string, ch <-chan []byte) {
+  self.streamMutex.Lock()
+  defer self.streamMutex.Unlock()
+  streams := self.patchStreams[perma_blobref]
+  for i, c := range streams {
+    if (<-chan []byte)(c) == ch {
+      close(c)
+      streams = append(streams[:i], streams[i+1:]...)
+      break
+    }
+  }
+  if len(streams) == 0 {
+    self.patchStreams[perma_blobref] = nil, false
+  } else {
+    self.patchStreams[perma_blobref] = streams
+  }
+}
+
+func (self *Grapher) emitPatch(perma_blobref string, node OTNode) {
+  self.streamMutex.Lock()
+  defer self.streamMutex.Unlock()
+  streams, ok := self.patchStreams[perma_blobref]
+  if !ok {
+    return
+  }
+  p, err := newPatch(node)
+  if err != nil {
+    log.Printf("Err: Cannot encode patch: %v", err)
+    return
+  }
+  if p == nil {
+    return
+  }
+  data, err := json.Marshal(p)
+  if err != nil {
+    log.Printf("Err: Cannot encode patch: %v", err)
+    return
+  }
+  kept := streams[:0]
+  for _, c := range streams {
+    select {
+    case c <- data:
+      kept = append(kept, c)
+    default:
+      log.Printf("Err: Closing the patch stream of %v because nobody reads it\n", perma_blobref)
+      close(c)
+    }
+  }
+  if len(kept) == 0 {
+    self.patchStreams[perma_blobref] = nil, false
+  } else {
+    self.patchStreams[perma_blobref] = kept
+  }
+}
+
+// Returns nil if the node does not contribute to the content of the perma node
+func newPatch(node OTNode) (p *patch, err os.Error) {
+  switch node.(type) {
+  case *entityNode:
+    e := node.(*entityNode)
+    c := json.RawMessage(e.Content())
+    return &patch{Type: "entity", Seq: e.SequenceNumber(), Signer: e.Signer(), Entity: e.BlobRef(), MimeType: e.MimeType(), After: e.After(), Content: &c}, nil
+  case *moveEntityNode:
+    m := node.(*moveEntityNode)
+    return &patch{Type: "moveentity", Seq: m.SequenceNumber(), Signer: m.Signer(), Entity: m.EntityBlobRef(), After: m.After()}, nil
+  case *metaNode:
+    m := node.(*metaNode)
+    return &patch{Type: "meta", Seq: m.SequenceNumber(), Signer: m.Signer(), Title: m.Title(), Tags: m.AddedTags(), RemovedTags: m.RemovedTags()}, nil
+  case *delEntityNode:
+    e := node.(*delEntityNode)
+    return &patch{Type: "delentity", Seq: e.SequenceNumber(), Signer: e.Signer(), Entity: e.EntityBlobRef()}, nil
+  case *mutationNode:
+    m := node.(*mutationNode)
+    if len(m.fields) > 0 {
+      p := &patch{Type: "mutation", Seq: m.SequenceNumber(), Signer: m.Signer(), Entity: m.EntityBlobRef(), Fields: make(map[string]*json.RawMessage)}
+      for _, part := range m.parts() {
+	op, err := operationToJSON(part.Operation())
+	if err != nil {
+	  return nil, err
+	}
+	p.Fields[part.Field()] = &op
+      }
+      return p, nil
+    }
+    op, err := operationToJSON(m.Operation())
+    if err != nil {
+      return nil, err
+    }
+    return &patch{Type: "mutation", Seq: m.SequenceNumber(), Signer: m.Signer(), Entity: m.EntityBlobRef(), Field: m.Field(), Operation: &op}, nil
+  }
+  return nil, nil
+}
+
+func operationToJSON(op interface{}) (msg json.RawMessage, err os.Error) {
+  switch op.(type) {
+  case []byte:
+    return json.RawMessage(op.([]byte)), nil
+  case json.Marshaler:
+    bytes, err := op.(json.Marshaler).MarshalJSON()
+    if err != nil {
+      return nil, err
+    }
+    return json.RawMessage(bytes), nil
+  }
+  return nil, os.NewError("Cannot serialize operation")
+}
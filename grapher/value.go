@@ -0,0 +1,171 @@
+package lightwavegrapher
+
+import (
+  "os"
+)
+
+// -----------------------------------------------------
+// Field values
+//
+// Although the grapher does not keep the content of fields, it can compute the value
+// of a string field by replaying the string operations which have been applied to the field.
+// This is meant for simple clients such as terminal editors, which do not want to
+// maintain the text themselves. The cost grows with the length of the field's history.
+
+// Returns the current value of a string field.
+// Fields which have never been mutated are empty.
+func (self *Grapher) FieldValue(perma_blobref, entity_blobref, field string) (value string, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return "", err
+  }
+  if perma == nil {
+    return "", os.NewError("Unknown perma node")
+  }
+  ch, err := self.getMutationsAscending(perma.BlobRef(), entity_blobref, field, 0, perma.SequenceNumber())
+  if err != nil {
+    return "", err
+  }
+  // Drain the channel even after an error, such that the goroutine feeding it terminates
+  for mut := range ch {
+    if err == nil {
+      value, err = applyStringOp(value, mut.Operation())
+    }
+  }
+  return
+}
+
+// Returns the value of a string field as it was when the frontier was the latest state
+// of the perma node, for example to browse the history of a document.
+// Only mutations which are causally included in the frontier are replayed.
+// The stored mutations have been transformed in the order in which they have been applied.
+// If a mutation included in the frontier has been applied after a mutation which is not,
+// the latter must be pruned from the former. This requires that the transformer of the
+// field implements Pruner. Otherwise an error is returned.
+func (self *Grapher) FieldValueAt(perma_blobref, entity_blobref, field string, frontier []string) (value interface{}, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if perma == nil {
+    return nil, os.NewError("Unknown perma node")
+  }
+  past, err := self.causalPast(perma_blobref, frontier)
+  if err != nil {
+    return nil, err
+  }
+  ch, err := self.getMutationsAscending(perma_blobref, entity_blobref, field, 0, perma.SequenceNumber())
+  if err != nil {
+    return nil, err
+  }
+  // The mutations of the field up to the last one which is included in the frontier
+  muts := []MutationNode{}
+  prune := make(map[string]bool)
+  var included int
+  for mut := range ch {
+    muts = append(muts, mut)
+    if past[mut.BlobRef()] {
+      included = len(muts)
+    } else {
+      prune[mut.BlobRef()] = true
+    }
+  }
+  muts = muts[:included]
+  for _, mut := range muts {
+    if prune[mut.BlobRef()] {
+      if muts, err = self.pruneMutations(perma, entity_blobref, field, muts, prune); err != nil {
+	return nil, err
+      }
+      break
+    }
+  }
+  text := ""
+  for _, mut := range muts {
+    if text, err = applyStringOp(text, mut.Operation()); err != nil {
+      return nil, err
+    }
+  }
+  return text, nil
+}
+
+// Returns the blobrefs of all OT nodes which precede or are part of the frontier.
+func (self *Grapher) causalPast(perma_blobref string, frontier []string) (past map[string]bool, err os.Error) {
+  past = make(map[string]bool)
+  stack := append([]string{}, frontier...)
+  for len(stack) > 0 {
+    blobref := stack[len(stack) - 1]
+    stack = stack[:len(stack) - 1]
+    if past[blobref] {
+      continue
+    }
+    data, err := self.gstore.GetOTNodeByBlobRef(perma_blobref, blobref)
+    if err != nil {
+      return nil, err
+    }
+    if data == nil {
+      return nil, os.NewError("The frontier refers to an unknown blob")
+    }
+    past[blobref] = true
+    stack = append(stack, self.otNodeFromMap(perma_blobref, data).Dependencies()...)
+  }
+  return past, nil
+}
+
+// Uses the Pruner of the field to remove the pruned mutations from the mutations of the field.
+func (self *Grapher) pruneMutations(perma *permaNode, entity_blobref, field string, muts []MutationNode, prune map[string]bool) ([]MutationNode, os.Error) {
+  entity, err := self.entity(perma.BlobRef(), entity_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if entity == nil {
+    return nil, os.NewError("Unknown entity")
+  }
+  t, err := self.transformer(perma, entity, field)
+  if err != nil {
+    return nil, err
+  }
+  pruner, ok := t.(Pruner)
+  if !ok {
+    return nil, os.NewError("The transformer of the field cannot prune mutations")
+  }
+  return pruner.PruneMutations(muts, prune)
+}
+
+// Applies a string operation of the form {"$t":["insert", {"$s":n}, {"$d":n}]} to the text.
+func applyStringOp(text string, operation interface{}) (result string, err os.Error) {
+  elements, ok := stringOpElements(operation)
+  if !ok {
+    return "", os.NewError("Operation is no string operation")
+  }
+  pos := 0
+  for _, x := range elements {
+    switch x.(type) {
+    case string:
+      text = text[:pos] + x.(string) + text[pos:]
+      pos += len(x.(string))
+    case map[string]interface{}:
+      m := x.(map[string]interface{})
+      if s, ok := m["$s"].(float64); ok {
+	pos += int(s)
+      } else if d, ok := m["$d"].(float64); ok {
+	if pos + int(d) > len(text) {
+	  return "", os.NewError("Deletion beyond the end of the text")
+	}
+	text = text[:pos] + text[pos + int(d):]
+	continue
+      } else {
+	return "", os.NewError("Malformed string operation")
+      }
+    default:
+      return "", os.NewError("Malformed string operation")
+    }
+    if pos > len(text) {
+      return "", os.NewError("Skipped beyond the end of the text")
+    }
+  }
+  return text, nil
+}
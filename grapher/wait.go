@@ -0,0 +1,103 @@
+package lightwavegrapher
+
+import (
+  store "lightwavestore"
+  "log"
+  "os"
+  "time"
+)
+
+// -----------------------------------------------------
+// Waiting for blobs
+//
+// Blobs added to the blob store are processed asynchronously by the dispatch goroutine of the store.
+// Callers that need to read the resulting state can wait until a blob has been processed.
+
+// Returned by StoreBlobAndWait if the blob has not been processed in time
+var ErrWaitTimeout = os.NewError("Timeout while waiting for the blob to be processed")
+
+// Stores the blob and blocks until the grapher has applied or rejected it.
+// Returns the error with which the blob has been rejected or nil if it has been applied.
+// If the blob depends on blobs which are not yet known, the function blocks until these have arrived,
+// but no longer than 'timeout' nanoseconds. Then ErrWaitTimeout is returned, although the blob
+// remains in the store and may still be applied later. A timeout of zero waits forever.
+// It must not be called from the goroutine dispatching blobs, for example from within an API callback.
+func (self *Grapher) StoreBlobAndWait(blob []byte, blobref string, timeout int64) (err os.Error) {
+  if blobref == "" {
+    blobref = newBlobRef(blob)
+  }
+  // The store does not dispatch blobs twice
+  if b, _ := self.store.GetBlob(blobref); b != nil {
+    return os.NewError("Blob is already known")
+  }
+  ch := make(chan os.Error, 1)
+  self.lock()
+  self.waiters[blobref] = append(self.waiters[blobref], ch)
+  self.unlock()
+  if _, err = self.store.StoreBlob(blob, blobref); err != nil {
+    self.removeWaiter(blobref, ch)
+    return err
+  }
+  if timeout <= 0 {
+    return <-ch
+  }
+  select {
+  case err = <-ch:
+    return err
+  case <-time.After(timeout):
+  }
+  self.removeWaiter(blobref, ch)
+  // The result may have arrived in the meantime
+  select {
+  case err = <-ch:
+    return err
+  default:
+  }
+  return ErrWaitTimeout
+}
+
+// Removes the channel from the waiters of the blob
+func (self *Grapher) removeWaiter(blobref string, ch chan os.Error) {
+  self.lock()
+  defer self.unlock()
+  waiters := self.waiters[blobref]
+  for i, w := range waiters {
+    if w == ch {
+      waiters = append(waiters[:i], waiters[i+1:]...)
+      break
+    }
+  }
+  if len(waiters) == 0 {
+    self.waiters[blobref] = nil, false
+  } else {
+    self.waiters[blobref] = waiters
+  }
+}
+
+// Blocks until all blobs stored so far have been processed.
+// Blobs waiting for blobs which have not yet arrived do not count as pending.
+// This requires a blob store which dispatches blobs via a queue and implements WaitIdle, for example
+// the SimpleBlobStore. For other blob stores the function returns immediately.
+// It must not be called from the goroutine dispatching blobs, for example from within an API callback.
+func (self *Grapher) WaitIdle() {
+  if w, ok := self.store.(store.IdleWaiter); ok {
+    w.WaitIdle()
+  }
+}
+
+// Informs all callers waiting for the blob. Must be called while holding the mutex, hence it must not block.
+// Each waiter has a channel of its own with room for the one result it receives.
+func (self *Grapher) complete(blobref string, err os.Error) {
+  waiters, ok := self.waiters[blobref]
+  if !ok {
+    return
+  }
+  self.waiters[blobref] = nil, false
+  for _, ch := range waiters {
+    select {
+    case ch <- err:
+    default:
+      log.Printf("Err: Waiter of blob %v has already been informed\n", blobref)
+    }
+  }
+}
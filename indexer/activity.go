@@ -0,0 +1,180 @@
+package lightwaveidx
+
+import (
+  "os"
+  . "lightwavestore"
+)
+
+// -----------------------------------------------------
+// Activity feed
+//
+// The activity feed of a perma node lists invitations, new followers and mutations
+// in the order in which they have been indexed. Notification UIs can read the past
+// events and subscribe to new ones instead of implementing an ApplicationIndexer.
+// The most recent events of each perma node are kept in memory in a ring buffer. When it
+// is full, the oldest event is dropped. Recording an event never blocks indexing: when a
+// subscriber does not keep up, the oldest event waiting on its channel is dropped.
+// An invitation of the local user shows up once the invitation has been applied, i.e.
+// after the perma node has been downloaded.
+
+const (
+  // A user has been invited to the perma node
+  Event_Invitation = iota
+  // An invited user has accepted the invitation by keeping the perma node
+  Event_NewFollower
+  // A mutation has been applied to the perma node
+  Event_Mutation
+)
+
+// The number of events kept per perma node by default.
+// Activity subscriptions buffer that many events, too.
+const DefaultActivityCapacity = 1000
+
+// Returned when setting a negative activity capacity
+var ErrNegativeCapacity = os.NewError("Capacity must not be negative")
+
+type Event struct {
+  // One of the Event_xxx constants
+  Kind int
+  // The user who signed the blob that caused the event
+  Actor string
+  // Timestamp of the blob in seconds since the epoch
+  Time int64
+  // The permission, keep or mutation that caused the event
+  BlobRef string
+  // The user who has been invited or who accepted an invitation. Empty for mutations
+  User string
+}
+
+// The recent events of one perma node
+type activityLog struct {
+  // A ring buffer. The oldest event is at index 'start'
+  ring []Event
+  start int
+  count int
+}
+
+func (self *activityLog) add(event Event) (dropped bool) {
+  if len(self.ring) == 0 {
+    return true
+  }
+  if self.count == len(self.ring) {
+    self.start = (self.start + 1) % len(self.ring)
+    self.count--
+    dropped = true
+  }
+  self.ring[(self.start + self.count) % len(self.ring)] = event
+  self.count++
+  return
+}
+
+// Sets the number of events kept per perma node. The default is DefaultActivityCapacity.
+// The capacity applies to perma nodes without events so far and to new subscriptions.
+// Returns ErrNegativeCapacity if the capacity is negative.
+func (self *Indexer) SetActivityCapacity(capacity int) os.Error {
+  if capacity < 0 {
+    return ErrNegativeCapacity
+  }
+  self.activityMutex.Lock()
+  defer self.activityMutex.Unlock()
+  self.activityCapacity = capacity
+  return nil
+}
+
+// Returns the number of events which have been dropped from the activity feeds because
+// they were full. These events are no longer returned by ActivityFeed.
+func (self *Indexer) DroppedActivity() int64 {
+  self.activityMutex.Lock()
+  defer self.activityMutex.Unlock()
+  return self.activityDropped
+}
+
+// Returns the kept events of the perma node which are timestamped at or after 'since'
+// in the order in which they have been indexed.
+func (self *Indexer) ActivityFeed(perma_blobref string, since int64) []Event {
+  self.activityMutex.Lock()
+  defer self.activityMutex.Unlock()
+  events := []Event{}
+  l, ok := self.activity[perma_blobref]
+  if !ok {
+    return events
+  }
+  for i := 0; i < l.count; i++ {
+    if e := l.ring[(l.start + i) % len(l.ring)]; e.Time >= since {
+      events = append(events, e)
+    }
+  }
+  return events
+}
+
+// Subscribes to the events of the perma node which are indexed from now on.
+// If the channel is not read, the oldest events on it are dropped.
+func (self *Indexer) SubscribeActivity(perma_blobref string) <-chan Event {
+  self.activityMutex.Lock()
+  defer self.activityMutex.Unlock()
+  buffer := self.activityCapacity
+  if buffer == 0 {
+    buffer = 1
+  }
+  c := make(chan Event, buffer)
+  self.activityStreams[perma_blobref] = append(self.activityStreams[perma_blobref], c)
+  return c
+}
+
+// Closes a channel returned by SubscribeActivity.
+func (self *Indexer) UnsubscribeActivity(perma_blobref string, ch <-chan Event) {
+  self.activityMutex.Lock()
+  defer self.activityMutex.Unlock()
+  streams := self.activityStreams[perma_blobref]
+  for i, c := range streams {
+    if (<-chan Event)(c) == ch {
+      close(c)
+      streams = append(streams[:i], streams[i+1:]...)
+      break
+    }
+  }
+  if len(streams) == 0 {
+    self.activityStreams[perma_blobref] = nil, false
+  } else {
+    self.activityStreams[perma_blobref] = streams
+  }
+}
+
+// Called on the indexing path while holding the mutex of the indexer, hence it must never block.
+// Subscribers which do not keep up lose their oldest events instead, see deliverEvent.
+func (self *Indexer) recordEvent(perma_blobref string, event Event) {
+  self.activityMutex.Lock()
+  defer self.activityMutex.Unlock()
+  l, ok := self.activity[perma_blobref]
+  if !ok {
+    l = &activityLog{ring: make([]Event, self.activityCapacity)}
+    self.activity[perma_blobref] = l
+  }
+  if l.add(event) {
+    self.activityDropped++
+  }
+  for _, c := range self.activityStreams[perma_blobref] {
+    deliverEvent(c, event)
+  }
+}
+
+// Sends the event on the channel without blocking. If the channel is full, the oldest event on it is dropped.
+func deliverEvent(c chan Event, event Event) {
+  send := func() bool {
+    select {
+    case c <- event:
+      return true
+    default:
+    }
+    return false
+  }
+  drop := func() bool {
+    select {
+    case <-c:
+      return true
+    default:
+    }
+    return false
+  }
+  SendDroppingOldest(send, drop)
+}
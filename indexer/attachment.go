@@ -0,0 +1,223 @@
+package lightwaveidx
+
+import (
+  . "lightwavestore"
+  "json"
+  lst "container/list"
+  "log"
+  "os"
+)
+
+// -----------------------------------------------------
+// Attachments
+//
+// Blobs which are no schema blobs, for example images, can be attached to a perma node.
+// A binary blob carries no signer and no perma node. Hence an attachment blob, which is a
+// schema blob signed by a user with write permission, references the binary blob and names the
+// perma node. Once both blobs have been indexed, the binary blob is a blobNode of the perma node
+// and is forwarded to all followers with read permission like the blobs of the perma node.
+// Attachment blobs are not part of the OT history of the perma node, but depend on its frontier.
+// The write permission of the signer is checked against the permissions at these dependencies,
+// such that all replicas decide alike.
+// A binary blob which arrives before its attachment blob waits until the attachment blob has been indexed.
+// At most DefaultMaxOrphanBlobs binary blobs wait at a time. The oldest of them stops waiting when another
+// one arrives. It is indexed nevertheless once its attachment blob arrives.
+// A binary blob can be attached to one perma node only. If several attachment blobs reference it,
+// the one with the smallest blobref wins, regardless of the order in which they arrive.
+
+// The maximum number of binary blobs which wait for their attachment blobs
+const DefaultMaxOrphanBlobs = 1000
+
+var (
+  ErrMissingBlob = os.NewError("Attachment is lacking a blob")
+  ErrUnknownAttachment = os.NewError("Unknown attachment")
+)
+
+type attachmentNode struct {
+  node
+  blobref string
+  dependencies []string
+  // The blobref of the attached binary blob
+  blob string
+  mimeType string
+}
+
+func (self *attachmentNode) BlobRef() string {
+  return self.blobref
+}
+
+func (self *attachmentNode) Dependencies() []string {
+  return self.dependencies
+}
+
+// A binary blob which has been attached to a perma node.
+// The signer and the time are those of the attachment blob.
+type blobNode struct {
+  node
+  blobref string
+  mimeType string
+  // The blobref of the attachment blob
+  attachment string
+}
+
+func (self *blobNode) BlobRef() string {
+  return self.blobref
+}
+
+func (self *blobNode) MimeType() string {
+  return self.mimeType
+}
+
+// Binary blobs which arrive before the attachment blob referencing them wait for this key
+func attachmentKey(blobref string) string {
+  return "attachment-" + blobref
+}
+
+// Binds the binary blob to the perma node, provided that the signer may write to the perma node
+// at the dependencies of the attachment blob. The caller must hold the mutex.
+func (self *Indexer) handleAttachment(perma *PermaNode, att *attachmentNode) bool {
+  if perma == nil {
+    log.Printf("Err: Attachment without a permanode\n")
+    return false
+  }
+  state := perma.currentPermissions()
+  if perma.ot != nil || len(att.Dependencies()) > 0 {
+    var missing []string
+    if perma.ot == nil {
+      missing = att.Dependencies()
+    } else {
+      missing = perma.ot.missing(att.Dependencies())
+    }
+    if len(missing) > 0 {
+      self.enqueue(perma.BlobRef(), att.BlobRef(), missing)
+      return false
+    }
+    var err os.Error
+    if state, err = perma.ot.PermissionsAt(att.Dependencies()); err != nil {
+      log.Printf("Err: %v\nsigner=%v blobref=%v\n", err, att.Signer(), att.BlobRef())
+      return false
+    }
+  }
+  if !perma.hasPermissionAt(state, att.Signer(), Perm_Write) {
+    log.Printf("Err: %v\nsigner=%v blobref=%v\n", ErrPermissionDenied, att.Signer(), att.BlobRef())
+    return false
+  }
+  if other, ok := self.attachments[att.blob]; ok && other < att.BlobRef() {
+    log.Printf("Err: Blob %v is already attached\n", att.blob)
+    return false
+  }
+  self.nodes[att.BlobRef()] = att
+  self.attachments[att.blob] = att.BlobRef()
+  // The binary blob has been attached by an attachment blob with a larger blobref? Then it moves to this attachment
+  if b, ok := self.nodes[att.blob].(*blobNode); ok {
+    b.node = node{time: att.Timestamp(), signer: att.Signer(), parent: att.Parent()}
+    b.attachment = att.BlobRef()
+    if att.mimeType != "" {
+      b.mimeType = att.mimeType
+    }
+  }
+  return true
+}
+
+// Returns the blobref of the binary blob which waited for the attachment blob, but stopped waiting
+// because too many binary blobs were waiting. Returns an empty string if there is no such blob.
+// The caller must hold the mutex.
+func (self *Indexer) orphanOf(att *attachmentNode) string {
+  if _, handled := self.nodes[att.blob]; handled || self.waitingBlobs[att.blob] || !self.store.HasBlob(att.blob) {
+    return ""
+  }
+  return att.blob
+}
+
+// Lets the oldest binary blobs stop waiting for their attachment blobs, such that at most
+// maxOrphans binary blobs are waiting. The caller must hold the mutex.
+func (self *Indexer) limitOrphans(blobref string) {
+  if self.orphans == nil {
+    self.orphans = lst.New()
+  }
+  self.orphans.PushBack(blobref)
+  for self.orphans.Len() > self.maxOrphans {
+    orphan := self.orphans.Remove(self.orphans.Front()).(string)
+    if _, ok := self.nodes[orphan]; !ok && self.waitingBlobs[orphan] {
+      log.Printf("Binary blob %v stops waiting for its attachment\n", orphan)
+      self.forgetWaiting(orphan)
+    }
+  }
+}
+
+// Returns the perma node to which the binary blob is attached and the signer of the attachment blob.
+// If the attachment blob has not yet been indexed, the binary blob waits for it.
+func (self *Indexer) handleBinaryBlob(blob []byte, blobref string) (perma *PermaNode, signer string, processed bool) {
+  att_blobref, ok := self.attachments[blobref]
+  if !ok {
+    log.Printf("Binary blob %v is waiting for its attachment\n", blobref)
+    // The perma node is not known yet
+    self.enqueue("", blobref, []string{attachmentKey(blobref)})
+    self.limitOrphans(blobref)
+    return nil, "", false
+  }
+  att := self.nodes[att_blobref].(*attachmentNode)
+  perma, err := self.permaNode(att.Parent())
+  if err != nil || perma == nil {
+    log.Printf("Err: Attachment %v references an unknown perma node\n", att_blobref)
+    return nil, "", false
+  }
+  mimetype := att.mimeType
+  if mimetype == "" {
+    mimetype = MimeType(blob)
+  }
+  self.nodes[blobref] = &blobNode{node: node{time: att.Timestamp(), signer: att.Signer(), parent: att.Parent()}, blobref: blobref, mimeType: mimetype, attachment: att_blobref}
+  log.Printf("Attached blob %v to %v\n", blobref, perma.BlobRef())
+  return perma, att.Signer(), true
+}
+
+// Returns the content of a binary blob attached to the perma node.
+// The local user must have read permission on the perma node.
+func (self *Indexer) GetAttachment(perma_blobref, blobref string) (data []byte, err os.Error) {
+  self.lock()
+  b, ok := self.nodes[blobref].(*blobNode)
+  perma, err := self.permaNode(perma_blobref)
+  self.unlock()
+  if err != nil {
+    return nil, err
+  }
+  if !ok || perma == nil || b.Parent() != perma_blobref {
+    return nil, ErrUnknownAttachment
+  }
+  if !perma.HasPermission(self.userID, Perm_Read) {
+    return nil, ErrPermissionDenied
+  }
+  return self.store.GetBlob(blobref)
+}
+
+// Stores the data as a binary blob and attaches it to the perma node.
+// Returns the blobref of the binary blob. The mime type is detected from the data.
+// The attachment blob depends on the current frontier of the perma node.
+func (self *Indexer) CreateAttachmentBlob(perma_blobref string, data []byte) (blobref string, err os.Error) {
+  blobref = NewBlobRef(data)
+  attJson := map[string]interface{}{ "signer": self.userID, "perma": perma_blobref, "blob": blobref, "mimetype": MimeType(data), "t": nowRFC3339()}
+  self.runOn(perma_blobref, func() {
+    self.lock()
+    defer self.unlock()
+    if perma, e := self.permaNode(perma_blobref); e == nil && perma != nil && perma.ot != nil {
+      attJson["dep"] = perma.ot.Frontier().IDs()
+    }
+  })
+  attBlob, err := json.Marshal(attJson)
+  if err != nil {
+    panic(err.String())
+  }
+  attBlob = append([]byte(`{"type":"attachment",`), attBlob[1:]...)
+  if attBlob, err = self.signBlob(attBlob); err != nil {
+    return "", err
+  }
+  log.Printf("Storing attachment %v\n", string(attBlob))
+  // The attachment blob is stored first, such that followers need not wait for it
+  if _, err = self.store.StoreBlob(attBlob, NewBlobRef(attBlob)); err != nil {
+    return "", err
+  }
+  if _, err = self.store.StoreBlob(data, blobref); err != nil {
+    return "", err
+  }
+  return blobref, nil
+}
@@ -0,0 +1,209 @@
+package lightwaveidx
+
+import (
+  . "lightwavestore"
+  "bufio"
+  "container/heap"
+  "fmt"
+  "io"
+  "json"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// -----------------------------------------------------
+// Bundles
+//
+// A bundle packs all blobs of a perma node into a single stream, for example
+// to mail or archive a document. Each blob is preceded by a header line of the form
+// "<blobref> <length>\n" followed by exactly <length> bytes of blob data.
+
+// Writes all blobs of the perma node to the writer, i.e. the perma node itself,
+// its keeps, permissions and mutations including those which have been compacted.
+// The blobs are written in dependency order, i.e. each blob follows all blobs it depends on.
+// Among the blobs whose dependencies have been written, the perma node comes first,
+// then keeps and permissions, then mutations in the order in which they have been applied.
+func (self *Indexer) Export(perma_blobref string, w io.Writer) os.Error {
+  return self.ExportBlobs(perma_blobref, func(blobref string, blob []byte) os.Error {
+    if _, err := fmt.Fprintf(w, "%v %v\n", blobref, len(blob)); err != nil {
+      return err
+    }
+    _, err := w.Write(blob)
+    return err
+  })
+}
+
+// Passes all blobs of the perma node to f in the order in which Export writes them.
+// Stops at the first error returned by f.
+func (self *Indexer) ExportBlobs(perma_blobref string, f func(blobref string, blob []byte) os.Error) os.Error {
+  self.lock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil || perma == nil {
+    self.unlock()
+    if err == nil {
+      err = ErrUnknownPermaNode
+    }
+    return err
+  }
+  blobrefs := []string{perma_blobref}
+  if perma.ot != nil {
+    blobrefs = append(blobrefs, perma.ot.checkpoint.order...)
+    blobrefs = append(blobrefs, perma.ot.AppliedBlobs()...)
+  }
+  self.unlock()
+  blobs, err := self.sortBundle(blobrefs)
+  if err != nil {
+    return err
+  }
+  for _, b := range blobs {
+    if err = f(b.blobref, b.blob); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+type bundleBlob struct {
+  blobref string
+  blob []byte
+  // Position in the list passed to sortBundle
+  index int
+  // 0 for perma nodes, 1 for keeps and permissions, 2 for everything else
+  rank int
+  // The number of dependencies which have not yet been written
+  pending int
+  // The blobs depending on this blob
+  dependents []*bundleBlob
+}
+
+// Blobs ready to be written, ordered by rank and position
+type bundleQueue []*bundleBlob
+
+func (self bundleQueue) Len() int {
+  return len(self)
+}
+
+func (self bundleQueue) Less(i, j int) bool {
+  if self[i].rank != self[j].rank {
+    return self[i].rank < self[j].rank
+  }
+  return self[i].index < self[j].index
+}
+
+func (self bundleQueue) Swap(i, j int) {
+  self[i], self[j] = self[j], self[i]
+}
+
+func (self *bundleQueue) Push(x interface{}) {
+  *self = append(*self, x.(*bundleBlob))
+}
+
+func (self *bundleQueue) Pop() interface{} {
+  old := *self
+  x := old[len(old)-1]
+  *self = old[:len(old)-1]
+  return x
+}
+
+type bundleSchema struct {
+  Type string "type"
+  Dependencies []string "dep"
+}
+
+// Loads the blobs and sorts them topologically.
+// Dependencies on blobs which are not in the list are ignored.
+func (self *Indexer) sortBundle(blobrefs []string) (result []*bundleBlob, err os.Error) {
+  blobs := make(map[string]*bundleBlob)
+  deps := make(map[string][]string)
+  for i, blobref := range blobrefs {
+    blob, err := self.store.GetBlob(blobref)
+    if err != nil {
+      return nil, err
+    }
+    var schema bundleSchema
+    if err = json.Unmarshal(blob, &schema); err != nil {
+      return nil, err
+    }
+    b := &bundleBlob{blobref: blobref, blob: blob, index: i, rank: 2}
+    switch schema.Type {
+    case "permanode":
+      b.rank = 0
+    case "keep", "permission":
+      b.rank = 1
+    }
+    blobs[blobref] = b
+    deps[blobref] = schema.Dependencies
+  }
+  for blobref, b := range blobs {
+    for _, dep := range deps[blobref] {
+      if d, ok := blobs[dep]; ok {
+	d.dependents = append(d.dependents, b)
+	b.pending++
+      }
+    }
+  }
+  queue := &bundleQueue{}
+  for _, b := range blobs {
+    if b.pending == 0 {
+      heap.Push(queue, b)
+    }
+  }
+  for queue.Len() > 0 {
+    b := heap.Pop(queue).(*bundleBlob)
+    result = append(result, b)
+    for _, d := range b.dependents {
+      d.pending--
+      if d.pending == 0 {
+	heap.Push(queue, d)
+      }
+    }
+  }
+  if len(result) != len(blobs) {
+    return nil, os.NewError("Cyclic dependencies in bundle")
+  }
+  return result, nil
+}
+
+// Reads a bundle written by Export and stores all of its blobs.
+// Blobs which are already in the store are skipped.
+// The indexer processes the stored blobs like any other blob arriving at the store.
+// Since Export writes blobs in dependency order, each blob can be applied as soon as
+// it is stored and no blob has to wait for another one. Bundles in arbitrary order,
+// for example assembled by hand, are imported as well. Their blobs wait in the
+// waiting lists of the indexer until their dependencies arrive.
+func (self *Indexer) Import(r io.Reader) os.Error {
+  reader := bufio.NewReader(r)
+  for {
+    line, err := reader.ReadString('\n')
+    if err == os.EOF && len(line) == 0 {
+      return nil
+    }
+    if err != nil {
+      return err
+    }
+    header := strings.Split(strings.TrimSpace(line), " ")
+    if len(header) != 2 {
+      return os.NewError("Malformed bundle header")
+    }
+    blobref := header[0]
+    length, err := strconv.Atoi(header[1])
+    if err != nil || length < 0 {
+      return os.NewError("Malformed blob length in bundle")
+    }
+    blob := make([]byte, length)
+    if _, err = io.ReadFull(reader, blob); err != nil {
+      return err
+    }
+    if NewBlobRef(blob) != blobref {
+      return os.NewError("Blob " + blobref + " in bundle does not match its blobref")
+    }
+    if self.store.HasBlobs([]string{blobref})[0] {
+      continue
+    }
+    if _, err = self.store.StoreBlob(blob, blobref); err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,112 @@
+package lightwaveidx
+
+import (
+  . "lightwavestore"
+  "json"
+  "log"
+  "os"
+)
+
+// -----------------------------------------------------
+// Deletion
+//
+// The owner of a perma node can ask all followers to delete blobs of the perma node,
+// for example to delete a document for everyone. The request is a delete blob which
+// lists the blobrefs to delete. It is federated like every other blob and remains
+// in the store as a tombstone.
+// Like a mutation, a delete blob depends on the frontier of the perma node at the time it has been created.
+// The signer must own the perma node at these dependencies and only blobs preceding them can be deleted.
+// Hence all followers come to the same verdict, no matter in which order they receive the blobs.
+// Deletion is best-effort. Followers may run software that ignores delete blobs,
+// may have copied the blobs elsewhere or may have disabled deletion via SetHonorDeleteRequests.
+// Deleted blobs are removed from the blob store only. The indexer keeps the already
+// indexed state of the perma node in memory.
+
+type deleteNode struct {
+  node
+  blobref string
+  dependencies []string
+  // The blobs to delete
+  blobs []string
+}
+
+func (self *deleteNode) BlobRef() string {
+  return self.blobref
+}
+
+func (self *deleteNode) Dependencies() []string {
+  return self.dependencies
+}
+
+// Determines whether delete blobs remove blobs from the local store. The default is true.
+func (self *Indexer) SetHonorDeleteRequests(honor bool) {
+  self.ignoreDeletes = !honor
+}
+
+// Deletes all blobs listed in the delete blob which belong to the perma node, i.e. the perma node itself
+// and the blobs preceding the delete, provided that the signer owns the perma node at the dependencies of the delete.
+// The delete waits until all its dependencies have been applied.
+func (self *Indexer) handleDelete(perma *PermaNode, del *deleteNode) bool {
+  if perma == nil {
+    log.Printf("Err: Delete without a permanode\n")
+    return false
+  }
+  state := perma.currentPermissions()
+  var preceding map[string]bool
+  if perma.ot != nil {
+    if deps := perma.ot.missing(del.Dependencies()); len(deps) > 0 {
+      self.enqueue(perma.BlobRef(), del.BlobRef(), deps)
+      return false
+    }
+    var err os.Error
+    if state, err = perma.ot.PermissionsAt(del.Dependencies()); err != nil {
+      log.Printf("Err: %v\nblobref=%v\n", err, del.BlobRef())
+      return false
+    }
+    preceding = perma.ot.ancestors(del.Dependencies())
+  } else if len(del.Dependencies()) > 0 {
+    self.enqueue(perma.BlobRef(), del.BlobRef(), del.Dependencies())
+    return false
+  }
+  if del.Signer() != state.owner {
+    log.Printf("Err: %v\nOnly the owner can delete blobs. signer=%v blobref=%v\n", ErrPermissionDenied, del.Signer(), del.BlobRef())
+    return false
+  }
+  if self.ignoreDeletes {
+    log.Printf("Ignoring delete %v\n", del.BlobRef())
+    return true
+  }
+  deleter, ok := self.store.(BlobDeleter)
+  if !ok {
+    log.Printf("The blob store does not support deletion\n")
+    return true
+  }
+  for _, blobref := range del.blobs {
+    if blobref != perma.BlobRef() && !preceding[blobref] && (perma.ot == nil || !perma.ot.checkpoint.blobs[blobref]) {
+      log.Printf("Err: Blob %v does not belong to the perma node %v and is not deleted\n", blobref, perma.BlobRef())
+      continue
+    }
+    if err := deleter.DeleteBlob(blobref); err != nil {
+      log.Printf("Err: Failed deleting blob %v: %v\n", blobref, err)
+    }
+  }
+  return true
+}
+
+// Asks all followers of the perma node to delete the blobs. The dependencies are usually the current frontier
+// of the perma node. Only the owner of the perma node can delete blobs and only blobs which precede the dependencies.
+func (self *Indexer) CreateDeleteBlob(perma_blobref string, dependencies []string, blobrefs []string) (blobref string, err os.Error) {
+  delJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": dependencies, "blobs": blobrefs, "t":nowRFC3339()}
+  delBlob, err := json.Marshal(delJson)
+  if err != nil {
+    panic(err.String())
+  }
+  delBlob = append([]byte(`{"type":"delete",`), delBlob[1:]...)
+  if delBlob, err = self.signBlob(delBlob); err != nil {
+    return "", err
+  }
+  log.Printf("Storing delete %v\n", string(delBlob))
+  delBlobRef := NewBlobRef(delBlob)
+  self.store.StoreBlob(delBlob, delBlobRef)
+  return delBlobRef, nil
+}
@@ -0,0 +1,174 @@
+package lightwaveidx
+
+import (
+  ot "lightwaveot"
+  "sort"
+  "strings"
+  "sync"
+  "unicode"
+)
+
+// -----------------------------------------------------
+// Full text index
+//
+// The FullTextIndex is an application indexer which maintains an inverted index
+// from words to perma nodes. Whenever a mutation has been applied to a perma node,
+// the text of the perma node is indexed anew. Hence text that has been deleted or undone
+// does not show up in search results anymore.
+// The index reads the text of the perma node while holding the mutex of the indexer.
+// The index has a mutex of its own, which guards the postings against concurrent searches.
+// Currently, the index understands documents which consist of plain text.
+
+type FullTextIndex struct {
+  indexer *Indexer
+  mutex sync.Mutex
+  // The keys are words. The values are sets of perma node blobrefs.
+  postings map[string]map[string]bool
+  // The keys are perma node blobrefs. The values are the words currently indexed for the perma node.
+  words map[string][]string
+}
+
+// Creates a full text index for the documents of the indexer and registers it as application indexer.
+// Mutations applied before are not indexed. The indexer may use workers.
+func NewFullTextIndex(indexer *Indexer) *FullTextIndex {
+  idx := &FullTextIndex{indexer: indexer, postings: make(map[string]map[string]bool), words: make(map[string][]string)}
+  indexer.lock()
+  indexer.AddListener(idx)
+  indexer.unlock()
+  return idx
+}
+
+// Implements the ApplicationIndexer interface.
+// The callbacks of the indexer run in order, hence the text read last is the most recent one.
+func (self *FullTextIndex) Mutation(permanode_blobref string, mutation ot.Mutation) {
+  self.indexer.lock()
+  perma, ok := self.indexer.nodes[permanode_blobref].(*PermaNode)
+  ok = ok && perma.ot != nil
+  var text string
+  if ok {
+    text = contentText(perma.ot.Content())
+  }
+  self.indexer.unlock()
+  if !ok {
+    return
+  }
+  words := tokenize(text)
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  self.remove(permanode_blobref)
+  self.add(permanode_blobref, words)
+}
+
+// The full text index is interested in mutations only
+func (self *FullTextIndex) Invitation(permanode_blobref, invitation_blobref string) {
+}
+
+func (self *FullTextIndex) AcceptedInvitation(permanode_blobref, invitation_blobref string, keep_blobref string) {
+}
+
+func (self *FullTextIndex) DeclinedInvitation(permanode_blobref, invitation_blobref string) {
+}
+
+func (self *FullTextIndex) NewFollower(permanode_blobref string, invitation_blobref, keep_blobref, userid string) {
+}
+
+func (self *FullTextIndex) ExpelledFollower(permanode_blobref string, permission_blobref, userid string) {
+}
+
+func (self *FullTextIndex) LeftPermaNode(permanode_blobref string) {
+}
+
+func (self *FullTextIndex) PermaNode(permanode_blobref string, mimetype string, invitation_blobref, keep_blobref string) {
+}
+
+func (self *FullTextIndex) Permission(permanode_blobref string, action int, permission ot.Permission) {
+}
+
+func (self *FullTextIndex) Synced(permanode_blobref string) {
+}
+
+func (self *FullTextIndex) MutationRejected(permanode_blobref, mutation_blobref string, reason string) {
+}
+
+func (self *FullTextIndex) DroppedBlob(blobref string, reason string) {
+}
+
+func (self *FullTextIndex) LocalMutationApplied(permanode_blobref, mutation_blobref string, transformed ot.Mutation) {
+}
+
+// Returns the blobrefs of all perma nodes which contain all words of the query.
+func (self *FullTextIndex) Search(query string) []string {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  var result map[string]bool
+  for _, word := range tokenize(query) {
+    perma_blobrefs := self.postings[word]
+    if result == nil {
+      result = make(map[string]bool)
+      for perma_blobref, _ := range perma_blobrefs {
+	result[perma_blobref] = true
+      }
+      continue
+    }
+    for perma_blobref, _ := range result {
+      if !perma_blobrefs[perma_blobref] {
+	result[perma_blobref] = false, false
+      }
+    }
+  }
+  list := []string{}
+  for perma_blobref, _ := range result {
+    list = append(list, perma_blobref)
+  }
+  sort.Strings(list)
+  return list
+}
+
+func (self *FullTextIndex) add(perma_blobref string, words []string) {
+  for _, word := range words {
+    p, ok := self.postings[word]
+    if !ok {
+      p = make(map[string]bool)
+      self.postings[word] = p
+    }
+    p[perma_blobref] = true
+  }
+  self.words[perma_blobref] = words
+}
+
+func (self *FullTextIndex) remove(perma_blobref string) {
+  for _, word := range self.words[perma_blobref] {
+    p := self.postings[word]
+    p[perma_blobref] = false, false
+    if len(p) == 0 {
+      self.postings[word] = nil, false
+    }
+  }
+  self.words[perma_blobref] = nil, false
+}
+
+// Extracts the text of a document
+func contentText(content interface{}) string {
+  switch content.(type) {
+  case *ot.SimpleText:
+    return content.(*ot.SimpleText).Text
+  case string:
+    return content.(string)
+  }
+  return ""
+}
+
+// Splits the text in lower case words. Each word is returned only once.
+func tokenize(text string) (words []string) {
+  f := func(c int) bool {
+    return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+  }
+  seen := make(map[string]bool)
+  for _, word := range strings.FieldsFunc(strings.ToLower(text), f) {
+    if !seen[word] {
+      seen[word] = true
+      words = append(words, word)
+    }
+  }
+  return
+}
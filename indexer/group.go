@@ -0,0 +1,131 @@
+package lightwaveidx
+
+import (
+  "log"
+  "os"
+  "strings"
+)
+
+// -----------------------------------------------------
+// Groups
+//
+// The target user of a permission may be a group instead of a single user.
+// A target of the form "@team.example.com" denotes a group whose members are determined
+// by the GroupResolver of the indexer. A target of the form "*@example.com" denotes all
+// users of the domain example.com and needs no resolver.
+// Group membership is recorded in blobs, such that all replicas decide alike no matter what
+// their resolvers say. Inviting a group invites each member of the group with a permission blob
+// of its own, which names the group. A member accepts the invitation by a keep which references
+// the invitation of the member. When a user joins or leaves a group, the user who invited the group
+// invites the new member or expels the former member, see GroupMembershipChanged.
+// Permissions granted to a user explicitly take precedence over those of a domain wildcard,
+// such that a single member of the domain can be restricted.
+
+type GroupResolver interface {
+  // Returns true if the user belongs to the group
+  IsMember(userid string, group string) bool
+  // Returns the members of the group. Invitations of the group are issued to these users.
+  // Returns nil if the members cannot be enumerated.
+  Members(group string) []string
+}
+
+// Returns true if the permission target denotes a group or all users of a domain.
+func IsGroupTarget(target string) bool {
+  return strings.HasPrefix(target, "@") || strings.HasPrefix(target, "*@")
+}
+
+// Without a resolver, groups have no members. Domain wildcards work nevertheless.
+func (self *Indexer) SetGroupResolver(resolver GroupResolver) {
+  self.lock()
+  self.groups = resolver
+  self.unlock()
+}
+
+// Returns true if the permission target is the user or a domain wildcard matching the user.
+// The members of a group are not targets of the group invitation, but of their own invitations.
+func (self *Indexer) isTarget(target, userid string) bool {
+  if target == userid {
+    return true
+  }
+  if strings.HasPrefix(target, "*@") {
+    return strings.HasSuffix(userid, target[1:])
+  }
+  return false
+}
+
+// Returns the users to whom an invitation of the target must be forwarded.
+// The invitation of a group is not forwarded, because its members receive invitations of their own.
+func (self *Indexer) targetUsers(target string) []string {
+  if !IsGroupTarget(target) {
+    return []string{target}
+  }
+  if self.groups == nil || strings.HasPrefix(target, "@") {
+    return nil
+  }
+  return self.groups.Members(target)
+}
+
+// Invites the members of the group on behalf of the group invitation.
+// The member invitations have the same dependencies as the group invitation.
+// Returns the first error but invites the remaining members nevertheless.
+func (self *Indexer) inviteMembers(perma_blobref string, dependencies []string, group string, allow int) (err os.Error) {
+  self.lock()
+  resolver := self.groups
+  self.unlock()
+  if resolver == nil {
+    return nil
+  }
+  for _, userid := range resolver.Members(group) {
+    if _, e := self.createPermissionBlob(perma_blobref, dependencies, userid, allow, 0, PermAction_Invite, group); e != nil && err == nil {
+      err = e
+    }
+  }
+  return
+}
+
+// Informs the indexer that a user joined or left a group.
+// For each perma node on which the local user invited the group, a new member is invited with the
+// permissions of the group and a member who left is expelled, provided that the local user
+// has the permission to do so. Until then, the membership change has no effect on the permissions.
+func (self *Indexer) GroupMembershipChanged(group string, userid string, member bool) {
+  if !member {
+    log.Printf("User %v left the group %v\n", userid, group)
+  }
+  type change struct {
+    perma string
+    frontier []string
+    allow int
+  }
+  var changes []change
+  self.lock()
+  for _, n := range self.nodes {
+    perma, ok := n.(*PermaNode)
+    if !ok || perma.ot == nil {
+      continue
+    }
+    allow, ok := perma.ot.permissions[group]
+    if !ok || !perma.ot.hasInvitation(self.userID, group, "") {
+      continue
+    }
+    if member {
+      if _, granted := perma.ot.permissions[userid]; granted || !perma.HasPermission(self.userID, Perm_Invite) {
+	continue
+      }
+    } else {
+      if !perma.ot.hasInvitation("", userid, group) || !perma.HasPermission(self.userID, Perm_Expel) || perma.ot.permissions[userid] == 0 {
+	continue
+      }
+    }
+    changes = append(changes, change{perma: perma.BlobRef(), frontier: perma.ot.Frontier().IDs(), allow: allow})
+  }
+  self.unlock()
+  for _, c := range changes {
+    action := PermAction_Invite
+    if !member {
+      action = PermAction_Expel
+    }
+    if _, err := self.createPermissionBlob(c.perma, c.frontier, userid, c.allow, 0, action, group); err != nil {
+      log.Printf("Err: Failed updating the members of %v on %v: %v\n", group, c.perma, err)
+    }
+  }
+}
@@ -25,11 +25,72 @@ type otHistory struct {
   // The current content of the document
   // TODO: This is a LARGE data structure. Do not keep it in memory ...
   content interface{}
+  // The current permissions and the current owner
+  permissionState
+  // The keys are blobrefs of applied permission nodes. The values are the permissions
+  // before the node has been applied. They allow computing the permissions at the causal past of a new node.
+  before map[string]*permissionState
+  // The keys are userids. The values are the frontiers of the blobs signed by the respective user.
+  // These are the parts of the history which the user is known to have seen.
+  known map[string]ot.Frontier
+  // Summary of the blobs that have been removed from the beginning of the history
+  checkpoint checkpoint
+  // The most recent applied mutations and their inverses. The log is not affected by compaction
+  undoLog []undoEntry
+  // The maximum number of entries in the undo log
+  undoWindow int
+}
+
+// The permissions of a perma node at some point of its history
+type permissionState struct {
+  // The keys are userids or group targets. The values are permission bits
   permissions map[string]int
+  // The userid of the owner
+  owner string
+}
+
+func (self *permissionState) copy() *permissionState {
+  result := &permissionState{permissions: make(map[string]int), owner: self.owner}
+  for user, bits := range self.permissions {
+    result.permissions[user] = bits
+  }
+  return result
+}
+
+// Applies the transformed permission node. A transfer makes the target user the owner,
+// all other actions merge the allow and deny bits of the permission into the bits of the target user.
+func (self *permissionState) apply(perm *permissionNode) (err os.Error) {
+  if perm.action == PermAction_Transfer {
+    // The new owner receives all rights. The previous owner keeps the rights
+    // specified by the allow bits of the permission.
+    if self.owner != "" && self.owner != perm.permission.User {
+      self.permissions[self.owner] = perm.permission.Allow
+    }
+    self.permissions[perm.permission.User] = ^0
+    self.owner = perm.permission.User
+    return
+  }
+  bits, _ := self.permissions[perm.permission.User]
+  if bits, err = ot.ExecutePermission(bits, perm.permission); err == nil {
+    self.permissions[perm.permission.User] = bits
+  }
+  return
+}
+
+// A checkpoint summarizes the compacted beginning of the history
+type checkpoint struct {
+  // The number of compacted blobs
+  count int
+  // The content of the document after applying all compacted blobs
+  content interface{}
+  // The keys are the blobrefs of all compacted blobs
+  blobs map[string]bool
+  // The blobrefs of all compacted blobs in the order in which they have been applied
+  order []string
 }
 
 func newOTHistory() *otHistory {
-  return &otHistory{frontier: make(ot.Frontier), members: make(map[string]otNode), permissions:make(map[string]int)}
+  return &otHistory{frontier: make(ot.Frontier), members: make(map[string]otNode), permissionState: permissionState{permissions: make(map[string]int)}, before: make(map[string]*permissionState), known: make(map[string]ot.Frontier), checkpoint: checkpoint{blobs: make(map[string]bool)}, undoWindow: DefaultUndoWindow}
 }
 
 func (self *otHistory) Content() interface{} {
@@ -40,6 +101,9 @@ func (self *otHistory) HasApplied(blobref string) bool {
   if _, ok := self.members[blobref]; ok {
     return true
   }
+  if _, ok := self.checkpoint.blobs[blobref]; ok {
+    return true
+  }
   return false
 }
 
@@ -101,6 +165,17 @@ func (self *otHistory) HistoryBlobRefs(reverse bool) <-chan string {
 }
 
 func (self *otHistory) Apply(newnode otNode) (deps []string, err os.Error) {
+  deps, _, err = self.apply(newnode)
+  return
+}
+
+// Like Apply but returns in addition the blobrefs of the concurrent nodes
+// against which the new node has been transformed, in the order of the history.
+func (self *otHistory) ApplyVerbose(newnode otNode) (deps []string, concurrent []string, err os.Error) {
+  return self.apply(newnode)
+}
+
+func (self *otHistory) apply(newnode otNode) (deps []string, concurrent []string, err os.Error) {
   // The mutation has already been applied?
   if self.HasApplied(newnode.BlobRef()) {
     return
@@ -115,14 +190,52 @@ func (self *otHistory) Apply(newnode otNode) (deps []string, err os.Error) {
     }
   }
   if unsatisfied {
-    return deps, nil
+    return deps, nil, nil
   }
 
+  nodes, prune, err := self.rollback(newnode.Dependencies())
+  if err != nil {
+    return
+  }
+  for _, n := range nodes {
+    if prune[n.BlobRef()] {
+      concurrent = append(concurrent, n.BlobRef())
+    }
+  }
+  
+  // Prune all mutations that have been applied locally but do not belong to the history of the new mutation
+  pnodes, e := pruneSeq(nodes, prune)
+  if e != nil {
+    log.Printf("Prune Error: %v\n", e)
+    err = e
+    return
+  }
+    
+  // Transform 'mut' to apply it locally
+  pnodes = append(pnodes, newnode)
+  for _, n := range nodes {
+    if n.BlobRef() != pnodes[0].BlobRef() {
+      pnodes, _, err = transformSeq(pnodes, n)
+      if err != nil {
+	log.Printf("TRANSFORM ERR: %v", err)
+	return
+      }
+    } else {
+      pnodes = pnodes[1:]
+    }
+  }
+  err = self.appendNode(pnodes[0])
+  return
+}
+
+// Returns the suffix of the history which must be rolled back to apply a node with the given dependencies,
+// oldest first. The keys of 'prune' are the blobrefs of the nodes in the suffix which do not belong
+// to the causal past of the dependencies. All dependencies must have been applied.
+func (self *otHistory) rollback(deps []string) (nodes []otNode, prune map[string]bool, err os.Error) {
   // Find out how far back we have to go in history to find a common anchor point for transformation
-  frontier := self.Frontier()
-  h := ot.NewHistoryGraph(frontier, newnode.Dependencies())
+  h := ot.NewHistoryGraph(self.Frontier(), deps)
   reverse_nodes := []otNode{}
-  prune := map[string]bool{}
+  prune = map[string]bool{}
   // Need to rollback?
   if !h.Test() {
     // Go back in history until our history is equal to (or earlier than) that of 'mut'.
@@ -138,58 +251,195 @@ func (self *otHistory) Apply(newnode otNode) (deps []string, err os.Error) {
 	break
       }
     }
+    // The new blob is concurrent to blobs which have already been compacted?
+    if !h.Test() {
+      err = ErrCompacted
+      return
+    }
   }
 
   // Reverse the mutation history, such that oldest are first in the list.
   // This is ugly but prepending in the above loops is too slow.
-  nodes := make([]otNode, len(reverse_nodes))
+  nodes = make([]otNode, len(reverse_nodes))
   for i := 0; i < len(nodes); i++ {
     nodes[i] = reverse_nodes[len(reverse_nodes) - 1 - i]
   }
-  
-  // Prune all mutations that have been applied locally but do not belong to the history of the new mutation
-  pnodes, e := pruneSeq(nodes, prune)
-  if e != nil {
-    log.Printf("Prune Error: %v\n", e)
-    err = e
-    return
+  return
+}
+
+// Returns the permissions after applying the dependencies and all blobs preceding them, i.e. the
+// permissions at the causal past of a node with these dependencies. All dependencies must have been applied.
+// Blobs which are concurrent to the node do not affect the result. Therefore all replicas compute the same
+// permissions, no matter in which order they applied the blobs. The result must not be modified.
+func (self *otHistory) PermissionsAt(deps []string) (state *permissionState, err os.Error) {
+  nodes, prune, err := self.rollback(deps)
+  if err != nil {
+    return nil, err
   }
-    
-  // Transform 'mut' to apply it locally
-  pnodes = append(pnodes, newnode)
+  if len(prune) == 0 {
+    return &self.permissionState, nil
+  }
+  // Undo the permissions of the rolled back suffix
+  state = &self.permissionState
   for _, n := range nodes {
-    if n.BlobRef() != pnodes[0].BlobRef() {
-      pnodes, _, err = transformSeq(pnodes, n)
-      if err != nil {
-	log.Printf("TRANSFORM ERR: %v", err)
-	return
+    if before, ok := self.before[n.BlobRef()]; ok {
+      state = before
+      break
+    }
+  }
+  // Apply the permissions of the suffix which precede the dependencies, as if the concurrent blobs had never been applied
+  pnodes, err := pruneSeq(nodes, prune)
+  if err != nil {
+    return nil, err
+  }
+  copied := false
+  for _, n := range pnodes {
+    if perm, ok := n.(*permissionNode); ok {
+      if !copied {
+	state = state.copy()
+	copied = true
       }
-    } else {
-      pnodes = pnodes[1:]
+      state.apply(perm)
     }
   }
-  newnode = pnodes[0]
-  
-  // Apply the mutation
+  return
+}
+
+// Appends a node which has already been transformed to the history and updates
+// the content, the frontier and the permissions accordingly.
+func (self *otHistory) appendNode(newnode otNode) (err os.Error) {
+  // Execute the mutation first. If it fails, the history remains untouched
   if mut, ok := newnode.(*mutationNode); ok {
-    mut.mutation.AppliedAt = len(self.appliedBlobs)
+    mut.mutation.AppliedAt = self.checkpoint.count + len(self.appliedBlobs)
+    inverse := self.inverse(mut.mutation)
+    if self.content, err = ot.Execute(self.content, mut.mutation); err != nil {
+      return
+    }
+    self.logUndo(newnode.BlobRef(), mut.mutation, inverse)
   }
   self.appliedBlobs = append(self.appliedBlobs, newnode.BlobRef())
   self.members[newnode.BlobRef()] = newnode
   self.frontier.AddBlob(newnode.BlobRef(), newnode.Dependencies())
+  known, ok := self.known[newnode.Signer()]
+  if !ok {
+    known = make(ot.Frontier)
+    self.known[newnode.Signer()] = known
+  }
+  known.AddBlob(newnode.BlobRef(), newnode.Dependencies())
   
-  if mut, ok := newnode.(*mutationNode); ok {
-    self.content, err = ot.Execute(self.content, mut.mutation)
-  } else if perm, ok := newnode.(*permissionNode); ok {
-    bits, ok := self.permissions[perm.permission.User]
-    if !ok {
-      bits = 0
+  if perm, ok := newnode.(*permissionNode); ok {
+    self.before[perm.BlobRef()] = self.permissionState.copy()
+    err = self.permissionState.apply(perm)
+  }
+  return
+}
+
+// Returns the blobrefs which have not yet been applied
+func (self *otHistory) missing(blobrefs []string) (result []string) {
+  for _, blobref := range blobrefs {
+    if !self.HasApplied(blobref) {
+      result = append(result, blobref)
     }
-    bits, err = ot.ExecutePermission(bits, perm.permission)
-    if err == nil {
-      self.permissions[perm.permission.User] = bits
+  }
+  return
+}
+
+// Returns the blobref of the first applied expel of the user which does not precede or belong to the frontier.
+// Returns an empty string if there is no such expel.
+func (self *otHistory) expelledConcurrently(user string, frontier []string) string {
+  var past map[string]bool
+  for _, blobref := range self.appliedBlobs {
+    perm, ok := self.members[blobref].(*permissionNode)
+    if !ok || perm.action != PermAction_Expel || perm.permission.User != user {
+      continue
+    }
+    if past == nil {
+      past = self.ancestors(frontier)
+    }
+    if !past[blobref] {
+      return blobref
+    }
+  }
+  return ""
+}
+
+// Returns true if the live history contains an invitation of the user on behalf of the group.
+// The group is empty for invitations which have not been issued on behalf of a group.
+// If the signer is not empty, only invitations issued by the signer are considered.
+func (self *otHistory) hasInvitation(signer, userid, group string) bool {
+  for _, blobref := range self.appliedBlobs {
+    perm, ok := self.members[blobref].(*permissionNode)
+    if ok && perm.action == PermAction_Invite && perm.permission.User == userid && perm.group == group && (signer == "" || perm.Signer() == signer) {
+      return true
+    }
+  }
+  return false
+}
+
+// Returns the blobrefs of all blobs in the live history which precede or are part of the frontier.
+func (self *otHistory) ancestors(frontier []string) map[string]bool {
+  result := make(map[string]bool)
+  stack := append([]string{}, frontier...)
+  for len(stack) > 0 {
+    blobref := stack[len(stack) - 1]
+    stack = stack[:len(stack) - 1]
+    if result[blobref] {
+      continue
     }
+    n, ok := self.members[blobref]
+    if !ok { // Compacted already
+      continue
+    }
+    result[blobref] = true
+    stack = append(stack, n.Dependencies()...)
+  }
+  return result
+}
+
+// Removes the longest prefix of the history which is known to all of the specified users.
+// These blobs will never be transformed again, because the users cannot send blobs which are
+// concurrent to them. The removed blobs are summarized in a checkpoint.
+// Returns the number of compacted blobs.
+func (self *otHistory) Compact(users []string) (count int, err os.Error) {
+  var common map[string]bool
+  for _, user := range users {
+    f, ok := self.known[user]
+    if !ok { // Nothing is known about this user
+      return 0, nil
+    }
+    a := self.ancestors(f.IDs())
+    if common == nil {
+      common = a
+      continue
+    }
+    for blobref, _ := range common {
+      if !a[blobref] {
+	common[blobref] = false, false
+      }
+    }
+  }
+  for count < len(self.appliedBlobs) && (common == nil || common[self.appliedBlobs[count]]) {
+    count++
+  }
+  // Compute the content of the checkpoint
+  content := self.checkpoint.content
+  for _, blobref := range self.appliedBlobs[:count] {
+    if mut, ok := self.members[blobref].(*mutationNode); ok {
+      content, err = ot.Execute(content, mut.mutation)
+      if err != nil {
+	return 0, err
+      }
+    }
+  }
+  self.checkpoint.content = content
+  for _, blobref := range self.appliedBlobs[:count] {
+    self.checkpoint.blobs[blobref] = true
+    self.checkpoint.order = append(self.checkpoint.order, blobref)
+    self.members[blobref] = nil, false
+    self.before[blobref] = nil, false
   }
+  self.checkpoint.count += count
+  self.appliedBlobs = self.appliedBlobs[count:]
   return
 }
 
@@ -7,8 +7,10 @@ import (
   "log"
   "os"
   "time"
-  "rand"
-  "fmt"
+  "io"
+  "sort"
+  "strings"
+  "sync"
   lst "container/list"
 )
 
@@ -16,29 +18,97 @@ import (
 // Struct to deserialize any schema blob
 
 type superSchema struct {
-  // Allowed value are "permanode", "mutation", "permission", "keep"
+  // Allowed value are "permanode", "mutation", "permission", "keep", "entity", "delete", "attachment"
   Type    string "type"
   Time    string "t"
   Signer string "signer"
   
   Permission string "permission"
   Action string "action"
-//  Sig    string "sig"
+  // The base64-encoded ed25519 signature, see KeyRing
+  Sig string "sig"
 
   Dependencies []string "dep"
   AppliedAt int "at"
   Site string "site"
+  // Only for mutations copied by Merge. The original mutation and its signer
+  CopyOf string "copyof"
+  Author string "author"
   
   Random string "random"
   PermaNode string "perma"
+  MimeType string "mimetype"
+  // Only for permanodes. If true, the permanode inherits the permissions of its parent
+  // at the frontier of the parent given by the dependencies
+  Inherit bool "inherit"
   
+  // A userid or a group, see IsGroupTarget
   User string "user"
   Allow int "allow"
   Deny int "deny"
+  // Only for permissions. The group on whose behalf the user has been invited or expelled
+  Group string "group"
   
   Operation *ot.Operation "op"
+  // The initial content of an entity
+  Content *json.RawMessage "content"
+  // The blobs to be deleted by a delete blob
+  Blobs []string "blobs"
+  // The binary blob referenced by an attachment blob
+  Blob string "blob"
 }
 
+// -----------------------------------------------------
+// Errors
+//
+// The errors are exported values, such that callers can compare them.
+// Errors found while decoding a schema blob are wrapped in a SchemaError.
+
+var (
+  ErrNotPermanode = os.NewError("Blob is not a permanode")
+  ErrNotPermissionNode = os.NewError("Blob is not a permissionNode")
+  // The perma node referenced by a blob is some other kind of blob
+  ErrBlobNotPermanode = os.NewError("Blob references a blob which is not a permanode")
+  ErrUnknownPermaNode = os.NewError("Unknown perma node")
+  ErrNoFederation = os.NewError("No federation")
+  ErrMalformedTime = os.NewError("Malformed timestamp")
+  ErrMissingSigner = os.NewError("Missing signer")
+  ErrMissingOperation = os.NewError("mutation is lacking an operation")
+  ErrMissingSite = os.NewError("mutation is lacking a site identifier")
+  ErrMissingUser = os.NewError("permission is lacking a target user")
+  ErrUnknownAction = os.NewError("Unknown action type in permission blob")
+  ErrUnknownSchemaType = os.NewError("Unknown schema type")
+  ErrForeignDependency = os.NewError("Dependency belongs to another permanode")
+  ErrCompacted = os.NewError("Blob is concurrent to a compacted part of the history")
+  // Returned by CompactHistory while invited users have not yet accepted or users of a domain wildcard may join
+  ErrPendingInvitations = os.NewError("Cannot compact while users may still join the perma node")
+  ErrRateLimited = os.NewError("Signer exceeded the mutation rate limit")
+  // Returned when the signer of a blob lacks the permission required to issue it
+  ErrPermissionDenied = os.NewError("Permission denied")
+  // Returned when a permission allows bits which the target user has already or denies bits which the user does not have
+  ErrPermissionMasks = os.NewError("Permission masks do not match the permissions at its dependencies")
+  // Wrapped in a SchemaError when the timestamp of a blob exceeds the maximum clock skew. Such blobs are deferred
+  ErrClockSkew = os.NewError("Timestamp of the blob is too far in the future")
+  ErrMissingPermaNode = os.NewError("blob is lacking a permanode")
+  // Returned when applying a blob panicked, for example because a mutation skips past the end of the content
+  ErrMalformedOperation = os.NewError("Operation cannot be applied to the content")
+)
+
+// A schema blob which could not be decoded
+type SchemaError struct {
+  BlobRef string
+  // One of the errors above, for example ErrMissingSigner
+  Err os.Error
+}
+
+func (self *SchemaError) String() string {
+  return self.Err.String() + " (blobref " + self.BlobRef + ")"
+}
+
+// The indexer defers incoming schema blobs which are timestamped more than one day
+// ahead of the local clock, unless SetMaxClockSkew configures another limit.
+const DefaultMaxClockSkew = 24 * 60 * 60
+
 // -----------------------------------------------------
 // Permission bits
 
@@ -86,14 +156,25 @@ type PermaNode struct {
   node
   // The blobref of this node
   blobref string
+  // The mime type of the document. May be empty
+  mimeType string
   // Optional. Contains OT mutations that constitute the content of the document
   ot *otHistory
   // The keys are userids. The values are blobrefs of the keep-blob.
-  // This map contains keeps of foreign users.
-  // The keep of the local user is not stored here.
+  // This map contains the keeps of all users including the local user.
   keeps map[string]string
   // The keys are userids. The values are blobrefs of the keep-blob.
   pendingInvitations map[string]string
+  // True if the local user left the perma node
+  left bool
+  // If true, users without an explicit permission on this node are granted the permissions of the parent node
+  inherit bool
+  // The frontier of the parent at which the permissions are inherited
+  parentDeps []string
+  // The permissions of the parent at parentDeps. Nil unless the node inherits permissions
+  inherited *permissionState
+  // Used to look up the parent node
+  indexer *Indexer
 }
 
 func (self *PermaNode) OT() OTHistory {
@@ -104,11 +185,15 @@ func (self *PermaNode) BlobRef() string {
   return self.blobref
 }
 
+func (self *PermaNode) MimeType() string {
+  return self.mimeType
+}
+
 func (self *PermaNode) FollowersWithPermission(bits int) (users []string) {
   for userid, _ := range self.keeps {
     if self.ot != nil && bits != 0 { // Need to check for special permission bits?
-      if self.signer != userid { // The user is not the owner. Then he needs special permissions
-	allowed, ok := self.ot.permissions[userid]
+      if self.Owner() != userid { // The user is not the owner. Then he needs special permissions
+	allowed, ok := self.grantedPermissions(userid)
 	if !ok {
 	  continue
 	}
@@ -134,14 +219,75 @@ func (self *PermaNode) HasKeep(userid string) bool {
   return ok
 }
 
+// The userid of the current owner. This is the signer of the permaNode
+// unless the ownership has been transferred.
+func (self *PermaNode) Owner() string {
+  if self.ot != nil && self.ot.owner != "" {
+    return self.ot.owner
+  }
+  return self.signer
+}
+
+// True if the node inherits the permissions of its parent node
+func (self *PermaNode) InheritsPermissions() bool {
+  return self.inherit
+}
+
+// Permissions granted to a domain wildcard apply to all users of the domain.
+// If the user has no permission on this node and the node inherits permissions, the permissions of
+// the parent node at the time the node has been created are consulted, i.e. those at the frontier of the
+// parent on which the node depends. The parent in turn may consult its parent.
+// Later changes of the permissions of the parent do not affect the node. Hence all replicas
+// decide alike, no matter when they receive the blobs of the parent.
+// Chains of parents cannot be cyclic, because the blobref of a child depends on the blobref of its parent.
 func (self *PermaNode) HasPermission(userid string, mask int) (ok bool) {
-  if self.Signer() == userid {
+  return self.hasPermissionAt(self.currentPermissions(), userid, mask)
+}
+
+// Like HasPermission, but decides against the permissions of this node at some point of its history, see otHistory.PermissionsAt
+func (self *PermaNode) hasPermissionAt(state *permissionState, userid string, mask int) bool {
+  if state.owner == userid {
     return true
   }
-  if self.ot == nil { // permaNode has no content ?
+  if bits, granted := self.grantedPermissionsAt(state, userid); granted {
+    return bits & mask == mask
+  }
+  if self.inherited == nil {
+    return false
+  }
+  parent, err := self.indexer.permaNode(self.Parent())
+  if err != nil || parent == nil {
     return false
   }
-  return self.ot.HasPermission(userid, mask)
+  return parent.hasPermissionAt(self.inherited, userid, mask)
+}
+
+// The current permissions of this node. Without an OT history, only the signer has permissions
+func (self *PermaNode) currentPermissions() *permissionState {
+  if self.ot != nil {
+    return &self.ot.permissionState
+  }
+  return &permissionState{owner: self.signer}
+}
+
+// Returns the permission bits granted on this node to the user or to the domain wildcards matching the user.
+// Explicit permissions of the user take precedence over those of the wildcards.
+// ok is false if neither the user nor any wildcard matching the user has been granted permissions.
+func (self *PermaNode) grantedPermissions(userid string) (bits int, ok bool) {
+  return self.grantedPermissionsAt(self.currentPermissions(), userid)
+}
+
+func (self *PermaNode) grantedPermissionsAt(state *permissionState, userid string) (bits int, ok bool) {
+  if bits, ok = state.permissions[userid]; ok {
+    return
+  }
+  for target, b := range state.permissions {
+    if strings.HasPrefix(target, "*@") && self.indexer.isTarget(target, userid) {
+      bits |= b
+      ok = true
+    }
+  }
+  return
 }
 
 // All nodes participating in Operational Transformation must implement this interface
@@ -154,12 +300,17 @@ const (
   PermAction_Invite = iota
   PermAction_Expel
   PermAction_Change
+  // Transfers the ownership of the permaNode to the target user.
+  // The allow bits denote the permissions left to the previous owner.
+  PermAction_Transfer
 )
 
 type permissionNode struct {
   node
   permission ot.Permission
   action int
+  // The group on whose behalf the user has been invited or expelled. May be empty
+  group string
 }
 
 func (self *permissionNode) BlobRef() string {
@@ -173,6 +324,9 @@ func (self *permissionNode) Dependencies() []string {
 type mutationNode struct {
   node
   mutation ot.Mutation
+  // Only for copies created by Merge. The blobref and the signer of the original mutation
+  copyOf string
+  author string
 }
 
 func (self *mutationNode) BlobRef() string {
@@ -198,24 +352,104 @@ func (self *keepNode) Dependencies() []string {
   return self.dependencies
 }
 
+// An entity is a part of a perma node, for example a paragraph or a comment.
+// Like keeps, entities are not scoped to positions in the content and need no transformation.
+type entityNode struct {
+  node
+  blobref string
+  dependencies []string
+  mimeType string
+  // The initial content as JSON. May be nil
+  content []byte
+}
+
+func (self *entityNode) BlobRef() string {
+  return self.blobref
+}
+
+func (self *entityNode) Dependencies() []string {
+  return self.dependencies
+}
+
+func (self *entityNode) MimeType() string {
+  return self.mimeType
+}
+
+func (self *entityNode) Content() []byte {
+  return self.content
+}
+
 // ------------------------------------------------------
 // Interfaces
  
 type Federation interface {
   SetIndexer(indexer *Indexer)
   Forward(blobref string, users []string)
+  // Like Forward, but sends many blobs in one go. The blobs are sent in the order given.
+  ForwardBatch(blobrefs []string, users []string)
   DownloadPermaNode(permission_blobref string) os.Error
+  // Downloads the perma node and all perma nodes which are (transitively) linked to it
+  // as children, including their histories.
+  DownloadSubtree(perma_blobref string) os.Error
+  // Asks the user 'from' for the current frontier of the perma node and downloads
+  // all blobs which are not yet in the local store.
+  PullPermaNode(perma_blobref string, from string) os.Error
+  // Asks the other users for a blob which has not arrived although other blobs depend on it.
+  // The blob is stored once it has been received.
+  RequestBlob(blobref string)
 }
 
+// The indexer calls the functions after releasing its mutex, hence they may call the indexer.
 type ApplicationIndexer interface {
   // This function is called when an invitation has been received
   Invitation(permanode_blobref, invitation_blobref string)
   // This function is called when the local user has accepted an invitation
   AcceptedInvitation(permanode_blobref, invitation_blobref string, keep_blobref string)
+  // This function is called when the local user has declined an invitation
+  DeclinedInvitation(permanode_blobref, invitation_blobref string)
   // This function is called when a new user has been added to a perma node.
   NewFollower(permanode_blobref string, invitation_blobref, keep_blobref, userid string)
+  // This function is called when a follower has been expelled from a perma node.
+  // A follower who left the perma node is reported as expelled as well.
+  ExpelledFollower(permanode_blobref string, permission_blobref, userid string)
+  // This function is called when the local user has left a perma node.
+  LeftPermaNode(permanode_blobref string)
   // This function is called when a perma node has been added
-  PermaNode(permanode_blobref string, invitation_blobref, keep_blobref string)
+  PermaNode(permanode_blobref string, mimetype string, invitation_blobref, keep_blobref string)
+  // This function is called when a mutation has been applied.
+  // The mutation passed in the parameter is already transformed
+  Mutation(permanode_blobref string, mutation ot.Mutation)
+  // This function is called when a permission mutation has been applied.
+  // The permission passed in the parameter is already transformed
+  Permission(permanode_blobref string, action int, permission ot.Permission)
+  // This function is called when no blob of the perma node is waiting for other blobs anymore.
+  // It is called again whenever the perma node becomes synced after new blobs arrived.
+  Synced(permanode_blobref string)
+  // This function is called when a mutation signed by the local user has been rejected,
+  // for example because of missing permissions or because it failed validation.
+  // The application should roll back the optimistically applied local change.
+  // A mutation rejected because of the rate limit is handled again later and may still be applied.
+  MutationRejected(permanode_blobref, mutation_blobref string, reason string)
+  // This function is called when a blob has been waiting too long for its dependencies and has been dropped.
+  DroppedBlob(blobref string, reason string)
+  // This function is called when a mutation signed by the local user has been applied, in addition to Mutation.
+  // The mutation passed in the parameter is already transformed. The application can replace
+  // the optimistically applied local change with it.
+  LocalMutationApplied(permanode_blobref, mutation_blobref string, transformed ot.Mutation)
+}
+
+// Application indexers can implement this interface to receive debug information.
+// It is only used if debugging has been enabled with SetDebug.
+type DebugIndexer interface {
+  // This function is called when a node has been applied. The concurrent blobrefs
+  // denote the nodes against which the node has been transformed.
+  Transformed(permanode_blobref string, blobref string, concurrent []string)
+}
+
+// An observer follows the mutations and permissions of a perma node without
+// keeping it. Observers do not show up as followers of the perma node.
+// Every ApplicationIndexer can serve as an Observer as well.
+type Observer interface {
   // This function is called when a mutation has been applied.
   // The mutation passed in the parameter is already transformed
   Mutation(permanode_blobref string, mutation ot.Mutation)
@@ -234,6 +468,9 @@ type Indexer struct {
   // The keys are blobrefs. The value is true if the blob has been successfully processed and
   // false if the blob was rejected for some reason.
   blobs map[string]bool
+  // The blobrefs of blobs which have been rejected for now, because their signer exceeded the
+  // rate limit or their timestamp is too far in the future. Handling them again may succeed.
+  deferredBlobs map[string]bool
   // The blobrefs of blobs that cannot be processed because they depend on
   // another blob that has not yet been indexed.
   waitingBlobs map[string]bool
@@ -244,10 +481,22 @@ type Indexer struct {
   // because they depend on blobs which are not yet indexed.
   // The value is the number of unsatisfied dependencies.
   pendingBlobs map[string]int
+  // The keys are blobrefs of waiting blobs. The values are the keys of the
+  // waitingLists on which the blobs have been listed.
+  waitingDeps map[string][]string
+  // The keys are blobrefs of blobs that wait for other blobs.
+  // The values are the blobrefs of the permaNodes these blobs belong to.
+  waitingRoots map[string]string
+  // The keys are blobrefs of permaNodes. The values are the number of blobs
+  // which belong to the permaNode and wait for other blobs.
+  unsynced map[string]int
   // Keys are blobrefs of permaNodes to which the local user has been invited.
   // The keys are the blobrefs of the invitation.
   // The map holds invitations that have not yet been accepted by the local user.
   openInvitations map[string]string
+  // The keys are blobrefs of keeps issued by the local user for which the
+  // invitation has been accepted and the download of the perma node has been started.
+  acceptedKeeps map[string]bool
   // The keys are blobrefs to permaNodes that are kept by command of a keep.
   // The values are the blobrefs of the respective keep blocks.
   // This list contains only keeps of the local user
@@ -257,13 +506,104 @@ type Indexer struct {
   // 'user@domain' of the local user.
   userID string 
   appIndexers []ApplicationIndexer
+  // The keys are blobrefs of permaNodes. The values are read-only observers of the permaNode.
+  observers map[string][]Observer
+  // The keys are blobrefs of permaNodes. The values are the blobrefs of their child permaNodes.
+  children map[string][]string
+  // The keys are mime types. The values are the blobrefs of the permaNodes of this mime type.
+  mimeTypes map[string][]string
+  // Limits the rate of mutations per signer. May be nil
+  limiter *rateLimiter
+  // Report transformations to the log and to DebugIndexers
+  debug bool
+  // Blobs with a timestamp further in the future (in seconds) are rejected. Zero disables the check
+  maxClockSkew int64
+  // If true, delete blobs do not remove blobs from the store
+  ignoreDeletes bool
+  // Index blobs of different perma nodes in parallel. Nil if blobs are indexed by the caller of HandleBlob
+  workers []*worker
+  // The jobs dispatched to the workers which have not yet completed
+  pending pendingJobs
+  // Guards the maps of the indexer while blobs are being indexed
+  mutex sync.Mutex
+  // Callbacks into the application indexers and observers which have been queued while holding the mutex
+  signals []func()
+  // Runs the queued callbacks in order when the indexer has workers. Nil otherwise
+  notifier *worker
+  // The keys are blobrefs of permaNodes. The values are the recent events of the activity feed
+  activity map[string]*activityLog
+  // The keys are blobrefs of permaNodes. The values are channels of subscribed activity feeds
+  activityStreams map[string][]chan Event
+  activityMutex sync.Mutex
+  // The number of events kept per perma node
+  activityCapacity int
+  // The number of events dropped from full activity feeds
+  activityDropped int64
+  // Produces the random field of new permanodes
+  random *RandomSource
+  // Resolves the members of groups which are the target of a permission. May be nil
+  groups GroupResolver
+  // The keys are blobrefs of waiting blobs. The values are the times in nanoseconds when they started waiting
+  waitingSince map[string]int64
+  // Blobs waiting for longer (in nanoseconds) are stalled
+  stallThreshold int64
+  // The number of recent mutations per perma node which can be undone
+  undoWindow int
+  // The keys are blobrefs of attached binary blobs. The values are the blobrefs of the attachment blobs
+  attachments map[string]string
+  // Blobrefs of binary blobs which have been waiting for their attachment blobs, the oldest first. May contain blobs which no longer wait
+  orphans *lst.List
+  // The maximum number of binary blobs waiting for their attachment blobs
+  maxOrphans int
+  // Blobs waiting for longer (in nanoseconds) request their missing dependencies. Zero disables requests
+  waitTimeout int64
+  // The number of requests after which a waiting blob is dropped. Zero means that blobs are never dropped
+  maxRequests int
+  // The keys are blobrefs of waiting blobs. The values are the number of requests for their dependencies
+  requests map[string]int
+  // Closed by Close to stop the retry loop
+  stop chan bool
+  // Signs created blobs and verifies incoming schema blobs. May be nil
+  keyRing KeyRing
+}
+
+// Configures an indexer. The zero value yields the indexer created by NewIndexer with no workers.
+type IndexerOptions struct {
+  // The number of goroutines indexing blobs, see NewIndexer
+  Workers int
+  // Blobs waiting for longer than the timeout (in nanoseconds) request their missing dependencies
+  // from the federation. The request is repeated whenever the blob has waited for another timeout.
+  // Zero disables the requests.
+  WaitTimeout int64
+  // A blob is dropped when its dependencies are still missing one timeout after the last request.
+  // Zero means that waiting blobs are never dropped.
+  MaxRequests int
+  // If not nil, created schema blobs are signed and incoming schema blobs must carry a valid signature
+  KeyRing KeyRing
 }
 
 // Creates a new indexer for the specified user based on the blob store.
 // The indexer calls the federation object to send messages to other users.
 // Federation may be nil as well.
-func NewIndexer(userid string, store BlobStore, fed Federation) *Indexer {
-  idx := &Indexer{userID: userid, store: store, nodes: make(map[string]interface{}), waitingBlobs: make(map[string]bool), waitingLists: make(map[string]*lst.List), pendingBlobs: make(map[string]int) /* keeps: make(map[string]string) */, openInvitations: make(map[string]string), blobs:make(map[string]bool), fed: fed}
+// If workers is positive, that many goroutines index the blobs of different perma nodes
+// in parallel. Application indexers must then be safe for concurrent use, although the
+// calls concerning one perma node are never concurrent. In this case HandleBlob returns
+// before the blob has been indexed, so store listeners added after the indexer cannot rely
+// on the blob being indexed. Otherwise blobs are indexed by the goroutine which passes them to HandleBlob.
+func NewIndexer(userid string, store BlobStore, fed Federation, workers int) *Indexer {
+  return NewIndexerWithOptions(userid, store, fed, IndexerOptions{Workers: workers})
+}
+
+// Creates a new indexer like NewIndexer. See IndexerOptions.
+func NewIndexerWithOptions(userid string, store BlobStore, fed Federation, options IndexerOptions) *Indexer {
+  workers := options.Workers
+  idx := &Indexer{userID: userid, store: store, nodes: make(map[string]interface{}), waitingBlobs: make(map[string]bool), waitingLists: make(map[string]*lst.List), pendingBlobs: make(map[string]int), waitingDeps: make(map[string][]string), waitingRoots: make(map[string]string), unsynced: make(map[string]int) /* keeps: make(map[string]string) */, openInvitations: make(map[string]string), acceptedKeeps: make(map[string]bool), blobs:make(map[string]bool), deferredBlobs: make(map[string]bool), fed: fed, observers: make(map[string][]Observer), children: make(map[string][]string), mimeTypes: make(map[string][]string), maxClockSkew: DefaultMaxClockSkew, activity: make(map[string]*activityLog), activityCapacity: DefaultActivityCapacity, activityStreams: make(map[string][]chan Event), random: NewRandomSource(), waitingSince: make(map[string]int64), stallThreshold: DefaultStallThreshold, undoWindow: DefaultUndoWindow, attachments: make(map[string]string), maxOrphans: DefaultMaxOrphanBlobs, waitTimeout: options.WaitTimeout, maxRequests: options.MaxRequests, requests: make(map[string]int), stop: make(chan bool), keyRing: options.KeyRing}
+  if workers > 0 {
+    idx.startWorkers(workers)
+  }
+  if idx.waitTimeout > 0 {
+    go idx.retryLoop()
+  }
   store.AddListener(idx)
   if fed != nil {
     fed.SetIndexer(idx)
@@ -275,35 +615,412 @@ func (self *Indexer) AddListener(appIndexer ApplicationIndexer) {
   self.appIndexers = append(self.appIndexers, appIndexer)
 }
 
+// Registers an observer which is informed about all mutations and permissions
+// applied to the perma node. In contrast to a keep, this does not create a blob
+// and the observer is not counted as a follower of the perma node.
+func (self *Indexer) AddObserver(perma_blobref string, observer Observer) {
+  self.lock()
+  defer self.unlock()
+  self.observers[perma_blobref] = append(self.observers[perma_blobref], observer)
+}
+
+func (self *Indexer) RemoveObserver(perma_blobref string, observer Observer) {
+  self.lock()
+  defer self.unlock()
+  // Copy the list, because a notification may be iterating over the current one
+  observers := []Observer{}
+  removed := false
+  for _, o := range self.observers[perma_blobref] {
+    if o == observer && !removed {
+      removed = true
+      continue
+    }
+    observers = append(observers, o)
+  }
+  if len(observers) == 0 {
+    self.observers[perma_blobref] = nil, false
+  } else {
+    self.observers[perma_blobref] = observers
+  }
+}
+
+// Returns true if the perma node is known and none of its blobs is waiting for other blobs.
+func (self *Indexer) IsSynced(perma_blobref string) bool {
+  self.lock()
+  defer self.unlock()
+  if _, ok := self.nodes[perma_blobref]; !ok {
+    return false
+  }
+  _, ok := self.unsynced[perma_blobref]
+  return !ok
+}
+
+// Returns the perma node or nil if it is unknown.
+// The perma node keeps changing while further blobs are indexed.
 func (self *Indexer) PermaNode(blobref string) (perma *PermaNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  return self.permaNode(blobref)
+}
+
+// Like PermaNode. The caller must hold the mutex.
+func (self *Indexer) permaNode(blobref string) (perma *PermaNode, err os.Error) {
   n, ok := self.nodes[blobref]
   if !ok {
     return nil, nil
   }
   perma, ok = n.(*PermaNode)
   if !ok {
-    err = os.NewError("Blob is not a permanode")
+    err = ErrNotPermanode
   }
   return
 }
 
+// Compacts the beginning of the history which is known to all followers of the perma node.
+// Returns the number of compacted blobs.
+// Users who start following after the compaction download the compacted blobs like all others, see ExportBlobs.
+// Their blobs cannot be concurrent to the compacted blobs, because their invitations depend on the frontier at that time.
+// An invited user who has not yet accepted may send blobs concurrent to anything after the invitation, though.
+// Hence the history is not compacted while invitations are pending, see ErrPendingInvitations.
+// With workers, the compaction runs on the worker of the perma node.
+func (self *Indexer) CompactHistory(perma_blobref string) (count int, err os.Error) {
+  self.runOn(perma_blobref, func() {
+    self.lock()
+    defer self.unlock()
+    perma, e := self.permaNode(perma_blobref)
+    if err = e; err != nil || perma == nil || perma.ot == nil {
+      return
+    }
+    // The members of a group receive invitations of their own
+    for target, _ := range perma.pendingInvitations {
+      if !strings.HasPrefix(target, "@") {
+	err = ErrPendingInvitations
+	return
+      }
+    }
+    users := []string{}
+    for userid, _ := range perma.keeps {
+      if userid != self.userID {
+	users = append(users, userid)
+      }
+    }
+    count, err = perma.ot.Compact(users)
+  })
+  return
+}
+
+// Returns the user ID of the local user
+func (self *Indexer) UserID() string {
+  return self.userID
+}
+
+// Returns the blob store whose blobs are indexed
+func (self *Indexer) Store() BlobStore {
+  return self.store
+}
+
+// Enables reporting which concurrent nodes a node has been transformed against.
+func (self *Indexer) SetDebug(debug bool) {
+  self.debug = debug
+}
+
+// Blocks until all blobs stored so far have been indexed.
+// Blobs waiting for blobs which have not yet arrived do not count as pending.
+// For blob stores which do not implement WaitIdle the function returns immediately.
+// Must not be called from within an ApplicationIndexer callback, because it waits for the callback to complete.
+func (self *Indexer) WaitIdle() {
+  if w, ok := self.store.(IdleWaiter); ok {
+    w.WaitIdle()
+  }
+  self.pending.wait()
+}
+
+// Defers blobs whose timestamp is more than 'seconds' ahead of the local clock.
+// They are handled again once the local clock has caught up.
+// Zero disables the check. The default is DefaultMaxClockSkew.
+func (self *Indexer) SetMaxClockSkew(seconds int64) {
+  self.lock()
+  self.maxClockSkew = seconds
+  self.unlock()
+}
+
+// Sets the source and the number of random bytes which make new permanodes unique.
+// A nil source selects crypto/rand. The default length is DefaultRandomLength of the store package.
+func (self *Indexer) SetRandom(source io.Reader, length int) {
+  self.random.Set(source, length)
+}
+
+// Limits the number of mutations each signer can issue per second.
+// Bursts are accepted as long as they do not exceed the burst size.
+// A rate of zero disables the limit, which is the default.
+// Permission and keep blobs are never limited.
+// Mutations exceeding the limit are deferred and handled again once the signer has a token.
+func (self *Indexer) SetMutationRateLimit(rate float64, burst int) {
+  if rate <= 0 {
+    self.limiter = nil
+    return
+  }
+  self.limiter = newRateLimiter(rate, burst)
+}
+
+// Returns the effective permission bits of the user for every perma node
+// which the user keeps or on which the user has been granted permissions.
+// The keys of the result are blobrefs of perma nodes.
+func (self *Indexer) UserPermissions(userid string) map[string]int {
+  self.lock()
+  defer self.unlock()
+  result := make(map[string]int)
+  for _, n := range self.nodes {
+    perma, ok := n.(*PermaNode)
+    if !ok {
+      continue
+    }
+    _, keeps := perma.keeps[userid]
+    _, granted := perma.grantedPermissions(userid)
+    if !keeps && !granted && perma.Owner() != userid {
+      continue
+    }
+    mask := 0
+    for _, bit := range []int{Perm_Read, Perm_Write, Perm_Invite, Perm_Expel} {
+      if perma.HasPermission(userid, bit) {
+	mask |= bit
+      }
+    }
+    result[perma.BlobRef()] = mask
+  }
+  return result
+}
+
+// Returns true if the local user may mutate the perma node.
+// The UI can use this to disable editing instead of creating mutations which are rejected.
+// Returns false if the perma node is unknown.
+func (self *Indexer) CanWrite(perma_blobref string) bool {
+  return self.hasLocalPermission(perma_blobref, Perm_Write)
+}
+
+// Returns true if the local user may invite other users to the perma node.
+func (self *Indexer) CanInvite(perma_blobref string) bool {
+  return self.hasLocalPermission(perma_blobref, Perm_Invite)
+}
+
+// Returns true if the local user may expel other users from the perma node.
+func (self *Indexer) CanExpel(perma_blobref string) bool {
+  return self.hasLocalPermission(perma_blobref, Perm_Expel)
+}
+
+// Returns nil if the user may read the perma node, ErrUnknownPermaNode if the perma node has not been indexed
+// and ErrPermissionDenied otherwise. Unlike HasPermission of the perma node, this takes the mutex, such that it
+// can be called while blobs are being indexed, for example when serving the requests of other servers.
+func (self *Indexer) CheckRead(userid, perma_blobref string) os.Error {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return err
+  }
+  if perma == nil {
+    return ErrUnknownPermaNode
+  }
+  if !perma.HasPermission(userid, Perm_Read) {
+    return ErrPermissionDenied
+  }
+  return nil
+}
+
+// Returns the current owner of the perma node. Like CheckRead, this can be called while blobs are being indexed.
+func (self *Indexer) OwnerOf(perma_blobref string) (string, os.Error) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return "", err
+  }
+  if perma == nil {
+    return "", ErrUnknownPermaNode
+  }
+  return perma.Owner(), nil
+}
+
+func (self *Indexer) hasLocalPermission(perma_blobref string, mask int) bool {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil || perma == nil {
+    return false
+  }
+  return perma.HasPermission(self.userID, mask)
+}
+
+// Returns the blobrefs of the entities of the perma node in the order in which they have been applied.
+// Entities which have been compacted are not included.
+func (self *Indexer) Entities(perma_blobref string) (entities []string) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil || perma == nil || perma.ot == nil {
+    return nil
+  }
+  for _, blobref := range perma.ot.AppliedBlobs() {
+    if _, ok := perma.ot.members[blobref].(*entityNode); ok {
+      entities = append(entities, blobref)
+    }
+  }
+  return
+}
+
+// Returns the causal graph of the perma node. The keys are the blobrefs of all applied nodes,
+// the values are the blobrefs of their dependencies. Compacted nodes are not part of the graph.
+// Returns nil if the perma node is unknown.
+func (self *Indexer) DependencyGraph(perma_blobref string) (graph map[string][]string) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil || perma == nil {
+    return nil
+  }
+  graph = make(map[string][]string)
+  if perma.ot == nil {
+    return
+  }
+  for _, blobref := range perma.ot.AppliedBlobs() {
+    graph[blobref] = append([]string{}, perma.ot.members[blobref].Dependencies()...)
+  }
+  return
+}
+
+// Returns the blobrefs of the keeps of a perma node including the keep of the local user.
+// The keys are userids and the values are the blobrefs of the respective keep.
+// Returns nil if the perma node is unknown.
+func (self *Indexer) Keeps(perma_blobref string) (keeps map[string]string) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil || perma == nil {
+    return nil
+  }
+  keeps = make(map[string]string)
+  for userid, keep_blobref := range perma.keeps {
+    keeps[userid] = keep_blobref
+  }
+  return
+}
+
+// Returns the blobrefs of the perma nodes which are linked to the perma node as children.
+// The result is a copy and can be held while further blobs are indexed.
+func (self *Indexer) Children(perma_blobref string) []string {
+  self.lock()
+  defer self.unlock()
+  return append([]string{}, self.children[perma_blobref]...)
+}
+
+// Returns the blobrefs of all perma nodes of the mime type in the order in which they have been indexed.
+// This allows hosts of several applications to dispatch each document to the right editor.
+// The result is a copy and can be held while further blobs are indexed.
+func (self *Indexer) PermanodesByMimeType(mimetype string) []string {
+  self.lock()
+  defer self.unlock()
+  return append([]string{}, self.mimeTypes[mimetype]...)
+}
+
+// Returns the blobrefs of all perma nodes which the local user keeps, sorted by blobref.
+// The result is a copy and can be held while further blobs are indexed.
+func (self *Indexer) MyPermaNodes() (blobrefs []string) {
+  self.lock()
+  defer self.unlock()
+  for blobref, n := range self.nodes {
+    if perma, ok := n.(*PermaNode); ok && perma.HasKeep(self.userID) {
+      blobrefs = append(blobrefs, blobref)
+    }
+  }
+  sort.Strings(blobrefs)
+  return
+}
+
+// An invitation of the local user which has neither been accepted nor declined.
+type Invitation struct {
+  PermaBlobRef string
+  // The blobref of the permission blob which invited the local user
+  BlobRef string
+}
+
+// Returns the open invitations of the local user, sorted by the blobref of the perma node.
+// The result is a copy and can be held while further blobs are indexed.
+func (self *Indexer) Invitations() (invitations []Invitation) {
+  self.lock()
+  defer self.unlock()
+  perma_blobrefs := make([]string, 0, len(self.openInvitations))
+  for perma_blobref, _ := range self.openInvitations {
+    perma_blobrefs = append(perma_blobrefs, perma_blobref)
+  }
+  sort.Strings(perma_blobrefs)
+  for _, perma_blobref := range perma_blobrefs {
+    invitations = append(invitations, Invitation{PermaBlobRef: perma_blobref, BlobRef: self.openInvitations[perma_blobref]})
+  }
+  return
+}
+
+// Returns the permission which authorized the keep of the user and the signer of that permission.
+// Together with the keep of the inviter this yields the chain of trust of a follower.
+// Returns false if the user does not keep the perma node or keeps it without an invitation,
+// which is the case for the signer of the perma node.
+func (self *Indexer) KeepAuthorization(perma_blobref, userid string) (permission_blobref, inviter string, ok bool) {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil || perma == nil {
+    return "", "", false
+  }
+  keep, ok := self.nodes[perma.keeps[userid]].(*keepNode)
+  if !ok || keep.permission == "" {
+    return "", "", false
+  }
+  perm, err := self.permission(keep.permission)
+  if err != nil || perm == nil {
+    return "", "", false
+  }
+  return perm.BlobRef(), perm.Signer(), true
+}
+
 func (self *Indexer) Permission(blobref string) (permission *permissionNode, err os.Error) {
+  self.lock()
+  defer self.unlock()
+  return self.permission(blobref)
+}
+
+// Like Permission. The caller must hold the mutex.
+func (self *Indexer) permission(blobref string) (permission *permissionNode, err os.Error) {
   n, ok := self.nodes[blobref]
   if !ok {
     return nil, nil
   }
   permission, ok = n.(*permissionNode)
   if !ok {
-    err = os.NewError("Blob is not a permissionNode")
+    err = ErrNotPermissionNode
   }
   return
 }
 
-func (self *Indexer) enqueue(blobref string, deps []string) {
+// Lets the blob wait until all of its dependencies have been indexed.
+// Dependencies which are indexed already are not waited for, because they will not be dequeued again.
+func (self *Indexer) enqueue(perma_blobref string, blobref string, deps []string) {
+  // A blob which is enqueued again waits for the new dependencies only
+  self.unlist(blobref)
   // Remember the blob
   self.waitingBlobs[blobref] = true
+  if _, ok := self.waitingSince[blobref]; !ok {
+    self.waitingSince[blobref] = nanoClock()
+  }
+  // The permaNode is no longer synced
+  if _, ok := self.waitingRoots[blobref]; !ok {
+    self.waitingRoots[blobref] = perma_blobref
+    self.unsynced[perma_blobref]++
+  }
   // For which other blob is 'blobref' waiting?
+  listed := []string{}
   for _, dep := range deps {
+    if _, ok := self.nodes[dep]; ok || containsString(listed, dep) {
+      continue
+    }
     // Remember that someone is waiting on 'dep'
     l, ok := self.waitingLists[dep]
     if !ok {
@@ -311,8 +1028,54 @@ func (self *Indexer) enqueue(blobref string, deps []string) {
       self.waitingLists[dep] = l
     }
     l.PushBack(blobref)
+    listed = append(listed, dep)
+  }
+  self.waitingDeps[blobref] = listed
+  self.pendingBlobs[blobref] = len(listed)
+}
+
+// Removes the blob from all waitingLists it has been listed on. Empty lists are deleted.
+func (self *Indexer) unlist(blobref string) {
+  for _, dep := range self.waitingDeps[blobref] {
+    l, ok := self.waitingLists[dep]
+    if !ok {
+      continue
+    }
+    for e := l.Front(); e != nil; {
+      next := e.Next()
+      if e.Value.(string) == blobref {
+	l.Remove(e)
+      }
+      e = next
+    }
+    if l.Len() == 0 {
+      self.waitingLists[dep] = nil, false
+    }
+  }
+  self.waitingDeps[blobref] = nil, false
+}
+
+// Forgets that the blob is waiting, for example because it has been rejected.
+func (self *Indexer) forgetWaiting(blobref string) {
+  self.unlist(blobref)
+  self.pendingBlobs[blobref] = 0, false
+  self.waitingBlobs[blobref] = false, false
+  self.waitingSince[blobref] = 0, false
+  self.requests[blobref] = 0, false
+  if root, ok := self.waitingRoots[blobref]; ok {
+    self.waitingRoots[blobref] = "", false
+    self.unsynced[root]--
+    self.checkSynced(root)
+  }
+}
+
+func containsString(list []string, str string) bool {
+  for _, s := range list {
+    if s == str {
+      return true
+    }
   }
-  self.pendingBlobs[blobref] = len(deps)
+  return false
 }
 
 func (self *Indexer) dequeue(waitFor string) (blobrefs []string) {
@@ -324,49 +1087,91 @@ func (self *Indexer) dequeue(waitFor string) (blobrefs []string) {
       self.pendingBlobs[waiting_id]--
       // The waiting mutation is no waiting for anything anymore -> return it
       if self.pendingBlobs[waiting_id] == 0 {
+	self.unlist(waiting_id)
 	self.pendingBlobs[waiting_id] = 0, false
 	blobrefs = append(blobrefs, waiting_id)
 	self.waitingBlobs[waiting_id] = false, false
+	self.waitingSince[waiting_id] = 0, false
+	self.requests[waiting_id] = 0, false
       }
     }
   }
   return
 }
 
+// Returns the node described by the schema blob. Errors are of type *SchemaError.
 func (self *Indexer) decodeNode(schema *superSchema, blobref string) (result interface{}, err os.Error) {
+  defer func() {
+    if err != nil {
+      result, err = nil, &SchemaError{BlobRef: blobref, Err: err}
+    }
+  }()
   if schema.Signer == "" {
-    return nil, os.NewError("Missing signer")
+    return nil, ErrMissingSigner
   }
-  var tstruct *time.Time
-  tstruct, err = time.Parse(time.RFC3339, schema.Time)
-  if err != nil || tstruct == nil {
-    return
+  tstruct, e := time.Parse(time.RFC3339, schema.Time)
+  if e != nil || tstruct == nil {
+    return nil, ErrMalformedTime
   }
   t := tstruct.Seconds()
+  if self.maxClockSkew > 0 && t > time.Seconds() + self.maxClockSkew {
+    return nil, ErrClockSkew
+  }
   switch schema.Type {
   case "keep":
     n := &keepNode{blobref: blobref, node: node{time:t, signer: schema.Signer, parent: schema.PermaNode}, dependencies: schema.Dependencies, permission: schema.Permission}
     return n, nil
+  case "entity":
+    if schema.PermaNode == "" {
+      err = ErrMissingPermaNode
+      return
+    }
+    n := &entityNode{blobref: blobref, node: node{time:t, signer: schema.Signer, parent: schema.PermaNode}, dependencies: schema.Dependencies, mimeType: schema.MimeType}
+    if schema.Content != nil {
+      n.content = []byte(*schema.Content)
+    }
+    return n, nil
+  case "delete":
+    if schema.PermaNode == "" {
+      err = ErrMissingPermaNode
+      return
+    }
+    n := &deleteNode{blobref: blobref, node: node{time:t, signer: schema.Signer, parent: schema.PermaNode}, dependencies: schema.Dependencies, blobs: schema.Blobs}
+    return n, nil
+  case "attachment":
+    if schema.PermaNode == "" {
+      err = ErrMissingPermaNode
+      return
+    }
+    if schema.Blob == "" {
+      err = ErrMissingBlob
+      return
+    }
+    n := &attachmentNode{blobref: blobref, node: node{time:t, signer: schema.Signer, parent: schema.PermaNode}, dependencies: schema.Dependencies, blob: schema.Blob, mimeType: schema.MimeType}
+    return n, nil
   case "permanode":
-    n := &PermaNode{blobref: blobref, node: node{time:t, signer: schema.Signer, parent: schema.PermaNode}, keeps: make(map[string]string), pendingInvitations: make(map[string]string)}
+    n := &PermaNode{blobref: blobref, mimeType: schema.MimeType, node: node{time:t, signer: schema.Signer, parent: schema.PermaNode}, keeps: make(map[string]string), pendingInvitations: make(map[string]string), inherit: schema.Inherit, parentDeps: schema.Dependencies, indexer: self}
     return n, nil
   case "mutation":
     if schema.Operation == nil {
-      err = os.NewError("mutation is lacking an operation")
+      err = ErrMissingOperation
       return
     }
     if schema.Site == "" {
-      err = os.NewError("mutation is lacking a site identifier")
+      err = ErrMissingSite
+      return
     }
     n := &mutationNode{node: node{time:t, signer: schema.Signer, parent: schema.PermaNode}}
     n.mutation.Operation = *schema.Operation
     n.mutation.ID = blobref
     n.mutation.Site = schema.Site
     n.mutation.Dependencies = schema.Dependencies
+    n.copyOf = schema.CopyOf
+    n.author = schema.Author
     return n, nil
   case "permission":
     if schema.User == "" {
-      err = os.NewError("permission is lacking a target user")
+      err = ErrMissingUser
       return
     }
     n := &permissionNode{node: node{time:t, signer: schema.Signer, parent: schema.PermaNode}}
@@ -375,6 +1180,7 @@ func (self *Indexer) decodeNode(schema *superSchema, blobref string) (result int
     n.permission.User = schema.User
     n.permission.Allow = schema.Allow
     n.permission.Deny = schema.Deny
+    n.group = schema.Group
     switch schema.Action {
     case "invite":
       n.action = PermAction_Invite
@@ -382,29 +1188,85 @@ func (self *Indexer) decodeNode(schema *superSchema, blobref string) (result int
       n.action = PermAction_Expel
     case "change":
       n.action = PermAction_Change
+    case "transfer":
+      n.action = PermAction_Transfer
     default:
-      err = os.NewError("Unknown action type in permission blob")
+      err = ErrUnknownAction
       return
     }
     return n, nil    
   default:
     log.Printf("Unknown schema type")
   }
-  return nil, os.NewError("Unknown schema type")
+  return nil, ErrUnknownSchemaType
 }
 
-func (self *Indexer) HandleBlob(blob []byte, blobref string) {
+// Implements the BlobStoreListener interface.
+// Returns ErrBlobRejected if the blob could not be applied to its perma node and
+// ErrBlobDeferred if the blob has been rejected for now, because its signer exceeded the rate limit
+// or its timestamp is too far in the future. Permission checks are decided at the causal past of a blob,
+// hence a blob denied by them is rejected no matter in which order the blobs arrived.
+// With workers, the blob is queued at the worker of its perma node and is never rejected,
+// because the verdict is not known when HandleBlob returns.
+// Blobs which have been handled before, for example before a snapshot has been taken, are skipped.
+// Deferred blobs are handled again.
+func (self *Indexer) HandleBlob(blob []byte, blobref string) (err os.Error) {
+  self.lock()
+  if self.deferredBlobs[blobref] {
+    self.deferredBlobs[blobref] = false, false
+    self.blobs[blobref] = false, false
+  }
+  applied, handled := self.blobs[blobref]
+  _, waiting := self.waitingBlobs[blobref]
+  self.unlock()
+  if handled && !applied {
+    return ErrBlobRejected
+  } else if handled || waiting {
+    return
+  }
+  if self.workers != nil {
+    self.dispatch(permaOf(blob, blobref), indexJob{blob: blob, blobref: blobref})
+    return
+  }
+  self.lock()
+  defer self.unlock()
+  self.handleBlob(blob, blobref)
+  if self.deferredBlobs[blobref] {
+    return ErrBlobDeferred
+  }
+  if applied, ok := self.blobs[blobref]; ok && !applied {
+    return ErrBlobRejected
+  }
+  return
+}
+
+// The caller must hold the mutex
+func (self *Indexer) handleBlob(blob []byte, blobref string) {
+  // Has this blob been waiting for other blobs? Then it is handled now
+  root, waiting := self.waitingRoots[blobref]
+  if waiting {
+    self.waitingRoots[blobref] = "", false
+    self.unsynced[root]--
+    defer self.checkSynced(root)
+  }
   var signer string
   var perma *PermaNode
   // First, determine the mimetype
   mimetype := MimeType(blob)
   if mimetype == "application/x-lightwave-schema" { // Is it a schema blob?
     var processed bool
-    if perma, signer, processed = self.handleSchemaBlob(blob, blobref); !processed {
+    if perma, signer, processed = self.handleSchemaBlob(blob, blobref, waiting); !processed {
+      // A rejected blob does not wait for anything
+      if !self.waitingBlobs[blobref] {
+	self.forgetWaiting(blobref)
+      }
       return
     }
   } else {
-    // TODO: Handle ordinary binary blobs
+    var processed bool
+    if perma, signer, processed = self.handleBinaryBlob(blob, blobref); !processed {
+      return
+    }
   }
     
   // Forward the blob to all followers
@@ -419,17 +1281,107 @@ func (self *Indexer) HandleBlob(blob []byte, blobref string) {
   self.blobs[blobref] = true
     
   // Did other blobs wait on this one?
-  for _, dep := range self.dequeue(blobref) {
-    b, err := self.store.GetBlob(dep)
-    if err != nil {
-      log.Printf("Failed retrieving blob: %v\n", err)
+  deps := self.dequeue(blobref)
+  // Did the attached binary blob wait for this attachment?
+  if att, ok := self.nodes[blobref].(*attachmentNode); ok {
+    deps = append(deps, self.dequeue(attachmentKey(att.blob))...)
+    if orphan := self.orphanOf(att); orphan != "" {
+      deps = append(deps, orphan)
+    }
+  }
+  if self.workers != nil {
+    for _, dep := range deps {
+      self.dispatch(self.waitingRoots[dep], indexJob{blobref: dep})
+    }
+    return
+  }
+  if len(deps) == 0 {
+    return
+  }
+  blobs, err := self.store.GetBlobsByRef(deps)
+  if err != nil {
+    log.Printf("Failed retrieving blobs: %v\n", err)
+    return
+  }
+  for _, dep := range deps {
+    b, ok := blobs[dep]
+    if !ok {
+      log.Printf("Failed retrieving blob %v\n", dep)
       continue
     }
-    self.HandleBlob(b, dep)
+    self.handleBlob(b, dep)
+  }
+}
+
+// Signals the application when the last waiting blob of the perma node has been handled
+func (self *Indexer) checkSynced(perma_blobref string) {
+  if self.unsynced[perma_blobref] != 0 {
+    return
+  }
+  self.unsynced[perma_blobref] = 0, false
+  if _, ok := self.nodes[perma_blobref]; !ok {
+    return
   }
+  self.notifyApps(func(app ApplicationIndexer) {
+    app.Synced(perma_blobref)
+  })
+}
+
+// Queues a call of f for each application indexer, see signal.
+// A panicking application indexer is logged and does not affect the remaining
+// application indexers or the processing of further blobs.
+func (self *Indexer) notifyApps(f func(app ApplicationIndexer)) {
+  apps := self.appIndexers
+  self.signal(func() {
+    for _, app := range apps {
+      func() {
+	defer func() {
+	  if r := recover(); r != nil {
+	    log.Printf("Err: Application indexer panicked: %v\n", r)
+	  }
+	}()
+	f(app)
+      }()
+    }
+  })
+}
+
+func (self *Indexer) lock() {
+  self.mutex.Lock()
 }
 
-func (self *Indexer) handleSchemaBlob(blob []byte, blobref string) (perma *PermaNode, signer string, processed bool) {
+// Releases the mutex and then invokes all queued callbacks.
+// Callbacks run outside of the critical section, hence they may call back into the indexer.
+// With workers, the callbacks run on the notifier in the order in which they have been queued,
+// such that a callback can wait for a worker without blocking it.
+func (self *Indexer) unlock() {
+  signals := self.signals
+  self.signals = nil
+  self.mutex.Unlock()
+  if len(signals) == 0 {
+    return
+  }
+  if self.notifier != nil {
+    self.pending.add()
+    self.notifier.push(indexJob{f: func() {
+      for _, f := range signals {
+	f()
+      }
+    }})
+    return
+  }
+  for _, f := range signals {
+    f()
+  }
+}
+
+// Queues a callback until the mutex is released. Must be called while holding the mutex.
+func (self *Indexer) signal(f func()) {
+  self.signals = append(self.signals, f)
+}
+
+// The parameter 'retry' is true if the blob has been handled before but had to wait for other blobs.
+func (self *Indexer) handleSchemaBlob(blob []byte, blobref string, retry bool) (perma *PermaNode, signer string, processed bool) {
   // Try to decode it into a camli-store schema blob
   var schema superSchema
   err := json.Unmarshal(blob, &schema)
@@ -437,33 +1389,82 @@ func (self *Indexer) handleSchemaBlob(blob []byte, blobref string) (perma *Perma
     log.Printf("Malformed schema blob: %v\n", err)
     return nil, "", false
   }
+  // Blobs which had to wait have been verified before
+  if self.keyRing != nil && !retry {
+    if err = self.verifyBlob(blob, &schema); err != nil {
+      log.Printf("Err: %v\nsigner=%v blobref=%v\n", err, schema.Signer, blobref)
+      self.blobs[blobref] = false
+      return nil, "", false
+    }
+  }
 
   newnode, err := self.decodeNode(&schema, blobref)
   if err != nil {
     log.Printf("Schema blob is not valid: %v\n", err)
+    if e, ok := err.(*SchemaError); ok && e.Err == ErrClockSkew {
+      // Retry once the local clock has caught up, but at least every maxDeferDelay
+      t, _ := time.Parse(time.RFC3339, schema.Time)
+      delay := t.Seconds() - self.maxClockSkew - time.Seconds() + 1
+      if delay > maxDeferDelay / 1e9 {
+	delay = maxDeferDelay / 1e9
+      }
+      self.deferBlob(blobref, delay * 1e9)
+    }
     return nil, "", false
   }
   ptr := newnode.(abstractNode)
   signer = ptr.Signer()
+  // Too many mutations of this signer? Blobs which had to wait have been counted before.
+  if _, ok := newnode.(*mutationNode); ok && !retry && self.limiter != nil && !self.limiter.allow(signer) {
+    log.Printf("Err: %v\nsigner=%v blobref=%v\n", ErrRateLimited, signer, blobref)
+    self.rejectMutation(ptr.Parent(), newnode, ErrRateLimited)
+    self.deferBlob(blobref, self.limiter.delay(signer))
+    return nil, "", false
+  }
   // The node is linked to another permaNode?
   if ptr.Parent() != "" {
     p, ok := self.nodes[ptr.Parent()]
-    if !ok { // The other permaNode is not yet applied? -> enqueue
-      self.enqueue(blobref, []string{ptr.Parent()})
-      return nil, "", false
-    }
-    if perma, ok = p.(*PermaNode); !ok {
-      log.Printf("The specified node is not a perma node")
+    if !ok {
+      // A child perma node which does not inherit permissions does not need its parent,
+      // which the local user may not be allowed to read
+      if child, isPerma := newnode.(*PermaNode); !isPerma || child.inherit { // The other permaNode is not yet applied? -> enqueue
+	self.enqueue(ptr.Parent(), blobref, []string{ptr.Parent()})
+	return nil, "", false
+      }
+    } else if perma, ok = p.(*PermaNode); !ok {
+      log.Printf("Err: %v\nblobref=%v\n", ErrBlobNotPermanode, blobref)
       return nil, "", false
     }
   }
   switch newnode.(type) {
   case *PermaNode:
+    // The inherited permissions are known once the frontier of the parent has been applied
+    if child := newnode.(*PermaNode); child.inherit && perma != nil {
+      if child.inherited, err = self.inheritedPermissions(perma, child); err != nil {
+	log.Printf("Err: %v\nblobref=%v\n", err, blobref)
+	return nil, "", false
+      }
+      if child.inherited == nil {
+	return nil, "", false
+      }
+    }
     perma = newnode.(*PermaNode)
     self.nodes[blobref] = newnode
+    if perma.Parent() != "" {
+      self.children[perma.Parent()] = append(self.children[perma.Parent()], blobref)
+    }
+    if perma.MimeType() != "" {
+      self.mimeTypes[perma.MimeType()] = append(self.mimeTypes[perma.MimeType()], blobref)
+    }
     log.Printf("Added a permanode successfully")
     processed = true
     return
+  case *deleteNode:
+    processed = self.handleDelete(perma, newnode.(*deleteNode))
+    return
+  case *attachmentNode:
+    processed = self.handleAttachment(perma, newnode.(*attachmentNode))
+    return
   case otNode:
     if perma == nil {
       log.Printf("Permission or mutation without a permanode")
@@ -471,14 +1472,45 @@ func (self *Indexer) handleSchemaBlob(blob []byte, blobref string) (perma *Perma
     }
     if perma.ot == nil {
       perma.ot = newOTHistory()
+      perma.ot.undoWindow = self.undoWindow
       // The owner of the permanode has all the rights on it
       perma.ot.permissions[perma.signer] = ^0
+      perma.ot.owner = perma.signer
+    }
+    // All dependencies must be nodes of the same permanode
+    if err = self.checkDependencies(perma, newnode.(otNode)); err != nil {
+      log.Printf("Err: %v\nblobref=%v\n", err, blobref)
+      self.rejectMutation(perma.BlobRef(), newnode, err)
+      return nil, "", false
+    }
+    // The permission must fit the permissions at its causal past
+    if perm, ok := newnode.(*permissionNode); ok && self.hasApplied(perma, perm.Dependencies()) {
+      if err = self.checkPermission(perma, perm); err != nil {
+	log.Printf("Err: %v\nsigner=%v blobref=%v\n", err, signer, blobref)
+	self.rejectMutation(perma.BlobRef(), newnode, err)
+	return nil, "", false
+      }
+    }
+    // Only users with write permission can mutate the content. The owner always passes.
+    // The permissions are those at the causal past of the mutation, such that a concurrent change of the
+    // permissions does not reject the mutation on some replicas only. They are known once all
+    // blobs preceding the mutation have been applied.
+    if mut, ok := newnode.(*mutationNode); ok && self.hasApplied(perma, mut.Dependencies()) {
+      state, err := perma.ot.PermissionsAt(mut.Dependencies())
+      if err == nil && !perma.hasPermissionAt(state, signer, Perm_Write) {
+	err = ErrPermissionDenied
+      }
+      if err != nil {
+	log.Printf("Err: %v\nsigner=%v blobref=%v\n", err, signer, blobref)
+	self.rejectMutation(perma.BlobRef(), newnode, err)
+	return nil, "", false
+      }
     }
     // Is this an invitation? Then we cannot apply it, because most data is missing.
-    if inv, ok := newnode.(*permissionNode); ok && inv.action == PermAction_Invite && inv.permission.User == self.userID && !self.hasBlobs(inv.Dependencies()) {
+    if inv, ok := newnode.(*permissionNode); ok && inv.action == PermAction_Invite && self.isTarget(inv.permission.User, self.userID) && !self.hasBlobs(inv.Dependencies()) {
       processed = self.handleInvitation(perma, inv)
       // Do not apply the blob here. We must first download all the data
-      self.enqueue(blobref, inv.Dependencies())
+      self.enqueue(perma.BlobRef(), blobref, inv.Dependencies())
       return
     } else if keep, ok := newnode.(*keepNode); ok {
       processed = self.checkKeep(perma, keep)
@@ -487,17 +1519,26 @@ func (self *Indexer) handleSchemaBlob(blob []byte, blobref string) (perma *Perma
 	return
       }
     }
-    deps, err := perma.ot.Apply(newnode.(otNode))
+    deps, concurrent, err := self.apply(perma, newnode.(otNode))
     if err != nil {
       log.Printf("Err: applying blob failed: %v\nblobref=%v\n", err, blobref)
+      self.rejectMutation(perma.BlobRef(), newnode, err)
       return nil, "", false
     }
     if len(deps) > 0 {
-      self.enqueue(blobref, deps)
+      self.enqueue(perma.BlobRef(), blobref, deps)
       return nil, "", false
     }
     self.nodes[blobref] = newnode
     log.Printf("Applied blob %v at %v\n", ptr.BlobRef(), self.userID)
+    if self.debug && len(concurrent) > 0 {
+      log.Printf("Transformed %v against %v\n", blobref, concurrent)
+      self.notifyApps(func(app ApplicationIndexer) {
+	if d, ok := app.(DebugIndexer); ok {
+	  d.Transformed(perma.BlobRef(), blobref, concurrent)
+	}
+      })
+    }
 
     processed = true
     if _, ok := newnode.(*permissionNode); ok {
@@ -507,6 +1548,7 @@ func (self *Indexer) handleSchemaBlob(blob []byte, blobref string) (perma *Perma
     } else if _, ok := newnode.(*mutationNode); ok {
       processed = self.HandleMutation(perma, newnode.(*mutationNode))
     }
+    // Entities need no further handling
     return
   }
 
@@ -514,45 +1556,200 @@ func (self *Indexer) handleSchemaBlob(blob []byte, blobref string) (perma *Perma
   return nil, "", false
 }
 
+// Returns the permissions of the parent at the frontier on which the child depends.
+// Returns nil and enqueues the child if the frontier has not yet been applied.
+func (self *Indexer) inheritedPermissions(parent *PermaNode, child *PermaNode) (*permissionState, os.Error) {
+  if parent.ot == nil {
+    if len(child.parentDeps) > 0 {
+      self.enqueue(parent.BlobRef(), child.BlobRef(), child.parentDeps)
+      return nil, nil
+    }
+    return parent.currentPermissions(), nil
+  }
+  if deps := parent.ot.missing(child.parentDeps); len(deps) > 0 {
+    self.enqueue(parent.BlobRef(), child.BlobRef(), deps)
+    return nil, nil
+  }
+  state, err := parent.ot.PermissionsAt(child.parentDeps)
+  if err != nil {
+    return nil, err
+  }
+  return state.copy(), nil
+}
+
+// Checks whether all blobs have been applied to the OT history of the perma node.
+func (self *Indexer) hasApplied(perma *PermaNode, blobrefs []string) bool {
+  for _, blobref := range blobrefs {
+    if !perma.ot.HasApplied(blobref) {
+      return false
+    }
+  }
+  return true
+}
+
+// Applies the node to the OT history of the perma node. The caller must hold the mutex.
+func (self *Indexer) apply(perma *PermaNode, node otNode) (deps []string, concurrent []string, err os.Error) {
+  // A structurally valid operation may still panic deep inside OT.
+  // This must not bring down the goroutine which indexes the blobs
+  defer func() {
+    if r := recover(); r != nil {
+      log.Printf("Err: Applying blob %v panicked: %v\n", node.BlobRef(), r)
+      deps, concurrent, err = nil, nil, ErrMalformedOperation
+    }
+  }()
+  return perma.ot.ApplyVerbose(node)
+}
+
+// Records that the blob has been rejected and informs the application indexers if a mutation
+// of the local user has been rejected. Mutations of other users are only logged.
+func (self *Indexer) rejectMutation(perma_blobref string, node interface{}, err os.Error) {
+  self.blobs[node.(abstractNode).BlobRef()] = false
+  mut, ok := node.(*mutationNode)
+  if !ok || mut.Signer() != self.userID {
+    return
+  }
+  self.notifyApps(func(app ApplicationIndexer) {
+    app.MutationRejected(perma_blobref, mut.BlobRef(), err.String())
+  })
+}
+
+// Checks a permission against the permissions at its causal past, such that all replicas come to the same verdict.
+// The masks must have been normalized like those of CreatePermissionBlob, i.e. the permission allows only bits
+// which the target user does not yet have and denies only bits which the user has.
+// Only the permissions of users who have been granted permissions before can be changed.
+// Only users with Perm_Expel can expel other users and the owner cannot be expelled.
+// Only the owner at the causal past of a transfer can transfer the ownership.
+// All dependencies of the permission must have been applied.
+func (self *Indexer) checkPermission(perma *PermaNode, perm *permissionNode) os.Error {
+  state, err := perma.ot.PermissionsAt(perm.Dependencies())
+  if err != nil {
+    return err
+  }
+  // Only the owner can transfer the ownership
+  if perm.action == PermAction_Transfer {
+    if perm.Signer() != state.owner {
+      log.Printf("Err: Only the owner can transfer the ownership of a permanode\n")
+      return ErrPermissionDenied
+    }
+    return nil
+  }
+  bits, granted := state.permissions[perm.permission.User]
+  if perm.action == PermAction_Change && !granted {
+    log.Printf("Err: Cannot change the permissions of %v who has no permissions\n", perm.permission.User)
+    return ErrPermissionDenied
+  }
+  if perm.action == PermAction_Expel {
+    if perm.permission.User == state.owner {
+      log.Printf("Err: The owner %v cannot be expelled\n", perm.permission.User)
+      return ErrPermissionDenied
+    }
+    // Expelling other users requires the permission to do so. Users can expel themselves without it, see Leave.
+    if perm.permission.User != perm.Signer() && !perma.hasPermissionAt(state, perm.Signer(), Perm_Expel) {
+      return ErrPermissionDenied
+    }
+    // An expel denies all bits of the user
+    if perm.permission.Allow != 0 || perm.permission.Deny != bits {
+      return ErrPermissionMasks
+    }
+  }
+  if perm.permission.Allow & bits != 0 || perm.permission.Deny &^ bits != 0 {
+    return ErrPermissionMasks
+  }
+  return nil
+}
+
 func (self *Indexer) handleInvitation(perma *PermaNode, perm *permissionNode) bool {
   log.Printf("Handling invitation at %v\n", self.userID)
   self.openInvitations[perma.BlobRef()] = perm.BlobRef()
   // Signal to the next layer that an invitation has been received
-  for _, app := range self.appIndexers {
+  self.notifyApps(func(app ApplicationIndexer) {
     app.Invitation(perma.BlobRef(), perm.BlobRef())
-  }
+  })
   return true
 }
 
 func (self *Indexer) HandleMutation(perma *PermaNode, mut *mutationNode) bool {
-  for _, app := range self.appIndexers {
+  if perma.left {
+    log.Printf("Ignoring mutation %v, because the local user left the perma node\n", mut.BlobRef())
+    return true
+  }
+  self.recordEvent(perma.BlobRef(), Event{Kind: Event_Mutation, Actor: mut.Signer(), Time: mut.Timestamp(), BlobRef: mut.BlobRef()})
+  self.notifyApps(func(app ApplicationIndexer) {
     app.Mutation(perma.BlobRef(), mut.mutation)
+  })
+  if mut.Signer() == self.userID {
+    self.notifyApps(func(app ApplicationIndexer) {
+      app.LocalMutationApplied(perma.BlobRef(), mut.BlobRef(), mut.mutation)
+    })
   }
+  observers := self.observers[perma.BlobRef()]
+  self.signal(func() {
+    for _, o := range observers {
+      o.Mutation(perma.BlobRef(), mut.mutation)
+    }
+  })
   return true
 }
 
 func (self *Indexer) handlePermission(perma *PermaNode, perm *permissionNode) bool {
   switch perm.action {
   case PermAction_Change:
-    // TODO
+    // The allow and deny bits of the transformed permission have already been merged into the
+    // permissions of the user when the blob has been applied
+    log.Printf("Permissions of user %v have been changed\n", perm.permission.User)
   case PermAction_Expel:
-    // TODO
+    // The user is no longer a follower. Forget the keep and a pending invitation
+    // of the user, such that the user can be invited again later.
+    user := perm.permission.User
+    _, follower := perma.keeps[user]
+    // Expelling a user who has not yet accepted the invitation revokes the invitation.
+    // A keep of the user arriving later is rejected by checkKeep unless it depends on the expel.
+    _, invited := perma.pendingInvitations[user]
+    perma.keeps[user] = "", false
+    perma.pendingInvitations[user] = "", false
+    // The expel has denied all bits of the user when it has been applied. The explicit empty permission of the user
+    // overrides those granted to a group of the user or inherited from the parent.
+    // Hence no further blobs are forwarded to the user. An invitation grants new rights.
+    log.Printf("User %v has been expelled\n", user)
+    // The expelled user learns about the expulsion, although FollowersWithPermission no longer lists the user
+    if users := self.targetUsers(user); (follower || invited) && user != self.userID && self.fed != nil && perm.Signer() == self.userID && len(users) > 0 {
+      self.fed.Forward(perm.BlobRef(), users)
+    }
+    if user == self.userID && perm.Signer() == self.userID {
+      perma.left = true
+      self.notifyApps(func(app ApplicationIndexer) {
+	app.LeftPermaNode(perma.BlobRef())
+      })
+    } else if follower {
+      self.notifyApps(func(app ApplicationIndexer) {
+	app.ExpelledFollower(perma.BlobRef(), perm.BlobRef(), user)
+      })
+    }
+  case PermAction_Transfer:
+    log.Printf("User %v is the new owner\n", perm.permission.User)
   case PermAction_Invite:
     // Add the invitation to remember that this user has been invited.
     perma.pendingInvitations[perm.permission.User] = perm.BlobRef()
     log.Printf("User %v has been invited\n", perm.permission.User)
-    // Forward the invitation to the user being invited
-    if self.fed != nil && perm.Signer() == self.userID {
-      self.fed.Forward(perm.BlobRef(), []string{perm.permission.User})
-      // Forward the permanode to the invited user as well
-      self.fed.Forward(perma.BlobRef(), []string{perm.permission.User})
+    self.recordEvent(perma.BlobRef(), Event{Kind: Event_Invitation, Actor: perm.Signer(), Time: perm.Timestamp(), BlobRef: perm.BlobRef(), User: perm.permission.User})
+    // Forward the invitation to the user being invited or to the members of the group
+    if users := self.targetUsers(perm.permission.User); self.fed != nil && perm.Signer() == self.userID && len(users) > 0 {
+      self.fed.Forward(perm.BlobRef(), users)
+      // Forward the permanode to the invited users as well
+      self.fed.Forward(perma.BlobRef(), users)
     }
   default:
     panic("Unknown action type")
   }
-  for _, app := range self.appIndexers {
+  self.notifyApps(func(app ApplicationIndexer) {
     app.Permission(perma.BlobRef(), perm.action, perm.permission)
-  }  
+  })
+  observers := self.observers[perma.BlobRef()]
+  self.signal(func() {
+    for _, o := range observers {
+      o.Permission(perma.BlobRef(), perm.action, perm.permission)
+    }
+  })
   return true
 }
 
@@ -566,17 +1763,20 @@ func (self *Indexer) checkKeep(perma *PermaNode, keep *keepNode) bool {
     }
     
     // The local user accepted the invitation?
-    if keep.Signer() == self.userID {
+    // The keep may be checked multiple times while it is waiting for the permission.
+    // Download and signal only once.
+    if keep.Signer() == self.userID && !self.acceptedKeeps[keep.BlobRef()] {
+      self.acceptedKeeps[keep.BlobRef()] = true
       if self.fed != nil {
-	go self.fed.DownloadPermaNode(keep.permission)
+	go self.downloadAcceptedPermaNode(perma.BlobRef(), keep.permission)
       }
-      for _, app := range self.appIndexers {
+      self.notifyApps(func(app ApplicationIndexer) {
 	app.AcceptedInvitation(perma.BlobRef(), keep.permission, keep.BlobRef())
-      }
+      })
     }
 
     var err os.Error
-    perm, err := self.Permission(keep.permission)
+    perm, err := self.permission(keep.permission)
     // Not an invitation?
     if err != nil {
       log.Printf("Err: Keep references a permision that is something else or malformed")
@@ -585,13 +1785,23 @@ func (self *Indexer) checkKeep(perma *PermaNode, keep *keepNode) bool {
     // Permission has not yet been received or processed? -> enqueue
     if perm == nil {
       log.Printf("Waiting for permission cited by the keep")
-      self.enqueue(keep.BlobRef(), []string{keep.permission})
+      self.enqueue(perma.BlobRef(), keep.BlobRef(), []string{keep.permission})
+      return false
+    }
+    // The invitation has been revoked by an expel of which the keep does not know? Then the expel wins.
+    // An expel arriving after the keep removes the keep. Hence all replicas agree regardless of the arrival order.
+    if missing := perma.ot.missing(keep.Dependencies()); len(missing) > 0 {
+      self.enqueue(perma.BlobRef(), keep.BlobRef(), missing)
+      return false
+    }
+    if expel := perma.ot.expelledConcurrently(keep.Signer(), keep.Dependencies()); expel != "" {
+      log.Printf("Err: Keep references an invitation which has been revoked by %v\n", expel)
       return false
     }
-    // TODO: Is the permission still valid or has it been overruled?
     
-    // The invitation has indeed been issued for the user who issued the keep? If not -> error
-    if perm.permission.User != keep.Signer() {
+    // The invitation has indeed been issued for the user who issued the keep
+    // or for a group of this user? If not -> error
+    if !self.isTarget(perm.permission.User, keep.Signer()) {
       log.Printf("Err: Keep references an invitation targeted at a different user")
       return false
     }    
@@ -599,6 +1809,44 @@ func (self *Indexer) checkKeep(perma *PermaNode, keep *keepNode) bool {
   return true
 }
 
+// Fetches the blobs which have been missed while the local user was offline from the user 'from'.
+// In contrast to Forward, this does not rely on the other side keeping a queue for the local user.
+// All perma nodes kept by the local user are pulled. Returns the first error but pulls
+// the remaining perma nodes nevertheless.
+func (self *Indexer) Pull(from string) (err os.Error) {
+  if self.fed == nil {
+    return ErrNoFederation
+  }
+  permas := []string{}
+  self.lock()
+  for blobref, n := range self.nodes {
+    if perma, ok := n.(*PermaNode); ok && perma.HasKeep(self.userID) {
+      permas = append(permas, blobref)
+    }
+  }
+  self.unlock()
+  for _, blobref := range permas {
+    if e := self.fed.PullPermaNode(blobref, from); e != nil {
+      log.Printf("Err: Failed pulling perma node %v: %v\n", blobref, e)
+      if err == nil {
+	err = e
+      }
+    }
+  }
+  return
+}
+
+// Downloads the perma node to which the local user has been invited and all its children
+func (self *Indexer) downloadAcceptedPermaNode(perma_blobref, permission_blobref string) {
+  if err := self.fed.DownloadPermaNode(permission_blobref); err != nil {
+    log.Printf("Err: Failed downloading perma node: %v\n", err)
+    return
+  }
+  if err := self.fed.DownloadSubtree(perma_blobref); err != nil {
+    log.Printf("Err: Failed downloading the children of the perma node: %v\n", err)
+  }
+}
+
 func (self *Indexer) handleKeep(perma *PermaNode, keep *keepNode) bool {
   log.Printf("Handling Keep from %v at %v\n", keep.Signer(), self.userID)
   var perm *permissionNode
@@ -606,21 +1854,30 @@ func (self *Indexer) handleKeep(perma *PermaNode, keep *keepNode) bool {
   // In this case he must present a valid invitation
   if keep.Signer() != perma.Signer() {
     var err os.Error
-    perm, err = self.Permission(keep.permission)
+    perm, err = self.permission(keep.permission)
     if err != nil || perm == nil {  // Problem already catched at checkKeep 
       panic("Keep references a permision that is something else or malformed")
     }
   }
 
+  // The user keeps the permaNode already? Then the new keep changes nothing.
+  if _, ok := perma.keeps[keep.Signer()]; ok {
+    log.Printf("The user %v keeps the perma node already\n", keep.Signer())
+    return true
+  }
   // Does this implicitly accept a pending invitation? Clean it up.
   if _, ok := perma.pendingInvitations[keep.Signer()]; ok {
     perma.pendingInvitations[keep.Signer()] = "", false
   }
   // This keep is new. The permaNode has a new user.
   perma.keeps[keep.Signer()] = keep.BlobRef()
+  // The local user follows the perma node again after leaving it?
+  if keep.Signer() == self.userID {
+    perma.left = false
+  }
 
   // This implies accepting an invitation?
-  if perm != nil && perm.permission.User == self.userID {
+  if perm != nil && keep.Signer() == self.userID {
     // Send the keep (which accepts the invitation) to the signer of the invitation
     if self.fed != nil && keep.Signer() != self.userID {
       self.fed.Forward(keep.BlobRef(), []string{keep.Signer()})
@@ -628,16 +1885,17 @@ func (self *Indexer) handleKeep(perma *PermaNode, keep *keepNode) bool {
     self.openInvitations[perma.BlobRef()] = "", false
     log.Printf("The local user accepted the invitation\n")
     // Signal this to the application
-    for _, app := range self.appIndexers {
-      app.PermaNode(perma.BlobRef(), perm.BlobRef(), keep.BlobRef())
-    }
+    self.notifyApps(func(app ApplicationIndexer) {
+      app.PermaNode(perma.BlobRef(), perma.MimeType(), perm.BlobRef(), keep.BlobRef())
+    })
   } else {
     if perm != nil {
       log.Printf("The user %v accepted the invitation\n", keep.Signer())
+      self.recordEvent(perma.BlobRef(), Event{Kind: Event_NewFollower, Actor: keep.Signer(), Time: keep.Timestamp(), BlobRef: keep.BlobRef(), User: perm.permission.User})
       // Signal this to the application
-      for _, app := range self.appIndexers {
+      self.notifyApps(func(app ApplicationIndexer) {
 	app.NewFollower(perma.BlobRef(), perm.BlobRef(), keep.BlobRef(), perm.permission.User)
-      }
+      })
       // Send this user all blobs of the local user that are not in the other user's frontier yet.
       if perma.ot != nil && self.fed != nil {
 	frontier := perma.ot.Frontier()
@@ -652,7 +1910,7 @@ func (self *Indexer) handleKeep(perma *PermaNode, keep *keepNode) bool {
 		forwards = append(forwards, history_node.BlobRef())
               // Send keeps that rely on a permission given by the local user
 	      } else if k, ok := x.(*keepNode); ok && k.permission != "" {
-		if p, e := self.Permission(k.permission); e == nil && p != nil && p.Signer() == self.userID {
+		if p, e := self.permission(k.permission); e == nil && p != nil && p.Signer() == self.userID {
 		  forwards = append(forwards, history_node.BlobRef())		  
 		}
 	      }
@@ -662,39 +1920,93 @@ func (self *Indexer) handleKeep(perma *PermaNode, keep *keepNode) bool {
 	    }
 	  }
 	}
-	for _, f := range forwards {
-	  self.fed.Forward(f, []string{keep.Signer()})
+	if len(forwards) > 0 {
+	  self.fed.ForwardBatch(forwards, []string{keep.Signer()})
 	}
       }
     } else {
       log.Printf("The user %v keeps his own perma node\n", keep.Signer())
       // Signal this to the application
-      for _, app := range self.appIndexers {
-	app.PermaNode(perma.BlobRef(), "", keep.BlobRef())
-      }
+      self.notifyApps(func(app ApplicationIndexer) {
+	app.PermaNode(perma.BlobRef(), perma.MimeType(), "", keep.BlobRef())
+      })
     }
   }
   return true
 }
 
+// Checks that all dependencies of the node which have already been indexed belong to the same permanode.
+// Dependencies which are not yet indexed are checked when the node is handled again after they arrived.
+func (self *Indexer) checkDependencies(perma *PermaNode, node otNode) os.Error {
+  for _, dep := range node.Dependencies() {
+    n, ok := self.nodes[dep]
+    if !ok {
+      continue
+    }
+    if ptr, ok := n.(abstractNode); !ok || ptr.Parent() != perma.BlobRef() {
+      return ErrForeignDependency
+    }
+  }
+  return nil
+}
+
+// Checks whether all blobs are in the blob store
 func (self *Indexer) hasBlobs(blobrefs []string) bool {
   for _, blobref := range blobrefs {
-    _, ok := self.nodes[blobref]
-    if !ok {
+    if !self.store.HasBlob(blobref) {
       return false
     }
   }
   return true
 }
 
-func (self *Indexer) CreatePermaBlob() (blobref string, err os.Error) {
-  permaJson := map[string]interface{}{ "signer": self.userID, "random":fmt.Sprintf("%v", rand.Int63()), "t":"2006-01-02T15:04:05+07:00"}
-  // TODO: Get time correctly
+// Returns the current time in seconds since the epoch. Tests can replace it with a fake clock.
+var clock = time.Seconds
+
+// Returns the current time in nanoseconds since the epoch. Tests can replace it with a fake clock.
+var nanoClock = time.Nanoseconds
+
+// Returns the current time in the format of the "t" property of schema blobs.
+func nowRFC3339() string {
+  return time.SecondsToUTC(clock()).Format(time.RFC3339)
+}
+
+func (self *Indexer) CreatePermaBlob(mimeType string) (blobref string, err os.Error) {
+  return self.CreateChildPermaBlob("", mimeType, false)
+}
+
+// Creates a permanode which is a child of the parent permanode.
+// If 'inherit' is true, the child inherits the current permissions of the parent, see PermaNode.HasPermission.
+func (self *Indexer) CreateChildPermaBlob(parent_blobref string, mimeType string, inherit bool) (blobref string, err os.Error) {
+  random, err := self.random.Next()
+  if err != nil {
+    return "", err
+  }
+  permaJson := map[string]interface{}{ "signer": self.userID, "random":random, "t":nowRFC3339()}
+  if mimeType != "" {
+    permaJson["mimetype"] = mimeType
+  }
+  if parent_blobref != "" {
+    permaJson["perma"] = parent_blobref
+  }
+  if inherit {
+    permaJson["inherit"] = true
+    self.runOn(parent_blobref, func() {
+      self.lock()
+      defer self.unlock()
+      if parent, e := self.permaNode(parent_blobref); e == nil && parent != nil && parent.ot != nil {
+	permaJson["dep"] = parent.ot.Frontier().IDs()
+      }
+    })
+  }
   permaBlob, err := json.Marshal(permaJson)
   if err != nil {
     panic(err.String())
   }
   permaBlob = append([]byte(`{"type":"permanode",`), permaBlob[1:]...)
+  if permaBlob, err = self.signBlob(permaBlob); err != nil {
+    return "", err
+  }
   log.Printf("Storing perma %v\n", string(permaBlob))
   permaBlobRef := NewBlobRef(permaBlob)
   self.store.StoreBlob(permaBlob, permaBlobRef)
@@ -704,25 +2016,55 @@ func (self *Indexer) CreatePermaBlob() (blobref string, err os.Error) {
 // The parameter 'permission_blobref' may be empty if the keep is from the same user that created the permaNode
 func (self *Indexer) CreateKeepBlob(perma_blobref, permission_blobref string) (blobref string, err os.Error) {
   // Create a keep on the permaNode.
-  keepJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": []string{permission_blobref}, "t":"2006-01-02T15:04:05+07:00"}
+  keepJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": []string{permission_blobref}, "t":nowRFC3339()}
   if permission_blobref != "" {
     keepJson["permission"] = permission_blobref
   }
-  // TODO: Get time correctly
   keepBlob, err := json.Marshal(keepJson)
   if err != nil {
     panic(err.String())
   }
   keepBlob = append([]byte(`{"type":"keep",`), keepBlob[1:]...)
+  if keepBlob, err = self.signBlob(keepBlob); err != nil {
+    return "", err
+  }
   log.Printf("Storing keep %v\n", string(keepBlob))
   keepBlobRef := NewBlobRef(keepBlob)
   self.store.StoreBlob(keepBlob, keepBlobRef)
   return keepBlobRef, nil
 }
 
+// Creates a permission for the target user. Unless the action is a transfer, the masks are normalized against the
+// permissions of the user at the dependencies: Bits which the user has already are not allowed again and bits
+// which the user does not have are not denied. An expel denies all bits of the user, the masks passed in are ignored.
+// The masks are taken as they are if the dependencies have not yet been indexed.
+// Inviting a group invites the members of the group as well, see GroupResolver.
 func (self *Indexer) CreatePermissionBlob(perma_blobref string, dependencies []string, userid string, allow int, deny int, action int) (blobref string, err os.Error) {
-  permJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": dependencies, "t":"2006-01-02T15:04:05+07:00", "user": userid, "allow":allow, "deny": deny}
-  // TODO: Get time correctly
+  if blobref, err = self.createPermissionBlob(perma_blobref, dependencies, userid, allow, deny, action, ""); err != nil {
+    return
+  }
+  if action == PermAction_Invite && strings.HasPrefix(userid, "@") {
+    err = self.inviteMembers(perma_blobref, dependencies, userid, allow)
+  }
+  return
+}
+
+// Like CreatePermissionBlob. The group is recorded in the blob if the user is invited or expelled on behalf of a group
+func (self *Indexer) createPermissionBlob(perma_blobref string, dependencies []string, userid string, allow int, deny int, action int, group string) (blobref string, err os.Error) {
+  if action != PermAction_Transfer {
+    if state := self.permissionsAt(perma_blobref, dependencies); state != nil {
+      bits := state.permissions[userid]
+      allow &^= bits
+      deny &= bits
+      if action == PermAction_Expel && userid != state.owner {
+	allow, deny = 0, bits
+      }
+    }
+  }
+  permJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": dependencies, "t":nowRFC3339(), "user": userid, "allow":allow, "deny": deny}
+  if group != "" {
+    permJson["group"] = group
+  }
   switch action {
   case PermAction_Invite:
     permJson["action"] = "invite"
@@ -730,6 +2072,8 @@ func (self *Indexer) CreatePermissionBlob(perma_blobref string, dependencies []s
     permJson["action"] = "expel"
   case PermAction_Change:
     permJson["action"] = "change"
+  case PermAction_Transfer:
+    permJson["action"] = "transfer"
   default:
     panic("Unknown action")
   }
@@ -738,16 +2082,67 @@ func (self *Indexer) CreatePermissionBlob(perma_blobref string, dependencies []s
     panic(err.String())
   }
   permBlob = append([]byte(`{"type":"permission",`), permBlob[1:]...)
+  if permBlob, err = self.signBlob(permBlob); err != nil {
+    return "", err
+  }
   log.Printf("Storing perm %v\n", string(permBlob))
   permBlobRef := NewBlobRef(permBlob)
   self.store.StoreBlob(permBlob, permBlobRef)
   return permBlobRef, nil
 }
 
+// Returns the permissions of the perma node at the causal past of a blob with the given dependencies.
+// Returns nil if the perma node or some dependency has not yet been indexed.
+func (self *Indexer) permissionsAt(perma_blobref string, deps []string) (state *permissionState) {
+  self.runOn(perma_blobref, func() {
+    self.lock()
+    defer self.unlock()
+    perma, err := self.permaNode(perma_blobref)
+    if err != nil || perma == nil {
+      return
+    }
+    if perma.ot == nil {
+      state = perma.currentPermissions()
+      return
+    }
+    if !self.hasApplied(perma, deps) {
+      return
+    }
+    if s, err := perma.ot.PermissionsAt(deps); err == nil {
+      state = s.copy()
+    }
+  })
+  return
+}
+
+// Creates an entity of the perma node. The content is the initial content of the entity.
+func (self *Indexer) CreateEntityBlob(perma_blobref string, dependencies []string, mimetype string, content string) (blobref string, err os.Error) {
+  entityJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": dependencies, "t":nowRFC3339(), "mimetype": mimetype, "content": content}
+  entityBlob, err := json.Marshal(entityJson)
+  if err != nil {
+    panic(err.String())
+  }
+  entityBlob = append([]byte(`{"type":"entity",`), entityBlob[1:]...)
+  if entityBlob, err = self.signBlob(entityBlob); err != nil {
+    return "", err
+  }
+  log.Printf("Storing entity %v\n", string(entityBlob))
+  entityBlobRef := NewBlobRef(entityBlob)
+  self.store.StoreBlob(entityBlob, entityBlobRef)
+  return entityBlobRef, nil
+}
+
 func (self *Indexer) CreateMutationBlob(perma_blobref string, mut ot.Mutation) (blobref string, err os.Error) {
+  return self.createMutationBlob(perma_blobref, mut, nil)
+}
+
+// Like CreateMutationBlob, but adds the fields to the blob
+func (self *Indexer) createMutationBlob(perma_blobref string, mut ot.Mutation, fields map[string]interface{}) (blobref string, err os.Error) {
   // TODO: Site should go away
-  mutJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": mut.Dependencies, "t":"2006-01-02T15:04:05+07:00", "site": mut.Site}
-  // TODO: Get time correctly
+  mutJson := map[string]interface{}{ "signer": self.userID, "perma":perma_blobref, "dep": mut.Dependencies, "t":nowRFC3339(), "site": mut.Site}
+  for key, value := range fields {
+    mutJson[key] = value
+  }
   schema, err := json.Marshal(mutJson)
   if err != nil {
     panic(err.String())
@@ -759,6 +2154,9 @@ func (self *Indexer) CreateMutationBlob(perma_blobref string, mut ot.Mutation) (
   mutBlob := append([]byte(`{"type":"mutation","op":`), op...)
   mutBlob = append(mutBlob, ',')
   mutBlob = append(mutBlob, schema[1:]...)
+  if mutBlob, err = self.signBlob(mutBlob); err != nil {
+    return "", err
+  }
   log.Printf("Storing mut %v\n", string(mutBlob))
   mutBlobRef := NewBlobRef(mutBlob)
   self.store.StoreBlob(mutBlob, mutBlobRef)
@@ -780,6 +2178,10 @@ func transformSeq(nodes []otNode, node otNode) (tnodes []otNode, tnode otNode, e
   return
 }
 
+// Transforms two concurrent nodes against each other.
+// Permissions always refer to the perma node as a whole and never to a position in its content.
+// Therefore, permissions and mutations commute and need no transformation against each other.
+// Should permissions ever be scoped to entities or positions, they must be transformed against mutations here.
 func transform(node1 otNode, node2 otNode) (tnode1, tnode2 otNode, err os.Error) {
   tnode1 = node1
   tnode2 = node2
@@ -792,15 +2194,15 @@ func transform(node1 otNode, node2 otNode) (tnode1, tnode2 otNode, err os.Error)
       m1.mutation, m2.mutation, err = ot.Transform(node1.(*mutationNode).mutation, node2.(*mutationNode).mutation)
       tnode1 = &m1
       tnode2 = &m2
-    case *permissionNode, *keepNode:
-      // Do nothing by intention
+    case *permissionNode, *keepNode, *entityNode:
+      // Do nothing by intention. Permissions, keeps and entities are not scoped to positions
     default:
       panic("Unknown node type")
     }
   case *permissionNode:
     switch node2.(type) {
-    case *mutationNode, *keepNode:
-      // Do nothing by intention
+    case *mutationNode, *keepNode, *entityNode:
+      // Do nothing by intention. Permissions, keeps and entities are not scoped to positions
     case *permissionNode:
       p1 := *(node1.(*permissionNode))
       p2 := *(node2.(*permissionNode))
@@ -810,7 +2212,7 @@ func transform(node1 otNode, node2 otNode) (tnode1, tnode2 otNode, err os.Error)
     default:
       panic("Unknown node type")
     }
-  case *keepNode:
+  case *keepNode, *entityNode:
     // Do nothing by intention    
   default:
     panic("Unknown node type")
@@ -824,17 +2226,22 @@ func pruneSeq(nodes []otNode, prune map[string]bool) (result []otNode, err os.Er
   for _, n := range nodes {
     // This mutation/permission is not to be pruned?
     if _, isundo := prune[n.BlobRef()]; !isundo {
-      if started { // Started pruning?
+      // Permissions are transformed against permissions only. Hence they must be pruned
+      // even if no mutation has been pruned so far
+      if perm, ok := n.(*permissionNode); ok {
+	p := *perm
+	p.permission, err = ot.PrunePermission(perm.permission, prune)
+	if err != nil {
+	  return
+	}
+	result = append(result, &p)
+      } else if started { // Started pruning?
 	switch n.(type) {
-	case *permissionNode:
-	  p := *(n.(*permissionNode))
-	  p.permission, err = ot.PrunePermission(n.(*permissionNode).permission, prune)
-	  result = append(result, &p)
 	case *mutationNode:
 	  m := *(n.(*mutationNode))
 	  m.mutation, u, err = ot.PruneMutation(n.(*mutationNode).mutation, u)
 	  result = append(result, &m)
-	case *keepNode:
+	case *keepNode, *entityNode:
 	  result = append(result, n)
 	}
 	if err != nil {
@@ -846,7 +2253,7 @@ func pruneSeq(nodes []otNode, prune map[string]bool) (result []otNode, err os.Er
       continue
     }
     switch n.(type) {
-    case *permissionNode, *keepNode: // Ignore the permission node
+    case *permissionNode, *keepNode, *entityNode: // Ignore the permission node
       // Do nothing by intention
     case *mutationNode: // Store in u that the mutation in 'n' are pruned.
       if !started { // Initialize 'u'
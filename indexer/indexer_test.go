@@ -2,40 +2,183 @@ package lightwaveidx
 
 import (
   . "lightwavestore"
+  "bytes"
+  "json"
   "testing"
   "fmt"
   "log"
+  "os"
+  "time"
+  "crypto/rand"
+  "github.com/agl/ed25519"
+  ot "lightwaveot"
 )
 
 type dummyFederation struct {
+  pulled []string
+  requested []string
+  // The keys are blobrefs, the values are the users to which the blob has been forwarded
+  forwarded map[string][]string
+  // The number of calls to ForwardBatch
+  batches int
 }
 
 func (self *dummyFederation) Forward(blobref string, users []string) {
-  log.Printf("Forwarding %v to %v\n", blobref, users) 
+  self.ForwardBatch([]string{blobref}, users)
+}
+
+func (self *dummyFederation) ForwardBatch(blobrefs []string, users []string) {
+  log.Printf("Forwarding %v to %v\n", blobrefs, users) 
+  self.batches++
+  if self.forwarded == nil {
+    self.forwarded = make(map[string][]string)
+  }
+  for _, blobref := range blobrefs {
+    self.forwarded[blobref] = append(self.forwarded[blobref], users...)
+  }
 }
 
 func (self *dummyFederation) SetIndexer(idx *Indexer) {
 }
 
-func (self *dummyFederation) DownloadPermaNode(permission_blobref string) {
+func (self *dummyFederation) DownloadPermaNode(permission_blobref string) os.Error {
+  return nil
+}
+
+func (self *dummyFederation) DownloadSubtree(perma_blobref string) os.Error {
+  return nil
+}
+
+func (self *dummyFederation) PullPermaNode(perma_blobref string, from string) os.Error {
+  self.pulled = append(self.pulled, perma_blobref)
+  return nil
+}
+
+func (self *dummyFederation) RequestBlob(blobref string) {
+  self.requested = append(self.requested, blobref)
+}
+
+type dummyObserver struct {
+  mutations int
+  permissions int
+}
+
+func (self *dummyObserver) Mutation(permanode_blobref string, mutation ot.Mutation) {
+  self.mutations++
+}
+
+func (self *dummyObserver) Permission(permanode_blobref string, action int, permission ot.Permission) {
+  self.permissions++
+}
+
+type dummyAppIndexer struct {
+  followers int
+  expelled []string
+  synced int
+  mutations int
+  rejected []string
+  // The keys are blobrefs of applied local mutations
+  local map[string]ot.Mutation
+  invitations []string
+  accepted []string
+  declined []string
+  left []string
+  dropped []string
+}
+
+func (self *dummyAppIndexer) Invitation(permanode_blobref, invitation_blobref string) {
+  self.invitations = append(self.invitations, invitation_blobref)
+}
+
+func (self *dummyAppIndexer) AcceptedInvitation(permanode_blobref, invitation_blobref string, keep_blobref string) {
+  self.accepted = append(self.accepted, invitation_blobref)
+}
+
+func (self *dummyAppIndexer) DeclinedInvitation(permanode_blobref, invitation_blobref string) {
+  self.declined = append(self.declined, invitation_blobref)
+}
+
+func (self *dummyAppIndexer) NewFollower(permanode_blobref string, invitation_blobref, keep_blobref, userid string) {
+  self.followers++
+}
+
+func (self *dummyAppIndexer) ExpelledFollower(permanode_blobref string, permission_blobref, userid string) {
+  self.expelled = append(self.expelled, userid)
+}
+
+func (self *dummyAppIndexer) LeftPermaNode(permanode_blobref string) {
+  self.left = append(self.left, permanode_blobref)
+}
+
+func (self *dummyAppIndexer) DroppedBlob(blobref string, reason string) {
+  self.dropped = append(self.dropped, blobref)
+}
+
+func (self *dummyAppIndexer) PermaNode(permanode_blobref string, mimetype string, invitation_blobref, keep_blobref string) {
+}
+
+func (self *dummyAppIndexer) Mutation(permanode_blobref string, mutation ot.Mutation) {
+  self.mutations++
+}
+
+func (self *dummyAppIndexer) Permission(permanode_blobref string, action int, permission ot.Permission) {
+}
+
+func (self *dummyAppIndexer) Synced(permanode_blobref string) {
+  self.synced++
+}
+
+func (self *dummyAppIndexer) MutationRejected(permanode_blobref, mutation_blobref string, reason string) {
+  self.rejected = append(self.rejected, mutation_blobref)
+}
+
+func (self *dummyAppIndexer) LocalMutationApplied(permanode_blobref, mutation_blobref string, transformed ot.Mutation) {
+  if self.local == nil {
+    self.local = make(map[string]ot.Mutation)
+  }
+  self.local[mutation_blobref] = transformed
+}
+
+type panickingAppIndexer struct {
+  dummyAppIndexer
+}
+
+func (self *panickingAppIndexer) Mutation(permanode_blobref string, mutation ot.Mutation) {
+  panic("Application indexer failed")
+}
+
+// Calls the indexer when a blob has been dropped
+type reentrantAppIndexer struct {
+  dummyAppIndexer
+  indexer *Indexer
+  stalled []StalledInfo
+}
+
+func (self *reentrantAppIndexer) DroppedBlob(blobref string, reason string) {
+  self.dummyAppIndexer.DroppedBlob(blobref, reason)
+  self.stalled = self.indexer.StalledBlobs()
 }
 
 func TestPermanode(t *testing.T) {
   store := NewSimpleBlobStore()
-  indexer := NewIndexer("a@b", store, &dummyFederation{})
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
   
-  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "mimetype":"application/x-test-file", "t":"2006-01-02T15:04:05+07:00"}`)
   blobref1 := NewBlobRef(blob1)
   blob2 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma2xyz", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
   blobref2 := NewBlobRef(blob2)
   
   store.StoreBlob(blob1, blobref1)
   store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
   
   perma, err := indexer.PermaNode(blobref1)
   if perma == nil || err != nil {
     t.Fatal("Did not find perma node")
   }
+  if perma.MimeType() != "application/x-test-file" {
+    t.Fatalf("Wrong mime type %v", perma.MimeType())
+  }
   perma, err = indexer.PermaNode(blobref2)
   if perma == nil || err != nil {
     t.Fatal("Did not find perma node")
@@ -44,7 +187,7 @@ func TestPermanode(t *testing.T) {
 
 func TestPermanode2(t *testing.T) {
   store := NewSimpleBlobStore()
-  indexer := NewIndexer("a@b", store, &dummyFederation{})
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
   
   blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
   blobref1 := NewBlobRef(blob1)
@@ -54,6 +197,7 @@ func TestPermanode2(t *testing.T) {
   // Insert them in the wrong order
   store.StoreBlob(blob2, blobref2)  
   store.StoreBlob(blob1, blobref1)
+  indexer.WaitIdle()
 
   perma, err := indexer.PermaNode(blobref1)
   if perma == nil || err != nil {
@@ -68,7 +212,7 @@ func TestPermanode2(t *testing.T) {
 func TestPermanode3(t *testing.T) {
   fed := &dummyFederation{}
   store := NewSimpleBlobStore()
-  indexer := NewIndexer("a@b", store, fed)
+  indexer := NewIndexer("a@b", store, fed, 0)
   
   blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2007-01-02T15:04:05+07:00"}`)
   blobref1 := NewBlobRef(blob1)
@@ -94,6 +238,7 @@ func TestPermanode3(t *testing.T) {
   store.StoreBlob(blob4, blobref4)  
   store.StoreBlob(blob5, blobref5)
   store.StoreBlob(blob7, blobref7)
+  indexer.WaitIdle()
   
   perma, err := indexer.PermaNode(blobref1)
   if perma == nil || err != nil {
@@ -150,3 +295,3249 @@ func TestPermanode3(t *testing.T) {
     t.Fatal("Wrong users")
   }
 }
+
+func TestObserver(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  indexer.WaitIdle()
+
+  observer := &dummyObserver{}
+  indexer.AddObserver(blobref1, observer)
+  
+  store.StoreBlob(blob2, blobref2)  
+  store.StoreBlob(blob3, blobref3)  
+  indexer.WaitIdle()
+
+  if observer.mutations != 1 || observer.permissions != 1 {
+    t.Fatalf("Observer missed some blobs: %v %v", observer.mutations, observer.permissions)
+  }
+  perma, err := indexer.PermaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  if len(perma.Followers()) != 1 {
+    t.Fatal("The observer must not be a follower")
+  }
+}
+
+func TestKeepBeforePermanode(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  // The foreign keep arrives before the permanode and the permission
+  store.StoreBlob(blob4, blobref4)
+  store.StoreBlob(blob3, blobref3)
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+
+  perma, err := indexer.PermaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  if !perma.HasKeep("foo@bar") {
+    t.Fatal("Missing a keep for foo@bar")
+  }
+  if !perma.HasPermission("foo@bar", Perm_Read) {
+    t.Fatal("Expected an allow for foo@bar")
+  }
+  if len(indexer.waitingBlobs) != 0 || len(indexer.pendingBlobs) != 0 {
+    t.Fatal("Blobs are still waiting")
+  }
+}
+
+func TestTransferOwnership(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":[], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"transfer", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  // a@b is no longer the owner and cannot transfer the ownership back
+  blob4 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"transfer", "dep":["` + blobref3 + `"], "user":"a@b", "allow":0, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  store.StoreBlob(blob4, blobref4)
+  indexer.WaitIdle()
+
+  perma, err := indexer.PermaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  if perma.Owner() != "foo@bar" {
+    t.Fatalf("Wrong owner %v", perma.Owner())
+  }
+  if !perma.HasPermission("foo@bar", Perm_Invite | Perm_Expel) {
+    t.Fatal("Expected an allow for foo@bar")
+  }
+  if !perma.HasPermission("a@b", Perm_Read) {
+    t.Fatal("Expected an allow for a@b")
+  }
+  if perma.HasPermission("a@b", Perm_Write) {
+    t.Fatal("Expected a deny for a@b")
+  }
+}
+
+func TestForeignDependency(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma2xyz", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref2 + `", "site":"site1", "dep":[], "op":{"$t":["Olla!!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  // This mutation depends on a mutation of another permanode
+  blob5 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref2 + `", "site":"site1", "dep":["` + blobref3 + `"], "op":{"$t":[{"$s":11}, "??"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  // This one is fine
+  blob6 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref2 + `", "site":"site1", "dep":["` + blobref4 + `"], "op":{"$t":[{"$s":6}, "??"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  store.StoreBlob(blob4, blobref4)
+  store.StoreBlob(blob5, blobref5)
+  store.StoreBlob(blob6, blobref6)
+  indexer.WaitIdle()
+
+  if indexer.blobs[blobref5] {
+    t.Fatal("Mutation with a foreign dependency has been applied")
+  }
+  if !indexer.blobs[blobref6] {
+    t.Fatal("Mutation has not been applied")
+  }
+}
+
+func TestDuplicateKeep(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  app := &dummyAppIndexer{}
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":[], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref2 + `", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  // A second keep of the same user
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref2 + `", "perma":"` + blobref1 + `", "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  store.StoreBlob(blob4, blobref4)
+  indexer.WaitIdle()
+
+  perma, err := indexer.PermaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  if perma.keeps["foo@bar"] != blobref3 {
+    t.Fatal("The first keep has been overwritten")
+  }
+  if app.followers != 1 {
+    t.Fatalf("Expected one new follower, got %v", app.followers)
+  }
+}
+
+func TestSynced(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  app := &dummyAppIndexer{}
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":[{"$s":11}, "??"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  store.StoreBlob(blob1, blobref1)
+  indexer.WaitIdle()
+  if !indexer.IsSynced(blobref1) {
+    t.Fatal("Perma node should be synced")
+  }
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+  if indexer.IsSynced(blobref1) {
+    t.Fatal("Perma node should not be synced")
+  }
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+  if !indexer.IsSynced(blobref1) {
+    t.Fatal("Perma node should be synced again")
+  }
+  if app.synced != 1 {
+    t.Fatalf("Expected one synced signal, got %v", app.synced)
+  }
+}
+
+func TestCompactHistory(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref1b + `"], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"mutation", "signer":"foo@bar", "perma":"` + blobref1 + `", "site":"site2", "dep":["` + blobref3 + `", "` + blobref4 + `"], "op":{"$t":[{"$s":11}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  // Concurrent to the compacted history
+  blob6 := []byte(`{"type":"mutation", "signer":"foo@bar", "perma":"` + blobref1 + `", "site":"site2", "dep":["` + blobref2 + `"], "op":{"$t":[{"$s":11}, "?"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+  blob7 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref5 + `"], "op":{"$t":[{"$s":12}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref7 := NewBlobRef(blob7)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  store.StoreBlob(blob4, blobref4)
+  store.StoreBlob(blob5, blobref5)
+  indexer.WaitIdle()
+
+  count, err := indexer.CompactHistory(blobref1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if count != 5 {
+    t.Fatalf("Expected 5 compacted blobs, got %v", count)
+  }
+  perma, _ := indexer.PermaNode(blobref1)
+  if !perma.ot.HasApplied(blobref2) {
+    t.Fatal("Compacted blob is no longer known")
+  }
+
+  store.StoreBlob(blob6, blobref6)
+  store.StoreBlob(blob7, blobref7)
+  indexer.WaitIdle()
+  if indexer.blobs[blobref6] {
+    t.Fatal("Blob concurrent to the compacted history has been applied")
+  }
+  if !indexer.blobs[blobref7] {
+    t.Fatal("Blob has not been applied")
+  }
+}
+
+func TestFullTextIndex(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  fulltext := NewFullTextIndex(indexer)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  // Delete "Hello "
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":[{"$d":6}, {"$s":5}]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+
+  result := fulltext.Search("hello world")
+  if len(result) != 1 || result[0] != blobref1 {
+    t.Fatalf("Wrong search result: %v", result)
+  }
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+  if result = fulltext.Search("hello"); len(result) != 0 {
+    t.Fatalf("Deleted text is still indexed: %v", result)
+  }
+  if result = fulltext.Search("WORLD"); len(result) != 1 {
+    t.Fatalf("Wrong search result: %v", result)
+  }
+}
+
+func TestMutationRateLimit(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  indexer.SetMutationRateLimit(1, 2)
+  app := &dummyAppIndexer{}
+  indexer.AddListener(app)
+  now := int64(0)
+  indexer.limiter.now = func() int64 { return now }
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":[{"$s":5}, " World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `"], "op":{"$t":[{"$s":11}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `"], "op":{"$t":[{"$s":11}, "?"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  store.StoreBlob(blob4, blobref4)
+  indexer.WaitIdle()
+  if !indexer.blobs[blobref2] || !indexer.blobs[blobref3] {
+    t.Fatal("A burst of two mutations must be accepted")
+  }
+  if indexer.blobs[blobref4] {
+    t.Fatal("The third mutation must be rejected")
+  }
+  if len(app.rejected) != 1 || app.rejected[0] != blobref4 {
+    t.Fatalf("The application has not been informed about the rejected mutation: %v", app.rejected)
+  }
+  // One second later there is a new token
+  now += 1e9
+  store.StoreBlob(blob5, blobref5)
+  indexer.WaitIdle()
+  if !indexer.blobs[blobref5] {
+    t.Fatal("Mutation has not been applied")
+  }
+  // Cancels the retry of the deferred mutation
+  indexer.Close()
+}
+
+func TestReinvite(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref1b + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref2 + `", "perma":"` + blobref1 + `", "dep":["` + blobref2 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"expel", "dep":["` + blobref3 + `"], "user":"foo@bar", "allow":0, "deny":` + fmt.Sprintf("%v", Perm_Read) + `, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref4 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-04T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  blob6 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref5 + `", "perma":"` + blobref1 + `", "dep":["` + blobref5 + `"], "t":"2006-01-04T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+
+  perma, err := indexer.PermaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  if !perma.HasKeep("foo@bar") {
+    t.Fatal("Missing a keep for foo@bar")
+  }
+
+  store.StoreBlob(blob4, blobref4)
+  indexer.WaitIdle()
+  if perma.HasKeep("foo@bar") || perma.HasPermission("foo@bar", Perm_Read) {
+    t.Fatal("foo@bar has not been expelled")
+  }
+  graph := indexer.DependencyGraph(blobref1)
+  if len(graph) != 4 || len(graph[blobref4]) != 1 || graph[blobref4][0] != blobref3 {
+    t.Fatalf("Wrong dependency graph: %v", graph)
+  }
+
+  store.StoreBlob(blob5, blobref5)
+  store.StoreBlob(blob6, blobref6)
+  indexer.WaitIdle()
+  if perma.keeps["foo@bar"] != blobref6 {
+    t.Fatal("The new keep has not been accepted")
+  }
+  if _, ok := perma.pendingInvitations["foo@bar"]; ok {
+    t.Fatal("The invitation is still pending")
+  }
+  if !perma.HasPermission("foo@bar", Perm_Read) {
+    t.Fatal("Expected an allow for foo@bar")
+  }
+  found := false
+  for _, user := range perma.Followers() {
+    if user == "foo@bar" {
+      found = true
+    }
+  }
+  if !found {
+    t.Fatal("foo@bar is not a follower")
+  }
+}
+
+func TestTransformPermissionMutation(t *testing.T) {
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref1b + `"], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  // A mutation and a permission which are concurrent to each other
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":[{"$s":11}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  // Depends on both
+  blob5 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `", "` + blobref4 + `"], "op":{"$t":[{"$s":12}, "?"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+
+  // Apply the concurrent blobs in both orders
+  orders := [][]string{[]string{blobref3, blobref4}, []string{blobref4, blobref3}}
+  blobs := map[string][]byte{blobref3: blob3, blobref4: blob4}
+  for _, order := range orders {
+    store := NewSimpleBlobStore()
+    indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+    store.StoreBlob(blob1, blobref1)
+    store.StoreBlob(blob1b, blobref1b)
+    store.StoreBlob(blob2, blobref2)
+    for _, blobref := range order {
+      store.StoreBlob(blobs[blobref], blobref)
+    }
+    store.StoreBlob(blob5, blobref5)
+    indexer.WaitIdle()
+
+    perma, err := indexer.PermaNode(blobref1)
+    if perma == nil || err != nil {
+      t.Fatal("Did not find perma node")
+    }
+    if !indexer.blobs[blobref5] {
+      t.Fatal("Blob has not been applied")
+    }
+    if text := contentText(perma.ot.Content()); text != "Hello World!?" {
+      t.Fatalf("Wrong content: %v", text)
+    }
+    if !perma.HasPermission("foo@bar", Perm_Read) {
+      t.Fatal("Expected an allow for foo@bar")
+    }
+  }
+
+  // Transforming a permission against a mutation leaves both untouched
+  mut := &mutationNode{mutation: ot.Mutation{ID: "m1", Site: "site1"}}
+  perm := &permissionNode{permission: ot.Permission{ID: "p1", User: "foo@bar", Allow: Perm_Read}}
+  tmut, tperm, err := transform(mut, perm)
+  if err != nil || tmut != otNode(mut) || tperm != otNode(perm) {
+    t.Fatal("Permission and mutation have been transformed")
+  }
+  tperm, tmut, err = transform(perm, mut)
+  if err != nil || tmut != otNode(mut) || tperm != otNode(perm) {
+    t.Fatal("Permission and mutation have been transformed")
+  }
+}
+
+func TestExportImport(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref1b + `"], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+
+  var buffer bytes.Buffer
+  if err := indexer.Export(blobref1, &buffer); err != nil {
+    t.Fatal(err)
+  }
+  bundle := buffer.Bytes()
+  // The blobs are written in dependency order
+  expected := ""
+  for _, blob := range [][]byte{blob1, blob1b, blob2, blob3} {
+    expected += fmt.Sprintf("%v %v\n", NewBlobRef(blob), len(blob)) + string(blob)
+  }
+  if string(bundle) != expected {
+    t.Fatalf("Wrong bundle: %v", string(bundle))
+  }
+
+  store2 := NewSimpleBlobStore()
+  indexer2 := NewIndexer("a@b", store2, &dummyFederation{}, 0)
+  // The permanode is already known
+  store2.StoreBlob(blob1, blobref1)
+  indexer2.WaitIdle()
+  if err := indexer2.Import(bytes.NewBuffer(bundle)); err != nil {
+    t.Fatal(err)
+  }
+  perma, err := indexer2.PermaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  if text := contentText(perma.ot.Content()); text != "Hello World" {
+    t.Fatalf("Wrong content: %v", text)
+  }
+  if !perma.HasPermission("foo@bar", Perm_Read) {
+    t.Fatal("Expected an allow for foo@bar")
+  }
+
+  // A bundle in reverse order is imported via the waiting lists
+  reversed := ""
+  for _, blob := range [][]byte{blob3, blob2, blob1b, blob1} {
+    reversed += fmt.Sprintf("%v %v\n", NewBlobRef(blob), len(blob)) + string(blob)
+  }
+  indexer3 := NewIndexer("a@b", NewSimpleBlobStore(), &dummyFederation{}, 0)
+  if err := indexer3.Import(bytes.NewBufferString(reversed)); err != nil {
+    t.Fatal(err)
+  }
+  perma, err = indexer3.PermaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  if text := contentText(perma.ot.Content()); text != "Hello World" {
+    t.Fatalf("Wrong content: %v", text)
+  }
+
+  // A corrupted bundle must be rejected
+  bundle[len(bundle) - 2] = 'X'
+  if err := NewIndexer("a@b", NewSimpleBlobStore(), &dummyFederation{}, 0).Import(bytes.NewBuffer(bundle)); err == nil {
+    t.Fatal("Expected an error for a corrupted bundle")
+  }
+}
+
+func TestPanickingAppIndexer(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  indexer.AddListener(&panickingAppIndexer{})
+  app := &dummyAppIndexer{}
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref1b + `"], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":[{"$s":11}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+
+  // The panicking listener must neither affect the other listener nor the following blobs.
+  // The second mutation depends on the first one and is only applied if the first one has been processed.
+  if app.mutations != 2 {
+    t.Fatalf("Listener missed some mutations: %v", app.mutations)
+  }
+}
+
+func TestPull(t *testing.T) {
+  store := NewSimpleBlobStore()
+  fed := &dummyFederation{}
+  indexer := NewIndexer("a@b", store, fed, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  // A perma node which is not kept by the local user
+  blob2 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma2abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+
+  if err := indexer.Pull("x@y"); err != nil {
+    t.Fatal(err)
+  }
+  if len(fed.pulled) != 1 || fed.pulled[0] != blobref1 {
+    t.Fatalf("Wrong perma nodes pulled: %v", fed.pulled)
+  }
+}
+
+// A new follower receives the backlog of the local user in one batch
+func TestForwardBatch(t *testing.T) {
+  store := NewSimpleBlobStore()
+  fed := &dummyFederation{}
+  indexer := NewIndexer("a@b", store, fed, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  indexer.WaitIdle()
+  muts := []string{}
+  dep := blobref1b
+  for i := 0; i < 50; i++ {
+    blob := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + dep + `"], "op":{"$t":[{"$s":` + fmt.Sprintf("%v", i) + `}, "x"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+    dep = NewBlobRef(blob)
+    store.StoreBlob(blob, dep)
+    muts = append(muts, dep)
+  }
+  blob2 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + dep + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+
+  // The follower has seen nothing but the invitation
+  fed.batches = 0
+  blob3 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref2 + `", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  store.StoreBlob(blob3, NewBlobRef(blob3))
+  indexer.WaitIdle()
+  if fed.batches != 1 {
+    t.Fatalf("Expected one batch, but got %v", fed.batches)
+  }
+  for _, mut := range muts {
+    if users := fed.forwarded[mut]; len(users) != 1 || users[0] != "foo@bar" {
+      t.Fatalf("Mutation %v has been forwarded to %v", mut, users)
+    }
+  }
+}
+
+func TestClockSkew(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"3000-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma2abc", "t":"3000-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+
+  store.StoreBlob(blob1, blobref1)
+  indexer.WaitIdle()
+  if perma, _ := indexer.PermaNode(blobref1); perma != nil {
+    t.Fatal("A blob from the far future must be rejected")
+  }
+  indexer.SetMaxClockSkew(0)
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+  if perma, _ := indexer.PermaNode(blobref2); perma == nil {
+    t.Fatal("Without a limit the blob must be accepted")
+  }
+}
+
+func TestInheritPermissions(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob1c := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref1b + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1c := NewBlobRef(blob1c)
+  blob1d := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref1c + `"], "user":"x@y", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1d := NewBlobRef(blob1d)
+  // A child which inherits permissions. It grants x@y write access only
+  blob2 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma2abc", "perma":"` + blobref1 + `", "inherit":true, "dep":["` + blobref1d + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob2b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref2 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2b := NewBlobRef(blob2b)
+  blob2c := []byte(`{"type":"permission", "perma":"` + blobref2 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2b + `"], "user":"x@y", "allow":` + fmt.Sprintf("%v", Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2c := NewBlobRef(blob2c)
+  // A grandchild which inherits permissions
+  blob3 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma3abc", "perma":"` + blobref2 + `", "inherit":true, "dep":["` + blobref2c + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  // A child which does not inherit permissions
+  blob4 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma4abc", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  for _, blob := range [][]byte{blob1, blob1b, blob1c, blob1d, blob2, blob2b, blob2c, blob3, blob4} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  child, _ := indexer.PermaNode(blobref2)
+  grandchild, _ := indexer.PermaNode(blobref3)
+  other, _ := indexer.PermaNode(blobref4)
+  if child == nil || grandchild == nil || other == nil {
+    t.Fatal("Did not find perma nodes")
+  }
+  if !child.HasPermission("foo@bar", Perm_Read) || !grandchild.HasPermission("foo@bar", Perm_Read) {
+    t.Fatal("Expected an inherited allow for foo@bar")
+  }
+  if other.HasPermission("foo@bar", Perm_Read) {
+    t.Fatal("Permissions must not be inherited without opt-in")
+  }
+  // The explicit permission of the child overrides the permission of the parent
+  if child.HasPermission("x@y", Perm_Read) || grandchild.HasPermission("x@y", Perm_Read) {
+    t.Fatal("Expected a deny for x@y")
+  }
+  if !grandchild.HasPermission("x@y", Perm_Write) {
+    t.Fatal("Expected an inherited write permission for x@y")
+  }
+  // Permissions granted on the parent after the child has been created are not inherited
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref1d + `"], "user":"z@w", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  store.StoreBlob(blob5, NewBlobRef(blob5))
+  indexer.WaitIdle()
+  parent, _ := indexer.PermaNode(blobref1)
+  if !parent.HasPermission("z@w", Perm_Read) || child.HasPermission("z@w", Perm_Read) {
+    t.Fatal("The child must inherit the permissions of the parent at its creation")
+  }
+}
+
+func TestCreateEntityBlob(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  perma, _ := indexer.CreatePermaBlob("application/x-test-file")
+  keep, _ := indexer.CreateKeepBlob(perma, "")
+  entity, err := indexer.CreateEntityBlob(perma, []string{keep}, "application/x-test-entity", "Hello")
+  if err != nil {
+    t.Fatal(err)
+  }
+  blob, err := store.GetBlob(entity)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if MimeType(blob) != "application/x-lightwave-schema" {
+    t.Fatal("Entity is not a schema blob")
+  }
+  var schema map[string]interface{}
+  if err = json.Unmarshal(blob, &schema); err != nil {
+    t.Fatal(err)
+  }
+  if schema["type"] != "entity" || schema["perma"] != perma || schema["mimetype"] != "application/x-test-entity" || schema["content"] != "Hello" || schema["signer"] != "a@b" {
+    t.Fatalf("Malformed entity blob: %v", string(blob))
+  }
+}
+
+func TestEntity(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1b + `"], "mimetype":"application/x-test-entity", "content":"", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  // A mutation which is concurrent to the entity
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref1b + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  // The entity must wait for the keep
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+
+  entities := indexer.Entities(blobref1)
+  if len(entities) != 1 || entities[0] != blobref2 {
+    t.Fatalf("Wrong entities: %v", entities)
+  }
+  perma, _ := indexer.PermaNode(blobref1)
+  if text := contentText(perma.ot.Content()); text != "Hello" {
+    t.Fatalf("Wrong content: %v", text)
+  }
+
+  // Created by the indexer
+  blobref4, err := indexer.CreateEntityBlob(blobref1, []string{blobref2, blobref3}, "application/x-test-entity", "World")
+  if err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+  entities = indexer.Entities(blobref1)
+  if len(entities) != 2 || entities[1] != blobref4 {
+    t.Fatalf("Wrong entities: %v", entities)
+  }
+  if string(indexer.nodes[blobref4].(*entityNode).Content()) != `"World"` {
+    t.Fatal("Wrong entity content")
+  }
+}
+
+func TestDelete(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref1b + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  // A blob of another perma node
+  blob3 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma3abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  // Only the owner can delete blobs
+  blob4 := []byte(`{"type":"delete", "signer":"x@y", "perma":"` + blobref1 + `", "blobs":["` + blobref2 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  for _, blob := range [][]byte{blob1, blob1b, blob2, blob3, blob4} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+  if !store.HasBlobs([]string{blobref2})[0] {
+    t.Fatal("Blob must not be deleted by a user other than the owner")
+  }
+  if indexer.blobs[blobref4] {
+    t.Fatal("Delete by a user other than the owner must be rejected")
+  }
+
+  if _, err := indexer.CreateDeleteBlob(blobref1, []string{blobref2}, []string{blobref2, blobref3}); err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+  if store.HasBlobs([]string{blobref2})[0] {
+    t.Fatal("Blob has not been deleted")
+  }
+  if !store.HasBlobs([]string{blobref3})[0] {
+    t.Fatal("Blobs of other perma nodes must not be deleted")
+  }
+}
+
+func TestWorkers(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 4)
+
+  permas := []string{}
+  for i := 0; i < 8; i++ {
+    blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma` + fmt.Sprintf("%v", i) + `", "t":"2006-01-02T15:04:05+07:00"}`)
+    blobref1 := NewBlobRef(blob1)
+    blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+    blobref2 := NewBlobRef(blob2)
+    blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":[{"$s":11}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+    blobref3 := NewBlobRef(blob3)
+    // Insert them in the wrong order
+    store.StoreBlob(blob3, blobref3)
+    store.StoreBlob(blob2, blobref2)
+    store.StoreBlob(blob1, blobref1)
+    permas = append(permas, blobref1)
+  }
+  indexer.WaitIdle()
+
+  for _, blobref := range permas {
+    perma, err := indexer.PermaNode(blobref)
+    if perma == nil || err != nil {
+      t.Fatal("Did not find perma node")
+    }
+    if text := contentText(perma.ot.Content()); text != "Hello World!" {
+      t.Fatalf("Wrong content: %v", text)
+    }
+    if !indexer.IsSynced(blobref) {
+      t.Fatal("Perma node should be synced")
+    }
+  }
+  // Compaction runs on the worker of the perma node
+  if _, err := indexer.CompactHistory(permas[0]); err != nil {
+    t.Fatal(err)
+  }
+
+  // A closed indexer no longer indexes new blobs
+  indexer.Close()
+  blob := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma8", "t":"2006-01-02T15:04:05+07:00"}`)
+  store.StoreBlob(blob, NewBlobRef(blob))
+  indexer.WaitIdle()
+  if _, ok := indexer.nodes[NewBlobRef(blob)]; ok {
+    t.Fatal("The closed indexer indexed a blob")
+  }
+}
+
+func TestCanWrite(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("foo@bar", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  store.StoreBlob(blob1, blobref1)
+  indexer.WaitIdle()
+  if indexer.CanWrite(blobref1) {
+    t.Fatal("The local user has not been granted write access yet")
+  }
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+
+  if !indexer.CanWrite(blobref1) {
+    t.Fatal("Expected write access")
+  }
+  if indexer.CanInvite(blobref1) || indexer.CanExpel(blobref1) {
+    t.Fatal("Expected no permission to invite or expel")
+  }
+  if indexer.CanWrite("unknown") {
+    t.Fatal("Expected no write access to an unknown perma node")
+  }
+}
+
+func TestMerge(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob1c := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref1b + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1c := NewBlobRef(blob1c)
+  blob2 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma2xyz", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob2b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref2 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2b := NewBlobRef(blob2b)
+  // The same site as in the target perma node
+  blob2c := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref2 + `", "site":"site1", "dep":["` + blobref2b + `"], "op":{"$t":["World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2c := NewBlobRef(blob2c)
+  blob2d := []byte(`{"type":"permission", "perma":"` + blobref2 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2c + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2d := NewBlobRef(blob2d)
+  blob2e := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref2d + `", "perma":"` + blobref2 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2e := NewBlobRef(blob2e)
+  blob2f := []byte(`{"type":"mutation", "signer":"foo@bar", "perma":"` + blobref2 + `", "site":"site3", "dep":["` + blobref2c + `", "` + blobref2e + `"], "op":{"$t":[{"$s":5}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2f := NewBlobRef(blob2f)
+
+  for _, b := range [][]byte{blob1, blob1b, blob1c, blob2, blob2b, blob2c, blob2d, blob2e, blob2f} {
+    store.StoreBlob(b, NewBlobRef(b))
+  }
+  indexer.WaitIdle()
+
+  blobrefs, err := indexer.Merge(blobref1, blobref2)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Two copied mutations and an invitation for foo@bar
+  if len(blobrefs) != 3 {
+    t.Fatalf("Expected three new blobs: %v", blobrefs)
+  }
+  indexer.WaitIdle()
+
+  perma, _ := indexer.PermaNode(blobref1)
+  text := contentText(perma.ot.Content())
+  if text != "HelloWorld!" && text != "World!Hello" {
+    t.Fatalf("Wrong merged content: %v", text)
+  }
+  if _, ok := perma.pendingInvitations["foo@bar"]; !ok {
+    t.Fatal("The follower of the merged perma node has not been invited")
+  }
+  // The copies are signed by the local user but record the original author
+  if indexer.MutationAuthor(blobref1, blobrefs[0]) != "a@b" || indexer.MutationAuthor(blobref1, blobrefs[1]) != "foo@bar" {
+    t.Fatal("The copies do not record the original authors")
+  }
+  if indexer.MutationAuthor(blobref1, blobref1c) != "a@b" {
+    t.Fatal("Wrong author of an ordinary mutation")
+  }
+  source, _ := indexer.PermaNode(blobref2)
+  if !source.HasKeep("foo@bar") || contentText(source.ot.Content()) != "World!" {
+    t.Fatal("The merged perma node has been modified")
+  }
+
+  // Merging again changes nothing
+  again, err := indexer.Merge(blobref1, blobref2)
+  if err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+  if len(again) != 2 || again[0] != blobrefs[0] || again[1] != blobrefs[1] || contentText(perma.ot.Content()) != text {
+    t.Fatalf("Merging again modified the perma node: %v", again)
+  }
+  if _, err = indexer.Merge(blobref1, blobref1); err == nil {
+    t.Fatal("Expected an error when merging a perma node with itself")
+  }
+}
+
+func sameEvent(e1, e2 Event) bool {
+  return e1.Kind == e2.Kind && e1.Actor == e2.Actor && e1.Time == e2.Time && e1.BlobRef == e2.BlobRef && e1.User == e2.User
+}
+
+func TestActivityFeed(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref3 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref4 + `", "perma":"` + blobref1 + `", "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  blob6 := []byte(`{"type":"mutation", "signer":"foo@bar", "perma":"` + blobref1 + `", "site":"site2", "dep":["` + blobref5 + `"], "op":{"$t":[{"$s":5}, "!"]}, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+
+  ch := indexer.SubscribeActivity(blobref1)
+  for _, b := range [][]byte{blob1, blob2, blob3, blob4, blob5, blob6} {
+    store.StoreBlob(b, "")
+  }
+  indexer.WaitIdle()
+
+  expected := []Event{
+    Event{Kind: Event_Mutation, Actor: "a@b", Time: 1136189045, BlobRef: blobref3},
+    Event{Kind: Event_Invitation, Actor: "a@b", Time: 1136189045, BlobRef: blobref4, User: "foo@bar"},
+    Event{Kind: Event_NewFollower, Actor: "foo@bar", Time: 1136275445, BlobRef: blobref5, User: "foo@bar"},
+    Event{Kind: Event_Mutation, Actor: "foo@bar", Time: 1136275445, BlobRef: blobref6}}
+  events := indexer.ActivityFeed(blobref1, 0)
+  if len(events) != len(expected) {
+    t.Fatalf("Wrong number of events: %v", events)
+  }
+  for i, e := range expected {
+    if !sameEvent(events[i], e) {
+      t.Fatalf("Wrong event %v: %v", i, events[i])
+    }
+    if live := <-ch; !sameEvent(live, e) {
+      t.Fatalf("Wrong live event %v: %v", i, live)
+    }
+  }
+  if events = indexer.ActivityFeed(blobref1, 1136275445); len(events) != 2 || events[0].BlobRef != blobref5 {
+    t.Fatalf("Wrong events since the second day: %v", events)
+  }
+  indexer.UnsubscribeActivity(blobref1, ch)
+  if _, ok := <-ch; ok {
+    t.Fatal("Expected the channel to be closed")
+  }
+}
+
+func TestActivityCapacity(t *testing.T) {
+  indexer := NewIndexer("a@b", NewSimpleBlobStore(), &dummyFederation{}, 0)
+  if err := indexer.SetActivityCapacity(-1); err != ErrNegativeCapacity {
+    t.Fatalf("Expected ErrNegativeCapacity: %v", err)
+  }
+  indexer.SetActivityCapacity(2)
+  ch := indexer.SubscribeActivity("perma1")
+  // Nobody reads the channel, but recording events must not block
+  for i := 0; i < 5; i++ {
+    indexer.recordEvent("perma1", Event{Kind: Event_Mutation, Actor: "a@b", Time: int64(i), BlobRef: fmt.Sprintf("m%v", i)})
+  }
+  events := indexer.ActivityFeed("perma1", 0)
+  if len(events) != 2 || events[0].BlobRef != "m3" || events[1].BlobRef != "m4" {
+    t.Fatalf("Expected the two most recent events: %v", events)
+  }
+  if dropped := indexer.DroppedActivity(); dropped != 3 {
+    t.Fatalf("Expected three dropped events, got %v", dropped)
+  }
+  // The channel holds the most recent events as well
+  if e := <-ch; e.BlobRef != "m3" {
+    t.Fatalf("Wrong live event: %v", e)
+  }
+  if e := <-ch; e.BlobRef != "m4" {
+    t.Fatalf("Wrong live event: %v", e)
+  }
+}
+
+func TestRandom(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  indexer.SetRandom(bytes.NewBuffer([]byte{1, 2, 3, 4, 5, 6, 7, 8}), 4)
+  blobref1, err := indexer.CreatePermaBlob("")
+  if err != nil {
+    t.Fatal(err)
+  }
+  blobref2, err := indexer.CreatePermaBlob("")
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i, blobref := range []string{blobref1, blobref2} {
+    blob, err := store.GetBlob(blobref)
+    if err != nil {
+      t.Fatal(err)
+    }
+    var schema superSchema
+    if err = json.Unmarshal(blob, &schema); err != nil {
+      t.Fatal(err)
+    }
+    if expected := []string{"01020304", "05060708"}[i]; schema.Random != expected {
+      t.Fatalf("Expected random %v, got %v", expected, schema.Random)
+    }
+  }
+  // The source is exhausted
+  if _, err = indexer.CreatePermaBlob(""); err == nil {
+    t.Fatal("Expected an error")
+  }
+}
+
+func TestMalformedOperation(t *testing.T) {
+  store := NewSimpleBlobStore()
+  store.DropRejected = true
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  // Skips past the end of the empty content
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":[{"$s":100}, "Oops"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site2", "dep":["` + blobref2 + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  for _, b := range [][]byte{blob1, blob2, blob3, blob4} {
+    store.StoreBlob(b, "")
+  }
+  indexer.WaitIdle()
+
+  perma, err := indexer.PermaNode(blobref1)
+  if err != nil || perma == nil {
+    t.Fatal("Expected a perma node")
+  }
+  if perma.ot.HasApplied(blobref3) || indexer.blobs[blobref3] {
+    t.Fatal("The malformed mutation must be rejected")
+  }
+  if store.HasBlobs([]string{blobref3})[0] {
+    t.Fatal("The store must drop the rejected mutation")
+  }
+  if !perma.ot.HasApplied(blobref4) || contentText(perma.ot.Content()) != "Hello" {
+    t.Fatalf("Wrong content: %v", contentText(perma.ot.Content()))
+  }
+}
+
+func TestPermanodesByMimeType(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  blobref1, err := indexer.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  blobref2, err := indexer.CreatePermaBlob("application/x-other-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  blobref3, err := indexer.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+
+  if permas := indexer.PermanodesByMimeType("application/x-test-file"); len(permas) != 2 || permas[0] != blobref1 || permas[1] != blobref3 {
+    t.Fatalf("Wrong perma nodes: %v", permas)
+  }
+  if permas := indexer.PermanodesByMimeType("application/x-other-file"); len(permas) != 1 || permas[0] != blobref2 {
+    t.Fatalf("Wrong perma nodes: %v", permas)
+  }
+  if permas := indexer.PermanodesByMimeType("application/x-unknown"); len(permas) != 0 {
+    t.Fatalf("Wrong perma nodes: %v", permas)
+  }
+  // The result is a copy
+  indexer.PermanodesByMimeType("application/x-test-file")[0] = blobref2
+  if permas := indexer.PermanodesByMimeType("application/x-test-file"); permas[0] != blobref1 {
+    t.Fatalf("The result is not a copy: %v", permas)
+  }
+}
+
+type dummyGroups struct {
+  members map[string][]string
+}
+
+func (self *dummyGroups) IsMember(userid string, group string) bool {
+  for _, m := range self.members[group] {
+    if m == userid {
+      return true
+    }
+  }
+  return false
+}
+
+func (self *dummyGroups) Members(group string) []string {
+  return self.members[group]
+}
+
+func TestGroupPermission(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  groups := &dummyGroups{members: map[string][]string{"@team": []string{"c@d", "x@y"}}}
+  indexer.SetGroupResolver(groups)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  for _, blob := range [][]byte{blob1, blob2} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  // Inviting the group invites each member
+  if _, err := indexer.CreatePermissionBlob(blobref1, []string{blobref2}, "@team", Perm_Read | Perm_Write, 0, PermAction_Invite); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := indexer.CreatePermissionBlob(blobref1, []string{blobref2}, "*@e", Perm_Read, 0, PermAction_Invite); err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+  perma, err := indexer.PermaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  invitation := ""
+  for _, blobref := range perma.ot.AppliedBlobs() {
+    if perm, ok := perma.ot.members[blobref].(*permissionNode); ok && perm.permission.User == "c@d" {
+      if perm.group != "@team" {
+	t.Fatalf("The invitation of c@d does not name the group: %v", perm.group)
+      }
+      invitation = blobref
+    }
+  }
+  if invitation == "" {
+    t.Fatal("c@d has not been invited")
+  }
+  // x@y is a member of the group, but is restricted explicitly
+  if _, err := indexer.CreatePermissionBlob(blobref1, perma.ot.Frontier().IDs(), "x@y", 0, Perm_Write, PermAction_Change); err != nil {
+    t.Fatal(err)
+  }
+  // c@d accepts the invitation
+  blob3 := []byte(`{"type":"keep", "signer":"c@d", "permission":"` + invitation + `", "perma":"` + blobref1 + `", "dep":["` + invitation + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+
+  if perma.keeps["c@d"] != blobref3 {
+    t.Fatal("The keep of the group member has not been accepted")
+  }
+  if !perma.HasPermission("c@d", Perm_Read | Perm_Write) {
+    t.Fatal("Expected the permissions of the group for c@d")
+  }
+  if !perma.HasPermission("x@y", Perm_Read) || perma.HasPermission("x@y", Perm_Write) {
+    t.Fatal("The explicit permission of x@y must override the group")
+  }
+  if !perma.HasPermission("f@e", Perm_Read) || perma.HasPermission("f@e", Perm_Write) {
+    t.Fatal("Expected the permissions of the domain wildcard for f@e")
+  }
+  if perma.HasPermission("g@h", Perm_Read) {
+    t.Fatal("g@h is in no group")
+  }
+  if users := perma.FollowersWithPermission(Perm_Write); len(users) != 2 {
+    t.Fatalf("Expected a@b and c@d as writers, got %v", users)
+  }
+
+  // The resolver alone does not change any decision
+  groups.members["@team"] = []string{"x@y", "g@h"}
+  if !perma.HasPermission("c@d", Perm_Read) || perma.HasPermission("g@h", Perm_Read) {
+    t.Fatal("Permissions must not depend on the resolver")
+  }
+
+  // c@d leaves the group and is expelled, g@h joins and is invited
+  indexer.GroupMembershipChanged("@team", "c@d", false)
+  indexer.GroupMembershipChanged("@team", "g@h", true)
+  indexer.WaitIdle()
+  if perma.HasPermission("c@d", Perm_Read) || perma.HasKeep("c@d") {
+    t.Fatal("c@d left the group and must not have access any more")
+  }
+  if users := perma.FollowersWithPermission(Perm_Read); len(users) != 1 || users[0] != "a@b" {
+    t.Fatalf("Expected a@b as the only reader, got %v", users)
+  }
+  if !perma.HasPermission("g@h", Perm_Read | Perm_Write) {
+    t.Fatal("g@h joined the group and must have been invited")
+  }
+}
+
+func TestStalledBlobs(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  indexer.SetStallThreshold(0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  // Depends on a blob which is never stored
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `", "sha256-lost"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  // Depends on the stored, but waiting blob3
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `"], "op":{"$t":[{"$s":5}, " World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  for _, b := range [][]byte{blob1, blob2, blob3, blob4} {
+    store.StoreBlob(b, "")
+  }
+  indexer.WaitIdle()
+
+  stalled := indexer.StalledBlobs()
+  if len(stalled) != 2 {
+    t.Fatalf("Expected two stalled blobs, got %v", stalled)
+  }
+  for _, info := range stalled {
+    if info.PermaBlobRef != blobref1 {
+      t.Fatalf("Wrong perma node %v", info.PermaBlobRef)
+    }
+    switch info.BlobRef {
+    case blobref3:
+      if info.Kind != Stall_Missing || len(info.Missing) != 1 || info.Missing[0] != "sha256-lost" || len(info.Pending) != 0 {
+	t.Fatalf("Wrong classification of blob3: %v", info)
+      }
+    case blobref4:
+      if info.Kind != Stall_Pending || len(info.Pending) != 1 || info.Pending[0] != blobref3 || len(info.Missing) != 0 {
+	t.Fatalf("Wrong classification of blob4: %v", info)
+      }
+    default:
+      t.Fatalf("Unexpected stalled blob %v", info.BlobRef)
+    }
+  }
+
+  indexer.SetStallThreshold(DefaultStallThreshold)
+  if stalled := indexer.StalledBlobs(); len(stalled) != 0 {
+    t.Fatal("The blobs have not been waiting long enough to be stalled")
+  }
+}
+
+func TestKeepAuthorization(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Invite) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  // foo@bar invites x@y in turn
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"foo@bar", "action":"invite", "dep":["` + blobref4 + `"], "user":"x@y", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  blob6 := []byte(`{"type":"keep", "signer":"x@y", "permission":"` + blobref5 + `", "perma":"` + blobref1 + `", "dep":["` + blobref5 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4, blob5, blob6} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  if perm, inviter, ok := indexer.KeepAuthorization(blobref1, "foo@bar"); !ok || perm != blobref3 || inviter != "a@b" {
+    t.Fatalf("Wrong authorization of foo@bar: %v %v %v", perm, inviter, ok)
+  }
+  if perm, inviter, ok := indexer.KeepAuthorization(blobref1, "x@y"); !ok || perm != blobref5 || inviter != "foo@bar" {
+    t.Fatalf("Wrong authorization of x@y: %v %v %v", perm, inviter, ok)
+  }
+  if _, _, ok := indexer.KeepAuthorization(blobref1, "a@b"); ok {
+    t.Fatal("The signer of the perma node needs no authorization")
+  }
+  if _, _, ok := indexer.KeepAuthorization(blobref1, "nobody@bar"); ok {
+    t.Fatal("nobody@bar does not keep the perma node")
+  }
+}
+
+func TestUndo(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  indexer.SetUndoWindow(3)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  // Deletes "World"
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `"], "op":{"$t":[{"$s":6}, {"$d":5}]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref4 + `"], "op":{"$t":[{"$s":11}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4, blob5} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+  // The undo log survives the compaction of the entire history
+  if count, err := indexer.CompactHistory(blobref1); err != nil || count != 4 {
+    t.Fatalf("Expected 4 compacted blobs, got %v %v", count, err)
+  }
+  perma, _ := indexer.PermaNode(blobref1)
+  if text := contentText(perma.ot.Content()); text != "Hello !" {
+    t.Fatalf("Wrong content: %v", text)
+  }
+
+  // Undo the deletion. The later mutation is preserved
+  undo, err := indexer.Undo(blobref1, blobref4)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !indexer.blobs[undo] {
+    t.Fatal("The undo has not been applied")
+  }
+  if text := contentText(perma.ot.Content()); text != "Hello World!" {
+    t.Fatalf("Wrong content after undo: %v", text)
+  }
+  // Undoing the undo deletes "World" again
+  if _, err = indexer.Undo(blobref1, undo); err != nil {
+    t.Fatal(err)
+  }
+  if text := contentText(perma.ot.Content()); text != "Hello !" {
+    t.Fatalf("Wrong content after redo: %v", text)
+  }
+  // The first mutations fell out of the undo window of three mutations
+  if _, err = indexer.Undo(blobref1, blobref3); err != ErrUndoUnavailable {
+    t.Fatalf("Expected ErrUndoUnavailable, got %v", err)
+  }
+  if _, err = indexer.Undo(blobref1, blobref5); err != nil {
+    t.Fatal(err)
+  }
+  if text := contentText(perma.ot.Content()); text != "Hello " {
+    t.Fatalf("Wrong content after undoing the insertion: %v", text)
+  }
+}
+
+func TestLocalMutationApplied(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  app := &dummyAppIndexer{}
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref3 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref4 + `", "perma":"` + blobref1 + `", "dep":["` + blobref4 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  blob6 := []byte(`{"type":"mutation", "signer":"foo@bar", "perma":"` + blobref1 + `", "site":"site2", "dep":["` + blobref5 + `"], "op":{"$t":["Oh ", {"$s":11}]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+  // Concurrent to the mutation of foo@bar
+  blob7 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `"], "op":{"$t":[{"$s":11}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref7 := NewBlobRef(blob7)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4, blob5, blob6, blob7} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  if len(app.local) != 2 {
+    t.Fatalf("Expected two local mutations, got %v", len(app.local))
+  }
+  if _, ok := app.local[blobref6]; ok {
+    t.Fatal("The mutation of foo@bar is not local")
+  }
+  mut, ok := app.local[blobref7]
+  if !ok {
+    t.Fatal("The application has not been informed about the local mutation")
+  }
+  // The local mutation has been transformed against the insertion of foo@bar
+  skip := 0
+  for _, op := range mut.Operation.Operations {
+    if op.Kind == ot.SkipOp {
+      skip += op.Len
+    }
+  }
+  if skip != 14 {
+    t.Fatalf("The local mutation has not been transformed: %v", mut.Operation)
+  }
+  perma, _ := indexer.PermaNode(blobref1)
+  if text := contentText(perma.ot.Content()); text != "Oh Hello World!" {
+    t.Fatalf("Wrong content: %v", text)
+  }
+}
+
+func TestExpel(t *testing.T) {
+  store := NewSimpleBlobStore()
+  fed := &dummyFederation{}
+  indexer := NewIndexer("a@b", store, fed, 0)
+  app := &dummyAppIndexer{}
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"expel", "dep":["` + blobref4 + `"], "user":"foo@bar", "allow":0, "deny":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  // Expels a user who never kept the perma node
+  blob6 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"expel", "dep":["` + blobref5 + `"], "user":"x@y", "allow":0, "deny":0, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+  blob7 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref6 + `"], "op":{"$t":["Hello"]}, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref7 := NewBlobRef(blob7)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4, blob5, blob6, blob7} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  perma, _ := indexer.PermaNode(blobref1)
+  if perma.HasKeep("foo@bar") || perma.HasPermission("foo@bar", Perm_Read) || perma.HasPermission("foo@bar", Perm_Write) {
+    t.Fatal("foo@bar has not been expelled")
+  }
+  if len(perma.FollowersWithPermission(Perm_Read)) != 1 {
+    t.Fatalf("Wrong followers: %v", perma.FollowersWithPermission(Perm_Read))
+  }
+  if len(app.expelled) != 1 || app.expelled[0] != "foo@bar" {
+    t.Fatalf("Expected one expelled follower: %v", app.expelled)
+  }
+  // The expelled user is informed, but receives no later blobs
+  forwarded := func(blobref, userid string) bool {
+    for _, u := range fed.forwarded[blobref] {
+      if u == userid {
+	return true
+      }
+    }
+    return false
+  }
+  if !forwarded(blobref5, "foo@bar") {
+    t.Fatalf("The expulsion has not been forwarded to foo@bar: %v", fed.forwarded[blobref5])
+  }
+  if forwarded(blobref7, "foo@bar") {
+    t.Fatalf("The mutation must not be forwarded to the expelled user: %v", fed.forwarded[blobref7])
+  }
+  if !indexer.blobs[blobref6] {
+    t.Fatal("Expelling a user who never kept the perma node must be accepted")
+  }
+}
+
+func TestChangePermission(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"change", "dep":["` + blobref4 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Write) + `, "deny":0, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  // x@y has never been granted any permissions
+  blob6 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"change", "dep":["` + blobref5 + `"], "user":"x@y", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+  perma, _ := indexer.PermaNode(blobref1)
+  if !perma.HasPermission("foo@bar", Perm_Read) || perma.HasPermission("foo@bar", Perm_Write) {
+    t.Fatal("foo@bar must only have read permission")
+  }
+
+  store.StoreBlob(blob5, blobref5)
+  store.StoreBlob(blob6, blobref6)
+  indexer.WaitIdle()
+  if !indexer.blobs[blobref5] {
+    t.Fatal("The change has not been applied")
+  }
+  if !perma.HasPermission("foo@bar", Perm_Read | Perm_Write) {
+    t.Fatal("foo@bar has not been granted write permission")
+  }
+  if users := perma.FollowersWithPermission(Perm_Write); len(users) != 2 {
+    t.Fatalf("foo@bar must be a follower with write permission: %v", users)
+  }
+  if indexer.blobs[blobref6] || perma.HasPermission("x@y", Perm_Read) {
+    t.Fatal("Changing the permissions of a user without permissions must be rejected")
+  }
+}
+
+func TestBlobTime(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  before := time.Seconds()
+  blobref, err := indexer.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+  perma, _ := indexer.PermaNode(blobref)
+  if perma == nil {
+    t.Fatal("The perma node has not been indexed")
+  }
+  if ts := perma.Timestamp(); ts < before || ts > time.Seconds() + 1 {
+    t.Fatalf("Wrong timestamp %v, expected about %v", ts, before)
+  }
+
+  // A fake clock
+  clock = func() int64 { return 1136214245 }
+  defer func() { clock = time.Seconds }()
+  if now := nowRFC3339(); now != "2006-01-02T15:04:05Z" {
+    t.Fatalf("Wrong time %v", now)
+  }
+  tstruct, err := time.Parse(time.RFC3339, nowRFC3339())
+  if err != nil || tstruct.Seconds() != 1136214245 {
+    t.Fatalf("The time does not round-trip: %v %v", tstruct, err)
+  }
+}
+
+func TestAttachment(t *testing.T) {
+  store := NewSimpleBlobStore()
+  fed := &dummyFederation{}
+  indexer := NewIndexer("a@b", store, fed, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  // An image which arrives before its attachment blob
+  image := append([]byte{137, 'P', 'N', 'G', '\r', '\n', 26, 10}, []byte("image data")...)
+  imageref := NewBlobRef(image)
+  blob5 := []byte(`{"type":"attachment", "signer":"a@b", "perma":"` + blobref1 + `", "blob":"` + imageref + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  // An attachment signed by a user without write permission
+  other := []byte("other data")
+  otherref := NewBlobRef(other)
+  blob6 := []byte(`{"type":"attachment", "signer":"foo@bar", "perma":"` + blobref1 + `", "blob":"` + otherref + `", "t":"2006-01-02T15:04:05+07:00"}`)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4, image, blob5, blob6, other} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  data, err := indexer.GetAttachment(blobref1, imageref)
+  if err != nil || !bytes.Equal(data, image) {
+    t.Fatalf("Wrong attachment: %v %v", data, err)
+  }
+  if b, ok := indexer.nodes[imageref].(*blobNode); !ok || b.MimeType() != "image/png" || b.Signer() != "a@b" {
+    t.Fatalf("Wrong blob node: %v", indexer.nodes[imageref])
+  }
+  forwarded := false
+  for _, u := range fed.forwarded[imageref] {
+    forwarded = forwarded || u == "foo@bar"
+  }
+  if !forwarded {
+    t.Fatalf("The image has not been forwarded to foo@bar: %v", fed.forwarded[imageref])
+  }
+  if _, err = indexer.GetAttachment(blobref1, otherref); err != ErrUnknownAttachment {
+    t.Fatalf("Attachment without write permission must be ignored: %v", err)
+  }
+  if _, err = indexer.GetAttachment(NewBlobRef([]byte("unknown")), imageref); err != ErrUnknownAttachment {
+    t.Fatalf("The image is not attached to an unknown perma node: %v", err)
+  }
+}
+
+func TestSchemaError(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  tests := []struct {
+    blob string
+    err os.Error
+  }{
+    {`{"type":"permanode", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`, ErrMissingSigner},
+    {`{"type":"frobnicate", "signer":"a@b", "t":"2006-01-02T15:04:05+07:00"}`, ErrUnknownSchemaType},
+    {`{"type":"permanode", "signer":"a@b", "t":"yesterday"}`, ErrMalformedTime},
+    {`{"type":"mutation", "signer":"a@b", "perma":"xyz", "site":"site1", "t":"2006-01-02T15:04:05+07:00"}`, ErrMissingOperation},
+  }
+  for _, test := range tests {
+    var schema superSchema
+    if err := json.Unmarshal([]byte(test.blob), &schema); err != nil {
+      t.Fatal(err)
+    }
+    blobref := NewBlobRef([]byte(test.blob))
+    _, err := indexer.decodeNode(&schema, blobref)
+    serr, ok := err.(*SchemaError)
+    if !ok || serr.Err != test.err || serr.BlobRef != blobref {
+      t.Fatalf("Expected %v for %v, got %v", test.err, test.blob, err)
+    }
+  }
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+  if _, err := indexer.PermaNode(blobref2); err != ErrNotPermanode {
+    t.Fatalf("Expected ErrNotPermanode, got %v", err)
+  }
+  if _, err := indexer.Permission(blobref1); err != ErrNotPermissionNode {
+    t.Fatalf("Expected ErrNotPermissionNode, got %v", err)
+  }
+}
+
+func TestDeclineInvitation(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("foo@bar", store, &dummyFederation{}, 0)
+  app := &dummyAppIndexer{}
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  // The keep of a@b is not forwarded to foo@bar. Hence the invitations cannot be applied
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+  if indexer.openInvitations[blobref1] != blobref3 {
+    t.Fatal("The invitation is not open")
+  }
+  if err := indexer.DeclineInvitation(blobref1); err != nil {
+    t.Fatal(err)
+  }
+  if _, ok := indexer.openInvitations[blobref1]; ok {
+    t.Fatal("The invitation is still open")
+  }
+  if len(app.declined) != 1 || app.declined[0] != blobref3 {
+    t.Fatalf("Wrong declined invitations: %v", app.declined)
+  }
+  if err := indexer.DeclineInvitation(blobref1); err != ErrNoInvitation {
+    t.Fatalf("Expected ErrNoInvitation, got %v", err)
+  }
+
+  // a@b invites foo@bar again
+  store.StoreBlob(blob4, blobref4)
+  indexer.WaitIdle()
+  if indexer.openInvitations[blobref1] != blobref4 {
+    t.Fatal("The new invitation is not open")
+  }
+  if len(app.invitations) != 2 || app.invitations[1] != blobref4 {
+    t.Fatalf("Wrong invitations: %v", app.invitations)
+  }
+}
+
+func TestRevokeInvitation(t *testing.T) {
+  store := NewSimpleBlobStore()
+  fed := &dummyFederation{}
+  indexer := NewIndexer("a@b", store, fed, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+  if _, err := indexer.RevokeInvitation(blobref1, "x@y"); err != ErrNoInvitation {
+    t.Fatalf("Expected ErrNoInvitation, got %v", err)
+  }
+  expel, err := indexer.RevokeInvitation(blobref1, "foo@bar")
+  if err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+  perma, _ := indexer.PermaNode(blobref1)
+  if _, ok := perma.pendingInvitations["foo@bar"]; ok {
+    t.Fatal("The invitation is still pending")
+  }
+  forwarded := false
+  for _, u := range fed.forwarded[expel] {
+    forwarded = forwarded || u == "foo@bar"
+  }
+  if !forwarded {
+    t.Fatalf("The revocation has not been forwarded to foo@bar: %v", fed.forwarded[expel])
+  }
+
+  // foo@bar accepts the revoked invitation
+  store.StoreBlob(blob4, blobref4)
+  indexer.WaitIdle()
+  if perma.HasKeep("foo@bar") || perma.HasPermission("foo@bar", Perm_Read) {
+    t.Fatal("The keep of a revoked invitation must be rejected")
+  }
+  if _, err := indexer.RevokeInvitation(blobref1, "foo@bar"); err != ErrNoInvitation {
+    t.Fatalf("Expected ErrNoInvitation, got %v", err)
+  }
+}
+
+func TestLeave(t *testing.T) {
+  store := NewSimpleBlobStore()
+  fed := &dummyFederation{}
+  indexer := NewIndexer("foo@bar", store, fed, 0)
+  app := &dummyAppIndexer{}
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  // A perma node owned by foo@bar
+  blob5 := []byte(`{"type":"permanode", "signer":"foo@bar", "random":"perma2abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4, blob5} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+  if err := indexer.Leave(blobref5); err != ErrOwnerCannotLeave {
+    t.Fatalf("Expected ErrOwnerCannotLeave, got %v", err)
+  }
+  if err := indexer.Leave(blobref1); err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+  perma, _ := indexer.PermaNode(blobref1)
+  if perma.HasKeep("foo@bar") {
+    t.Fatal("foo@bar still keeps the perma node")
+  }
+  if len(app.left) != 1 || app.left[0] != blobref1 {
+    t.Fatalf("Wrong perma nodes left: %v", app.left)
+  }
+  if len(app.expelled) != 0 {
+    t.Fatalf("Leaving is no expulsion for the local user: %v", app.expelled)
+  }
+  // The other followers learn about it
+  graph := indexer.DependencyGraph(blobref1)
+  leave := ""
+  for blobref, deps := range graph {
+    if len(deps) == 1 && deps[0] == blobref4 {
+      leave = blobref
+    }
+  }
+  forwarded := false
+  for _, u := range fed.forwarded[leave] {
+    forwarded = forwarded || u == "a@b"
+  }
+  if !forwarded {
+    t.Fatalf("The leave %v has not been forwarded to a@b: %v", leave, fed.forwarded)
+  }
+  if err := indexer.Leave(blobref1); err != ErrNotFollowing {
+    t.Fatalf("Expected ErrNotFollowing, got %v", err)
+  }
+
+  // Later mutations are ignored
+  mutations := app.mutations
+  blob6 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + leave + `"], "op":{"$t":["Hello"]}, "t":"2006-01-03T15:04:05+07:00"}`)
+  store.StoreBlob(blob6, NewBlobRef(blob6))
+  indexer.WaitIdle()
+  if app.mutations != mutations {
+    t.Fatal("The mutation must be ignored after leaving")
+  }
+}
+
+func TestRejectWithoutWritePermission(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref3 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref4 + `", "perma":"` + blobref1 + `", "dep":["` + blobref4 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  // foo@bar may only read
+  blob6 := []byte(`{"type":"mutation", "signer":"foo@bar", "perma":"` + blobref1 + `", "site":"site2", "dep":["` + blobref5 + `"], "op":{"$t":[{"$s":11}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+  // The owner may always write
+  blob7 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref5 + `"], "op":{"$t":[{"$s":11}, "?"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref7 := NewBlobRef(blob7)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4, blob5, blob6, blob7} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  perma, _ := indexer.PermaNode(blobref1)
+  if text := contentText(perma.ot.Content()); text != "Hello World?" {
+    t.Fatalf("Wrong text: %v", text)
+  }
+  if applied, ok := indexer.blobs[blobref6]; !ok || applied {
+    t.Fatal("The mutation of foo@bar must be rejected")
+  }
+  if !indexer.blobs[blobref7] {
+    t.Fatal("The mutation of the owner has not been applied")
+  }
+}
+
+// Returns the sizes of the internal maps which track waiting blobs
+func (self *Indexer) pendingStats() map[string]int {
+  return map[string]int{"waitingBlobs": len(self.waitingBlobs), "waitingLists": len(self.waitingLists), "pendingBlobs": len(self.pendingBlobs), "waitingDeps": len(self.waitingDeps), "waitingRoots": len(self.waitingRoots), "waitingSince": len(self.waitingSince), "unsynced": len(self.unsynced), "requests": len(self.requests)}
+}
+
+func TestPendingStats(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site2", "dep":["` + blobref2 + `"], "op":{"$t":["World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  // Depends on both concurrent mutations
+  blob5 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `", "` + blobref4 + `"], "op":{"$t":[{"$s":10}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  // Depends on a mutation and on its successor
+  blob6 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref5 + `", "` + blobref3 + `"], "op":{"$t":[{"$s":11}, "?"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+  // Waits and is rejected eventually, because x@y may not write
+  blob7 := []byte(`{"type":"mutation", "signer":"x@y", "perma":"` + blobref1 + `", "site":"site3", "dep":["` + blobref4 + `", "` + blobref3 + `"], "op":{"$t":[{"$s":10}, "#"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref7 := NewBlobRef(blob7)
+
+  for _, blob := range [][]byte{blob6, blob2, blob7, blob5, blob1, blob4, blob3} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  for name, size := range indexer.pendingStats() {
+    if size != 0 {
+      t.Fatalf("%v is not empty: %v", name, indexer.pendingStats())
+    }
+  }
+  if !indexer.blobs[blobref6] || indexer.blobs[blobref7] {
+    t.Fatal("Wrong blobs have been applied")
+  }
+  perma, _ := indexer.PermaNode(blobref1)
+  if text := contentText(perma.ot.Content()); len(text) != 12 {
+    t.Fatalf("Wrong text: %v", text)
+  }
+}
+
+func TestRetryWaitingBlobs(t *testing.T) {
+  var now int64 = 1136214245e9
+  nanoClock = func() int64 { return now }
+  defer func() { nanoClock = time.Nanoseconds }()
+
+  store := NewSimpleBlobStore()
+  fed := &dummyFederation{}
+  app := &dummyAppIndexer{}
+  // The timeout is long enough that the retry loop does not interfere with the test
+  indexer := NewIndexerWithOptions("a@b", store, fed, IndexerOptions{WaitTimeout: 3600e9, MaxRequests: 1})
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  // Never stored
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `"], "op":{"$t":[{"$s":5}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  for _, blob := range [][]byte{blob1, blob2, blob4} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  indexer.retryWaitingBlobs()
+  if len(fed.requested) != 0 {
+    t.Fatalf("Requested blobs before the timeout: %v", fed.requested)
+  }
+  now += 3601e9
+  indexer.retryWaitingBlobs()
+  if len(fed.requested) != 1 || fed.requested[0] != blobref3 {
+    t.Fatalf("Missing blob has not been requested: %v", fed.requested)
+  }
+  // The request is not repeated before the next timeout
+  indexer.retryWaitingBlobs()
+  if len(fed.requested) != 1 {
+    t.Fatalf("Request has been repeated too early: %v", fed.requested)
+  }
+  now += 3600e9
+  indexer.retryWaitingBlobs()
+  if len(fed.requested) != 1 {
+    t.Fatalf("Requested blobs more often than allowed: %v", fed.requested)
+  }
+  if len(app.dropped) != 1 || app.dropped[0] != blobref4 {
+    t.Fatalf("Blob has not been dropped: %v", app.dropped)
+  }
+  for name, size := range indexer.pendingStats() {
+    if size != 0 {
+      t.Fatalf("%v is not empty: %v", name, indexer.pendingStats())
+    }
+  }
+  if len(indexer.StalledBlobs()) != 0 {
+    t.Fatal("Dropped blob is still stalled")
+  }
+}
+
+func newTestKeyRing(t *testing.T, userids ...string) *SimpleKeyRing {
+  keys := NewSimpleKeyRing()
+  for _, userid := range userids {
+    pub, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+      t.Fatal(err)
+    }
+    keys.AddPublicKey(userid, pub)
+    keys.AddPrivateKey(userid, priv)
+  }
+  return keys
+}
+
+func TestSignAndVerify(t *testing.T) {
+  keys := newTestKeyRing(t, "a@b")
+  store := NewSimpleBlobStore()
+  indexer := NewIndexerWithOptions("a@b", store, &dummyFederation{}, IndexerOptions{KeyRing: keys})
+
+  perma, err := indexer.CreatePermaBlob("")
+  if err != nil {
+    t.Fatal(err)
+  }
+  keep, err := indexer.CreateKeepBlob(perma, "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  var op ot.Operation
+  if err = json.Unmarshal([]byte(`{"$t":["Hello"]}`), &op); err != nil {
+    t.Fatal(err)
+  }
+  mut, err := indexer.CreateMutationBlob(perma, ot.Mutation{Operation: op, Site: "site1", Dependencies: []string{keep}})
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, blobref := range []string{perma, keep, mut} {
+    blob, _ := store.GetBlob(blobref)
+    var schema superSchema
+    if err = json.Unmarshal(blob, &schema); err != nil || schema.Sig == "" {
+      t.Fatalf("Blob is not signed: %v", string(blob))
+    }
+    if err = indexer.verifyBlob(blob, &schema); err != nil {
+      t.Fatalf("Signature does not verify: %v", err)
+    }
+    if !indexer.blobs[blobref] {
+      t.Fatalf("Signed blob %v has not been applied", blobref)
+    }
+  }
+  p, _ := indexer.PermaNode(perma)
+  if text := contentText(p.ot.Content()); text != "Hello" {
+    t.Fatalf("Wrong text: %v", text)
+  }
+
+  // Without a private key for the local user nothing can be signed
+  other := NewIndexerWithOptions("x@y", NewSimpleBlobStore(), &dummyFederation{}, IndexerOptions{KeyRing: keys})
+  if _, err = other.CreatePermaBlob(""); err != ErrNoPrivateKey {
+    t.Fatalf("Expected ErrNoPrivateKey, got %v", err)
+  }
+}
+
+func TestCanonicalJSON(t *testing.T) {
+  c1, err := canonicalJSON([]byte(`{"type":"keep", "signer":"a@b", "dep":["x", "y"], "at":3, "sig":"abc"}`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  c2, err := canonicalJSON([]byte(`{"at":3,"dep":["x","y"],"signer":"a@b","type":"keep"}`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if string(c1) != `{"at":3,"dep":["x","y"],"signer":"a@b","type":"keep"}` || !bytes.Equal(c1, c2) {
+    t.Fatalf("Canonical JSON differs: %v %v", string(c1), string(c2))
+  }
+}
+
+func TestRejectBadSignature(t *testing.T) {
+  keys := newTestKeyRing(t, "a@b", "x@y")
+  store1 := NewSimpleBlobStore()
+  indexer1 := NewIndexerWithOptions("a@b", store1, &dummyFederation{}, IndexerOptions{KeyRing: keys})
+  store2 := NewSimpleBlobStore()
+  indexer2 := NewIndexerWithOptions("x@y", store2, &dummyFederation{}, IndexerOptions{KeyRing: keys})
+
+  perma, _ := indexer1.CreatePermaBlob("")
+  blob, _ := store1.GetBlob(perma)
+  store2.StoreBlob(blob, perma)
+  indexer2.WaitIdle()
+  if !indexer2.blobs[perma] {
+    t.Fatal("Correctly signed blob has been rejected")
+  }
+
+  // The signature does not match the content
+  tampered := bytes.Replace(blob, []byte(`"signer":"a@b"`), []byte(`"signer":"x@y"`), 1)
+  tampered_blobref := NewBlobRef(tampered)
+  store2.StoreBlob(tampered, tampered_blobref)
+  // A blob without a signature
+  unsigned := []byte(`{"type":"permanode", "signer":"x@y", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  unsigned_blobref := NewBlobRef(unsigned)
+  store2.StoreBlob(unsigned, unsigned_blobref)
+  // A blob signed by a user whose key is unknown
+  var schema superSchema
+  json.Unmarshal(blob, &schema)
+  unknown := []byte(`{"type":"permanode", "signer":"u@v", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00", "sig":"` + schema.Sig + `"}`)
+  unknown_blobref := NewBlobRef(unknown)
+  store2.StoreBlob(unknown, unknown_blobref)
+  indexer2.WaitIdle()
+
+  for _, blobref := range []string{tampered_blobref, unsigned_blobref, unknown_blobref} {
+    if applied, ok := indexer2.blobs[blobref]; !ok || applied {
+      t.Fatalf("Blob %v has not been rejected", blobref)
+    }
+  }
+  if p, _ := indexer2.PermaNode(tampered_blobref); p != nil {
+    t.Fatal("Tampered perma node has been indexed")
+  }
+}
+
+func TestSnapshot(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  perma1, _ := indexer.CreatePermaBlob("application/x-test-file")
+  keep1, _ := indexer.CreateKeepBlob(perma1, "")
+  var op ot.Operation
+  if err := json.Unmarshal([]byte(`{"$t":["Hello"]}`), &op); err != nil {
+    t.Fatal(err)
+  }
+  mut1, _ := indexer.CreateMutationBlob(perma1, ot.Mutation{Operation: op, Site: "site1", Dependencies: []string{keep1}})
+  invite, _ := indexer.CreatePermissionBlob(perma1, []string{mut1}, "x@y", Perm_Read | Perm_Write, 0, PermAction_Invite)
+  change, _ := indexer.CreatePermissionBlob(perma1, []string{invite}, "x@y", Perm_Invite, Perm_Write, PermAction_Change)
+  // A child perma node which inherits the permissions
+  perma2, _ := indexer.CreateChildPermaBlob(perma1, "application/x-test-file", true)
+  keep2, _ := indexer.CreateKeepBlob(perma2, "")
+  indexer.WaitIdle()
+
+  var buf bytes.Buffer
+  if err := indexer.Snapshot(&buf); err != nil {
+    t.Fatal(err)
+  }
+
+  // The blobs are in the store of the restarted indexer
+  store2 := NewSimpleBlobStore()
+  indexer2 := NewIndexer("a@b", store2, &dummyFederation{}, 0)
+  if err := indexer2.Restore(&buf); err != nil {
+    t.Fatal(err)
+  }
+  for _, blobref := range []string{perma1, keep1, mut1, invite, change, perma2, keep2} {
+    blob, _ := store.GetBlob(blobref)
+    store2.StoreBlob(blob, blobref)
+  }
+  indexer2.WaitIdle()
+
+  for _, blobref := range []string{perma1, perma2} {
+    p1, _ := indexer.PermaNode(blobref)
+    p2, err := indexer2.PermaNode(blobref)
+    if err != nil || p2 == nil {
+      t.Fatalf("Perma node %v has not been restored: %v", blobref, err)
+    }
+    if p1.Owner() != p2.Owner() || p1.MimeType() != p2.MimeType() || p1.Parent() != p2.Parent() || p1.InheritsPermissions() != p2.InheritsPermissions() || !p2.HasKeep("a@b") {
+      t.Fatalf("Restored perma node %v differs", blobref)
+    }
+    for _, userid := range []string{"a@b", "x@y", "u@v"} {
+      for _, bit := range []int{Perm_Read, Perm_Write, Perm_Invite, Perm_Expel} {
+	if p1.HasPermission(userid, bit) != p2.HasPermission(userid, bit) {
+	  t.Fatalf("Permission %v of %v on %v differs after restore", bit, userid, blobref)
+	}
+      }
+    }
+  }
+  p1, _ := indexer.PermaNode(perma1)
+  p2, _ := indexer2.PermaNode(perma1)
+  if !p2.HasPermission("x@y", Perm_Invite) || p2.HasPermission("x@y", Perm_Write) {
+    t.Fatal("Wrong permissions of x@y after restore")
+  }
+  if text := contentText(p2.ot.Content()); text != contentText(p1.ot.Content()) || text != "Hello" {
+    t.Fatalf("Wrong text after restore: %v", text)
+  }
+  if len(p2.ot.Frontier()) != 1 || !p2.ot.Frontier()[change] {
+    t.Fatalf("Wrong frontier after restore: %v", p2.ot.Frontier())
+  }
+
+  // Blobs newer than the snapshot are indexed
+  if err := json.Unmarshal([]byte(`{"$t":[{"$s":5}, " World"]}`), &op); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := indexer2.CreateMutationBlob(perma1, ot.Mutation{Operation: op, Site: "site1", Dependencies: []string{change}}); err != nil {
+    t.Fatal(err)
+  }
+  indexer2.WaitIdle()
+  if text := contentText(p2.ot.Content()); text != "Hello World" {
+    t.Fatalf("Wrong text after restore: %v", text)
+  }
+}
+
+func TestMyPermaNodesAndInvitations(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("foo@bar", store, &dummyFederation{}, 0)
+
+  doc1, _ := indexer.CreatePermaBlob("")
+  indexer.CreateKeepBlob(doc1, "")
+  doc2, _ := indexer.CreatePermaBlob("")
+  indexer.CreateKeepBlob(doc2, "")
+  // Not kept by the local user
+  indexer.CreatePermaBlob("")
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+
+  mine := indexer.MyPermaNodes()
+  if len(mine) != 2 || (mine[0] != doc1 && mine[1] != doc1) || (mine[0] != doc2 && mine[1] != doc2) {
+    t.Fatalf("Wrong perma nodes of the local user: %v", mine)
+  }
+  invitations := indexer.Invitations()
+  if len(invitations) != 1 || invitations[0].PermaBlobRef != blobref1 || invitations[0].BlobRef != blobref3 {
+    t.Fatalf("Wrong invitations: %v", invitations)
+  }
+
+  // The results are not affected by blobs indexed later
+  savedMine := append([]string{}, mine...)
+  savedInvitations := append([]Invitation{}, invitations...)
+  if err := indexer.DeclineInvitation(blobref1); err != nil {
+    t.Fatal(err)
+  }
+  doc3, _ := indexer.CreatePermaBlob("")
+  indexer.CreateKeepBlob(doc3, "")
+  indexer.WaitIdle()
+  if len(mine) != len(savedMine) || mine[0] != savedMine[0] || mine[1] != savedMine[1] {
+    t.Fatalf("The perma nodes have been modified: %v", mine)
+  }
+  if len(invitations) != len(savedInvitations) || invitations[0] != savedInvitations[0] {
+    t.Fatalf("The invitations have been modified: %v", invitations)
+  }
+  if len(indexer.MyPermaNodes()) != 3 || len(indexer.Invitations()) != 0 {
+    t.Fatalf("Wrong results after indexing: %v %v", indexer.MyPermaNodes(), indexer.Invitations())
+  }
+}
+
+func TestWriteConcurrentToRevocation(t *testing.T) {
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  // a@b revokes the write permission of foo@bar
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"change", "dep":["` + blobref4 + `"], "user":"foo@bar", "allow":0, "deny":` + fmt.Sprintf("%v", Perm_Write) + `, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  // Concurrently, foo@bar mutates the document
+  blob6 := []byte(`{"type":"mutation", "signer":"foo@bar", "perma":"` + blobref1 + `", "site":"site2", "dep":["` + blobref4 + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+  // This mutation knows about the revocation
+  blob7 := []byte(`{"type":"mutation", "signer":"foo@bar", "perma":"` + blobref1 + `", "site":"site2", "dep":["` + blobref5 + `", "` + blobref6 + `"], "op":{"$t":[{"$s":5}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref7 := NewBlobRef(blob7)
+
+  // All replicas come to the same verdict, no matter in which order they receive the blobs
+  for _, order := range [][][]byte{[][]byte{blob1, blob2, blob3, blob4, blob5, blob6, blob7}, [][]byte{blob1, blob2, blob3, blob4, blob6, blob5, blob7}} {
+    store := NewSimpleBlobStore()
+    indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+    for _, blob := range order {
+      store.StoreBlob(blob, NewBlobRef(blob))
+    }
+    indexer.WaitIdle()
+    perma, _ := indexer.PermaNode(blobref1)
+    if text := contentText(perma.ot.Content()); text != "Hello" {
+      t.Fatalf("Wrong text: %v", text)
+    }
+    if !indexer.blobs[blobref6] {
+      t.Fatal("The mutation concurrent to the revocation must be applied")
+    }
+    if applied, ok := indexer.blobs[blobref7]; !ok || applied {
+      t.Fatal("The mutation following the revocation must be rejected")
+    }
+  }
+}
+
+func TestPermissionMasks(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blobref1, _ := indexer.CreatePermaBlob("")
+  blobref2, _ := indexer.CreateKeepBlob(blobref1, "")
+  blobref3, _ := indexer.CreatePermissionBlob(blobref1, []string{blobref2}, "foo@bar", Perm_Read, 0, PermAction_Invite)
+  indexer.WaitIdle()
+  // Read is granted already and Expel has never been granted
+  blobref4, err := indexer.CreatePermissionBlob(blobref1, []string{blobref3}, "foo@bar", Perm_Read | Perm_Write, Perm_Expel, PermAction_Change)
+  if err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+  blob4, _ := store.GetBlob(blobref4)
+  var schema superSchema
+  if err = json.Unmarshal(blob4, &schema); err != nil {
+    t.Fatal(err)
+  }
+  if schema.Allow != Perm_Write || schema.Deny != 0 {
+    t.Fatalf("Masks have not been normalized: allow=%v deny=%v", schema.Allow, schema.Deny)
+  }
+  perma, _ := indexer.PermaNode(blobref1)
+  if !indexer.blobs[blobref4] || !perma.HasPermission("foo@bar", Perm_Read | Perm_Write) {
+    t.Fatal("The change has not been applied")
+  }
+
+  // A permission which does not fit the permissions at its dependencies is rejected,
+  // even if it would fit the permissions after concurrent blobs.
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"change", "dep":["` + blobref3 + `"], "user":"foo@bar", "allow":0, "deny":` + fmt.Sprintf("%v", Perm_Write) + `, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  store.StoreBlob(blob5, blobref5)
+  indexer.WaitIdle()
+  if applied, ok := indexer.blobs[blobref5]; !ok || applied {
+    t.Fatal("A permission denying bits which the user did not have must be rejected")
+  }
+  if !perma.HasPermission("foo@bar", Perm_Write) {
+    t.Fatal("The rejected permission has been applied")
+  }
+}
+
+func TestExpelRequiresPermission(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref4 + `"], "user":"x@y", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  // foo@bar lacks Perm_Expel
+  blob6 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"foo@bar", "action":"expel", "dep":["` + blobref5 + `"], "user":"x@y", "allow":0, "deny":` + fmt.Sprintf("%v", Perm_Read) + `, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+  // Nobody can expel the owner
+  blob7 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"expel", "dep":["` + blobref5 + `"], "user":"a@b", "allow":0, "deny":0, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref7 := NewBlobRef(blob7)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4, blob5, blob6, blob7} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  perma, _ := indexer.PermaNode(blobref1)
+  if applied, ok := indexer.blobs[blobref6]; !ok || applied {
+    t.Fatal("The expel of a user without Perm_Expel must be rejected")
+  }
+  if !perma.HasPermission("x@y", Perm_Read) {
+    t.Fatal("x@y has been expelled")
+  }
+  if applied, ok := indexer.blobs[blobref7]; !ok || applied {
+    t.Fatal("Expelling the owner must be rejected")
+  }
+  if !perma.HasKeep("a@b") {
+    t.Fatal("The owner has been expelled")
+  }
+
+  // The owner expels foo@bar. The expel denies all bits of foo@bar
+  expel, err := indexer.CreatePermissionBlob(blobref1, []string{blobref5}, "foo@bar", 0, 0, PermAction_Expel)
+  if err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+  if !indexer.blobs[expel] || perma.HasKeep("foo@bar") || perma.HasPermission("foo@bar", Perm_Read) {
+    t.Fatal("foo@bar has not been expelled")
+  }
+  if bits, ok := perma.ot.permissions["foo@bar"]; !ok || bits != 0 {
+    t.Fatalf("Expected an explicit empty permission, got %v", bits)
+  }
+}
+
+func TestLeaveWithoutExpelPermission(t *testing.T) {
+  store := NewSimpleBlobStore()
+  app := &dummyAppIndexer{}
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  // foo@bar may only read, but can leave nevertheless
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"foo@bar", "action":"expel", "dep":["` + blobref4 + `"], "user":"foo@bar", "allow":0, "deny":` + fmt.Sprintf("%v", Perm_Read) + `, "t":"2006-01-03T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4, blob5} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  perma, _ := indexer.PermaNode(blobref1)
+  if !indexer.blobs[blobref5] || perma.HasKeep("foo@bar") {
+    t.Fatal("foo@bar could not leave")
+  }
+  if len(app.expelled) != 1 || app.expelled[0] != "foo@bar" {
+    t.Fatalf("To the other followers, leaving is an expulsion: %v", app.expelled)
+  }
+}
+
+func TestSnapshotExpelledUsers(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  perma1, _ := indexer.CreatePermaBlob("")
+  keep1, _ := indexer.CreateKeepBlob(perma1, "")
+  invite1, _ := indexer.CreatePermissionBlob(perma1, []string{keep1}, "x@y", Perm_Read | Perm_Write, 0, PermAction_Invite)
+  invite2, _ := indexer.CreatePermissionBlob(perma1, []string{invite1}, "u@v", Perm_Read, 0, PermAction_Invite)
+  invite3, _ := indexer.CreatePermissionBlob(perma1, []string{invite2}, "w@z", Perm_Read, 0, PermAction_Invite)
+  blob4 := []byte(`{"type":"keep", "signer":"x@y", "permission":"` + invite1 + `", "perma":"` + perma1 + `", "dep":["` + invite3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  keep4 := NewBlobRef(blob4)
+  store.StoreBlob(blob4, keep4)
+  indexer.WaitIdle()
+  blob5 := []byte(`{"type":"keep", "signer":"u@v", "permission":"` + invite2 + `", "perma":"` + perma1 + `", "dep":["` + keep4 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  keep5 := NewBlobRef(blob5)
+  store.StoreBlob(blob5, keep5)
+  indexer.WaitIdle()
+  // x@y is expelled, u@v leaves and the invitation of w@z is revoked
+  expel, _ := indexer.CreatePermissionBlob(perma1, []string{keep5}, "x@y", 0, 0, PermAction_Expel)
+  indexer.WaitIdle()
+  blob6 := []byte(`{"type":"permission", "perma":"` + perma1 + `", "signer":"u@v", "action":"expel", "dep":["` + expel + `"], "user":"u@v", "allow":0, "deny":` + fmt.Sprintf("%v", Perm_Read) + `, "t":"2006-01-03T15:04:05+07:00"}`)
+  leave := NewBlobRef(blob6)
+  store.StoreBlob(blob6, leave)
+  indexer.WaitIdle()
+  revoke, err := indexer.RevokeInvitation(perma1, "w@z")
+  if err != nil {
+    t.Fatal(err)
+  }
+  indexer.WaitIdle()
+
+  var buf bytes.Buffer
+  if err := indexer.Snapshot(&buf); err != nil {
+    t.Fatal(err)
+  }
+  store2 := NewSimpleBlobStore()
+  indexer2 := NewIndexer("a@b", store2, &dummyFederation{}, 0)
+  if err := indexer2.Restore(&buf); err != nil {
+    t.Fatal(err)
+  }
+  for _, blobref := range []string{perma1, keep1, invite1, invite2, invite3, keep4, keep5, expel, leave, revoke} {
+    blob, _ := store.GetBlob(blobref)
+    store2.StoreBlob(blob, blobref)
+  }
+  indexer2.WaitIdle()
+
+  p1, _ := indexer.PermaNode(perma1)
+  p2, _ := indexer2.PermaNode(perma1)
+  for _, userid := range []string{"x@y", "u@v", "w@z"} {
+    if p2.HasKeep(userid) || p2.HasPermission(userid, Perm_Read) || p1.HasPermission(userid, Perm_Read) {
+      t.Fatalf("%v regained permissions after restore", userid)
+    }
+  }
+  if users := p2.FollowersWithPermission(Perm_Read); len(users) != 1 || users[0] != "a@b" {
+    t.Fatalf("Wrong followers after restore: %v", users)
+  }
+}
+
+func TestTransferArrivingEarly(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"transfer", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  // The new owner transfers the ownership to x@y
+  blob4 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"foo@bar", "action":"transfer", "dep":["` + blobref3 + `"], "user":"x@y", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  // The second transfer arrives first. It is decided once the first one has been applied
+  for _, blob := range [][]byte{blob1, blob2, blob4, blob3} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+
+  perma, _ := indexer.PermaNode(blobref1)
+  if !indexer.blobs[blobref3] || !indexer.blobs[blobref4] {
+    t.Fatal("Both transfers must be applied")
+  }
+  if perma.Owner() != "x@y" {
+    t.Fatalf("Wrong owner %v", perma.Owner())
+  }
+}
+
+func TestDeleteDecidedCausally(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"transfer", "dep":["` + blobref3 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  // Concurrent to the transfer
+  blob5 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `"], "op":{"$t":[{"$s":5}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  // The new owner deletes a blob preceding the delete and a concurrent one
+  blob6 := []byte(`{"type":"delete", "signer":"foo@bar", "perma":"` + blobref1 + `", "dep":["` + blobref4 + `"], "blobs":["` + blobref3 + `", "` + blobref5 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+
+  // The delete arrives before the transfer on which it depends
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob5, blob6, blob4} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+  if !indexer.blobs[blobref6] {
+    t.Fatal("The delete of the new owner has not been accepted")
+  }
+  if store.HasBlobs([]string{blobref3})[0] {
+    t.Fatal("The blob preceding the delete has not been deleted")
+  }
+  if !store.HasBlobs([]string{blobref5})[0] {
+    t.Fatal("Blobs concurrent to the delete must not be deleted")
+  }
+}
+
+func TestKeepConcurrentToRevocation(t *testing.T) {
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  // The keep of foo@bar and the revocation of the invitation are concurrent
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"expel", "dep":["` + blobref3 + `"], "user":"foo@bar", "allow":0, "deny":` + fmt.Sprintf("%v", Perm_Read) + `, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  // foo@bar is invited again and accepts the invitation which depends on the revocation
+  blob6 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref5 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+  blob7 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref6 + `", "perma":"` + blobref1 + `", "dep":["` + blobref6 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref7 := NewBlobRef(blob7)
+
+  // The revocation wins regardless of the order in which the keep and the revocation arrive
+  for _, blobs := range [][][]byte{[][]byte{blob1, blob2, blob3, blob4, blob5}, [][]byte{blob1, blob2, blob3, blob5, blob4}} {
+    store := NewSimpleBlobStore()
+    indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+    for _, blob := range blobs {
+      store.StoreBlob(blob, NewBlobRef(blob))
+    }
+    indexer.WaitIdle()
+    perma, _ := indexer.PermaNode(blobref1)
+    if perma.HasKeep("foo@bar") {
+      t.Fatal("The keep of a revoked invitation must not be kept")
+    }
+    if perma.HasPermission("foo@bar", Perm_Read) {
+      t.Fatal("foo@bar must not have read permission")
+    }
+
+    store.StoreBlob(blob6, blobref6)
+    store.StoreBlob(blob7, blobref7)
+    indexer.WaitIdle()
+    if !indexer.blobs[blobref7] || indexer.Keeps(blobref1)["foo@bar"] != blobref7 {
+      t.Fatal("The keep depending on the revocation has not been accepted")
+    }
+    if !perma.HasPermission("foo@bar", Perm_Read) {
+      t.Fatal("foo@bar has not been granted read permission")
+    }
+  }
+}
+
+func TestAttachmentDecidedCausally(t *testing.T) {
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  image := append([]byte{137, 'P', 'N', 'G', '\r', '\n', 26, 10}, []byte("image data")...)
+  imageref := NewBlobRef(image)
+  // Two attachment blobs reference the same image. foo@bar may write at the dependencies of its attachment
+  blob4 := []byte(`{"type":"attachment", "signer":"a@b", "perma":"` + blobref1 + `", "blob":"` + imageref + `", "dep":["` + blobref2 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+  blob5 := []byte(`{"type":"attachment", "signer":"foo@bar", "perma":"` + blobref1 + `", "blob":"` + imageref + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref5 := NewBlobRef(blob5)
+  winner, signer := blobref4, "a@b"
+  if blobref5 < blobref4 {
+    winner, signer = blobref5, "foo@bar"
+  }
+
+  // The attachment of foo@bar arrives before the invitation on which it depends
+  for _, blobs := range [][][]byte{[][]byte{blob1, blob2, blob5, blob4, image, blob3}, [][]byte{blob1, blob2, image, blob3, blob4, blob5}} {
+    store := NewSimpleBlobStore()
+    indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+    for _, blob := range blobs {
+      store.StoreBlob(blob, NewBlobRef(blob))
+    }
+    indexer.WaitIdle()
+    if !indexer.blobs[blobref5] && winner == blobref5 {
+      t.Fatal("The attachment of foo@bar has not been accepted")
+    }
+    if indexer.attachments[imageref] != winner {
+      t.Fatalf("Expected the attachment %v to win, got %v", winner, indexer.attachments[imageref])
+    }
+    if b, ok := indexer.nodes[imageref].(*blobNode); !ok || b.attachment != winner || b.Signer() != signer {
+      t.Fatalf("Wrong blob node: %v", indexer.nodes[imageref])
+    }
+  }
+}
+
+func TestOrphanBlobsAreBounded(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  indexer.maxOrphans = 1
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  image1 := []byte("image data 1")
+  imageref1 := NewBlobRef(image1)
+  image2 := []byte("image data 2")
+  imageref2 := NewBlobRef(image2)
+  blob2 := []byte(`{"type":"attachment", "signer":"a@b", "perma":"` + blobref1 + `", "blob":"` + imageref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+
+  for _, blob := range [][]byte{blob1, image1, image2} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+  if indexer.waitingBlobs[imageref1] || !indexer.waitingBlobs[imageref2] {
+    t.Fatal("Only the most recent binary blob may wait for its attachment")
+  }
+  // The attachment of the blob which stopped waiting arrives nevertheless
+  store.StoreBlob(blob2, NewBlobRef(blob2))
+  indexer.WaitIdle()
+  if data, err := indexer.GetAttachment(blobref1, imageref1); err != nil || !bytes.Equal(data, image1) {
+    t.Fatalf("Wrong attachment: %v %v", data, err)
+  }
+}
+
+func TestCompactWithPendingInvitation(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read | Perm_Write) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `"], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  // foo@bar accepts the invitation and writes concurrently to the mutation of a@b
+  blob5 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "dep":["` + blobref3 + `"], "t":"2006-01-02T15:04:05+07:00"}`)
+  blob6 := []byte(`{"type":"mutation", "signer":"foo@bar", "perma":"` + blobref1 + `", "site":"site2", "dep":["` + blobref3 + `"], "op":{"$t":["Hi"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref6 := NewBlobRef(blob6)
+
+  for _, blob := range [][]byte{blob1, blob2, blob3, blob4} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+  if _, err := indexer.CompactHistory(blobref1); err != ErrPendingInvitations {
+    t.Fatalf("Expected ErrPendingInvitations, got %v", err)
+  }
+  for _, blob := range [][]byte{blob5, blob6} {
+    store.StoreBlob(blob, NewBlobRef(blob))
+  }
+  indexer.WaitIdle()
+  if !indexer.blobs[blobref6] {
+    t.Fatal("The mutation of the new follower has not been applied")
+  }
+  if _, err := indexer.CompactHistory(blobref1); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestDeferredBlob(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"3000-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+
+  if err := indexer.HandleBlob(blob1, blobref1); err != ErrBlobDeferred {
+    t.Fatalf("A blob from the far future must be deferred: %v", err)
+  }
+  // Once the blob is acceptable, handling it again succeeds
+  indexer.SetMaxClockSkew(0)
+  if err := indexer.HandleBlob(blob1, blobref1); err != nil {
+    t.Fatalf("A deferred blob must be handled again: %v", err)
+  }
+  if perma, _ := indexer.PermaNode(blobref1); perma == nil {
+    t.Fatal("The deferred blob has not been applied")
+  }
+}
+
+func TestActivityStreamDoesNotBlockIndexing(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  indexer.SetActivityCapacity(1)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  // Nobody reads the channel
+  ch := indexer.SubscribeActivity(blobref1)
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+  dep := blobref2
+  var last string
+  for i := 0; i < 5; i++ {
+    blob := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + dep + `"], "op":{"$t":[` + fmt.Sprintf("{\"$s\":%v}", i) + `, "x"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+    if i == 0 {
+      blob = []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + dep + `"], "op":{"$t":["x"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+    }
+    last = NewBlobRef(blob)
+    store.StoreBlob(blob, last)
+    dep = last
+  }
+  // Returns only if indexing did not block on the subscription
+  indexer.WaitIdle()
+  if !indexer.blobs[last] {
+    t.Fatal("The mutations have not been indexed")
+  }
+  if e := <-ch; e.BlobRef != last {
+    t.Fatalf("The subscription must hold the most recent event: %v", e)
+  }
+}
+
+func TestDropBlobWithoutMutex(t *testing.T) {
+  var now int64 = 1136214245e9
+  nanoClock = func() int64 { return now }
+  defer func() { nanoClock = time.Nanoseconds }()
+
+  store := NewSimpleBlobStore()
+  indexer := NewIndexerWithOptions("a@b", store, &dummyFederation{}, IndexerOptions{WaitTimeout: 3600e9, MaxRequests: 1})
+  app := &reentrantAppIndexer{indexer: indexer}
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  // Never stored
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+  now += 3601e9
+  indexer.retryWaitingBlobs()
+  now += 3600e9
+  // Deadlocks if the application indexer is called while the mutex is held
+  indexer.retryWaitingBlobs()
+  if len(app.dropped) != 1 || app.dropped[0] != blobref3 {
+    t.Fatalf("Blob has not been dropped: %v", app.dropped)
+  }
+  if len(app.stalled) != 0 {
+    t.Fatalf("The dropped blob must no longer stall: %v", app.stalled)
+  }
+  // Stops the retry loop
+  indexer.Close()
+}
+
+func TestRateLimitedMutationIsRetried(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  // A new token every 10ms
+  indexer.SetMutationRateLimit(100, 1)
+  app := &dummyAppIndexer{}
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref3 + `"], "op":{"$t":[{"$s":5}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+  ch := indexer.SubscribeActivity(blobref1)
+  store.StoreBlob(blob3, blobref3)
+  store.StoreBlob(blob4, blobref4)
+  indexer.WaitIdle()
+  indexer.mutex.Lock()
+  deferred := indexer.deferredBlobs[blobref4]
+  indexer.mutex.Unlock()
+  if !deferred {
+    t.Fatal("The second mutation must be deferred")
+  }
+  if len(app.rejected) != 1 || app.rejected[0] != blobref4 {
+    t.Fatalf("The application has not been informed about the rejected mutation: %v", app.rejected)
+  }
+  for {
+    select {
+    case e := <-ch:
+      if e.BlobRef != blobref4 {
+	continue
+      }
+    case <-time.After(5e9):
+      t.Fatal("The deferred mutation has not been retried")
+    }
+    break
+  }
+  indexer.mutex.Lock()
+  defer indexer.mutex.Unlock()
+  if !indexer.blobs[blobref4] || indexer.deferredBlobs[blobref4] {
+    t.Fatal("The deferred mutation has not been applied")
+  }
+}
+
+func TestClockSkewedBlobIsRetried(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+  indexer.SetMaxClockSkew(1)
+
+  // Acceptable in about two seconds
+  ts := time.SecondsToUTC(time.Seconds() + 2).Format(time.RFC3339)
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"` + ts + `"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":["Hello"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  ch := indexer.SubscribeActivity(blobref1)
+  store.StoreBlob(blob1, blobref1)
+  indexer.WaitIdle()
+  if perma, _ := indexer.PermaNode(blobref1); perma != nil {
+    t.Fatal("A blob from the future must be deferred")
+  }
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+  // The mutation waits for the perma node and yields an event once the perma node has been retried
+  select {
+  case <-ch:
+  case <-time.After(10e9):
+    t.Fatal("The deferred blob has not been retried")
+  }
+  if perma, _ := indexer.PermaNode(blobref1); perma == nil {
+    t.Fatal("The deferred blob has not been applied")
+  }
+  indexer.Close()
+}
+
+func TestFullTextIndexWithWorkers(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 2)
+  fulltext := NewFullTextIndex(indexer)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+
+  if result := fulltext.Search("world"); len(result) != 1 || result[0] != blobref1 {
+    t.Fatalf("Wrong search result: %v", result)
+  }
+  indexer.Close()
+}
+
+// Reports the downloads of perma nodes and subtrees on channels
+type downloadFederation struct {
+  dummyFederation
+  downloads chan string
+  subtrees chan string
+}
+
+func (self *downloadFederation) DownloadPermaNode(permission_blobref string) os.Error {
+  self.downloads <- permission_blobref
+  return nil
+}
+
+func (self *downloadFederation) DownloadSubtree(perma_blobref string) os.Error {
+  if self.subtrees != nil {
+    self.subtrees <- perma_blobref
+  }
+  return nil
+}
+
+func TestAcceptedKeepBeforePermanode(t *testing.T) {
+  store := NewSimpleBlobStore()
+  fed := &downloadFederation{downloads: make(chan string, 10)}
+  indexer := NewIndexer("foo@bar", store, fed, 0)
+  app := &dummyAppIndexer{}
+  indexer.AddListener(app)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  // The keep of the local user arrives before the permanode and the permission.
+  // It is checked once the permanode arrives and again once the permission has been applied.
+  store.StoreBlob(blob4, blobref4)
+  store.StoreBlob(blob3, blobref3)
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+
+  perma, err := indexer.PermaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  if !perma.HasKeep("foo@bar") {
+    t.Fatal("Missing a keep for foo@bar")
+  }
+  if len(indexer.waitingBlobs) != 0 || len(indexer.pendingBlobs) != 0 {
+    t.Fatal("Blobs are still waiting")
+  }
+  // The invitation is accepted and the perma node is downloaded exactly once
+  if len(app.accepted) != 1 || app.accepted[0] != blobref3 {
+    t.Fatalf("Wrong accepted invitations: %v", app.accepted)
+  }
+  select {
+  case permission := <-fed.downloads:
+    if permission != blobref3 {
+      t.Fatalf("Downloaded the wrong perma node: %v", permission)
+    }
+  case <-time.After(5e9):
+    t.Fatal("The perma node has not been downloaded")
+  }
+  select {
+  case permission := <-fed.downloads:
+    t.Fatalf("The perma node has been downloaded twice: %v", permission)
+  case <-time.After(1e8):
+  }
+  indexer.Close()
+}
+
+func TestUserPermissions(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  // foo@bar may read the first perma node and read and write the second one
+  var permas []string
+  for i, allow := range []int{Perm_Read, Perm_Read | Perm_Write} {
+    blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma` + fmt.Sprintf("%v", i) + `", "t":"2007-01-02T15:04:05+07:00"}`)
+    blobref1 := NewBlobRef(blob1)
+    blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2007-01-02T15:04:05+07:00"}`)
+    blobref1b := NewBlobRef(blob1b)
+    blob2 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":[], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", allow) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+    blobref2 := NewBlobRef(blob2)
+    store.StoreBlob(blob1, blobref1)
+    store.StoreBlob(blob1b, blobref1b)
+    store.StoreBlob(blob2, blobref2)
+    permas = append(permas, blobref1)
+  }
+  // A perma node on which foo@bar does not appear
+  blob3 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma3", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+
+  perms := indexer.UserPermissions("foo@bar")
+  if len(perms) != 2 || perms[permas[0]] != Perm_Read || perms[permas[1]] != Perm_Read | Perm_Write {
+    t.Fatalf("Wrong permissions for foo@bar: %v", perms)
+  }
+  // The results agree with HasPermission
+  for perma_blobref, mask := range perms {
+    perma, err := indexer.PermaNode(perma_blobref)
+    if perma == nil || err != nil {
+      t.Fatal("Did not find perma node")
+    }
+    if perma.HasPermission("foo@bar", Perm_Write) != (mask & Perm_Write != 0) {
+      t.Fatalf("UserPermissions disagrees with HasPermission on %v", perma_blobref)
+    }
+  }
+  // The owner has all permissions on all perma nodes
+  perms = indexer.UserPermissions("a@b")
+  all := Perm_Read | Perm_Write | Perm_Invite | Perm_Expel
+  if len(perms) != 3 || perms[permas[0]] != all || perms[permas[1]] != all || perms[blobref3] != all {
+    t.Fatalf("Wrong permissions for a@b: %v", perms)
+  }
+  if perms = indexer.UserPermissions("x@y"); len(perms) != 0 {
+    t.Fatalf("Unexpected permissions for x@y: %v", perms)
+  }
+}
+
+func TestKeeps(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":[], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref2 + `", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  indexer.WaitIdle()
+
+  // The keep of the local user is included
+  keeps := indexer.Keeps(blobref1)
+  if len(keeps) != 1 || keeps["a@b"] != blobref1b {
+    t.Fatalf("Wrong keeps: %v", keeps)
+  }
+
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+
+  keeps = indexer.Keeps(blobref1)
+  if len(keeps) != 2 || keeps["a@b"] != blobref1b || keeps["foo@bar"] != blobref3 {
+    t.Fatalf("Wrong keeps: %v", keeps)
+  }
+  // The result is a copy
+  keeps["x@y"] = "dummy"
+  if keeps = indexer.Keeps(blobref1); len(keeps) != 2 {
+    t.Fatalf("The keeps of the perma node have been modified: %v", keeps)
+  }
+  if keeps = indexer.Keeps("unknown"); keeps != nil {
+    t.Fatalf("Expected no keeps of an unknown perma node: %v", keeps)
+  }
+}
+
+func TestDownloadSubtree(t *testing.T) {
+  store := NewSimpleBlobStore()
+  fed := &downloadFederation{downloads: make(chan string, 10), subtrees: make(chan string, 10)}
+  indexer := NewIndexer("foo@bar", store, fed, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  // A child perma node of the first one
+  blob2 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma2xyz", "perma":"` + blobref1 + `", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":[], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"keep", "signer":"foo@bar", "permission":"` + blobref3 + `", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  store.StoreBlob(blob2, blobref2)
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+
+  if children := indexer.Children(blobref1); len(children) != 1 || children[0] != blobref2 {
+    t.Fatalf("Wrong children: %v", children)
+  }
+  if children := indexer.Children(blobref2); len(children) != 0 {
+    t.Fatalf("Wrong children of the child: %v", children)
+  }
+
+  // Accepting the invitation downloads the perma node and then its subtree
+  store.StoreBlob(blob4, blobref4)
+  indexer.WaitIdle()
+  select {
+  case permission := <-fed.downloads:
+    if permission != blobref3 {
+      t.Fatalf("Downloaded the wrong perma node: %v", permission)
+    }
+  case <-time.After(5e9):
+    t.Fatal("The perma node has not been downloaded")
+  }
+  select {
+  case perma_blobref := <-fed.subtrees:
+    if perma_blobref != blobref1 {
+      t.Fatalf("Downloaded the wrong subtree: %v", perma_blobref)
+    }
+  case <-time.After(5e9):
+    t.Fatal("The subtree has not been downloaded")
+  }
+  indexer.Close()
+}
+
+// Records the transformations reported in debug mode
+type debugAppIndexer struct {
+  dummyAppIndexer
+  // The keys are blobrefs, the values are the concurrent blobrefs
+  transformed map[string][]string
+}
+
+func (self *debugAppIndexer) Transformed(permanode_blobref string, blobref string, concurrent []string) {
+  self.transformed[blobref] = concurrent
+}
+
+func TestDebugTransformed(t *testing.T) {
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2007-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  // Two concurrent mutations
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site2", "dep":[], "op":{"$t":["Olla!!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+  // A mutation which knows both
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `", "` + blobref3 + `"], "op":{"$t":[{"$s":17}, "??"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref4 := NewBlobRef(blob4)
+
+  for _, debug := range []bool{false, true} {
+    store := NewSimpleBlobStore()
+    indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+    indexer.SetDebug(debug)
+    app := &debugAppIndexer{transformed: make(map[string][]string)}
+    indexer.AddListener(app)
+
+    store.StoreBlob(blob1, blobref1)
+    store.StoreBlob(blob1b, blobref1b)
+    store.StoreBlob(blob2, blobref2)
+    store.StoreBlob(blob3, blobref3)
+    store.StoreBlob(blob4, blobref4)
+    indexer.WaitIdle()
+
+    if !debug {
+      if len(app.transformed) != 0 {
+	t.Fatalf("Transformations reported without debugging: %v", app.transformed)
+      }
+      continue
+    }
+    // Only the second of the concurrent mutations has been transformed
+    if len(app.transformed) != 1 {
+      t.Fatalf("Wrong transformations: %v", app.transformed)
+    }
+    if c := app.transformed[blobref3]; len(c) != 1 || c[0] != blobref2 {
+      t.Fatalf("Wrong concurrent blobs of the second mutation: %v", c)
+    }
+  }
+}
+
+// Declines every invitation from within the callback
+type decliningAppIndexer struct {
+  dummyAppIndexer
+  indexer *Indexer
+  errors []os.Error
+}
+
+func (self *decliningAppIndexer) Invitation(permanode_blobref, invitation_blobref string) {
+  self.dummyAppIndexer.Invitation(permanode_blobref, invitation_blobref)
+  if _, err := self.indexer.PermaNode(permanode_blobref); err != nil {
+    self.errors = append(self.errors, err)
+  }
+  if err := self.indexer.DeclineInvitation(permanode_blobref); err != nil {
+    self.errors = append(self.errors, err)
+  }
+}
+
+func TestCallbackCallsIndexer(t *testing.T) {
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"permission", "perma":"` + blobref1 + `", "signer":"a@b", "action":"invite", "dep":["` + blobref2 + `"], "user":"foo@bar", "allow":` + fmt.Sprintf("%v", Perm_Read) + `, "deny":0, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  for _, workers := range []int{0, 2} {
+    store := NewSimpleBlobStore()
+    indexer := NewIndexer("foo@bar", store, &dummyFederation{}, workers)
+    app := &decliningAppIndexer{indexer: indexer}
+    indexer.AddListener(app)
+
+    store.StoreBlob(blob1, blobref1)
+    store.StoreBlob(blob3, blobref3)
+    indexer.WaitIdle()
+    if len(app.errors) != 0 {
+      t.Fatalf("Calling the indexer from the callback failed with %v workers: %v", workers, app.errors)
+    }
+    if len(app.declined) != 1 || app.declined[0] != blobref3 {
+      t.Fatalf("Wrong declined invitations with %v workers: %v", workers, app.declined)
+    }
+    indexer.Close()
+  }
+}
+
+// Removes itself when it observes the first mutation
+type leavingObserver struct {
+  dummyObserver
+  indexer *Indexer
+}
+
+func (self *leavingObserver) Mutation(permanode_blobref string, mutation ot.Mutation) {
+  self.dummyObserver.Mutation(permanode_blobref, mutation)
+  self.indexer.RemoveObserver(permanode_blobref, self)
+}
+
+func TestRemoveObserverDuringNotification(t *testing.T) {
+  store := NewSimpleBlobStore()
+  indexer := NewIndexer("a@b", store, &dummyFederation{}, 0)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1 := NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref1b := NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":[], "op":{"$t":["Hello World"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref2 := NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "site":"site1", "dep":["` + blobref2 + `"], "op":{"$t":[{"$s":11}, "!"]}, "t":"2006-01-02T15:04:05+07:00"}`)
+  blobref3 := NewBlobRef(blob3)
+
+  store.StoreBlob(blob1, blobref1)
+  store.StoreBlob(blob1b, blobref1b)
+  indexer.WaitIdle()
+
+  observer1 := &leavingObserver{indexer: indexer}
+  observer2 := &dummyObserver{}
+  indexer.AddObserver(blobref1, observer1)
+  indexer.AddObserver(blobref1, observer2)
+
+  store.StoreBlob(blob2, blobref2)
+  indexer.WaitIdle()
+  if observer1.mutations != 1 || observer2.mutations != 1 {
+    t.Fatalf("The observers missed the first mutation: %v %v", observer1.mutations, observer2.mutations)
+  }
+  store.StoreBlob(blob3, blobref3)
+  indexer.WaitIdle()
+  if observer1.mutations != 1 || observer2.mutations != 2 {
+    t.Fatalf("Wrong mutations after removing the observer: %v %v", observer1.mutations, observer2.mutations)
+  }
+}
@@ -0,0 +1,68 @@
+package lightwaveidx
+
+import (
+  "log"
+  "os"
+)
+
+// -----------------------------------------------------
+// Declining and revoking invitations
+//
+// An invitation is accepted by a keep blob, see CreateKeepBlob.
+// The invited user can decline the invitation instead. Declining is a local decision.
+// No blob is created, the inviter is not informed and the perma node is not downloaded.
+// A later invitation to the same perma node is reported to the application again.
+// The inviter can revoke an invitation which has not yet been accepted by expelling the invited user.
+// Keeps which cite a revoked invitation are rejected, unless they have been applied before the revocation.
+
+var ErrNoInvitation = os.NewError("No pending invitation")
+
+// Declines the open invitation of the local user to the perma node.
+func (self *Indexer) DeclineInvitation(perma_blobref string) (err os.Error) {
+  self.runOn(perma_blobref, func() {
+    self.lock()
+    defer self.unlock()
+    invitation, ok := self.openInvitations[perma_blobref]
+    self.openInvitations[perma_blobref] = "", false
+    if !ok {
+      err = ErrNoInvitation
+      return
+    }
+    log.Printf("The local user declined the invitation %v\n", invitation)
+    self.notifyApps(func(app ApplicationIndexer) {
+      app.DeclinedInvitation(perma_blobref, invitation)
+    })
+  })
+  return
+}
+
+// Revokes the invitation of the user to the perma node, provided that the user has not yet accepted it.
+// The local user must have the permission to expel users. Returns the blobref of the expel blob.
+func (self *Indexer) RevokeInvitation(perma_blobref, userid string) (blobref string, err os.Error) {
+  var frontier []string
+  self.runOn(perma_blobref, func() {
+    self.lock()
+    defer self.unlock()
+    perma, e := self.permaNode(perma_blobref)
+    if err = e; err != nil {
+      return
+    }
+    if perma == nil {
+      err = ErrUnknownPermaNode
+      return
+    }
+    if _, ok := perma.pendingInvitations[userid]; !ok {
+      err = ErrNoInvitation
+      return
+    }
+    if !perma.HasPermission(self.userID, Perm_Expel) {
+      err = ErrPermissionDenied
+      return
+    }
+    frontier = perma.ot.Frontier().IDs()
+  })
+  if err != nil {
+    return "", err
+  }
+  return self.CreatePermissionBlob(perma_blobref, frontier, userid, 0, 0, PermAction_Expel)
+}
@@ -0,0 +1,180 @@
+package lightwaveidx
+
+import (
+  "bytes"
+  "encoding/base64"
+  "github.com/agl/ed25519"
+  "json"
+  "os"
+  "sort"
+  "sync"
+)
+
+// -----------------------------------------------------
+// Signatures
+//
+// Schema blobs name their author in the "signer" property. If the indexer has a KeyRing,
+// the blobs created by the indexer are signed with the ed25519 private key of the local user
+// and the signature is stored base64-encoded in the "sig" property. Incoming schema blobs are
+// verified against the public key of their signer. Blobs with a missing or bad signature,
+// or signed by a user whose public key is unknown, are rejected.
+// The signature covers the canonical JSON of the blob, i.e. the blob without the "sig"
+// property, with all object keys sorted and without whitespace. Hence the signature does not
+// depend on the order in which the creator serialized the properties.
+// Binary blobs are not signed. They are bound to a perma node by a signed attachment blob.
+// Without a KeyRing blobs are neither signed nor verified.
+
+var (
+  ErrMissingSignature = os.NewError("Missing signature")
+  ErrBadSignature = os.NewError("Bad signature")
+  ErrUnknownKey = os.NewError("Unknown public key of the signer")
+  ErrNoPrivateKey = os.NewError("No private key for the local user")
+)
+
+// Maps userids to their ed25519 keys.
+type KeyRing interface {
+  // Returns nil if the public key of the user is not known
+  PublicKey(userid string) *[ed25519.PublicKeySize]byte
+  // Returns nil if the private key of the user is not known.
+  // The indexer asks for the key of the local user only.
+  PrivateKey(userid string) *[ed25519.PrivateKeySize]byte
+}
+
+// A KeyRing which keeps the keys in memory.
+type SimpleKeyRing struct {
+  mutex sync.Mutex
+  public map[string]*[ed25519.PublicKeySize]byte
+  private map[string]*[ed25519.PrivateKeySize]byte
+}
+
+func NewSimpleKeyRing() *SimpleKeyRing {
+  return &SimpleKeyRing{public: make(map[string]*[ed25519.PublicKeySize]byte), private: make(map[string]*[ed25519.PrivateKeySize]byte)}
+}
+
+func (self *SimpleKeyRing) AddPublicKey(userid string, key *[ed25519.PublicKeySize]byte) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  self.public[userid] = key
+}
+
+func (self *SimpleKeyRing) AddPrivateKey(userid string, key *[ed25519.PrivateKeySize]byte) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  self.private[userid] = key
+}
+
+func (self *SimpleKeyRing) PublicKey(userid string) *[ed25519.PublicKeySize]byte {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return self.public[userid]
+}
+
+func (self *SimpleKeyRing) PrivateKey(userid string) *[ed25519.PrivateKeySize]byte {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return self.private[userid]
+}
+
+// Returns the blob with a "sig" property. Without a KeyRing the blob is returned unchanged.
+func (self *Indexer) signBlob(blob []byte) ([]byte, os.Error) {
+  if self.keyRing == nil {
+    return blob, nil
+  }
+  key := self.keyRing.PrivateKey(self.userID)
+  if key == nil {
+    return nil, ErrNoPrivateKey
+  }
+  canonical, err := canonicalJSON(blob)
+  if err != nil {
+    return nil, err
+  }
+  sig := ed25519.Sign(key, canonical)
+  // Replace the closing brace of the blob
+  signed := append([]byte{}, blob[:len(blob)-1]...)
+  signed = append(signed, []byte(`,"sig":"`)...)
+  signed = append(signed, []byte(base64.StdEncoding.EncodeToString(sig[:]))...)
+  signed = append(signed, []byte(`"}`)...)
+  return signed, nil
+}
+
+// Checks the signature of a schema blob against the public key of its signer.
+func (self *Indexer) verifyBlob(blob []byte, schema *superSchema) os.Error {
+  if schema.Sig == "" {
+    return ErrMissingSignature
+  }
+  key := self.keyRing.PublicKey(schema.Signer)
+  if key == nil {
+    return ErrUnknownKey
+  }
+  sig, err := base64.StdEncoding.DecodeString(schema.Sig)
+  if err != nil || len(sig) != ed25519.SignatureSize {
+    return ErrBadSignature
+  }
+  canonical, err := canonicalJSON(blob)
+  if err != nil {
+    return err
+  }
+  var s [ed25519.SignatureSize]byte
+  copy(s[:], sig)
+  if !ed25519.Verify(key, canonical, &s) {
+    return ErrBadSignature
+  }
+  return nil
+}
+
+// Returns the canonical JSON of a schema blob, which is the input of signing and verification.
+func canonicalJSON(blob []byte) ([]byte, os.Error) {
+  var m map[string]interface{}
+  if err := json.Unmarshal(blob, &m); err != nil {
+    return nil, err
+  }
+  m["sig"] = nil, false
+  var buf bytes.Buffer
+  if err := writeCanonical(&buf, m); err != nil {
+    return nil, err
+  }
+  return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, value interface{}) os.Error {
+  switch v := value.(type) {
+  case map[string]interface{}:
+    keys := make([]string, 0, len(v))
+    for key, _ := range v {
+      keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    buf.WriteByte('{')
+    for i, key := range keys {
+      if i > 0 {
+	buf.WriteByte(',')
+      }
+      if err := writeCanonical(buf, key); err != nil {
+	return err
+      }
+      buf.WriteByte(':')
+      if err := writeCanonical(buf, v[key]); err != nil {
+	return err
+      }
+    }
+    buf.WriteByte('}')
+  case []interface{}:
+    buf.WriteByte('[')
+    for i, element := range v {
+      if i > 0 {
+	buf.WriteByte(',')
+      }
+      if err := writeCanonical(buf, element); err != nil {
+	return err
+      }
+    }
+    buf.WriteByte(']')
+  default:
+    data, err := json.Marshal(v)
+    if err != nil {
+      return err
+    }
+    buf.Write(data)
+  }
+  return nil
+}
@@ -0,0 +1,53 @@
+package lightwaveidx
+
+import (
+  "os"
+)
+
+// -----------------------------------------------------
+// Leaving a perma node
+//
+// A follower leaves a perma node by expelling itself. The expel blob is forwarded to the
+// other followers, which forget the keep of the user and hence stop forwarding blobs to the user.
+// To the other followers, leaving looks like an expulsion signed by the user who left.
+// Expelling oneself is the only expulsion which does not require Perm_Expel, see checkPermission.
+// The history of the perma node is still applied locally, but the mutations are no longer
+// passed to the application indexers. Accepting a new invitation lets the user follow again.
+// The owner of a perma node cannot leave it. Transfer the ownership first.
+
+var (
+  ErrOwnerCannotLeave = os.NewError("The owner cannot leave the perma node")
+  ErrNotFollowing = os.NewError("The local user does not follow the perma node")
+)
+
+// Stops the local user following the perma node. Returns once the expel blob has been stored.
+// The application indexers are informed via LeftPermaNode once the blob has been indexed.
+func (self *Indexer) Leave(perma_blobref string) (err os.Error) {
+  var frontier []string
+  self.runOn(perma_blobref, func() {
+    self.lock()
+    defer self.unlock()
+    perma, e := self.permaNode(perma_blobref)
+    if err = e; err != nil {
+      return
+    }
+    if perma == nil {
+      err = ErrUnknownPermaNode
+      return
+    }
+    if perma.Owner() == self.userID {
+      err = ErrOwnerCannotLeave
+      return
+    }
+    if !perma.HasKeep(self.userID) || perma.ot == nil {
+      err = ErrNotFollowing
+      return
+    }
+    frontier = perma.ot.Frontier().IDs()
+  })
+  if err != nil {
+    return
+  }
+  _, err = self.CreatePermissionBlob(perma_blobref, frontier, self.userID, 0, 0, PermAction_Expel)
+  return
+}
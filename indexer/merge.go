@@ -0,0 +1,193 @@
+package lightwaveidx
+
+import (
+  ot "lightwaveot"
+  "json"
+  "os"
+)
+
+// -----------------------------------------------------
+// Merging perma nodes
+//
+// Two users may independently create a perma node for the same document.
+// Merging copies the mutations of one perma node (the source) into the other (the target).
+// All copies are signed by the local user, but record the original mutation and its signer,
+// see MutationAuthor. Merging again reuses the copies which are already part of the target.
+// Each site of the source is replaced by a fresh site, because the sites of the source may
+// have been used in the target, too, and concurrent mutations must have distinct sites.
+// Each copy has the operation of the original mutation and depends on the copies of
+// the mutations the original depended on. Copies of mutations which did not depend on
+// any other mutation are concurrent to the entire history of the target. Hence they
+// are transformed against the target history like any concurrent mutation and all
+// followers of the target converge to the same content.
+//
+// A merge is only sound if
+//  - both perma nodes have the same mime type, i.e. both documents started out with the same empty content,
+//  - neither perma node has been compacted, because the copies are transformed against the
+//    entire history of the target and the history of the source must be complete,
+//  - the local user may write to the target and, if the source has other followers, invite users to it.
+// Only mutations are copied. Keeps, permissions and entities of the source are skipped,
+// but the followers of the source are invited to the target with the permissions they
+// have on the source. The source perma node and the keeps on it are left untouched.
+
+// Copies the mutations of the source perma node into the target perma node and invites the
+// followers of the source to the target. Returns the blobrefs of the copies and of the invitations.
+// Merging the same perma nodes again creates no new mutations and returns the existing copies.
+func (self *Indexer) Merge(target_blobref, source_blobref string) (blobrefs []string, err os.Error) {
+  if target_blobref == source_blobref {
+    return nil, os.NewError("Cannot merge a perma node with itself")
+  }
+  self.lock()
+  invitees, allows, frontier, applied, existing, err := self.prepareMerge(target_blobref, source_blobref)
+  self.unlock()
+  if err != nil {
+    return nil, err
+  }
+
+  if applied != nil {
+    // The keys are blobrefs of the source. The values are the blobrefs of the copies
+    // on which a copy must depend if its original depended on the key.
+    copies := make(map[string][]string)
+    // The keys are sites of the source. The values are the sites of the copies
+    sites := make(map[string]string)
+    for _, blobref := range applied {
+      blob, err := self.store.GetBlob(blobref)
+      if err != nil {
+	return blobrefs, err
+      }
+      var schema superSchema
+      if err = json.Unmarshal(blob, &schema); err != nil {
+	return blobrefs, err
+      }
+      deps := []string{}
+      seen := make(map[string]bool)
+      for _, dep := range schema.Dependencies {
+	for _, c := range copies[dep] {
+	  if !seen[c] {
+	    seen[c] = true
+	    deps = append(deps, c)
+	  }
+	}
+      }
+      // Blobs other than mutations are skipped. Copies depending on them depend on their dependencies instead
+      if schema.Type != "mutation" {
+	copies[blobref] = deps
+	continue
+      }
+      c, ok := existing[blobref]
+      if !ok {
+	site, ok := sites[schema.Site]
+	if !ok {
+	  site = ot.NewSite(self.userID)
+	  sites[schema.Site] = site
+	}
+	c, err = self.createMutationBlob(target_blobref, ot.Mutation{Operation: *schema.Operation, Site: site, Dependencies: deps}, map[string]interface{}{"copyof": blobref, "author": schema.Signer})
+	if err != nil {
+	  return blobrefs, err
+	}
+      }
+      copies[blobref] = []string{c}
+      blobrefs = append(blobrefs, c)
+    }
+  }
+
+  for i, userid := range invitees {
+    perm, err := self.CreatePermissionBlob(target_blobref, frontier, userid, allows[i], 0, PermAction_Invite)
+    if err != nil {
+      return blobrefs, err
+    }
+    blobrefs = append(blobrefs, perm)
+  }
+  return
+}
+
+// Checks whether the source can be merged into the target. Returns the followers of the source
+// which must be invited to the target together with their permissions on the source,
+// the frontier of the target, the blobs applied to the source or nil if the source has no history,
+// and the existing copies in the target, see copiesOf. The caller must hold the mutex.
+func (self *Indexer) prepareMerge(target_blobref, source_blobref string) (invitees []string, allows []int, frontier []string, applied []string, existing map[string]string, err os.Error) {
+  target, err := self.permaNode(target_blobref)
+  if err != nil {
+    return
+  }
+  source, err := self.permaNode(source_blobref)
+  if err != nil {
+    return
+  }
+  if target == nil || source == nil {
+    err = ErrUnknownPermaNode
+    return
+  }
+  if target.MimeType() != source.MimeType() {
+    err = os.NewError("Perma nodes of different mime types cannot be merged")
+    return
+  }
+  if (target.ot != nil && target.ot.checkpoint.count > 0) || (source.ot != nil && source.ot.checkpoint.count > 0) {
+    err = os.NewError("Compacted perma nodes cannot be merged")
+    return
+  }
+  if !target.HasPermission(self.userID, Perm_Write) {
+    err = ErrPermissionDenied
+    return
+  }
+  for _, userid := range source.Followers() {
+    if _, invited := target.pendingInvitations[userid]; userid != self.userID && !target.HasKeep(userid) && !invited {
+      allow := 0
+      for _, bit := range []int{Perm_Read, Perm_Write, Perm_Invite, Perm_Expel} {
+	if source.HasPermission(userid, bit) {
+	  allow |= bit
+	}
+      }
+      invitees = append(invitees, userid)
+      allows = append(allows, allow)
+    }
+  }
+  if len(invitees) > 0 && !target.HasPermission(self.userID, Perm_Invite) {
+    err = ErrPermissionDenied
+    return
+  }
+  // The invitations depend on the history of the target before the merge
+  frontier = []string{}
+  if target.ot != nil {
+    frontier = target.ot.Frontier().IDs()
+  }
+  if source.ot != nil {
+    applied = append([]string{}, source.ot.AppliedBlobs()...)
+    existing = self.copiesOf(target)
+  }
+  return
+}
+
+// Returns the copies of mutations in the perma node. The keys are the blobrefs of the originals,
+// the values are the blobrefs of the copies. The caller must hold the mutex.
+func (self *Indexer) copiesOf(perma *PermaNode) map[string]string {
+  copies := make(map[string]string)
+  if perma.ot == nil {
+    return copies
+  }
+  for blobref, n := range perma.ot.members {
+    if mut, ok := n.(*mutationNode); ok && mut.copyOf != "" {
+      copies[mut.copyOf] = blobref
+    }
+  }
+  return copies
+}
+
+// Returns the author of the mutation. For a copy created by Merge, this is the signer of the original mutation.
+// Returns an empty string if the mutation has not been applied to the perma node.
+func (self *Indexer) MutationAuthor(perma_blobref, blobref string) string {
+  self.lock()
+  defer self.unlock()
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil || perma == nil || perma.ot == nil {
+    return ""
+  }
+  mut, ok := perma.ot.members[blobref].(*mutationNode)
+  if !ok {
+    return ""
+  }
+  if mut.author != "" {
+    return mut.author
+  }
+  return mut.Signer()
+}
@@ -0,0 +1,65 @@
+package lightwaveidx
+
+import (
+  "time"
+)
+
+// -----------------------------------------------------
+// Rate limiting
+//
+// Mutations are rate limited per signer with a token bucket. Each mutation costs one token.
+// Tokens are refilled at a constant rate up to the size of the bucket. This allows for
+// short bursts, for example when the user pastes text.
+
+type tokenBucket struct {
+  tokens float64
+  // Time of the last refill in nanoseconds
+  last int64
+}
+
+type rateLimiter struct {
+  // Tokens per second
+  rate float64
+  // The size of the bucket
+  burst float64
+  // The keys are userids
+  buckets map[string]*tokenBucket
+  // Returns the current time in nanoseconds
+  now func() int64
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+  if burst < 1 {
+    burst = 1
+  }
+  return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket), now: time.Nanoseconds}
+}
+
+// Takes a token from the bucket of the user. Returns false if the bucket is empty.
+func (self *rateLimiter) allow(userid string) bool {
+  now := self.now()
+  b, ok := self.buckets[userid]
+  if !ok {
+    b = &tokenBucket{tokens: self.burst, last: now}
+    self.buckets[userid] = b
+  }
+  b.tokens += float64(now - b.last) / 1e9 * self.rate
+  if b.tokens > self.burst {
+    b.tokens = self.burst
+  }
+  b.last = now
+  if b.tokens < 1 {
+    return false
+  }
+  b.tokens--
+  return true
+}
+
+// Returns the time in nanoseconds until the bucket of the user holds a token again
+func (self *rateLimiter) delay(userid string) int64 {
+  b, ok := self.buckets[userid]
+  if !ok || b.tokens >= 1 {
+    return 0
+  }
+  return int64((1 - b.tokens) / self.rate * 1e9)
+}
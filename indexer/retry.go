@@ -0,0 +1,131 @@
+package lightwaveidx
+
+import (
+  "fmt"
+  "log"
+  "time"
+)
+
+// -----------------------------------------------------
+// Requesting missing dependencies
+//
+// A blob may wait for a dependency which never arrives, for example because a forward got lost.
+// If a wait timeout has been configured via NewIndexerWithOptions, the indexer asks the federation
+// for the missing dependencies of blobs which have been waiting for longer than the timeout.
+// Dependencies which are in the store but waiting themselves are not requested.
+// Their own missing dependencies are requested instead.
+// The request is repeated each time the blob has waited for another timeout. When the maximum
+// number of requests has been reached and the blob has waited for one more timeout, the blob is
+// dropped and the application indexers are informed. Blobs depending on a dropped blob time out as well.
+// Drops are permanent: a dropped blob counts as rejected and is not indexed again, even if its
+// dependencies arrive later. The blob remains in the store.
+// In contrast to StalledBlobs, which merely reports waiting blobs, this changes the state of the indexer.
+
+// Runs until the indexer is closed
+func (self *Indexer) retryLoop() {
+  for {
+    select {
+    case <-self.stop:
+      return
+    case <-time.After(self.waitTimeout):
+      self.retryWaitingBlobs()
+    }
+  }
+}
+
+// Requests the missing dependencies of blobs which have been waiting too long and drops blobs
+// which have been waiting for too many requests.
+func (self *Indexer) retryWaitingBlobs() {
+  self.lock()
+  now := nanoClock()
+  request := make(map[string]bool)
+  for blobref, since := range self.waitingSince {
+    // The number of timeouts which have elapsed
+    elapsed := int((now - since) / self.waitTimeout)
+    if elapsed <= self.requests[blobref] {
+      continue
+    }
+    missing := []string{}
+    for _, dep := range self.waitingDeps[blobref] {
+      // Lists are deleted once the dependency has been indexed
+      if _, ok := self.waitingLists[dep]; ok && dep != attachmentKey(blobref) && !self.store.HasBlob(dep) {
+	missing = append(missing, dep)
+      }
+    }
+    if self.maxRequests > 0 && self.requests[blobref] >= self.maxRequests {
+      self.dropBlob(blobref, fmt.Sprintf("Waited for dependencies %v too long", self.waitingDeps[blobref]))
+      continue
+    }
+    self.requests[blobref]++
+    for _, dep := range missing {
+      request[dep] = true
+    }
+  }
+  self.unlock()
+  if self.fed == nil {
+    return
+  }
+  for dep, _ := range request {
+    log.Printf("Requesting missing blob %v\n", dep)
+    self.fed.RequestBlob(dep)
+  }
+}
+
+// Gives up on a waiting blob. The caller must hold the mutex.
+func (self *Indexer) dropBlob(blobref string, reason string) {
+  log.Printf("Err: Dropping blob %v: %v\n", blobref, reason)
+  self.blobs[blobref] = false
+  self.forgetWaiting(blobref)
+  self.notifyApps(func(app ApplicationIndexer) {
+    app.DroppedBlob(blobref, reason)
+  })
+}
+
+// -----------------------------------------------------
+// Retrying deferred blobs
+//
+// A blob is deferred when its signer exceeded the rate limit or when its timestamp is too far
+// in the future. The blob is rejected for now. If the local user signed a rate limited mutation,
+// the application indexers are informed via MutationRejected.
+// Once the signer may issue mutations again or the local clock has caught up with the timestamp,
+// the blob is read from the store and handled again.
+// If it is deferred again, another retry is scheduled. A blob which arrives again in the meantime
+// is handled right away, see HandleBlob. Closing the indexer cancels the scheduled retries.
+
+// Deferred blobs are retried at least this often (in nanoseconds)
+const maxDeferDelay = 3600e9
+
+// Marks the blob as deferred and handles it again after the delay (in nanoseconds).
+// The caller must hold the mutex
+func (self *Indexer) deferBlob(blobref string, delay int64) {
+  self.deferredBlobs[blobref] = true
+  if delay < 0 {
+    delay = 0
+  } else if delay > maxDeferDelay {
+    delay = maxDeferDelay
+  }
+  go func() {
+    select {
+    case <-self.stop:
+      return
+    case <-time.After(delay):
+      self.retryDeferredBlob(blobref)
+    }
+  }()
+}
+
+// Handles a deferred blob again unless it has been handled in the meantime
+func (self *Indexer) retryDeferredBlob(blobref string) {
+  self.lock()
+  deferred := self.deferredBlobs[blobref]
+  self.unlock()
+  if !deferred {
+    return
+  }
+  blob, err := self.store.GetBlob(blobref)
+  if err != nil {
+    log.Printf("Err: Failed reading deferred blob %v: %v\n", blobref, err)
+    return
+  }
+  self.HandleBlob(blob, blobref)
+}
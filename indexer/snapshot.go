@@ -0,0 +1,366 @@
+package lightwaveidx
+
+import (
+  ot "lightwaveot"
+  lst "container/list"
+  "io"
+  "json"
+  "log"
+  "os"
+)
+
+// -----------------------------------------------------
+// Snapshots
+//
+// The indexer keeps its state in memory. Without a snapshot, a restarted indexer must index all
+// blobs of the store again. Snapshot writes the indexed state as JSON, i.e. the perma nodes with
+// their applied (and transformed) blobs, the attachments, the open invitations and the blobs which
+// are waiting for other blobs. The blobs themselves are not part of the snapshot.
+// Restore loads a snapshot into a new indexer. Afterwards, the blobs of the store can be passed
+// to HandleBlob again. Blobs which had been handled before the snapshot was taken are skipped,
+// such that only blobs which are newer than the snapshot are indexed.
+// The content, the frontier and the permissions of a perma node are not stored. Restore computes
+// them by executing the transformed blobs again, which is much cheaper than transforming them.
+// Activity feeds and the state of the rate limiter are not part of the snapshot.
+// Perma nodes whose history has been compacted cannot be snapshotted, because the content of the
+// compacted blobs is no longer known.
+
+var (
+  ErrSnapshotCompacted = os.NewError("Cannot snapshot a compacted history")
+  ErrSnapshotUser = os.NewError("The snapshot belongs to another user")
+  ErrMalformedSnapshot = os.NewError("Malformed snapshot")
+)
+
+type indexerSnapshot struct {
+  UserID string "user"
+  // The keys are blobrefs of handled blobs. The value is false for rejected blobs
+  Blobs map[string]bool "blobs"
+  // Ordered such that parents precede their children
+  PermaNodes []*permaSnapshot "permas"
+  // Attachments and attached binary blobs
+  Nodes []*nodeSnapshot "nodes"
+  OpenInvitations map[string]string "invitations"
+  AcceptedKeeps map[string]bool "accepted"
+  Children map[string][]string "children"
+  MimeTypes map[string][]string "mimetypes"
+  WaitingBlobs map[string]bool "waiting"
+  WaitingLists map[string][]string "lists"
+  PendingBlobs map[string]int "pending"
+  WaitingDeps map[string][]string "deps"
+  WaitingRoots map[string]string "roots"
+  Unsynced map[string]int "unsynced"
+  WaitingSince map[string]int64 "since"
+  Requests map[string]int "requests"
+}
+
+type permaSnapshot struct {
+  BlobRef string "blobref"
+  Parent string "perma"
+  Signer string "signer"
+  Time int64 "t"
+  MimeType string "mimetype"
+  Inherit bool "inherit"
+  // The frontier of the parent at which the permissions are inherited
+  ParentDeps []string "dep"
+  Keeps map[string]string "keeps"
+  PendingInvitations map[string]string "pending"
+  Left bool "left"
+  // Nil if the perma node has no OT history
+  History *historySnapshot "history"
+}
+
+type historySnapshot struct {
+  // The applied blobs in the order in which they have been applied
+  Applied []*nodeSnapshot "applied"
+  UndoWindow int "undo"
+}
+
+// A node other than a perma node. The fields which are used depend on the type.
+type nodeSnapshot struct {
+  // One of "mutation", "permission", "keep", "entity", "attachment" or "blob"
+  Type string "type"
+  BlobRef string "blobref"
+  Parent string "perma"
+  Signer string "signer"
+  Time int64 "t"
+  Dependencies []string "dep"
+  // The transformed operation of a mutation
+  Operation *ot.Operation "op"
+  Site string "site"
+  // Only for copies created by Merge. The original mutation and its signer
+  CopyOf string "copyof"
+  Author string "author"
+  // The transformed permission
+  Permission *ot.Permission "permission"
+  Action int "action"
+  // The group on whose behalf a permission has been issued
+  Group string "group"
+  // The invitation cited by a keep
+  Invitation string "invitation"
+  MimeType string "mimetype"
+  Content []byte "content"
+  // The binary blob referenced by an attachment
+  Blob string "blob"
+  // The attachment of a binary blob
+  Attachment string "attachment"
+}
+
+// Writes the indexed state to w. See Restore.
+func (self *Indexer) Snapshot(w io.Writer) os.Error {
+  self.WaitIdle()
+  self.lock()
+  snapshot := &indexerSnapshot{UserID: self.userID, Blobs: self.blobs, OpenInvitations: self.openInvitations, AcceptedKeeps: self.acceptedKeeps, Children: self.children, MimeTypes: self.mimeTypes, WaitingBlobs: self.waitingBlobs, WaitingLists: make(map[string][]string), PendingBlobs: self.pendingBlobs, WaitingDeps: self.waitingDeps, WaitingRoots: self.waitingRoots, Unsynced: self.unsynced, WaitingSince: self.waitingSince, Requests: self.requests}
+  // Deferred blobs are handled again after the snapshot has been restored
+  if len(self.deferredBlobs) > 0 {
+    snapshot.Blobs = make(map[string]bool)
+    for blobref, applied := range self.blobs {
+      if !self.deferredBlobs[blobref] {
+	snapshot.Blobs[blobref] = applied
+      }
+    }
+  }
+  for key, l := range self.waitingLists {
+    for e := l.Front(); e != nil; e = e.Next() {
+      snapshot.WaitingLists[key] = append(snapshot.WaitingLists[key], e.Value.(string))
+    }
+  }
+  added := make(map[string]bool)
+  for blobref, n := range self.nodes {
+    switch n.(type) {
+    case *PermaNode:
+      if err := self.snapshotPermaNode(snapshot, n.(*PermaNode), added); err != nil {
+	self.unlock()
+	return err
+      }
+    case *attachmentNode, *blobNode:
+      snapshot.Nodes = append(snapshot.Nodes, snapshotNode(n))
+    default:
+      // Nodes of the OT history are stored with their perma node
+      if _, ok := n.(otNode); !ok {
+	log.Printf("Err: Node %v cannot be snapshotted\n", blobref)
+      }
+    }
+  }
+  data, err := json.Marshal(snapshot)
+  self.unlock()
+  if err != nil {
+    return err
+  }
+  _, err = w.Write(data)
+  return err
+}
+
+// Adds the perma node to the snapshot after its parent. The caller must hold the mutex.
+func (self *Indexer) snapshotPermaNode(snapshot *indexerSnapshot, perma *PermaNode, added map[string]bool) os.Error {
+  if added[perma.BlobRef()] {
+    return nil
+  }
+  added[perma.BlobRef()] = true
+  if parent, ok := self.nodes[perma.Parent()].(*PermaNode); ok {
+    if err := self.snapshotPermaNode(snapshot, parent, added); err != nil {
+      return err
+    }
+  }
+  p := &permaSnapshot{BlobRef: perma.BlobRef(), Parent: perma.Parent(), Signer: perma.Signer(), Time: perma.Timestamp(), MimeType: perma.MimeType(), Inherit: perma.inherit, ParentDeps: perma.parentDeps, Keeps: perma.keeps, PendingInvitations: perma.pendingInvitations, Left: perma.left}
+  if perma.ot != nil {
+    if perma.ot.checkpoint.count > 0 {
+      return ErrSnapshotCompacted
+    }
+    p.History = &historySnapshot{UndoWindow: perma.ot.undoWindow}
+    for _, blobref := range perma.ot.appliedBlobs {
+      p.History.Applied = append(p.History.Applied, snapshotNode(perma.ot.members[blobref]))
+    }
+  }
+  snapshot.PermaNodes = append(snapshot.PermaNodes, p)
+  return nil
+}
+
+func snapshotNode(n interface{}) *nodeSnapshot {
+  abstract := n.(abstractNode)
+  s := &nodeSnapshot{BlobRef: abstract.BlobRef(), Parent: abstract.Parent(), Signer: abstract.Signer(), Time: abstract.Timestamp()}
+  switch n.(type) {
+  case *mutationNode:
+    mut := n.(*mutationNode)
+    s.Type = "mutation"
+    s.Dependencies = mut.mutation.Dependencies
+    s.Operation = &mut.mutation.Operation
+    s.Site = mut.mutation.Site
+    s.CopyOf = mut.copyOf
+    s.Author = mut.author
+  case *permissionNode:
+    perm := n.(*permissionNode)
+    s.Type = "permission"
+    s.Dependencies = perm.Dependencies()
+    s.Permission = &perm.permission
+    s.Action = perm.action
+    s.Group = perm.group
+  case *keepNode:
+    keep := n.(*keepNode)
+    s.Type = "keep"
+    s.Dependencies = keep.dependencies
+    s.Invitation = keep.permission
+  case *entityNode:
+    entity := n.(*entityNode)
+    s.Type = "entity"
+    s.Dependencies = entity.dependencies
+    s.MimeType = entity.mimeType
+    s.Content = entity.content
+  case *attachmentNode:
+    att := n.(*attachmentNode)
+    s.Type = "attachment"
+    s.Dependencies = att.dependencies
+    s.Blob = att.blob
+    s.MimeType = att.mimeType
+  case *blobNode:
+    b := n.(*blobNode)
+    s.Type = "blob"
+    s.MimeType = b.mimeType
+    s.Attachment = b.attachment
+  }
+  return s
+}
+
+func (self *nodeSnapshot) restore() (interface{}, os.Error) {
+  n := node{parent: self.Parent, signer: self.Signer, time: self.Time}
+  switch self.Type {
+  case "mutation":
+    if self.Operation == nil {
+      return nil, ErrMalformedSnapshot
+    }
+    return &mutationNode{node: n, mutation: ot.Mutation{Operation: *self.Operation, ID: self.BlobRef, Site: self.Site, Dependencies: self.Dependencies}, copyOf: self.CopyOf, author: self.Author}, nil
+  case "permission":
+    if self.Permission == nil {
+      return nil, ErrMalformedSnapshot
+    }
+    perm := *self.Permission
+    perm.ID = self.BlobRef
+    return &permissionNode{node: n, permission: perm, action: self.Action, group: self.Group}, nil
+  case "keep":
+    return &keepNode{node: n, blobref: self.BlobRef, dependencies: self.Dependencies, permission: self.Invitation}, nil
+  case "entity":
+    return &entityNode{node: n, blobref: self.BlobRef, dependencies: self.Dependencies, mimeType: self.MimeType, content: self.Content}, nil
+  case "attachment":
+    return &attachmentNode{node: n, blobref: self.BlobRef, dependencies: self.Dependencies, blob: self.Blob, mimeType: self.MimeType}, nil
+  case "blob":
+    return &blobNode{node: n, blobref: self.BlobRef, mimeType: self.MimeType, attachment: self.Attachment}, nil
+  }
+  return nil, ErrMalformedSnapshot
+}
+
+// Loads a snapshot written by Snapshot. The indexer must belong to the same user and
+// must not have handled any blobs yet.
+func (self *Indexer) Restore(r io.Reader) os.Error {
+  var snapshot indexerSnapshot
+  if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+    return err
+  }
+  if snapshot.UserID != self.userID {
+    return ErrSnapshotUser
+  }
+  self.lock()
+  defer self.unlock()
+  for _, p := range snapshot.PermaNodes {
+    perma := &PermaNode{blobref: p.BlobRef, mimeType: p.MimeType, node: node{time: p.Time, signer: p.Signer, parent: p.Parent}, keeps: p.Keeps, pendingInvitations: p.PendingInvitations, left: p.Left, inherit: p.Inherit, parentDeps: p.ParentDeps, indexer: self}
+    if perma.keeps == nil {
+      perma.keeps = make(map[string]string)
+    }
+    if perma.pendingInvitations == nil {
+      perma.pendingInvitations = make(map[string]string)
+    }
+    // The parent has been restored already
+    if parent, ok := self.nodes[perma.Parent()].(*PermaNode); ok && perma.inherit {
+      perma.inherited = parent.currentPermissions()
+      if parent.ot != nil {
+	state, err := parent.ot.PermissionsAt(perma.parentDeps)
+	if err != nil {
+	  return err
+	}
+	perma.inherited = state.copy()
+      }
+    }
+    self.nodes[perma.BlobRef()] = perma
+    if p.History == nil {
+      continue
+    }
+    // Like a history created by handleSchemaBlob
+    perma.ot = newOTHistory()
+    perma.ot.undoWindow = p.History.UndoWindow
+    perma.ot.permissions[perma.signer] = ^0
+    perma.ot.owner = perma.signer
+    for _, s := range p.History.Applied {
+      n, err := s.restore()
+      if err != nil {
+	return err
+      }
+      otnode, ok := n.(otNode)
+      if !ok {
+	return ErrMalformedSnapshot
+      }
+      if err = perma.ot.appendNode(otnode); err != nil {
+	if _, ok := otnode.(*mutationNode); ok {
+	  return err
+	}
+	// A permission which failed has been applied to the history nevertheless
+	log.Printf("Err: Restoring blob %v: %v\n", otnode.BlobRef(), err)
+      }
+      self.nodes[otnode.BlobRef()] = otnode
+    }
+  }
+  for _, s := range snapshot.Nodes {
+    n, err := s.restore()
+    if err != nil {
+      return err
+    }
+    self.nodes[s.BlobRef] = n
+    // The attachment blob with the smallest blobref wins
+    if att, ok := n.(*attachmentNode); ok {
+      if other, ok := self.attachments[att.blob]; !ok || att.BlobRef() < other {
+	self.attachments[att.blob] = att.BlobRef()
+      }
+    }
+  }
+  for key, blobrefs := range snapshot.WaitingLists {
+    l := lst.New()
+    for _, blobref := range blobrefs {
+      l.PushBack(blobref)
+    }
+    self.waitingLists[key] = l
+  }
+  if snapshot.Blobs != nil {
+    self.blobs = snapshot.Blobs
+  }
+  if snapshot.OpenInvitations != nil {
+    self.openInvitations = snapshot.OpenInvitations
+  }
+  if snapshot.AcceptedKeeps != nil {
+    self.acceptedKeeps = snapshot.AcceptedKeeps
+  }
+  if snapshot.Children != nil {
+    self.children = snapshot.Children
+  }
+  if snapshot.MimeTypes != nil {
+    self.mimeTypes = snapshot.MimeTypes
+  }
+  if snapshot.WaitingBlobs != nil {
+    self.waitingBlobs = snapshot.WaitingBlobs
+  }
+  if snapshot.PendingBlobs != nil {
+    self.pendingBlobs = snapshot.PendingBlobs
+  }
+  if snapshot.WaitingDeps != nil {
+    self.waitingDeps = snapshot.WaitingDeps
+  }
+  if snapshot.WaitingRoots != nil {
+    self.waitingRoots = snapshot.WaitingRoots
+  }
+  if snapshot.Unsynced != nil {
+    self.unsynced = snapshot.Unsynced
+  }
+  if snapshot.WaitingSince != nil {
+    self.waitingSince = snapshot.WaitingSince
+  }
+  if snapshot.Requests != nil {
+    self.requests = snapshot.Requests
+  }
+  return nil
+}
@@ -0,0 +1,107 @@
+package lightwaveidx
+
+import (
+  "log"
+  "time"
+)
+
+// -----------------------------------------------------
+// Stalled blobs
+//
+// A blob waits while some of its dependencies have not been indexed. Usually the dependencies
+// arrive shortly after. A blob which has been waiting for longer than the stall threshold is stalled.
+// For each stalled blob the indexer tells apart dependencies which are in the store but not
+// yet indexed, because they are waiting themselves, from dependencies which have never been seen.
+// The former are transient and resolve once the blobs they are waiting for arrive.
+// The latter have probably been lost and must be fetched again, for example by Pull.
+
+// Blobs waiting longer than one minute (in nanoseconds) are reported as stalled by default.
+const DefaultStallThreshold = 60000000000
+
+const (
+  // All missing dependencies are in the store, but they are waiting for other blobs
+  Stall_Pending = iota
+  // At least one dependency has never been seen
+  Stall_Missing
+)
+
+type StalledInfo struct {
+  BlobRef string
+  // The perma node to which the blob belongs
+  PermaBlobRef string
+  // The time in nanoseconds when the blob started waiting
+  Since int64
+  // Stall_Pending or Stall_Missing
+  Kind int
+  // Dependencies which are in the store but not yet indexed
+  Pending []string
+  // Dependencies which are not in the store
+  Missing []string
+}
+
+// Blobs which have been waiting for dependencies for longer than 'nanoseconds' are stalled.
+// The default is DefaultStallThreshold.
+func (self *Indexer) SetStallThreshold(nanoseconds int64) {
+  self.stallThreshold = nanoseconds
+}
+
+// Returns the blobs which have been waiting for their dependencies for longer than the stall threshold.
+func (self *Indexer) StalledBlobs() (result []StalledInfo) {
+  self.lock()
+  defer self.unlock()
+  now := nanoClock()
+  // The keys are the blobrefs of stalled blobs. The values are their missing dependencies
+  stalled := make(map[string]map[string]bool)
+  for blobref, since := range self.waitingSince {
+    if now - since >= self.stallThreshold {
+      stalled[blobref] = make(map[string]bool)
+    }
+  }
+  if len(stalled) == 0 {
+    return nil
+  }
+  for dep, l := range self.waitingLists {
+    for e := l.Front(); e != nil; e = e.Next() {
+      if deps, ok := stalled[e.Value.(string)]; ok {
+	deps[dep] = true
+      }
+    }
+  }
+  for blobref, deps := range stalled {
+    info := StalledInfo{BlobRef: blobref, PermaBlobRef: self.waitingRoots[blobref], Since: self.waitingSince[blobref], Kind: Stall_Pending}
+    for dep, _ := range deps {
+      if self.store.HasBlobs([]string{dep})[0] {
+	info.Pending = append(info.Pending, dep)
+      } else {
+	info.Missing = append(info.Missing, dep)
+	info.Kind = Stall_Missing
+      }
+    }
+    result = append(result, info)
+  }
+  return
+}
+
+// Logs the stalled blobs every 'interval' nanoseconds until the returned function is called.
+func (self *Indexer) ReportStalledBlobs(interval int64) (stop func()) {
+  done := make(chan bool, 1)
+  go func() {
+    for {
+      select {
+      case <-done:
+	return
+      case <-time.After(interval):
+      }
+      for _, info := range self.StalledBlobs() {
+	if info.Kind == Stall_Missing {
+	  log.Printf("Err: Blob %v of perma node %v is stalled. Never saw the dependencies %v\n", info.BlobRef, info.PermaBlobRef, info.Missing)
+	} else {
+	  log.Printf("Blob %v of perma node %v is stalled. The dependencies %v are waiting themselves\n", info.BlobRef, info.PermaBlobRef, info.Pending)
+	}
+      }
+    }
+  }()
+  return func() {
+    done <- true
+  }
+}
@@ -0,0 +1,139 @@
+package lightwaveidx
+
+import (
+  ot "lightwaveot"
+  "os"
+)
+
+// -----------------------------------------------------
+// Undo
+//
+// Undoing a mutation creates a new mutation which reverts its effect on the current content.
+// The inverse of a mutation is computed when the mutation is applied, because only then the
+// content it has been applied to is at hand. Each history keeps an undo log of the most recent
+// mutations in the order in which they have been applied, i.e. in their transformed form, together
+// with their inverses. The undo window is the number of mutations in the log.
+//
+// Interaction with checkpoints: Compact removes blobs from the live history but leaves the undo
+// log untouched. Hence a mutation can be undone as long as it is in the undo window, no matter
+// whether it has been compacted. Compaction never waits for the undo window.
+//
+// Interaction with PruneMutation: when a concurrent blob arrives, the history prunes and transforms
+// a copy of the recent history in order to transform the new blob. The applied mutations themselves are
+// never rolled back. The undo log therefore records a linear sequence of mutations, each applying to the
+// content left by its predecessor. To undo a mutation, its inverse is transformed against all mutations
+// which have been applied after it and the result depends on the current frontier. Mutations concurrent to
+// the undo are transformed against it like any other concurrent mutation.
+//
+// Only string operations on text content can be inverted. Other mutations are logged, because inverses
+// must be transformed against them, but they cannot be undone.
+
+// By default the last 100 mutations of each perma node can be undone
+const DefaultUndoWindow = 100
+
+var (
+  ErrUndoUnavailable = os.NewError("The mutation is not in the undo window")
+  ErrNotInvertible = os.NewError("The mutation cannot be inverted")
+)
+
+type undoEntry struct {
+  blobref string
+  // The mutation as it has been applied
+  mutation ot.Mutation
+  // Reverts the mutation if applied right after it. Nil if the mutation cannot be inverted.
+  inverse *ot.Operation
+}
+
+// Sets the number of recent mutations per perma node which can be undone.
+// The window applies to perma nodes which are indexed afterwards.
+// A window of 0 disables undo.
+func (self *Indexer) SetUndoWindow(count int) {
+  self.lock()
+  self.undoWindow = count
+  self.unlock()
+}
+
+// Creates a mutation which reverts the effect of the specified mutation of the perma node.
+// Mutations applied after the undone one are preserved.
+// Returns ErrUndoUnavailable if the mutation is not among the recent mutations of the undo window.
+func (self *Indexer) Undo(perma_blobref, mutation_blobref string) (blobref string, err os.Error) {
+  var mut ot.Mutation
+  self.runOn(perma_blobref, func() {
+    // The history is read while holding the mutex, because blobs of other perma nodes may be indexed meanwhile
+    self.lock()
+    defer self.unlock()
+    perma, e := self.permaNode(perma_blobref)
+    if err = e; err == nil && perma != nil && !perma.HasPermission(self.userID, Perm_Write) {
+      err = ErrPermissionDenied
+    }
+    if err != nil {
+      return
+    }
+    if perma == nil {
+      err = ErrUnknownPermaNode
+      return
+    }
+    if perma.ot == nil {
+      err = ErrUndoUnavailable
+      return
+    }
+    mut, err = perma.ot.undo(mutation_blobref, ot.NewSite(self.userID))
+  })
+  if err != nil {
+    return
+  }
+  return self.CreateMutationBlob(perma_blobref, mut)
+}
+
+// Returns the inverse of the mutation in the state before it is applied or nil
+// if the mutation cannot be inverted.
+func (self *otHistory) inverse(mut ot.Mutation) *ot.Operation {
+  if self.undoWindow <= 0 || mut.Operation.Kind != ot.StringOp {
+    return nil
+  }
+  text, ok := self.content.(*ot.SimpleText)
+  if self.content == nil {
+    text, ok = ot.NewSimpleText(""), true
+  }
+  if !ok {
+    return nil
+  }
+  op, err := text.Inverse(mut.Operation)
+  if err != nil {
+    return nil
+  }
+  return &op
+}
+
+// Appends an applied mutation to the undo log and drops entries which fall out of the undo window
+func (self *otHistory) logUndo(blobref string, mut ot.Mutation, inverse *ot.Operation) {
+  if self.undoWindow <= 0 {
+    return
+  }
+  self.undoLog = append(self.undoLog, undoEntry{blobref: blobref, mutation: mut, inverse: inverse})
+  if len(self.undoLog) > self.undoWindow {
+    self.undoLog = self.undoLog[len(self.undoLog) - self.undoWindow:]
+  }
+}
+
+// Returns a mutation which reverts the logged mutation when applied to the current content.
+// The mutation depends on the current frontier.
+func (self *otHistory) undo(blobref string, site string) (mut ot.Mutation, err os.Error) {
+  for i, entry := range self.undoLog {
+    if entry.blobref != blobref {
+      continue
+    }
+    if entry.inverse == nil {
+      return mut, ErrNotInvertible
+    }
+    mut = ot.Mutation{Operation: *entry.inverse, Site: site}
+    for _, later := range self.undoLog[i+1:] {
+      if _, mut, err = ot.Transform(later.mutation, mut); err != nil {
+	return
+      }
+    }
+    mut.Dependencies = self.frontier.IDs()
+    return
+  }
+  return mut, ErrUndoUnavailable
+}
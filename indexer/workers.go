@@ -0,0 +1,199 @@
+package lightwaveidx
+
+import (
+  "hash/crc32"
+  "json"
+  "log"
+  "sync"
+)
+
+// -----------------------------------------------------
+// Workers
+//
+// With workers, blobs of different perma nodes are indexed in parallel.
+// All blobs of a perma node are handled by the same worker in the order in which
+// they are dispatched. Hence the OT state of a perma node is only touched by its worker.
+// The bookkeeping shared by all perma nodes is guarded by the mutex of the indexer.
+// Workers load blobs from the store in parallel, but hold the mutex while indexing a blob,
+// such that readers never observe a partially indexed blob.
+// The callbacks into the application indexers run on a separate notifier in the order in which
+// they have been queued, see Indexer.unlock.
+// Close stops the workers.
+
+type indexJob struct {
+  // The blob data or nil if the blob must be loaded from the store
+  blob []byte
+  blobref string
+  // If not nil, the job runs this function instead of handling a blob
+  f func()
+}
+
+type worker struct {
+  mutex sync.Mutex
+  cond *sync.Cond
+  queue []indexJob
+  // True once the worker has been told to stop
+  closed bool
+}
+
+func newWorker() *worker {
+  w := &worker{}
+  w.cond = sync.NewCond(&w.mutex)
+  return w
+}
+
+func (self *worker) push(job indexJob) {
+  self.mutex.Lock()
+  self.queue = append(self.queue, job)
+  self.cond.Signal()
+  self.mutex.Unlock()
+}
+
+// Returns false if the worker has been closed and its queue is empty
+func (self *worker) pop() (job indexJob, ok bool) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  for len(self.queue) == 0 && !self.closed {
+    self.cond.Wait()
+  }
+  if len(self.queue) == 0 {
+    return indexJob{}, false
+  }
+  job = self.queue[0]
+  self.queue = self.queue[1:]
+  return job, true
+}
+
+// Lets the worker stop once its queue is empty
+func (self *worker) close() {
+  self.mutex.Lock()
+  self.closed = true
+  self.cond.Broadcast()
+  self.mutex.Unlock()
+}
+
+// Counts the jobs which have been dispatched but not yet completed
+type pendingJobs struct {
+  mutex sync.Mutex
+  cond *sync.Cond
+  count int
+}
+
+func (self *pendingJobs) init() {
+  if self.cond == nil {
+    self.cond = sync.NewCond(&self.mutex)
+  }
+}
+
+func (self *pendingJobs) add() {
+  self.mutex.Lock()
+  self.count++
+  self.mutex.Unlock()
+}
+
+func (self *pendingJobs) done() {
+  self.mutex.Lock()
+  self.init()
+  self.count--
+  if self.count == 0 {
+    self.cond.Broadcast()
+  }
+  self.mutex.Unlock()
+}
+
+func (self *pendingJobs) wait() {
+  self.mutex.Lock()
+  self.init()
+  for self.count > 0 {
+    self.cond.Wait()
+  }
+  self.mutex.Unlock()
+}
+
+func (self *Indexer) startWorkers(count int) {
+  self.workers = make([]*worker, count)
+  for i := range self.workers {
+    self.workers[i] = newWorker()
+    go self.work(self.workers[i])
+  }
+  self.notifier = newWorker()
+  go self.work(self.notifier)
+}
+
+func (self *Indexer) work(w *worker) {
+  for {
+    job, ok := w.pop()
+    if !ok {
+      return
+    }
+    if job.f != nil {
+      job.f()
+    } else {
+      self.runJob(job)
+    }
+    self.pending.done()
+  }
+}
+
+func (self *Indexer) runJob(job indexJob) {
+  if job.blob == nil {
+    blob, err := self.store.GetBlob(job.blobref)
+    if err != nil {
+      log.Printf("Failed retrieving blob: %v\n", err)
+      return
+    }
+    job.blob = blob
+  }
+  self.lock()
+  defer self.unlock()
+  self.handleBlob(job.blob, job.blobref)
+}
+
+// Stops listening to the store, stops the retry loop and stops the workers once the jobs dispatched so far have completed.
+// The indexer must not be used afterwards.
+// Must not be called from within an ApplicationIndexer callback, because it waits for the callback to complete.
+func (self *Indexer) Close() {
+  self.store.RemoveListener(self)
+  close(self.stop)
+  self.pending.wait()
+  for _, w := range self.workers {
+    w.close()
+  }
+  if self.notifier != nil {
+    self.notifier.close()
+  }
+}
+
+// Queues the job at the worker responsible for the perma node
+func (self *Indexer) dispatch(perma_blobref string, job indexJob) {
+  self.pending.add()
+  self.workers[crc32.ChecksumIEEE([]byte(perma_blobref)) % uint32(len(self.workers))].push(job)
+}
+
+// Runs f on the worker responsible for the perma node and waits until it completes.
+// Without workers, f runs on the calling goroutine.
+func (self *Indexer) runOn(perma_blobref string, f func()) {
+  if self.workers == nil {
+    f()
+    return
+  }
+  done := make(chan bool)
+  self.dispatch(perma_blobref, indexJob{f: func() {
+    f()
+    done <- true
+  }})
+  <-done
+}
+
+// Returns the blobref of the perma node which is responsible for the blob.
+// This is the perma node the blob belongs to, the parent of a perma node or
+// the perma node itself. Blobs which are no schema blobs are responsible for themselves.
+func permaOf(blob []byte, blobref string) string {
+  var schema struct {
+    PermaNode string "perma"
+  }
+  if MimeType(blob) != "application/x-lightwave-schema" || json.Unmarshal(blob, &schema) != nil || schema.PermaNode == "" {
+    return blobref
+  }
+  return schema.PermaNode
+}
@@ -261,6 +261,12 @@ func (self Frontier) FromIDs(ids []string) {
 // ----------------------------------------------------------------------
 // HistoryGraph
 
+// A HistoryGraph determines which part of a history is known to a remote site.
+// It starts with the local frontier and the frontier of the remote site (dest).
+// The history is then walked backwards, i.e. newest blobs first, and each blob is substituted
+// by its dependencies. Blobs that are reachable from dest are marked, because the remote
+// site knows them already. Once Test returns true, all remaining blobs are known
+// to the remote site and the walk can stop.
 type HistoryGraph struct {
   frontier    map[string]bool
   oldFrontier map[string]bool
@@ -308,6 +314,8 @@ func (self *HistoryGraph) Substitute(mut Mutation) bool {
   return ismarked
 }
 
+// Replaces the blob by its dependencies. The blob must be part of the current frontier of the graph.
+// Returns true if the remote site knows the blob and false if it is missing at the remote site.
 func (self *HistoryGraph) SubstituteBlob(blobref string, dependencies []string) bool {
   if _, ok := self.frontier[blobref]; !ok {
     panic("Substituting a mutation that is not part of the history graph")
@@ -331,6 +339,42 @@ func (self *HistoryGraph) SubstituteBlob(blobref string, dependencies []string)
   return ismarked
 }
 
+// Returns true if the remote site knows all blobs which have not been substituted yet.
 func (self *HistoryGraph) Test() bool {
   return self.markedCount == len(self.frontier)
 }
+
+// A blob of the history as seen by the HistoryGraph
+type HistoryNode interface {
+  BlobRef() string
+  Dependencies() []string
+}
+
+// Walks the history and returns the blobrefs which the remote site is missing.
+// The history must deliver the blobs in descending order, i.e. each blob is delivered
+// before its dependencies. The walk stops as soon as the remaining blobs are known
+// to the remote site, hence the channel is not necessarily drained.
+func (self *HistoryGraph) Missing(history <-chan HistoryNode) (missing []string) {
+  if self.Test() {
+    return
+  }
+  for n := range history {
+    if _, ok := self.frontier[n.BlobRef()]; !ok {
+      // The blob is not reachable from the frontier
+      continue
+    }
+    if !self.SubstituteBlob(n.BlobRef(), n.Dependencies()) {
+      missing = append(missing, n.BlobRef())
+    }
+    if self.Test() {
+      break
+    }
+  }
+  return
+}
+
+// Returns the blobrefs of all blobs in the history which are reachable from the frontier
+// but not from the remote frontier dest.
+func MissingBlobs(frontier Frontier, dest []string, history <-chan HistoryNode) []string {
+  return NewHistoryGraph(frontier, dest).Missing(history)
+}
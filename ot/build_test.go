@@ -35,6 +35,33 @@ func TestHistoryGraph(t *testing.T) {
   }
 }
 
+type testHistoryNode struct {
+  blobref string
+  deps    []string
+}
+
+func (self *testHistoryNode) BlobRef() string {
+  return self.blobref
+}
+
+func (self *testHistoryNode) Dependencies() []string {
+  return self.deps
+}
+
+func TestMissingBlobs(t *testing.T) {
+  // m1 <- m2 <- m4, m1 <- m3 <- m4. The remote site knows m2 only
+  history := []*testHistoryNode{&testHistoryNode{"m4", []string{"m2", "m3"}}, &testHistoryNode{"m3", []string{"m1"}}, &testHistoryNode{"m2", []string{"m1"}}, &testHistoryNode{"m1", nil}}
+  ch := make(chan HistoryNode, len(history))
+  for _, n := range history {
+    ch <- n
+  }
+  close(ch)
+  missing := MissingBlobs(map[string]bool{"m4": true}, []string{"m2"}, ch)
+  if len(missing) != 2 || missing[0] != "m4" || missing[1] != "m3" {
+    t.Fatalf("Wrong missing blobs: %v", missing)
+  }
+}
+
 func TestBuild(t *testing.T) {
   m7a := Mutation{ID: "m7a"}
   m7b := Mutation{ID: "m7b"}
@@ -13,6 +13,7 @@ import (
 // {"site":"xxx", dep:["xxx","yyy"], "op":{"myattr":{"v":0, "s":{"$t":[ {"$i":"Hello World"}, {"$s":5}, {"$d":3} ] } } } }
 // {"site":"xxx", dep:["xxx","yyy"], "op":{"myattr":{"v":1, "v":"Some constant"} } }
 // {"site":"xxx", dep:["xxx","yyy"], "op":{"myattr":{"d":1} } }
+// {"site":"xxx", dep:["xxx","yyy"], "op":{"$n":-3} }
 
 func DecodeMutation(blob []byte) (result Mutation, err error) {
   // Decode JSON
@@ -130,6 +131,18 @@ func decodeOperation(operation interface{}) (result Operation, err error) {
     }
     return
   }
+  n, ok := op["$n"]
+  if ok {
+    add, ok := n.(float64)
+    if ok && add == float64(int64(add)) {
+      result.Kind = AddOp
+      result.Len = 1
+      result.Value = int64(add)
+    } else {
+      err = errors.New("Malformed mutation")
+    }
+    return
+  }
   // TODO: Array
   // TODO ObjectOp ?
   result.Kind = InsertOp
@@ -183,6 +196,8 @@ func encodeOperation(op Operation) (result interface{}, err error) {
       arr = append(arr, x)
     }
     result = map[string]interface{}{"$t": arr}
+  case AddOp:
+    result = map[string]interface{}{"$n": op.Value}
   case ObjectOp:
     // TODO
   case AttributeOp:
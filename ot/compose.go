@@ -77,6 +77,9 @@ func composeOp(first Operation, second Operation) (result Operation, err error)
     // TODO
   case ObjectOp:
     result.Operations, err = composeObject(first.Operations, second.Operations)
+  case AddOp:
+    result.Len = 1
+    result.Value = first.Value.(int64) + second.Value.(int64)
   case NoOp:
     // Do nothing by intention
   default:
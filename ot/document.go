@@ -257,6 +257,16 @@ func ExecuteOperation(input interface{}, op Operation) (output interface{}, err
     }
     err = executeObject(obj, op.Operations)
     output = obj
+  case AddOp:
+    if input == nil {
+      input = int64(0)
+    }
+    num, ok := input.(int64)
+    if !ok {
+      err = errors.New("Type mismatch: Not an integer")
+      return
+    }
+    output = num + op.Value.(int64)
   default:
     err = errors.New("Operation not allowed in this place")
   }
@@ -396,6 +406,45 @@ func (self *TextRange) Delete(pos int, length int) {
   self.Anchor.Delete(pos, length)
 }
 
+// Returns the position of a marker after the string operation has been applied to the text.
+// The marker moves along with the characters surrounding it.
+// The position and the lengths of the operation count characters, i.e. the text must not contain tombs.
+// Characters inserted exactly at the marker are inserted in front of it and the marker moves behind them.
+// Hence a cursor stays behind the characters typed at its position.
+// A marker inside deleted characters moves to the start of the deletion.
+func TransformMarker(pos int, op Operation) int {
+  if op.Kind != StringOp {
+    return pos
+  }
+  // The position in the text before and after the operation
+  p, q := 0, 0
+  for _, o := range op.Operations {
+    switch o.Kind {
+    case InsertOp:
+      if str, _ := o.Value.(string); len(str) > 0 {
+        q += len(str)
+      }
+    case SkipOp:
+      if pos < p+o.Len {
+        return q + pos - p
+      }
+      p += o.Len
+      q += o.Len
+    case DeleteOp:
+      p += o.Len
+      if pos < p {
+        pos = p
+      }
+    }
+  }
+  return q + pos - p
+}
+
+// Returns the range after the string operation has been applied to the text. See TransformMarker.
+func TransformRange(r TextRange, op Operation) TextRange {
+  return TextRange{Current: TextMarker{TransformMarker(r.Current.TextPos, op)}, Anchor: TextMarker{TransformMarker(r.Anchor.TextPos, op)}}
+}
+
 // --------------------------------------------
 // SimpleText
 
@@ -424,6 +473,77 @@ func (self *SimpleText) Clone() SimpleText {
   return SimpleText{Text: self.Text, tombs: self.tombs.Copy()}
 }
 
+// Returns the string operation which reverts the effect of 'op' on the text.
+// The text must be in the state before 'op' is applied. It is not modified.
+// Inserted characters are deleted by the inverse and hence become tombs.
+// Deleted characters are inserted again in front of the tombs left by the deletion.
+// Inserted tombs cannot be removed and are skipped by the inverse.
+func (self *SimpleText) Inverse(op Operation) (inverse Operation, err error) {
+  if op.Kind != StringOp {
+    return Operation{}, errors.New("Only string operations can be inverted")
+  }
+  tombs := IntVector(self.tombs.Copy())
+  stream := NewTombStream(&tombs)
+  // The position in Text
+  pos := 0
+  var ops []Operation
+  for _, o := range op.Operations {
+    switch o.Kind {
+    case InsertOp:
+      if str, _ := o.Value.(string); len(str) > 0 {
+        stream.InsertChars(len(str))
+        ops = append(ops, Operation{Kind: DeleteOp, Len: len(str)})
+      } else {
+        stream.InsertTombs(o.Len)
+        ops = append(ops, Operation{Kind: SkipOp, Len: o.Len})
+      }
+    case SkipOp:
+      chars, e := stream.Skip(o.Len)
+      if e != nil {
+        return Operation{}, e
+      }
+      pos += chars
+      ops = append(ops, Operation{Kind: SkipOp, Len: o.Len})
+    case DeleteOp:
+      burried, e := stream.Bury(o.Len)
+      if e != nil {
+        return Operation{}, e
+      }
+      if burried > 0 {
+        ops = append(ops, Operation{Kind: InsertOp, Len: burried, Value: self.Text[pos : pos+burried]})
+      }
+      pos += burried
+      ops = append(ops, Operation{Kind: SkipOp, Len: o.Len})
+    case NoOp:
+      // Do nothing by intention
+    default:
+      return Operation{}, fmt.Errorf("Operation not allowed in a string: %v", o.Kind)
+    }
+  }
+  return Operation{Kind: StringOp, Operations: ops}, nil
+}
+
+// Returns the string operation which reverts the effect of the operation on the plain text 'doc'.
+// The text must be in the state before the operation is applied and must not contain tombs.
+// Like all string operations, the operation must span the entire text.
+// Applying the operation and then its inverse yields 'doc' again. The characters deleted by the
+// operation remain as tombs and are skipped by the inverse. See SimpleText.Inverse.
+func (op Operation) Invert(doc string) (Operation, error) {
+  if op.Kind != StringOp {
+    return Operation{}, errors.New("Only string operations can be inverted")
+  }
+  length := 0
+  for _, o := range op.Operations {
+    if o.Kind == SkipOp || o.Kind == DeleteOp {
+      length += o.Len
+    }
+  }
+  if length != len(doc) {
+    return Operation{}, fmt.Errorf("Operation spans %v characters but the text has %v", length, len(doc))
+  }
+  return NewSimpleText(doc).Inverse(op)
+}
+
 func (self *SimpleText) Begin() {
   self.tombStream = NewTombStream(&self.tombs)
   self.pos = 0
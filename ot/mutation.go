@@ -1,7 +1,10 @@
 package ot
 
 import (
+  "crypto/rand"
+  "encoding/hex"
   "fmt"
+  "io"
 )
 
 const (
@@ -13,6 +16,7 @@ const (
   ArrayOp     // Used as root or in ArrayOp or in ObjectOp and AttributeOp
   ObjectOp    // Used as root or in ArrayOp or in ObjectOp and AttributeOp
   AttributeOp // Used in ObjectOp
+  AddOp       // Used as root or in AttributeOp
 )
 
 type Operation struct {
@@ -26,6 +30,7 @@ type Operation struct {
   // A simple value, e.g. string or int or float etc.
   // This value is used in case of InsertOp and OverwriteOp.
   // In case of InsertOp it stores the string value to insert.
+  // In case of AddOp it stores the int64 which is added to a number.
   // However, with InsertOp the Value might be an empty string while the Len field is larger than 0.
   // This indicates that the operation wants to insert a number of tombs as specified by the Len field. 
   Value interface{} "v"
@@ -49,6 +54,17 @@ type Mutation struct {
   DebugName string "n"
 }
 
+// Returns a new site identifier for the user.
+// The random nonce makes the site unique for each session of the user.
+// Sites are compared lexicographically to break a tie between concurrent mutations.
+func NewSite(userid string) string {
+  nonce := make([]byte, 8)
+  if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+    panic("Failed reading random numbers: " + err.Error())
+  }
+  return userid + "/" + hex.EncodeToString(nonce)
+}
+
 func (self Mutation) String() string {
   return fmt.Sprintf("MUT %v {%v}", self.DebugName, self.Operation.String())
 }
@@ -75,6 +91,8 @@ func (self Operation) String() string {
     return fmt.Sprintf("obj:%v", self.Operations)
   case AttributeOp:
     return fmt.Sprintf("attr[key:%v ops:%v]", self.Value.(string), self.Operations)
+  case AddOp:
+    return fmt.Sprintf("add:%v", self.Value)
   default:
     panic("Unsupported op")
   }
@@ -543,3 +543,206 @@ func TestTransform(t *testing.T) {
     }
   }
 }
+
+func TestTransformSites(t *testing.T) {
+  original := "abcdefghijk"
+  // Two concurrent inserts at the same position
+  m1 := Mutation{ID: "m1", Site: NewSite("a@b"), Operation: Operation{Kind: StringOp, Operations: []Operation{Operation{Kind: SkipOp, Len: 3}, Operation{Kind: InsertOp, Len: 3, Value: "xxx"}, Operation{Kind: SkipOp, Len: 8}}}}
+  m2 := Mutation{ID: "m2", Site: NewSite("c@d"), Operation: Operation{Kind: StringOp, Operations: []Operation{Operation{Kind: SkipOp, Len: 3}, Operation{Kind: InsertOp, Len: 3, Value: "yyy"}, Operation{Kind: SkipOp, Len: 8}}}}
+  if m1.Site == m2.Site {
+    t.Fatal("Sites are not unique")
+  }
+  // The second round uses colliding sites. The IDs break the tie then
+  for round := 0; round < 2; round++ {
+    if round == 1 {
+      m2.Site = m1.Site
+    }
+    // The first peer applies m1 first
+    _, tm2, err := Transform(m1, m2)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    doc1, err := Execute(NewSimpleText(original), m1)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    doc1, err = Execute(doc1, tm2)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    // The second peer applies m2 first
+    _, tm1, err := Transform(m2, m1)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    doc2, err := Execute(NewSimpleText(original), m2)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    doc2, err = Execute(doc2, tm1)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    if doc1.(*SimpleText).Text != doc2.(*SimpleText).Text {
+      t.Fatalf("Peers did not converge: %v %v", doc1.(*SimpleText).Text, doc2.(*SimpleText).Text)
+    }
+  }
+}
+
+func TestTransformAdd(t *testing.T) {
+  // Two offline peers increment the same counter
+  m1 := Mutation{ID: "m1", Site: NewSite("a@b"), Operation: Operation{Kind: AddOp, Len: 1, Value: int64(3)}}
+  m2 := Mutation{ID: "m2", Site: NewSite("c@d"), Operation: Operation{Kind: AddOp, Len: 1, Value: int64(5)}}
+  tm1, tm2, err := Transform(m1, m2)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if tm1.Operation.Value.(int64) != 3 || tm2.Operation.Value.(int64) != 5 {
+    t.Fatalf("Additions must not be changed by transformation: %v %v", tm1, tm2)
+  }
+  // Both peers converge to the sum regardless of the order
+  for _, muts := range [][]Mutation{[]Mutation{m1, tm2}, []Mutation{m2, tm1}} {
+    var doc interface{}
+    for _, mut := range muts {
+      if doc, err = Execute(doc, mut); err != nil {
+	t.Fatal(err.Error())
+      }
+    }
+    if doc.(int64) != 8 {
+      t.Fatalf("Wrong counter %v", doc)
+    }
+  }
+  c, err := Compose(m1, m2)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if c.Operation.Kind != AddOp || c.Operation.Value.(int64) != 8 {
+    t.Fatalf("Wrong composition %v", c)
+  }
+  // JSON encoding
+  mut, err := DecodeMutation([]byte(`{"site":"xxx", "dep":[], "op":{"$n":-3}}`))
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if mut.Operation.Kind != AddOp || mut.Operation.Value.(int64) != -3 {
+    t.Fatalf("Wrong decoding %v", mut)
+  }
+  if _, err = DecodeMutation([]byte(`{"site":"xxx", "dep":[], "op":{"$n":1.5}}`)); err == nil {
+    t.Fatal("Expected an error for a fractional addition")
+  }
+}
+
+func TestInverse(t *testing.T) {
+  doc := NewSimpleText("abcdef")
+  ops := []Operation{
+    Operation{Kind: StringOp, Operations: []Operation{Operation{Kind: SkipOp, Len: 2}, Operation{Kind: DeleteOp, Len: 2}, Operation{Kind: InsertOp, Len: 2, Value: "XY"}, Operation{Kind: SkipOp, Len: 2}}},
+    // Deletes characters and tombs at once
+    Operation{Kind: StringOp, Operations: []Operation{Operation{Kind: SkipOp, Len: 1}, Operation{Kind: DeleteOp, Len: 4}, Operation{Kind: InsertOp, Len: 2, Value: ""}, Operation{Kind: SkipOp, Len: 3}}},
+  }
+  for _, op := range ops {
+    before := doc.Text
+    inverse, err := doc.Inverse(op)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    result, err := Execute(doc, Mutation{Operation: op})
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    doc = result.(*SimpleText)
+    after := doc.Clone()
+    result, err = Execute(&after, Mutation{Operation: inverse})
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    if text := result.(*SimpleText).Text; text != before {
+      t.Fatalf("Inverse did not restore the text: %v %v", text, before)
+    }
+  }
+  if _, err := doc.Inverse(Operation{Kind: ObjectOp}); err == nil {
+    t.Fatal("Expected an error for inverting an object operation")
+  }
+}
+
+func TestInvert(t *testing.T) {
+  tests := []struct {
+    doc string
+    op  Operation
+  }{
+    {"abcdef", Operation{Kind: StringOp, Operations: []Operation{Operation{Kind: SkipOp, Len: 2}, Operation{Kind: DeleteOp, Len: 2}, Operation{Kind: InsertOp, Len: 2, Value: "XY"}, Operation{Kind: SkipOp, Len: 2}}}},
+    // Inserts in front of a deletion and at the end
+    {"abcdef", Operation{Kind: StringOp, Operations: []Operation{Operation{Kind: InsertOp, Len: 1, Value: "X"}, Operation{Kind: DeleteOp, Len: 3}, Operation{Kind: SkipOp, Len: 1}, Operation{Kind: DeleteOp, Len: 2}, Operation{Kind: InsertOp, Len: 2, Value: "YZ"}}}},
+    // Deletes everything
+    {"abc", Operation{Kind: StringOp, Operations: []Operation{Operation{Kind: DeleteOp, Len: 3}}}},
+    // Inserts into an empty document
+    {"", Operation{Kind: StringOp, Operations: []Operation{Operation{Kind: InsertOp, Len: 5, Value: "Hello"}}}},
+    // Inserts tombs only
+    {"", Operation{Kind: StringOp, Operations: []Operation{Operation{Kind: InsertOp, Len: 2, Value: ""}}}},
+    {"", Operation{Kind: StringOp}},
+  }
+  for _, test := range tests {
+    inverse, err := test.op.Invert(test.doc)
+    if err != nil {
+      t.Fatalf("Failed inverting %v: %v", test.op, err)
+    }
+    result, err := Execute(NewSimpleText(test.doc), Mutation{Operation: test.op})
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    result, err = Execute(result, Mutation{Operation: inverse})
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    if text := result.(*SimpleText).Text; text != test.doc {
+      t.Fatalf("Inverse %v of %v did not restore the text: %v %v", inverse, test.op, text, test.doc)
+    }
+  }
+  op := Operation{Kind: StringOp, Operations: []Operation{Operation{Kind: SkipOp, Len: 2}, Operation{Kind: DeleteOp, Len: 2}}}
+  if _, err := op.Invert("abc"); err == nil {
+    t.Fatal("Expected an error for an operation longer than the text")
+  }
+  if _, err := op.Invert("abcdef"); err == nil {
+    t.Fatal("Expected an error for an operation shorter than the text")
+  }
+}
+
+func TestTransformMarker(t *testing.T) {
+  skip := func(n int) Operation { return Operation{Kind: SkipOp, Len: n} }
+  del := func(n int) Operation { return Operation{Kind: DeleteOp, Len: n} }
+  ins := func(str string) Operation { return Operation{Kind: InsertOp, Len: len(str), Value: str} }
+  str := func(ops ...Operation) Operation { return Operation{Kind: StringOp, Operations: ops} }
+  // All operations apply to "abcdef"
+  tests := []struct {
+    pos      int
+    op       Operation
+    expected int
+  }{
+    // Insert before the marker
+    {3, str(skip(1), ins("XY"), skip(5)), 5},
+    // Insert at the marker
+    {3, str(skip(3), ins("XY"), skip(3)), 5},
+    // Insert after the marker
+    {3, str(skip(4), ins("XY"), skip(2)), 3},
+    // Delete spanning the marker
+    {3, str(skip(1), del(4), skip(1)), 1},
+    // Delete spanning the marker and replaced by new characters
+    {3, str(skip(1), del(4), ins("XY"), skip(1)), 3},
+    // Delete ending at the marker
+    {3, str(skip(1), del(2), skip(3)), 1},
+    // Delete after the marker
+    {3, str(skip(3), del(2), skip(1)), 3},
+    // Insert at the end
+    {6, str(skip(6), ins("XY")), 8},
+    // Tombs are no characters
+    {3, str(skip(1), Operation{Kind: InsertOp, Len: 2, Value: ""}, skip(5)), 3},
+  }
+  for _, test := range tests {
+    if pos := TransformMarker(test.pos, test.op); pos != test.expected {
+      t.Fatalf("Marker %v transformed against %v is at %v, expected %v", test.pos, test.op, pos, test.expected)
+    }
+  }
+  r := TransformRange(TextRange{Current: TextMarker{4}, Anchor: TextMarker{1}}, str(skip(2), del(1), ins("XYZ"), skip(3)))
+  if r.Current.TextPos != 6 || r.Anchor.TextPos != 1 {
+    t.Fatalf("Wrong range %v", r)
+  }
+}
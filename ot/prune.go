@@ -53,6 +53,8 @@ func pruneOp(op Operation, prune Operation) (top Operation, tprune Operation, er
     // TODO
   case ObjectOp:
     top.Operations, tprune.Operations, err = pruneObject(op.Operations, prune.Operations)
+  case AddOp:
+    // Additions commute. Hence pruning does not change the operation
   case NoOp:
     // Do nothing by intention
   default:
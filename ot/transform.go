@@ -124,7 +124,10 @@ func TransformSeq(muts []Mutation, mut Mutation) (tmuts []Mutation, tmut Mutatio
   return
 }
 
-// Transform two mutations
+// Transform two mutations.
+// The site breaks the tie if both mutations insert at the same position, and the ID if the sites collide.
+// Site and ID form a total order of concurrent mutations, hence all peers resolve the tie alike,
+// no matter in which order they apply the mutations. Use NewSite to obtain a unique site.
 func Transform(m1 Mutation, m2 Mutation) (tm1 Mutation, tm2 Mutation, err error) {
   tm1 = m1
   tm2 = m2
@@ -155,6 +158,8 @@ func transformOp(op1 Operation, op2 Operation) (top1 Operation, top2 Operation,
     // TODO
   case ObjectOp:
     top1.Operations, top2.Operations, err = transformObject(op1.Operations, op2.Operations)
+  case AddOp:
+    // Additions commute. Hence both operations remain unchanged
   default:
     err = errors.New("Operation kind not allowed in this place")
   }
@@ -0,0 +1,210 @@
+package main
+
+import (
+  . "lightwave/ot"
+  "github.com/nsf/termbox-go"
+  "strings"
+)
+
+// A Buffer holds the text of one open document and the cursors in it.
+// The buffer listens to the indexer of its document.
+type Buffer struct {
+  editor *Editor
+  indexer *Indexer
+  // The perma node shown in this buffer. It is empty if the client has been launched without naming a perma node
+  perma string
+  frontier Frontier
+  text string
+  tombs IntVector
+  // Required during mutations
+  mutPos, mutLinePos, mutLine int
+  mutTombs *TombStream
+  ScrollX, ScrollY int
+  ranges []*TextRange  // The first range is the cursor. Other ranges are cursors of other users
+}
+
+func NewBuffer(editor *Editor, perma string, indexer *Indexer) *Buffer {
+  b := &Buffer{editor: editor, indexer: indexer, perma: perma, frontier: make(Frontier)}
+  b.ranges = []*TextRange{&TextRange{}}
+  indexer.AddListener(b)
+  return b
+}
+
+func (self *Buffer) Begin() {
+  self.mutPos = 0
+  self.mutLine = 0
+  self.mutLinePos = 0
+  self.mutTombs = NewTombStream(&self.tombs)
+}
+
+// Text interface
+func (self *Buffer) InsertChars(str string) {
+  self.mutTombs.InsertChars(len(str))
+  self.text = self.text[:self.mutPos] + str + self.text[self.mutPos:]
+  newlines := strings.Count(str, "\n")
+  if newlines > 0 {
+    termbox.SetCursor(self.mutLinePos, self.mutLine)
+    //Stdwin.Clrtobot()
+    self.mutLine += newlines
+    self.mutLinePos = len(str) - strings.LastIndex(str, "\n") - 1
+  } else {
+    self.mutLinePos += len(str)
+  }
+  self.mutPos += len(str)
+}
+
+// Text interface
+func (self *Buffer) InsertTombs(count int) {
+  self.mutTombs.InsertTombs(count)
+}
+
+// Text interface
+func (self *Buffer) Delete(count int) (err error) {
+  var burried int
+  burried, err = self.mutTombs.Bury(count)
+  if err != nil {
+    return
+  }
+  termbox.SetCursor(self.mutLinePos, self.mutLine)
+  if strings.Count(self.text[self.mutPos:self.mutPos + burried], "\n") > 0 {
+    //Stdwin.Clrtobot()
+  } else {
+    //Stdwin.Clrtoeol()
+  }
+  self.text = self.text[:self.mutPos] + self.text[self.mutPos + burried:]
+  return
+}
+
+// Text interface
+func (self *Buffer) Skip(count int) (err error) {
+  var chars int
+  chars, err = self.mutTombs.Skip(count)
+  str := self.text[self.mutPos:self.mutPos + chars]
+  newlines := strings.Count(str, "\n")
+  if newlines > 0 {
+    self.mutLine += newlines
+    self.mutLinePos = chars - strings.LastIndex(str, "\n") - 1
+  } else {
+    self.mutLinePos += chars
+  }
+  self.mutPos += chars
+  return
+}
+
+// Text interface
+func (self *Buffer) End() {
+  self.mutTombs = nil
+  self.Refresh()
+}
+
+// Redraws the screen if this buffer is the one being shown
+func (self *Buffer) Refresh() {
+  if self.editor.Current() == self {
+    self.editor.Refresh()
+  }
+}
+
+func (self *Buffer) LineCount() (result int) {
+  result = 1
+  for pos := 0; pos < len(self.text); pos++ {
+    if self.text[pos] == '\n' {
+      result++
+    }
+  }
+  return
+}
+
+func (self *Buffer) GetLineString(line int) string {
+  l := 0
+  start := 0
+  for pos := 0; pos <= len(self.text); pos++ {
+    if pos == len(self.text) || self.text[pos] == '\n' {
+      if l == line {
+	return self.text[start:pos]
+      }
+      l++
+      start = pos + 1
+    }
+  }
+  return ""
+}
+
+func (self *Buffer) Cursor() int {
+  return self.ranges[0].Current.TextPos
+}
+
+// Moves the cursor without redrawing the screen. The editor scrolls to the cursor when it redraws.
+func (self *Buffer) SetCursor(pos int) {
+  self.ranges[0].Current.TextPos = pos
+}
+
+func (self *Buffer) CursorToScreenPos(pos int) (linepos int, line int) {
+  for p := 0; p < pos; p++ {
+    if p == len(self.text) || self.text[p] == '\n' {
+      line++
+      linepos = 0
+    } else {
+      linepos++
+    }
+  }
+  return
+}
+
+func (self *Buffer) ScreenPosToCursor(linepos, line int) int {
+  l := 0
+  lpos := 0
+  for pos := 0; pos <= len(self.text); pos++ {
+    if l == line && lpos == linepos {
+      return pos
+    }
+    if pos == len(self.text) || self.text[pos] == '\n' {
+      l++
+      lpos = 0
+    } else {
+      lpos++
+    }
+  }
+  return len(self.text)
+}
+
+// interface IndexListener
+func (self *Buffer) HandleMutation(mut Mutation) {
+//  log.Printf("Apply %v", mut)
+  // Move the cursors along with the characters surrounding them
+  op := self.visibleOperation(mut.Operation)
+  for _, r := range self.ranges {
+    *r = TransformRange(*r, op)
+  }
+  _, err := Execute(self, mut)
+  if err != nil {
+    panic(err.Error())
+  }
+  self.frontier.Add(mut)
+  self.Refresh()
+}
+
+// Returns the string operation as seen by the visible text, i.e. the operation
+// without the tombs it skips, deletes or inserts. Cursors count visible characters only.
+func (self *Buffer) visibleOperation(op Operation) Operation {
+  tombs := IntVector(self.tombs.Copy())
+  stream := NewTombStream(&tombs)
+  var ops []Operation
+  for _, o := range op.Operations {
+    switch o.Kind {
+    case InsertOp:
+      if str, _ := o.Value.(string); len(str) > 0 {
+        stream.InsertChars(len(str))
+        ops = append(ops, o)
+      } else {
+        stream.InsertTombs(o.Len)
+      }
+    case SkipOp:
+      chars, _ := stream.Skip(o.Len)
+      ops = append(ops, Operation{Kind: SkipOp, Len: chars})
+    case DeleteOp:
+      burried, _ := stream.Bury(o.Len)
+      ops = append(ops, Operation{Kind: DeleteOp, Len: burried})
+    }
+  }
+  return Operation{Kind: StringOp, Operations: ops}
+}
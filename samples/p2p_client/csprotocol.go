@@ -2,24 +2,52 @@ package main
 
 import (
   . "lightwave/ot"
+  "encoding/json"
   "log"
   "net"
   "net/textproto"
   "bufio"
 )
 
+// One connection to the server is shared by all open documents.
+// If more than one document is open, each mutation carries the perma node of its document
+// in a "perma" property. With a single document the mutations are sent without it.
 type CSProtocol struct {
-  indexer *Indexer
+  // The keys are perma nodes
+  indexers map[string]*Indexer
   laddr string
   conn net.Conn
   sendChan chan []byte
 }
 
-func NewCSProtocol(laddr string, indexer *Indexer) *CSProtocol {
-  cs := &CSProtocol{laddr: laddr, indexer: indexer, sendChan: make(chan []byte, 1000)}
+func NewCSProtocol(laddr string) *CSProtocol {
+  cs := &CSProtocol{laddr: laddr, indexers: make(map[string]*Indexer), sendChan: make(chan []byte, 1000)}
   return cs
 }
 
+// Routes the mutations of the indexer's document through this connection.
+// Must be called before Dial.
+func (self *CSProtocol) AddIndexer(indexer *Indexer) {
+  self.indexers[indexer.perma] = indexer
+  indexer.SetCSProtocol(self)
+}
+
+// Returns the indexer of the document to which the mutation sent by the server belongs
+func (self *CSProtocol) route(blob []byte) *Indexer {
+  var tag struct {
+    Perma string `json:"perma"`
+  }
+  if err := json.Unmarshal(blob, &tag); err != nil {
+    return nil
+  }
+  if tag.Perma == "" && len(self.indexers) == 1 {
+    for _, indexer := range self.indexers {
+      return indexer
+    }
+  }
+  return self.indexers[tag.Perma]
+}
+
 func (self *CSProtocol) Dial() (err error) {
   self.conn, err = net.Dial("tcp", self.laddr)
   if err != nil {
@@ -45,7 +73,12 @@ func (self *CSProtocol) read() {
       self.closeConn()
       return
     }      
-    err = self.indexer.HandleServerMutation(mut)
+    indexer := self.route(blob)
+    if indexer == nil {
+      log.Printf("CS-ROUTE: No open document for mutation %v\n", string(blob))
+      continue
+    }
+    err = indexer.HandleServerMutation(mut)
     if err != nil {
       log.Printf("CS-APPLY: %v\n", err)
       self.closeConn()
@@ -71,10 +104,21 @@ func (self *CSProtocol) closeConn() {
   self.conn = nil
 }
 
-func (self *CSProtocol) SendMutation(mut Mutation) {
+func (self *CSProtocol) SendMutation(perma string, mut Mutation) {
   blob, _, err := EncodeMutation(mut, EncExcludeDependencies)
   if err != nil {
     panic("FAILED encoding a mutation")
   }
+  if len(self.indexers) > 1 {
+    // Tell the server to which document the mutation belongs
+    j := make(map[string]interface{})
+    if err = json.Unmarshal(blob, &j); err != nil {
+      panic("FAILED tagging a mutation")
+    }
+    j["perma"] = perma
+    if blob, err = json.Marshal(j); err != nil {
+      panic("FAILED tagging a mutation")
+    }
+  }
   self.sendChan <- blob
 }
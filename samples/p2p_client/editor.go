@@ -5,185 +5,74 @@ import (
   "github.com/nsf/termbox-go"
   "os"
   "fmt"
-  "strings"
 )
 
+// The editor shows one buffer at a time. Each open document has its own buffer.
 type Editor struct {
-  indexer *Indexer
-  frontier Frontier
-  text string
-  tombs IntVector
-  // Required during mutations
-  mutPos, mutLinePos, mutLine int
-  mutTombs *TombStream
   Rows, Columns int
-  ScrollX, ScrollY int
-  ranges []*TextRange  // The first range is the cursor. Other ranges are cursors of other users
+  buffers []*Buffer
+  current int
 }
 
-func NewEditor(indexer *Indexer) *Editor {
-  rows, cols := termbox.Size()
-  e := &Editor{indexer: indexer, Rows: rows, Columns: cols, frontier:make(Frontier)}
-  indexer.AddListener(e)
+func NewEditor() *Editor {
+  cols, rows := termbox.Size()
+  e := &Editor{Rows: rows, Columns: cols}
   return e
 }
 
-func (self *Editor) Begin() {
-  self.mutPos = 0
-  self.mutLine = 0
-  self.mutLinePos = 0
-  self.mutTombs = NewTombStream(&self.tombs)
-}
-
-// Text interface
-func (self *Editor) InsertChars(str string) {
-  for _, r := range self.ranges {
-    r.Insert(self.mutPos, len(str))
-  }
-  self.mutTombs.InsertChars(len(str))
-  self.text = self.text[:self.mutPos] + str + self.text[self.mutPos:]
-  newlines := strings.Count(str, "\n")
-  if newlines > 0 {
-    termbox.SetCursor(self.mutLinePos, self.mutLine)
-    //Stdwin.Clrtobot()
-    self.mutLine += newlines
-    self.mutLinePos = len(str) - strings.LastIndex(str, "\n") - 1
-  } else {
-    self.mutLinePos += len(str)
-  }
-  self.mutPos += len(str)
-}
-
-// Text interface
-func (self *Editor) InsertTombs(count int) {
-  self.mutTombs.InsertTombs(count)
-}
-
-// Text interface
-func (self *Editor) Delete(count int) (err error) {
-  for _, r := range self.ranges {
-    r.Delete(self.mutPos, count)
-  }
-  var burried int
-  burried, err = self.mutTombs.Bury(count)
-  if err != nil {
-    return
-  }
-  termbox.SetCursor(self.mutLinePos, self.mutLine)
-  if strings.Count(self.text[self.mutPos:self.mutPos + burried], "\n") > 0 {
-    //Stdwin.Clrtobot()
-  } else {
-    //Stdwin.Clrtoeol()
-  }  
-  self.text = self.text[:self.mutPos] + self.text[self.mutPos + burried:]
-  return
-}
-
-// Text interface
-func (self *Editor) Skip(count int) (err error) {
-  var chars int
-  chars, err = self.mutTombs.Skip(count)
-  str := self.text[self.mutPos:self.mutPos + chars]
-  newlines := strings.Count(str, "\n")
-  if newlines > 0 {
-    self.mutLine += newlines
-    self.mutLinePos = chars - strings.LastIndex(str, "\n") - 1
-  } else {
-    self.mutLinePos += chars
-  }  
-  self.mutPos += chars
-  return
-}
-
-// Text interface
-func (self *Editor) End() {
-  self.mutTombs = nil
+// Adapts the editor to a new terminal size and redraws the screen
+func (self *Editor) Resize(rows, cols int) {
+  self.Rows = rows
+  self.Columns = cols
   self.Refresh()
 }
 
-func (self *Editor) LineCount() (result int) {
-  result = 1
-  for pos := 0; pos < len(self.text); pos++ {
-    if self.text[pos] == '\n' {
-      result++
-    }
-  }
-  return
+// Opens a buffer for the document which is maintained by the indexer.
+// The first buffer added is shown initially.
+func (self *Editor) AddBuffer(perma string, indexer *Indexer) *Buffer {
+  b := NewBuffer(self, perma, indexer)
+  self.buffers = append(self.buffers, b)
+  return b
 }
 
-func (self *Editor) GetLineString(line int) string {
-  l := 0
-  start := 0
-  for pos := 0; pos <= len(self.text); pos++ {
-    if pos == len(self.text) || self.text[pos] == '\n' {
-      if l == line {
-	return self.text[start:pos]
-      }
-      l++
-      start = pos + 1
-    }
+// Returns the buffer being shown or nil if there are no buffers
+func (self *Editor) Current() *Buffer {
+  if len(self.buffers) == 0 {
+    return nil
   }
-  return ""
+  return self.buffers[self.current]
 }
 
-func (self *Editor) Cursor() int {
-  return self.ranges[0].Current.TextPos
-}
-
-func (self *Editor) SetCursor(pos int) {
-  self.ranges[0].Current.TextPos = pos
-  linepos, line := self.CursorToScreenPos(pos)
-  //Stdwin.Move(linepos - self.ScrollX, line - self.ScrollY)
-  termbox.SetCursor(linepos - self.ScrollX, line - self.ScrollY)
-  termbox.Flush()
-}
-
-func (self *Editor) CursorToScreenPos(pos int) (linepos int, line int) {
-  for p := 0; p < pos; p++ {
-    if p == len(self.text) || self.text[p] == '\n' {
-      line++
-      linepos = 0
-    } else {
-      linepos++
-    }
-  }
-  return
-}
-
-func (self *Editor) ScreenPosToCursor(linepos, line int) int {
-  l := 0
-  lpos := 0
-  for pos := 0; pos <= len(self.text); pos++ {
-    if l == line && lpos == linepos {
-      return pos
-    }
-    if pos == len(self.text) || self.text[pos] == '\n' {
-      l++
-      lpos = 0
-    } else {
-      lpos++
-    }
+// Shows the buffer with the given index together with its cursor
+func (self *Editor) SwitchBuffer(index int) {
+  if index < 0 || index >= len(self.buffers) {
+    return
   }
-  return len(self.text)
+  self.current = index
+  self.Refresh()
 }
 
+// Draws the visible lines of the current buffer. The buffer is scrolled first if the cursor is not visible.
 func (self *Editor) Refresh() {
+  b := self.Current()
+  self.scrollToCursor(b)
+  termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
   line := 0
   linepos := 0
   start := 0
-  for pos := 0; pos <= len(self.text); pos++ {
-    if pos == len(self.text) || self.text[pos] == '\n' {
+  for pos := 0; pos <= len(b.text) && line - b.ScrollY < self.Rows; pos++ {
+    if pos == len(b.text) || b.text[pos] == '\n' {
       // Is this line visible?
-      if line - self.ScrollY >= 0 && line - self.ScrollY < self.Rows {
-        str := self.text[start:pos]
-        if len(self.text) > self.ScrollX {
-          str = str[self.ScrollX:]
+      if line - b.ScrollY >= 0 {
+        str := b.text[start:pos]
+        if len(b.text) > b.ScrollX {
+          str = str[b.ScrollX:]
         }
         if len(str) > self.Columns {
           str = str[0:self.Columns]
         }
         for i, r := range(str) {
-          termbox.SetCell(i, line - self.ScrollY, r, termbox.ColorDefault, termbox.ColorDefault)
+          termbox.SetCell(i, line - b.ScrollY, r, termbox.ColorDefault, termbox.ColorDefault)
         }
         //Stdwin.Addstr(0, line - self.ScrollY, str, 0)
       }
@@ -195,73 +84,143 @@ func (self *Editor) Refresh() {
     }
   }
   // Show the cursor
-  linepos, line = self.CursorToScreenPos(self.Cursor())
+  linepos, line = b.CursorToScreenPos(b.Cursor())
   //Stdwin.Move(linepos - self.ScrollX, line - self.ScrollY)
-  termbox.SetCursor(linepos - self.ScrollX, line - self.ScrollY)
+  termbox.SetCursor(linepos - b.ScrollX, line - b.ScrollY)
   termbox.Flush()
 }
 
+// Changes the vertical scroll offset of the buffer as little as possible such that the line of the cursor is visible.
+// Returns true if the offset has changed.
+func (self *Editor) scrollToCursor(b *Buffer) bool {
+  _, line := b.CursorToScreenPos(b.Cursor())
+  rows := self.Rows
+  if rows < 1 {
+    rows = 1
+  }
+  scroll := b.ScrollY
+  if line < scroll {
+    scroll = line
+  } else if line >= scroll + rows {
+    scroll = line - rows + 1
+  }
+  if scroll == b.ScrollY {
+    return false
+  }
+  b.ScrollY = scroll
+  return true
+}
+
+// Moves the cursor of the buffer if the key is an arrow key or a page key and keeps the cursor visible.
+// Page keys scroll by the height of the terminal. Returns false if the cursor did not move.
+func (self *Editor) moveCursor(b *Buffer, key termbox.Key) bool {
+  linePos, line := b.CursorToScreenPos(b.Cursor())
+  switch key {
+  case termbox.KeyArrowLeft:
+    if line == 0 && linePos == 0 {
+      return false
+    }
+    if linePos == 0 {
+      line--
+      str := b.GetLineString(line)
+      linePos = len(str)
+      b.SetCursor(b.ScreenPosToCursor(linePos, line))
+    } else {
+      b.SetCursor(b.Cursor() - 1)
+    }
+  case termbox.KeyArrowRight:
+    str := b.GetLineString(line)
+    if linePos >= len(str) {
+      if line == b.LineCount() - 1 {
+        return false
+      }
+      b.SetCursor(b.ScreenPosToCursor(0, line + 1))
+    } else {
+      b.SetCursor(b.Cursor() + 1)
+    }
+  case termbox.KeyArrowUp, termbox.KeyPgup:
+    if line == 0 {
+      return false
+    }
+    if key == termbox.KeyPgup {
+      line -= self.Rows
+      if b.ScrollY -= self.Rows; b.ScrollY < 0 {
+        b.ScrollY = 0
+      }
+    } else {
+      line--
+    }
+    if line < 0 {
+      line = 0
+    }
+    str := b.GetLineString(line)
+    if linePos > len(str) {
+      linePos = len(str)
+    }
+    b.SetCursor(b.ScreenPosToCursor(linePos, line))
+  case termbox.KeyArrowDown, termbox.KeyPgdn:
+    if line + 1 == b.LineCount() {
+      return false
+    }
+    if key == termbox.KeyPgdn {
+      line += self.Rows
+      // Do not scroll beyond the last page
+      b.ScrollY += self.Rows
+      if max := b.LineCount() - self.Rows; b.ScrollY > max {
+        b.ScrollY = max
+      }
+      if b.ScrollY < 0 {
+        b.ScrollY = 0
+      }
+    } else {
+      line++
+    }
+    if line >= b.LineCount() {
+      line = b.LineCount() - 1
+    }
+    str := b.GetLineString(line)
+    if linePos > len(str) {
+      linePos = len(str)
+    }
+    b.SetCursor(b.ScreenPosToCursor(linePos, line))
+  default:
+    return false
+  }
+  self.scrollToCursor(b)
+  return true
+}
+
 func (self *Editor) Loop() {
   for {
     e := termbox.PollEvent()
+    if e.Type == termbox.EventResize {
+      self.Resize(e.Height, e.Width)
+      continue
+    }
     if e.Type != termbox.EventKey {
       continue
     }
 
-    linePos, line := self.CursorToScreenPos(self.Cursor())
+    b := self.Current()
+    if self.moveCursor(b, e.Key) {
+      self.Refresh()
+      continue
+    }
+    linePos, line := b.CursorToScreenPos(b.Cursor())
     switch {
     case e.Ch == 'q':
       return
-    case e.Key == termbox.KeyArrowLeft:
-      if line == 0 && linePos == 0 {
-        continue
-      }
-      if linePos == 0 {
-        line--
-        str := self.GetLineString(line)
-        linePos = len(str)
-        self.SetCursor(self.ScreenPosToCursor(linePos, line))
-      } else {
-        self.SetCursor(self.Cursor() - 1)
-      }
-    case e.Key == termbox.KeyArrowRight:
-      str := self.GetLineString(line)
-      if linePos >= len(str) {
-        if line == self.LineCount() - 1 {
-          continue
-        }
-        self.SetCursor(self.ScreenPosToCursor(0, line + 1))
-      } else {
-        self.SetCursor(self.Cursor() + 1)
-      }
-    case e.Key == termbox.KeyArrowUp:
-      if line == 0 {
-        continue
-      }
-      line--
-      str := self.GetLineString(line)
-      if linePos > len(str) {
-        linePos = len(str)
-      }
-      self.SetCursor(self.ScreenPosToCursor(linePos, line))
-    case e.Key == termbox.KeyArrowDown:
-      if line + 1 == self.LineCount() {
-        continue
-      }
-      line++
-      str := self.GetLineString(line)
-      if linePos > len(str) {
-        linePos = len(str)
-      }
-      self.SetCursor(self.ScreenPosToCursor(linePos, line))
+    case e.Key == termbox.KeyTab:
+      // Show the next document
+      self.SwitchBuffer((self.current + 1) % len(self.buffers))
     case e.Key == termbox.KeyBackspace || e.Key == termbox.KeyBackspace2:
       if line == 0 && linePos == 0 {
         continue
       }
       var mut Mutation
       var ops []Operation
-      stream := NewTombStream(&self.tombs)
-      skipped, _ := stream.SkipChars(self.Cursor() - 1)
+      stream := NewTombStream(&b.tombs)
+      skipped, _ := stream.SkipChars(b.Cursor() - 1)
       if skipped > 0 {
         ops = append(ops, Operation{Kind: SkipOp, Len: skipped})
       }
@@ -272,15 +231,15 @@ func (self *Editor) Loop() {
         ops = append(ops, Operation{Kind: SkipOp, Len: skipped})
       }
       mut.Operation = Operation{Kind: StringOp, Operations: ops}
-      self.indexer.HandleClientMutation(mut)
+      b.indexer.HandleClientMutation(mut)
     case e.Ch != 0 || e.Key == termbox.KeyEnter:
       if e.Key == termbox.KeyEnter {
         e.Ch = '\n'
       }
       var mut Mutation
       var ops []Operation
-      stream := NewTombStream(&self.tombs)
-      skipped, _ := stream.SkipChars(self.Cursor())
+      stream := NewTombStream(&b.tombs)
+      skipped, _ := stream.SkipChars(b.Cursor())
       if skipped > 0 {
         ops = append(ops, Operation{Kind: SkipOp, Len: skipped})
       }
@@ -290,22 +249,11 @@ func (self *Editor) Loop() {
         ops = append(ops, Operation{Kind: SkipOp, Len: stream.SkipToEnd()})
       }
       mut.Operation = Operation{Kind: StringOp, Operations: ops}
-      self.indexer.HandleClientMutation(mut)
+      b.indexer.HandleClientMutation(mut)
     }
   }
 }
 
-// interface IndexListener
-func (self *Editor) HandleMutation(mut Mutation) {
-//  log.Printf("Apply %v", mut)
-  _, err := Execute(self, mut)
-  if err != nil {
-    panic(err.Error())
-  }
-  self.frontier.Add(mut)
-  self.Refresh()
-}
-
 func startGoCurses() (err error) {
   termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
   return
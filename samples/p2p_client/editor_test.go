@@ -0,0 +1,87 @@
+package main
+
+import (
+  . "lightwave/ot"
+  "github.com/nsf/termbox-go"
+  "fmt"
+  "strings"
+  "testing"
+)
+
+// Returns a buffer with the given number of lines, which is not connected to an indexer
+func testBuffer(lines int) *Buffer {
+  strs := make([]string, lines)
+  for i := range strs {
+    strs[i] = fmt.Sprintf("line %v", i)
+  }
+  return &Buffer{text: strings.Join(strs, "\n"), ranges: []*TextRange{&TextRange{}}}
+}
+
+func checkVisible(t *testing.T, e *Editor, b *Buffer) {
+  _, line := b.CursorToScreenPos(b.Cursor())
+  if line < b.ScrollY || line >= b.ScrollY + e.Rows {
+    t.Fatalf("Line %v of the cursor is not visible at offset %v with %v rows", line, b.ScrollY, e.Rows)
+  }
+}
+
+func TestScrolling(t *testing.T) {
+  e := &Editor{Rows: 5, Columns: 80}
+  b := testBuffer(30)
+  e.buffers = []*Buffer{b}
+
+  // Moving down scrolls once the cursor leaves the screen
+  for i := 0; i < 12; i++ {
+    if !e.moveCursor(b, termbox.KeyArrowDown) {
+      t.Fatal("Cursor did not move")
+    }
+    checkVisible(t, e, b)
+  }
+  if b.ScrollY != 8 {
+    t.Fatalf("Wrong offset %v", b.ScrollY)
+  }
+  // Moving up within the screen does not scroll
+  e.moveCursor(b, termbox.KeyArrowUp)
+  if b.ScrollY != 8 {
+    t.Fatalf("Wrong offset %v", b.ScrollY)
+  }
+  // Paging moves cursor and offset by one screen
+  e.moveCursor(b, termbox.KeyPgdn)
+  checkVisible(t, e, b)
+  if _, line := b.CursorToScreenPos(b.Cursor()); line != 16 || b.ScrollY != 13 {
+    t.Fatalf("Wrong line %v or offset %v", line, b.ScrollY)
+  }
+  // The last page is not scrolled beyond the end of the document
+  for i := 0; i < 5; i++ {
+    e.moveCursor(b, termbox.KeyPgdn)
+    checkVisible(t, e, b)
+  }
+  if _, line := b.CursorToScreenPos(b.Cursor()); line != 29 || b.ScrollY != 25 {
+    t.Fatalf("Wrong line %v or offset %v", line, b.ScrollY)
+  }
+  if e.moveCursor(b, termbox.KeyArrowDown) {
+    t.Fatal("Cursor moved beyond the last line")
+  }
+  for i := 0; i < 7; i++ {
+    e.moveCursor(b, termbox.KeyPgup)
+    checkVisible(t, e, b)
+  }
+  if b.Cursor() != 0 || b.ScrollY != 0 {
+    t.Fatalf("Wrong cursor %v or offset %v", b.Cursor(), b.ScrollY)
+  }
+  // Moving left at the start of a line scrolls up to the previous line
+  b.SetCursor(b.ScreenPosToCursor(0, 20))
+  b.ScrollY = 20
+  checkVisible(t, e, b)
+  e.moveCursor(b, termbox.KeyArrowLeft)
+  checkVisible(t, e, b)
+  if b.ScrollY != 19 {
+    t.Fatalf("Wrong offset %v", b.ScrollY)
+  }
+  // A smaller terminal scrolls such that the cursor remains visible
+  b.SetCursor(b.ScreenPosToCursor(0, 23))
+  e.Rows = 2
+  if !e.scrollToCursor(b) {
+    t.Fatal("Expected scrolling")
+  }
+  checkVisible(t, e, b)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
   . "lightwave/ot"
+  "lightwave/store"
   "errors"
-  //"log"
+  "log"
+  "sort"
 )
 
 type IndexerListener interface {
@@ -17,13 +19,62 @@ type Indexer struct {
   listeners []IndexerListener
   csProto *CSProtocol
   site string
+  // The perma node of the document maintained by this indexer
+  perma string
+  // Holds all mutations as ordered by the server
+  store store.BlobStore
 }
 
-func NewIndexer() *Indexer {
-  idx := &Indexer{site: uuid()}
+func NewIndexer(perma string, s store.BlobStore) *Indexer {
+  idx := &Indexer{site: uuid(), perma: perma, store: s}
   return idx
 }
 
+type mutationsByAppliedAt []Mutation
+
+func (self mutationsByAppliedAt) Len() int { return len(self) }
+func (self mutationsByAppliedAt) Less(i, j int) bool { return self[i].AppliedAt < self[j].AppliedAt }
+func (self mutationsByAppliedAt) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+// Replays all mutations found in the store in the order in which the server applied them.
+// Must be called after all listeners have been added and before connecting to the server.
+func (self *Indexer) Load() (err error) {
+  ch, err := self.store.GetBlobs("")
+  if err != nil {
+    return err
+  }
+  var muts []Mutation
+  for blob := range ch {
+    mut, err := DecodeMutation(blob.Data)
+    if err != nil {
+      log.Printf("Err: Stored mutation %v cannot be decoded: %v\n", blob.BlobRef, err)
+      continue
+    }
+    muts = append(muts, mut)
+  }
+  sort.Sort(mutationsByAppliedAt(muts))
+  for _, mut := range muts {
+    if mut.AppliedAt != self.serverVersion {
+      return errors.New("The stored history has a gap")
+    }
+    self.serverVersion = mut.AppliedAt + 1
+    self.Apply(mut)
+  }
+  return
+}
+
+// Stores a mutation as ordered by the server, such that it can be replayed after a restart
+func (self *Indexer) persist(mut Mutation) {
+  blob, blobref, err := EncodeMutation(mut, EncNormal)
+  if err != nil {
+    log.Printf("Err: Cannot encode mutation: %v\n", err)
+    return
+  }
+  if _, err = self.store.StoreBlob(blob, blobref); err != nil {
+    log.Printf("Err: Cannot store mutation: %v\n", err)
+  }
+}
+
 func (self *Indexer) SetCSProtocol(csProto *CSProtocol) {
   self.csProto = csProto
 }
@@ -37,7 +88,7 @@ func (self *Indexer) HandleClientMutation(mut Mutation) {
   } else {
     self.mutationInFlight = mut
     self.mutationInFlight.AppliedAt = self.serverVersion
-    self.csProto.SendMutation(self.mutationInFlight)
+    self.csProto.SendMutation(self.perma, self.mutationInFlight)
   }
 }
 
@@ -51,15 +102,20 @@ func (self *Indexer) HandleServerMutation(mut Mutation) (err error) {
     }
     self.mutationInFlight = Mutation{}
     self.serverVersion = mut.AppliedAt + 1
+    self.persist(mut)
     if len(self.mutationQueue) > 0 {
       mut := self.mutationQueue[0]
       mut.AppliedAt = self.serverVersion
-      self.csProto.SendMutation(mut)
+      self.csProto.SendMutation(self.perma, mut)
       // TODO: On the long run this will leak memory.
       self.mutationQueue = self.mutationQueue[1:]
     }
     return
   }
+  // The server sends its entire history upon connect. Skip everything that has been loaded from the store already.
+  if mut.AppliedAt < self.serverVersion {
+    return
+  }
   // This server-sent mutation must be transformed against locally queued mutations
   tmut := mut
   if self.mutationInFlight.Operation.Kind != NoOp {
@@ -73,6 +129,7 @@ func (self *Indexer) HandleServerMutation(mut Mutation) (err error) {
     return errors.New("Transformation Error")
   }
   self.serverVersion = mut.AppliedAt + 1  
+  self.persist(mut)
   self.Apply(tmut)
   return
 }
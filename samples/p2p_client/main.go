@@ -2,15 +2,51 @@ package main
 
 import (
   "github.com/nsf/termbox-go"
-  . "lightwave/ot"
+  "lightwave/store"
   "flag"
+  "fmt"
+  "os"
+  "path/filepath"
 )
 
 func main() {
   // Parse the command line
   var csAddr string
   flag.StringVar(&csAddr, "s", ":6868", "Address of the server")
+  var storeKind, storeDir string
+  flag.StringVar(&storeKind, "store", "memory", "Blob store backend, either 'memory' or 'file'")
+  flag.StringVar(&storeDir, "dir", "p2pclient.store", "Directory of the file blob store")
   flag.Parse()
+
+  // The perma nodes to open. Without any, a single unnamed document is opened
+  permas := flag.Args()
+  if len(permas) == 0 {
+    permas = []string{""}
+  }
+
+  // Open the blob stores before the terminal is taken over, such that errors are visible.
+  // Each document has its own store. A single document uses the store directory itself.
+  stores := make([]store.BlobStore, len(permas))
+  for i, perma := range permas {
+    switch storeKind {
+    case "memory":
+      stores[i] = store.NewSimpleBlobStore()
+    case "file":
+      dir := storeDir
+      if len(permas) > 1 {
+        dir = filepath.Join(storeDir, perma)
+      }
+      fs, err := store.NewFileBlobStore(dir)
+      if err != nil {
+        fmt.Fprintf(os.Stderr, "Could not open the blob store: %v\n", err)
+        os.Exit(1)
+      }
+      stores[i] = fs
+    default:
+      fmt.Fprintf(os.Stderr, "Unknown blob store backend '%v'\n", storeKind)
+      os.Exit(1)
+    }
+  }
   
   // Start Curses
   err := termbox.Init()
@@ -20,14 +56,19 @@ func main() {
   defer termbox.Close()
   //Init_pair(1, COLOR_RED, COLOR_BLACK)
 
-  // Initialize Indexer and Network
-  indexer := NewIndexer()
-  csProto := NewCSProtocol(csAddr, indexer)
-  indexer.SetCSProtocol(csProto)
-  
-  // Launch the UI
-  editor := NewEditor(indexer)
-  editor.ranges = []*TextRange{&TextRange{TextMarker{0}, TextMarker{0}}}
+  // Initialize the UI, one Indexer per document and the Network
+  editor := NewEditor()
+  csProto := NewCSProtocol(csAddr)
+  for i, perma := range permas {
+    indexer := NewIndexer(perma, stores[i])
+    csProto.AddIndexer(indexer)
+    editor.AddBuffer(perma, indexer)
+    // Reload the document of the last session (if any)
+    err = indexer.Load()
+    if err != nil {
+      panic(err.Error())
+    }
+  }
   editor.Refresh()
   
   // Connect to the server
@@ -2,153 +2,202 @@ package main
 
 import (
   . "curses"
-  . "lightwaveot"
   grapher "lightwavegrapher"
   api "lightwaveapi"
   "os"
   "fmt"
-  "strings"
-  vec "container/vector"
+  "json"
+)
+
+// The mime types of the documents and of their paragraphs
+const (
+  documentMimeType = "application/x-lightwave-text"
+  paragraphMimeType = "application/x-lightwave-paragraph"
 )
 
 type Editor struct {
   userID string
   grapher *grapher.Grapher
   api api.API
+  // The value of the selected field
   text string
-  tombs vec.IntVector
-  // Required during mutations
-  mutPos, mutLinePos, mutLine int
-  mutTombs *TombStream
+  // The position of the cursor in text
+  cursor int
   Rows, Columns int
   ScrollX, ScrollY int
-  ranges []*TextRange  // The first range is the cursor. Other ranges are cursors of other users
   // The document we are currently editing
   permaBlobRef string
+  // The entity and the field of the document which receive the keystrokes.
+  // The entity is empty if the document has no paragraph yet
+  entityBlobRef string
+  field string
   // List of all perma nodes
   permaBlobs []string
   invitations map[string]string
-  seqNumber int
+  seqNumber int64
 }
 
 func NewEditor(userid string, grapher *grapher.Grapher, api api.API) *Editor {
-  e := &Editor{userID: userid, grapher: grapher, api: api, Rows: *Rows, Columns: *Cols, invitations: make(map[string]string)}
+  e := &Editor{userID: userid, grapher: grapher, api: api, Rows: *Rows, Columns: *Cols, invitations: make(map[string]string), field: "text"}
   api.SetApplication(e)
   return e
 }
 
 // Application interface
-func (self *Editor) Signal_ReceivedInvitation(permission *grapher.Permission) {
-  self.invitations[permission.PermaBlobRef] = permission.PermissionBlobRef
+func (self *Editor) Signal_ReceivedInvitation(perma grapher.PermaNode, permission grapher.PermissionNode) {
+  self.invitations[perma.BlobRef()] = permission.BlobRef()
 }
 
 // Application interface
-func (self *Editor) Signal_AcceptedInvitation(Keep *grapher.Keep) {
+func (self *Editor) Signal_AcceptedInvitation(perma grapher.PermaNode, permission grapher.PermissionNode, keep grapher.KeepNode) {
 }
 
-func (self *Editor) Signal_ProcessedKeep(keep *grapher.Keep) {
-  self.permaBlobs = append(self.permaBlobs, keep.PermaBlobRef)
+// Application interface
+func (self *Editor) Signal_ProcessedKeep(perma grapher.PermaNode, keep grapher.KeepNode) {
+  self.permaBlobs = append(self.permaBlobs, perma.BlobRef())
 }
 
 // Application interface
-func (self *Editor) Blob(blob interface{}, seqNumber int) {
-  switch blob.(type) {
-  case *grapher.Keep:
-    // Do nothing yet
-  case *grapher.Permission:
-    // Do nothing yet
-  case *grapher.Mutation:
-    mut := blob.(*grapher.Mutation)
-    op, ok := mut.Operation.(Operation)
-    if !ok {
-      panic("Unknown operator kind")
-    }
-    _, err := ExecuteOperation(self, op)
-    if err != nil {
-      panic(err.String())
-    }
-    Stdwin.Refresh()
-  default:
-    panic("Unknown blob kind")
+func (self *Editor) Blob(perma grapher.PermaNode, blob grapher.OTNode) {
+  if perma.BlobRef() != self.permaBlobRef {
+    return
   }
-  
-  if seqNumber >= 0 {
-    self.seqNumber = seqNumber + 1
+  self.seqNumber = blob.SequenceNumber() + 1
+  mut, ok := blob.(grapher.MutationNode)
+  if !ok || mut.EntityBlobRef() != self.entityBlobRef || mut.Field() != self.field {
+    return
   }
+  self.cursor = transformCursor(self.cursor, mut.Operation(), mut.Signer() == self.userID)
+  self.reload()
+  Stdwin.Refresh()
 }
 
-
-func (self *Editor) Begin() {
-  self.mutPos = 0
-  self.mutLine = 0
-  self.mutLinePos = 0
-  self.mutTombs = NewTombStream(&self.tombs)
+// Selects the entity and the field which receive the keystrokes and shows the value of the field.
+func (self *Editor) SelectField(entity_blobref string, field string) {
+  self.entityBlobRef = entity_blobref
+  self.field = field
+  self.cursor = 0
+  self.ScrollX = 0
+  self.ScrollY = 0
+  self.reload()
+  Stdwin.Refresh()
 }
 
-// Text interface
-func (self *Editor) InsertChars(str string) {
-  for _, r := range self.ranges {
-    r.Insert(self.mutPos, len(str))
+// Reads the value of the selected field from the grapher and redraws the screen
+func (self *Editor) reload() {
+  self.text = ""
+  if self.entityBlobRef != "" {
+    text, err := self.grapher.FieldValue(self.permaBlobRef, self.entityBlobRef, self.field)
+    if err != nil {
+      panic(err.String())
+    }
+    self.text = text
   }
-  self.mutTombs.InsertChars(len(str))
-  self.text = self.text[:self.mutPos] + str + self.text[self.mutPos:]
-  newlines := strings.Count(str, "\n")
-  if newlines > 0 {
-    Stdwin.Move(self.mutLinePos, self.mutLine)
-    Stdwin.Clrtobot()
-    self.mutLine += newlines
-    self.mutLinePos = len(str) - strings.LastIndex(str, "\n") - 1
-  } else {
-    self.mutLinePos += len(str)
+  if self.cursor > len(self.text) {
+    self.cursor = len(self.text)
   }
-  self.mutPos += len(str)
+  Stdwin.Clear()
+  self.Refresh()
 }
 
-// Text interface
-func (self *Editor) InsertTombs(count int) {
-  self.mutTombs.InsertTombs(count)
+// Moves the cursor across the text inserted or deleted by a string operation.
+// Text inserted right at the cursor by the local user pushes the cursor forward.
+func transformCursor(cursor int, operation interface{}, local bool) int {
+  op := operation
+  if b, ok := operation.([]byte); ok {
+    var v interface{}
+    if json.Unmarshal(b, &v) != nil {
+      return cursor
+    }
+    op = v
+  }
+  m, ok := op.(map[string]interface{})
+  if !ok {
+    return cursor
+  }
+  elements, _ := m["$t"].([]interface{})
+  pos := 0
+  for _, x := range elements {
+    switch x.(type) {
+    case string:
+      if pos < cursor || (pos == cursor && local) {
+	cursor += len(x.(string))
+      }
+      pos += len(x.(string))
+    case map[string]interface{}:
+      if s, ok := x.(map[string]interface{})["$s"].(float64); ok {
+	pos += int(s)
+      } else if d, ok := x.(map[string]interface{})["$d"].(float64); ok {
+	if pos + int(d) <= cursor {
+	  cursor -= int(d)
+	} else if pos < cursor {
+	  cursor = pos
+	}
+      }
+    }
+  }
+  return cursor
 }
 
-// Text interface
-func (self *Editor) Delete(count int) (err os.Error) {
-  for _, r := range self.ranges {
-    r.Delete(self.mutPos, count)
+// Returns a string operation which skips 'skip' characters, inserts 'insert', deletes 'del' characters
+// and skips the remaining 'rest' characters.
+func stringOp(skip int, insert string, del int, rest int) []byte {
+  t := []interface{}{}
+  if skip > 0 {
+    t = append(t, map[string]int{"$s": skip})
+  }
+  if insert != "" {
+    t = append(t, insert)
+  }
+  if del > 0 {
+    t = append(t, map[string]int{"$d": del})
   }
-  var burried int
-  burried, err = self.mutTombs.Bury(count)
+  if rest > 0 {
+    t = append(t, map[string]int{"$s": rest})
+  }
+  op, err := json.Marshal(map[string]interface{}{"$t": t})
   if err != nil {
+    panic(err.String())
+  }
+  return op
+}
+
+// Sends the operation to the grapher. The screen is updated once the grapher applied the mutation.
+func (self *Editor) mutate(op []byte) {
+  if self.entityBlobRef == "" {
     return
   }
-  Stdwin.Move(self.mutLinePos, self.mutLine)
-  if strings.Count(self.text[self.mutPos:self.mutPos + burried], "\n") > 0 {
-    Stdwin.Clrtobot()
-  } else {
-    Stdwin.Clrtoeol()
-  }  
-  self.text = self.text[:self.mutPos] + self.text[self.mutPos + burried:]
-  return
+  _, err := self.grapher.CreateMutationBlob(self.permaBlobRef, self.entityBlobRef, self.field, op, self.seqNumber)
+  if err != nil {
+    panic(err.String())
+  }
 }
 
-// Text interface
-func (self *Editor) Skip(count int) (err os.Error) {
-  var chars int
-  chars, err = self.mutTombs.Skip(count)
-  str := self.text[self.mutPos:self.mutPos + chars]
-  newlines := strings.Count(str, "\n")
-  if newlines > 0 {
-    self.mutLine += newlines
-    self.mutLinePos = chars - strings.LastIndex(str, "\n") - 1
-  } else {
-    self.mutLinePos += chars
-  }  
-  self.mutPos += chars
-  return
+// Selects the paragraph following the selected one. After the last paragraph, the first one is selected.
+func (self *Editor) nextParagraph() {
+  entities, err := self.grapher.EntityOrder(self.permaBlobRef)
+  if err != nil {
+    panic(err.String())
+  }
+  if len(entities) == 0 {
+    return
+  }
+  next := entities[0]
+  for i, entity := range entities {
+    if entity == self.entityBlobRef && i + 1 < len(entities) {
+      next = entities[i + 1]
+    }
+  }
+  self.SelectField(next, self.field)
 }
 
-// Text interface
-func (self *Editor) End() {
-  self.mutTombs = nil
-  self.Refresh()
+// Creates a paragraph after the selected one and selects it
+func (self *Editor) newParagraph() {
+  entity, err := self.grapher.CreateEntityBlobAfter(self.permaBlobRef, self.entityBlobRef, paragraphMimeType, []byte(`""`))
+  if err != nil {
+    panic(err.String())
+  }
+  self.SelectField(entity.BlobRef(), self.field)
 }
 
 func (self *Editor) LineCount() (result int) {
@@ -177,11 +226,11 @@ func (self *Editor) GetLineString(line int) string {
 }
 
 func (self *Editor) Cursor() int {
-  return self.ranges[0].Current.TextPos
+  return self.cursor
 }
 
 func (self *Editor) SetCursor(pos int) {
-  self.ranges[0].Current.TextPos = pos
+  self.cursor = pos
   linepos, line := self.CursorToScreenPos(pos)
   Stdwin.Move(linepos - self.ScrollX, line - self.ScrollY)
 }
@@ -239,7 +288,7 @@ func (self *Editor) Refresh() {
       linepos++
     }
   }
-  Stdwin.Addstr(0, self.Rows - 1, "ESC-q=Quit ESC-i=Invite ESC-l=List", 0)
+  Stdwin.Addstr(0, self.Rows - 1, "ESC-q=Quit ESC-i=Invite ESC-e=Next paragraph ESC-n=New paragraph", 0)
   // Show the cursor
   linepos, line = self.CursorToScreenPos(self.Cursor())
   Stdwin.Move(linepos - self.ScrollX, line - self.ScrollY)
@@ -257,15 +306,16 @@ func (self *Editor) Loop() {
     inp := Stdwin.Getch()
     switch inp {
     case '1':
-      perma, err := self.grapher.CreatePermaBlob()
+      perma, err := self.grapher.CreatePermaBlob(documentMimeType)
       if err != nil {
 	panic(err.String())
       }
-      _, err = self.grapher.CreateKeepBlob(perma, "")
+      _, err = self.grapher.CreateKeepBlob(perma.BlobRef(), "")
       if err != nil {
 	panic(err.String())
       }
-      self.open(perma)
+      self.open(perma.BlobRef())
+      self.newParagraph()
       self.editLoop()
     case '2':
       Stdwin.Clear()
@@ -335,7 +385,10 @@ func (self *Editor) editLoop() {
 	  }
 	}
 	self.grapher.CreatePermissionBlob(self.permaBlobRef, self.seqNumber, userid, grapher.Perm_Read | grapher.Perm_Write | grapher.Perm_Invite, 0, grapher.PermAction_Invite)
-      case 'l':
+      case 'e':
+	self.nextParagraph()
+      case 'n':
+	self.newParagraph()
       case 'q':
 	return
       }
@@ -385,41 +438,12 @@ func (self *Editor) editLoop() {
       if line == 0 && linePos == 0 {
 	continue
       }
-      var ops []Operation
-      stream := NewTombStream(&self.tombs)
-      skipped, _ := stream.SkipChars(self.Cursor() - 1)
-      if skipped > 0 {
-	ops = append(ops, Operation{Kind: SkipOp, Len: skipped})
-      }
-      deleted, _ := stream.SkipChars(1)
-      ops = append(ops, Operation{Kind: DeleteOp, Len: deleted})
-      skipped = stream.SkipToEnd()
-      if skipped > 0 {
-	ops = append(ops, Operation{Kind: SkipOp, Len: skipped})
-      }
-      _, err := self.grapher.CreateMutationBlob(self.permaBlobRef, Operation{Kind: StringOp, Operations: ops}, self.seqNumber)
-      if err != nil {
-	panic(err.String())
-      }
+      self.mutate(stringOp(self.Cursor() - 1, "", 1, len(self.text) - self.Cursor()))
     default:
       if inp == KEY_ENTER || inp == 13 {
 	inp = 10
       }
-      var ops []Operation
-      stream := NewTombStream(&self.tombs)
-      skipped, _ := stream.SkipChars(self.Cursor())
-      if skipped > 0 {
-	ops = append(ops, Operation{Kind: SkipOp, Len: skipped})
-      }
-      ops = append(ops, Operation{Kind: InsertOp, Len: 1, Value: string(inp)})
-      skipped = stream.SkipToEnd()
-      if skipped > 0 {
-	ops = append(ops, Operation{Kind: SkipOp, Len: stream.SkipToEnd()})
-      }
-      _, err := self.grapher.CreateMutationBlob(self.permaBlobRef, Operation{Kind: StringOp, Operations: ops}, self.seqNumber)
-      if err != nil {
-	panic(err.String())
-      }
+      self.mutate(stringOp(self.Cursor(), string(inp), 0, len(self.text) - self.Cursor()))
     }
   }
 }
@@ -446,16 +470,19 @@ func (self *Editor) open(perma_blobref string) {
     self.api.Close(self.permaBlobRef)
   }
   self.permaBlobRef = perma_blobref
-  self.tombs = vec.IntVector{}
-  self.text = ""
+  self.entityBlobRef = ""
   self.seqNumber = 0
-  self.ScrollX = 0
-  self.ScrollY = 0
-  self.ranges = []*TextRange{&TextRange{TextMarker{0}, TextMarker{0}}}
-  Stdwin.Clear()
-  self.Refresh()
-  Stdwin.Refresh()
   self.api.Open(self.permaBlobRef, 0)
+  // Start with the first paragraph. A new document has none
+  entities, err := self.grapher.EntityOrder(self.permaBlobRef)
+  if err != nil {
+    panic(err.String())
+  }
+  if len(entities) > 0 {
+    self.SelectField(entities[0], self.field)
+  } else {
+    self.SelectField("", self.field)
+  }
 }
 
 func stopGoCurses() {
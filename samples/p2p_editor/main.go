@@ -2,34 +2,24 @@ package main
 
 import (
   . "curses"
-  ot "lightwaveot"
   store "lightwavestore"
   fed "lightwavefed"
   grapher "lightwavegrapher"
   tf "lightwavetransformer"
   api "lightwaveapi"
   "flag"
-  "os"
   "http"
   "fmt"
 )
 
-type dummyNameService struct {
-}
+// The servers of the demo users run on the local machine
+var resolver = fed.StaticResolver{"alice": "localhost:8181", "bob": "localhost:8282", "charly": "localhost:8383", "daisy": "localhost:8484"}
 
-func (self *dummyNameService) Lookup(identity string) (url string, err os.Error) {
-  switch identity {
-  case "a@alice":
-    return "http://localhost:8181/fed", nil
-  case "b@bob":
-    return "http://localhost:8282/fed", nil
-  case "c@charly":
-    return "http://localhost:8383/fed", nil
-  case "d@daisy":
-    return "http://localhost:8484/fed", nil
-  }
-  return "", os.NewError("Unknown identity")
-}
+// Documents consist of paragraphs, each of which has a text field
+var schema = &grapher.Schema{ FileSchemas: map[string]*grapher.FileSchema {
+  documentMimeType: &grapher.FileSchema{ EntitySchemas: map[string]*grapher.EntitySchema {
+    paragraphMimeType: &grapher.EntitySchema{ FieldSchemas: map[string]*grapher.FieldSchema {
+      "text": &grapher.FieldSchema{ Type: grapher.TypeString, ElementType: grapher.TypeNone, Transformation: grapher.TransformationMerge } } } } } } }
 
 func main() {
   // Parse the command line
@@ -55,11 +45,11 @@ func main() {
   s := store.NewSimpleBlobStore()
   var federation *fed.Federation
   if port != 0 {
-    ns := &dummyNameService{}
+    ns := fed.NewResolverNameService(resolver)
     federation = fed.NewFederation(userid, "localhost", port, http.DefaultServeMux, ns, s)
     go http.ListenAndServe(fmt.Sprintf(":%v", port), nil)
   }
-  grapher := grapher.NewGrapher(userid, s, federation)
+  grapher := grapher.NewGrapher(userid, schema, s, grapher.NewSimpleGraphStore(), federation)
   tf.NewTransformer(grapher)
   a := api.NewUniAPI(userid, grapher)
   
@@ -71,7 +61,6 @@ func main() {
   
   // Launch the UI
   editor := NewEditor(userid, grapher, a)
-  editor.ranges = []*ot.TextRange{&ot.TextRange{ot.TextMarker{0}, ot.TextMarker{0}}}
   editor.Refresh()
   
   // Wait for UI events
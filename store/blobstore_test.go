@@ -0,0 +1,74 @@
+package store
+
+import (
+  "io/ioutil"
+  "os"
+  "testing"
+)
+
+func testGetBlobsByRef(t *testing.T, s BlobStore) {
+  blobref1, _ := s.StoreBlob([]byte("blob1"), "")
+  blobref2, _ := s.StoreBlob([]byte("blob2"), "")
+  blobs, err := s.GetBlobsByRef([]string{blobref1, "unknown", blobref2})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(blobs) != 2 || string(blobs[blobref1]) != "blob1" || string(blobs[blobref2]) != "blob2" {
+    t.Fatalf("Wrong blobs: %v", blobs)
+  }
+}
+
+func TestGetBlobsByRef(t *testing.T) {
+  testGetBlobsByRef(t, NewSimpleBlobStore())
+
+  dir, err := ioutil.TempDir("", "blobstore")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  s, err := NewFileBlobStore(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  testGetBlobsByRef(t, s)
+}
+
+func TestVerifyOnRead(t *testing.T) {
+  dir, err := ioutil.TempDir("", "blobstore")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  s, err := NewFileBlobStore(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  blobref, err := s.StoreBlob([]byte("blob1"), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  s.WaitIdle()
+  // Corrupt the blob on disk
+  if err = ioutil.WriteFile(s.path(blobref), []byte("blob2"), 0600); err != nil {
+    t.Fatal(err)
+  }
+  // Without verification the corrupted content is returned
+  if blob, err := s.GetBlob(blobref); err != nil || string(blob) != "blob2" {
+    t.Fatalf("Wrong blob: %v %v", string(blob), err)
+  }
+  s.VerifyOnRead = true
+  if _, err = s.GetBlob(blobref); err == nil {
+    t.Fatal("Expected an error for a corrupted blob")
+  }
+  if _, err = s.GetBlobsByRef([]string{blobref}); err == nil {
+    t.Fatal("Expected an error for a corrupted blob")
+  }
+  // Intact blobs are returned as usual
+  blobref2, err := s.StoreBlob([]byte("blob3"), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if blob, err := s.GetBlob(blobref2); err != nil || string(blob) != "blob3" {
+    t.Fatalf("Wrong blob: %v %v", string(blob), err)
+  }
+}
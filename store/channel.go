@@ -0,0 +1,14 @@
+package store
+
+// Sends a value on a buffered channel without ever blocking, such that a reader who does not keep up
+// cannot stall the sender. If the channel is full, the oldest value on it is dropped to make room.
+// Channels of different element types are handled alike: 'send' attempts a non-blocking send of the
+// value and 'drop' a non-blocking receive, and both report whether they succeeded.
+// Returns false if the value itself has been dropped, because the channel filled up again in the meantime.
+func SendDroppingOldest(send func() bool, drop func() bool) bool {
+  if send() {
+    return true
+  }
+  drop()
+  return send()
+}
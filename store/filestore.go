@@ -0,0 +1,221 @@
+package store
+
+import (
+  "errors"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+)
+
+// A FileBlobStore keeps each blob in a file of its own inside a directory.
+// The name of the file is the blobref.
+type FileBlobStore struct {
+  // If true, GetBlob recomputes the blobref of each blob read from disk
+  // and returns an error if the blob does not match it.
+  // This requires that all blobrefs have been computed with NewBlobRef.
+  VerifyOnRead bool
+  // If true, blobs rejected by the listeners are deleted
+  DropRejected bool
+  dir       string
+  mutex     sync.Mutex
+  listeners listenerList
+  hashTree  *SimpleHashTree
+  channel   chan blobStruct
+  pending   pendingBlobs
+}
+
+// Opens the blob store in the directory. The directory is created if it does not exist.
+// Blobs stored during earlier runs are available via GetBlob and GetBlobs.
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+  s := &FileBlobStore{dir: dir, hashTree: NewSimpleHashTree()}
+  blobrefs, err := s.blobRefs("")
+  if err != nil {
+    return nil, err
+  }
+  for _, blobref := range blobrefs {
+    s.hashTree.Add(blobref)
+  }
+
+  s.channel = make(chan blobStruct, 1000)
+  f := func() {
+    for {
+      b := <-s.channel
+      if s.listeners.notify(b.data, b.ref) && s.DropRejected {
+        if err := s.DeleteBlob(b.ref); err != nil {
+          log.Printf("Err: %v", err)
+        }
+      }
+      s.pending.done()
+    }
+  }
+  go f()
+
+  return s, nil
+}
+
+func (self *FileBlobStore) path(blobref string) string {
+  return filepath.Join(self.dir, blobref)
+}
+
+func (self *FileBlobStore) StoreBlob(blob []byte, blobref string) (finalBlobRef string, err error) {
+  // Empty blob reference?
+  if len(blobref) == 0 {
+    blobref = NewBlobRef(blob)
+  }
+  // Do not allow blobrefs that escape the directory
+  if strings.ContainsAny(blobref, "/\\.") {
+    return "", errors.New("Malformed blob reference")
+  }
+  self.mutex.Lock()
+  // The blob is already known?
+  if _, err = os.Stat(self.path(blobref)); err == nil {
+    self.mutex.Unlock()
+    log.Printf("Blob is already known\n")
+    return blobref, nil
+  }
+  // Write to a temporary file first, such that no partial blobs are left behind
+  tmp := self.path(blobref + ".tmp")
+  if err = ioutil.WriteFile(tmp, blob, 0600); err == nil {
+    err = os.Rename(tmp, self.path(blobref))
+  }
+  if err != nil {
+    self.mutex.Unlock()
+    return "", err
+  }
+  self.hashTree.Add(blobref)
+  self.mutex.Unlock()
+  self.pending.add()
+  self.channel <- blobStruct{blob, blobref}
+  return blobref, nil
+}
+
+// Blocks until all stored blobs have been handled by the listeners.
+func (self *FileBlobStore) WaitIdle() {
+  self.pending.wait()
+}
+
+func (self *FileBlobStore) HashTree() HashTree {
+  return self.hashTree
+}
+
+func (self *FileBlobStore) GetBlob(blobref string) (blob []byte, err error) {
+  if strings.ContainsAny(blobref, "/\\.") {
+    return nil, errors.New("Malformed blob reference")
+  }
+  blob, err = ioutil.ReadFile(self.path(blobref))
+  if err != nil {
+    return nil, errors.New("Unknown Blob ID")
+  }
+  if self.VerifyOnRead && NewBlobRef(blob) != blobref {
+    return nil, errors.New("Blob " + self.path(blobref) + " is corrupted: its content does not match the blobref")
+  }
+  return
+}
+
+func (self *FileBlobStore) DeleteBlob(blobref string) error {
+  if strings.ContainsAny(blobref, "/\\.") {
+    return errors.New("Malformed blob reference")
+  }
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if err := os.Remove(self.path(blobref)); err != nil {
+    return errors.New("Unknown Blob ID")
+  }
+  self.hashTree.Remove(blobref)
+  return nil
+}
+
+func (self *FileBlobStore) HasBlob(blobref string) bool {
+  if strings.ContainsAny(blobref, "/\\.") {
+    return false
+  }
+  _, err := os.Stat(self.path(blobref))
+  return err == nil
+}
+
+func (self *FileBlobStore) HasBlobs(blobrefs []string) []bool {
+  result := make([]bool, len(blobrefs))
+  for i, blobref := range blobrefs {
+    result[i] = self.HasBlob(blobref)
+  }
+  return result
+}
+
+func (self *FileBlobStore) Enumerate() <-chan string {
+  // Listing the directory takes the snapshot
+  blobrefs, err := self.blobRefs("")
+  if err != nil {
+    log.Printf("Err: Enumerating blobs failed: %v\n", err)
+  }
+  ch := make(chan string, len(blobrefs))
+  for _, blobref := range blobrefs {
+    ch <- blobref
+  }
+  close(ch)
+  return ch
+}
+
+func (self *FileBlobStore) GetBlobsByRef(blobrefs []string) (blobs map[string][]byte, err error) {
+  blobs = make(map[string][]byte)
+  for i, exists := range self.HasBlobs(blobrefs) {
+    if !exists {
+      continue
+    }
+    blob, err := self.GetBlob(blobrefs[i])
+    if err != nil {
+      return nil, err
+    }
+    blobs[blobrefs[i]] = blob
+  }
+  return blobs, nil
+}
+
+func (self *FileBlobStore) GetBlobs(prefix string) (channel <-chan Blob, err error) {
+  blobrefs, err := self.blobRefs(prefix)
+  if err != nil {
+    return nil, err
+  }
+  ch := make(chan Blob)
+  f := func() {
+    for _, blobref := range blobrefs {
+      blob, err := self.GetBlob(blobref)
+      if err != nil {
+        continue
+      }
+      ch <- Blob{Data: blob, BlobRef: blobref}
+    }
+    close(ch)
+  }
+  go f()
+  return ch, nil
+}
+
+// Returns the blobrefs of all blobs in the directory which start with the prefix
+func (self *FileBlobStore) blobRefs(prefix string) (blobrefs []string, err error) {
+  infos, err := ioutil.ReadDir(self.dir)
+  if err != nil {
+    return nil, err
+  }
+  for _, info := range infos {
+    name := info.Name()
+    if info.IsDir() || strings.Contains(name, ".") || !strings.HasPrefix(name, prefix) {
+      continue
+    }
+    blobrefs = append(blobrefs, name)
+  }
+  return
+}
+
+func (self *FileBlobStore) AddListener(l BlobStoreListener) {
+  self.listeners.add(l)
+}
+
+func (self *FileBlobStore) RemoveListener(l BlobStoreListener) {
+  self.listeners.remove(l)
+}
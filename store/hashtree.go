@@ -77,6 +77,20 @@ func (self *SimpleHashTree) Add(id string) error {
   return nil
 }
 
+// Removes a BLOB id from the tree. Removing an unknown id does nothing.
+// Afterwards the tree has the same hash as a tree to which the id has never been added.
+func (self *SimpleHashTree) Remove(id string) error {
+  if len(id) != HashTree_Depth {
+    return errors.New("ID has the wrong length.")
+  }
+  bin_id, e := hex.DecodeString(id)
+  if e != nil {
+    return errors.New("Malformed ID")
+  }
+  self.remove(bin_id, 0)
+  return nil
+}
+
 func (self *SimpleHashTree) Children(prefix string) (kind int, children []string, err error) {
   depth := len(prefix)
   if depth >= HashTree_Depth {
@@ -169,6 +183,52 @@ func (self *hashTreeNode) add(id []byte, level int) {
   }
 }
 
+// Returns true if the id has been found and removed
+func (self *hashTreeNode) remove(id []byte, level int) bool {
+  if self.childNodes == nil {
+    for i, child := range self.childIDs {
+      if bytes.Equal(child, id) {
+        self.childIDs = append(self.childIDs[:i], self.childIDs[i+1:]...)
+        self.hash = nil
+        return true
+      }
+    }
+    return false
+  }
+  index := id[level/2]
+  if level%2 == 0 {
+    index = index >> 4
+  } else {
+    index = index & 0xf
+  }
+  ch := self.childNodes[index]
+  if ch == nil || !ch.remove(id, level+1) {
+    return false
+  }
+  self.hash = nil
+  if len(ch.childIDs) == 0 && ch.childNodes == nil {
+    self.childNodes[index] = nil
+  }
+  // Undo the split of this node if it has few enough ids, just as if they had been added to an empty tree
+  ids := self.ids(nil)
+  if len(ids) <= HashTree_NodeDegree {
+    self.childNodes = nil
+    self.childIDs = ids
+  }
+  return true
+}
+
+// Appends all ids stored in the node and its children
+func (self *hashTreeNode) ids(result [][]byte) [][]byte {
+  result = append(result, self.childIDs...)
+  for _, ch := range self.childNodes {
+    if ch != nil {
+      result = ch.ids(result)
+    }
+  }
+  return result
+}
+
 func (self *hashTreeNode) binaryHash() []byte {
   if len(self.hash) != 0 {
     return self.hash
@@ -35,3 +35,28 @@ func TestHashTree1(t *testing.T) {
     }
   }
 }
+
+// This test checks that removing IDs yields the same hash tree
+// as if the removed IDs had never been inserted
+func TestHashTreeRemove(t *testing.T) {
+  ids := []string{}
+  for i := 0; i < 100; i++ {
+    h := sha256.New()
+    h.Write([]byte(fmt.Sprintf("m%v", i)))
+    ids = append(ids, hex.EncodeToString(h.Sum([]byte{})))
+  }
+  tree1 := NewSimpleHashTree()
+  for _, id := range ids {
+    tree1.Add(id)
+  }
+  for _, id := range ids[10:] {
+    tree1.Remove(id)
+  }
+  tree2 := NewSimpleHashTree()
+  for _, id := range ids[:10] {
+    tree2.Add(id)
+  }
+  if tree1.Hash() != tree2.Hash() {
+    t.Fatal("Hashes are not the same")
+  }
+}
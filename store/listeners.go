@@ -0,0 +1,57 @@
+package store
+
+import (
+  "log"
+  "sync"
+)
+
+// The listeners of a blob store in the order in which they have been added.
+// Listeners may be added while blobs are being dispatched.
+// The zero value is ready to use.
+type listenerList struct {
+  mutex     sync.Mutex
+  listeners []BlobStoreListener
+}
+
+func (self *listenerList) add(l BlobStoreListener) {
+  self.mutex.Lock()
+  self.listeners = append(self.listeners, l)
+  self.mutex.Unlock()
+}
+
+func (self *listenerList) remove(l BlobStoreListener) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  // Copy the list, because a notification may be iterating over the current one
+  listeners := []BlobStoreListener{}
+  for _, x := range self.listeners {
+    if x != l {
+      listeners = append(listeners, x)
+    }
+  }
+  self.listeners = listeners
+}
+
+// Calls the listeners one after the other in the order in which they have been added.
+// A listener added during the notification is informed about the next blob.
+// Returns true if the listeners rejected the blob as described by BlobStoreListener.
+func (self *listenerList) notify(blob []byte, blobref string) (rejected bool) {
+  self.mutex.Lock()
+  listeners := self.listeners
+  self.mutex.Unlock()
+  kept := false
+  for _, l := range listeners {
+    switch err := l.HandleBlob(blob, blobref); err {
+    case nil, ErrBlobDeferred:
+      kept = true
+    case ErrBlobRejected:
+      rejected = true
+    case ErrBlobIgnored:
+      // Do nothing by intention
+    default:
+      log.Printf("Err: %v", err)
+      kept = true
+    }
+  }
+  return rejected && !kept
+}
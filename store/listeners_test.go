@@ -0,0 +1,148 @@
+package store
+
+import (
+  "errors"
+  "fmt"
+  "testing"
+)
+
+type orderListener struct {
+  name string
+  log  *[]string
+}
+
+func (self *orderListener) HandleBlob(blob []byte, blobref string) error {
+  *self.log = append(*self.log, self.name+":"+string(blob))
+  return nil
+}
+
+func TestListenerOrder(t *testing.T) {
+  s := NewSimpleBlobStore()
+  var log []string
+  s.AddListener(&orderListener{"a", &log})
+  s.AddListener(&orderListener{"b", &log})
+  for i := 0; i < 3; i++ {
+    s.StoreBlob([]byte(fmt.Sprintf("%v", i)), "")
+  }
+  s.WaitIdle()
+  expected := []string{"a:0", "b:0", "a:1", "b:1", "a:2", "b:2"}
+  if len(log) != len(expected) {
+    t.Fatalf("Wrong number of calls: %v", log)
+  }
+  for i, e := range expected {
+    if log[i] != e {
+      t.Fatalf("Wrong order of calls: %v", log)
+    }
+  }
+}
+
+// Observes all blobs without objecting to any of them
+type observingListener struct {
+  orderListener
+}
+
+func (self *observingListener) HandleBlob(blob []byte, blobref string) error {
+  self.orderListener.HandleBlob(blob, blobref)
+  return ErrBlobIgnored
+}
+
+type verdictListener struct {
+  // The keys are blobs, the values are the answers of the listener.
+  // Other blobs are ignored.
+  verdicts map[string]error
+}
+
+func (self *verdictListener) HandleBlob(blob []byte, blobref string) error {
+  if err, ok := self.verdicts[string(blob)]; ok {
+    return err
+  }
+  return ErrBlobIgnored
+}
+
+func TestRejectBlob(t *testing.T) {
+  s := NewSimpleBlobStore()
+  s.DropRejected = true
+  var log []string
+  s.AddListener(&observingListener{orderListener{"a", &log}})
+  s.AddListener(&verdictListener{map[string]error{"rejected": ErrBlobRejected, "failed": ErrBlobRejected, "deferred": ErrBlobRejected, "contested": ErrBlobRejected}})
+  s.AddListener(&verdictListener{map[string]error{"failed": errors.New("Failure"), "deferred": ErrBlobDeferred, "contested": nil}})
+  rejected, _ := s.StoreBlob([]byte("rejected"), "")
+  failed, _ := s.StoreBlob([]byte("failed"), "")
+  accepted, _ := s.StoreBlob([]byte("accepted"), "")
+  deferred, _ := s.StoreBlob([]byte("deferred"), "")
+  contested, _ := s.StoreBlob([]byte("contested"), "")
+  s.WaitIdle()
+  if has := s.HasBlobs([]string{rejected, failed, accepted, deferred, contested}); has[0] || !has[1] || !has[2] || !has[3] || !has[4] {
+    t.Fatalf("Wrong blobs have been dropped: %v", has)
+  }
+  if len(log) != 5 {
+    t.Fatalf("All listeners must see all blobs: %v", log)
+  }
+}
+
+func TestRemoveListener(t *testing.T) {
+  s := NewSimpleBlobStore()
+  var log []string
+  a := &orderListener{"a", &log}
+  s.AddListener(a)
+  s.AddListener(&orderListener{"b", &log})
+  s.StoreBlob([]byte("0"), "")
+  s.WaitIdle()
+  s.RemoveListener(a)
+  s.StoreBlob([]byte("1"), "")
+  s.WaitIdle()
+  expected := []string{"a:0", "b:0", "b:1"}
+  if len(log) != len(expected) {
+    t.Fatalf("Wrong number of calls: %v", log)
+  }
+  for i, e := range expected {
+    if log[i] != e {
+      t.Fatalf("Removed listener has been called: %v", log)
+    }
+  }
+}
+
+func TestConcurrentListeners(t *testing.T) {
+  s := NewSimpleBlobStore()
+  done := make(chan bool)
+  for i := 0; i < 4; i++ {
+    go func(i int) {
+      var log []string
+      for j := 0; j < 50; j++ {
+        l := &orderListener{"x", &log}
+        s.AddListener(l)
+        s.StoreBlob([]byte(fmt.Sprintf("%v-%v", i, j)), "")
+        s.RemoveListener(l)
+      }
+      done <- true
+    }(i)
+  }
+  for i := 0; i < 4; i++ {
+    <-done
+  }
+  s.WaitIdle()
+}
+
+func TestEnumerate(t *testing.T) {
+  s := NewSimpleBlobStore()
+  n := 20
+  for i := 0; i < n; i++ {
+    s.StoreBlob([]byte(fmt.Sprintf("%v", i)), "")
+  }
+  ch := s.Enumerate()
+  // Blobs stored during the enumeration are not part of the snapshot
+  s.StoreBlob([]byte("late"), "")
+  count := 0
+  for blobref := range ch {
+    if !s.HasBlob(blobref) {
+      t.Fatalf("Enumerated unknown blob %v", blobref)
+    }
+    count++
+  }
+  if count != n {
+    t.Fatalf("Wrong number of blobs: %v", count)
+  }
+  if s.HasBlob(NewBlobRef([]byte("unknown"))) {
+    t.Fatal("Unknown blob reported")
+  }
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+  "sync"
+)
+
+// Counts the blobs which have been stored but not yet handled by all listeners.
+// The zero value is ready to use.
+type pendingBlobs struct {
+  mutex sync.Mutex
+  cond  *sync.Cond
+  count int
+}
+
+func (self *pendingBlobs) init() {
+  if self.cond == nil {
+    self.cond = sync.NewCond(&self.mutex)
+  }
+}
+
+func (self *pendingBlobs) add() {
+  self.mutex.Lock()
+  self.count++
+  self.mutex.Unlock()
+}
+
+func (self *pendingBlobs) done() {
+  self.mutex.Lock()
+  self.init()
+  self.count--
+  if self.count == 0 {
+    self.cond.Broadcast()
+  }
+  self.mutex.Unlock()
+}
+
+func (self *pendingBlobs) wait() {
+  self.mutex.Lock()
+  self.init()
+  for self.count > 0 {
+    self.cond.Wait()
+  }
+  self.mutex.Unlock()
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "io"
+  "sync"
+)
+
+// Number of random bytes in the "random" field of new permanodes.
+// 16 bytes make collisions of blobrefs practically impossible.
+const DefaultRandomLength = 16
+
+// Produces the "random" field which makes new permanodes unique.
+// The grapher and the indexer use it alike. It is safe for concurrent use.
+type RandomSource struct {
+  mutex sync.Mutex
+  reader io.Reader
+  length int
+}
+
+// Reads DefaultRandomLength bytes from crypto/rand for each permanode
+func NewRandomSource() *RandomSource {
+  return &RandomSource{reader: rand.Reader, length: DefaultRandomLength}
+}
+
+// Sets the source and the number of random bytes. A nil source selects crypto/rand.
+// Permanodes created with other settings remain valid, because the random field is opaque.
+func (self *RandomSource) Set(source io.Reader, length int) {
+  if source == nil {
+    source = rand.Reader
+  }
+  self.mutex.Lock()
+  self.reader = source
+  self.length = length
+  self.mutex.Unlock()
+}
+
+// Returns a hex encoded random string for the "random" field of a new permanode
+func (self *RandomSource) Next() (string, error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  b := make([]byte, self.length)
+  if _, err := io.ReadFull(self.reader, b); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,33 @@
+package store
+
+import (
+  "bytes"
+  "testing"
+)
+
+func TestRandomSource(t *testing.T) {
+  r := NewRandomSource()
+  a, err := r.Next()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(a) != 2*DefaultRandomLength {
+    t.Fatalf("Wrong length of %v", a)
+  }
+  if b, _ := r.Next(); a == b {
+    t.Fatal("Random strings must differ")
+  }
+  r.Set(bytes.NewBuffer([]byte{1, 2, 3, 4, 5}), 4)
+  if a, err = r.Next(); err != nil || a != "01020304" {
+    t.Fatalf("Wrong random string %v: %v", a, err)
+  }
+  // The source is exhausted
+  if _, err = r.Next(); err == nil {
+    t.Fatal("Expected an error")
+  }
+  // A nil source selects crypto/rand
+  r.Set(nil, 2)
+  if a, err = r.Next(); err != nil || len(a) != 4 {
+    t.Fatalf("Wrong random string %v: %v", a, err)
+  }
+}
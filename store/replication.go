@@ -97,7 +97,8 @@ func (self *Replication) dialMaster(raddr string) (err error) {
   return
 }
 
-// Called from the store when a new blob has been stored
+// Called from the store when a new blob has been stored.
+// Replication forwards the blob but does not need it, hence it never objects to a blob being dropped.
 func (self *Replication) HandleBlob(blob []byte, blobref string) error {
   for connection, flags := range self.connections {
     if flags&connStreaming == connStreaming {
@@ -107,7 +108,7 @@ func (self *Replication) HandleBlob(blob []byte, blobref string) error {
       }
     }
   }
-  return nil
+  return ErrBlobIgnored
 }
 
 func (self *Replication) HandleMessage(msg Message) {
@@ -44,8 +44,8 @@ func TestReplication(t *testing.T) {
   time.Sleep(3000000000)
 
   // Now both stores should have the same stuff
-  m1 := store1.Enumerate()
-  m2 := store2.Enumerate()
+  m1 := enumerate(store1)
+  m2 := enumerate(store2)
   if len(m1) != len(m2) || len(m1) != 1000+d1+d2 {
     t.Fatalf("Wrong number of entries: %v %v", len(m1), len(m2))
   }
@@ -60,3 +60,11 @@ func TestReplication(t *testing.T) {
     }
   }
 }
+
+func enumerate(s *SimpleBlobStore) map[string][]byte {
+  result := make(map[string][]byte)
+  for blobref := range s.Enumerate() {
+    result[blobref], _ = s.GetBlob(blobref)
+  }
+  return result
+}
@@ -6,6 +6,7 @@ import (
   "errors"
   "log"
   "strings"
+  "sync"
 )
 
 func NewBlobRef(blob []byte) string {
@@ -20,10 +21,15 @@ type blobStruct struct {
 }
 
 type SimpleBlobStore struct {
-  listeners []BlobStoreListener
+  // If true, blobs rejected by the listeners are deleted
+  DropRejected bool
+  // Guards the blobs and the hash tree
+  mutex     sync.Mutex
+  listeners listenerList
   blobs     map[string][]byte
   hashTree  *SimpleHashTree
   channel   chan blobStruct
+  pending   pendingBlobs
 }
 
 func NewSimpleBlobStore() *SimpleBlobStore {
@@ -34,12 +40,12 @@ func NewSimpleBlobStore() *SimpleBlobStore {
     for {
       var b blobStruct
       b = <-s.channel
-      for _, l := range s.listeners {
-        err := l.HandleBlob(b.data, b.ref)
-        if err != nil {
+      if s.listeners.notify(b.data, b.ref) && s.DropRejected {
+        if err := s.DeleteBlob(b.ref); err != nil {
           log.Printf("Err: %v", err)
         }
       }
+      s.pending.done()
     }
   }
   go f()
@@ -47,8 +53,16 @@ func NewSimpleBlobStore() *SimpleBlobStore {
   return s
 }
 
-func (self *SimpleBlobStore) Enumerate() (result map[string][]byte) {
-  return self.blobs
+func (self *SimpleBlobStore) Enumerate() <-chan string {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  // The channel is large enough to hold the snapshot. Hence readers may stop early
+  ch := make(chan string, len(self.blobs))
+  for blobref := range self.blobs {
+    ch <- blobref
+  }
+  close(ch)
+  return ch
 }
 
 func (self *SimpleBlobStore) StoreBlob(blob []byte, blobref string) (finalBlobRef string, err error) {
@@ -56,26 +70,37 @@ func (self *SimpleBlobStore) StoreBlob(blob []byte, blobref string) (finalBlobRe
   if len(blobref) == 0 {
     blobref = NewBlobRef(blob)
   }
+  self.mutex.Lock()
   // The blob is already known?
   if _, ok := self.blobs[blobref]; ok {
+    self.mutex.Unlock()
     log.Printf("Blob is already known\n")
     return blobref, nil
   }
   self.hashTree.Add(blobref)
   // Store the blob and allow for its further processing
   self.blobs[blobref] = blob
+  self.mutex.Unlock()
   //  for _, l := range self.listeners {
   //    l.HandleBlob(blob, blobref)
   //  }
+  self.pending.add()
   self.channel <- blobStruct{blob, blobref}
   return blobref, nil
 }
 
+// Blocks until all stored blobs have been handled by the listeners.
+func (self *SimpleBlobStore) WaitIdle() {
+  self.pending.wait()
+}
+
 func (self *SimpleBlobStore) HashTree() HashTree {
   return self.hashTree
 }
 
 func (self *SimpleBlobStore) GetBlob(blobref string) (blob []byte, err error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
   var ok bool
   if blob, ok = self.blobs[blobref]; ok {
     return
@@ -84,6 +109,46 @@ func (self *SimpleBlobStore) GetBlob(blobref string) (blob []byte, err error) {
   return
 }
 
+func (self *SimpleBlobStore) DeleteBlob(blobref string) error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if _, ok := self.blobs[blobref]; !ok {
+    return errors.New("Unknown Blob ID")
+  }
+  delete(self.blobs, blobref)
+  self.hashTree.Remove(blobref)
+  return nil
+}
+
+func (self *SimpleBlobStore) HasBlob(blobref string) bool {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  _, ok := self.blobs[blobref]
+  return ok
+}
+
+func (self *SimpleBlobStore) HasBlobs(blobrefs []string) []bool {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  result := make([]bool, len(blobrefs))
+  for i, blobref := range blobrefs {
+    _, result[i] = self.blobs[blobref]
+  }
+  return result
+}
+
+func (self *SimpleBlobStore) GetBlobsByRef(blobrefs []string) (blobs map[string][]byte, err error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  blobs = make(map[string][]byte)
+  for _, blobref := range blobrefs {
+    if blob, ok := self.blobs[blobref]; ok {
+      blobs[blobref] = blob
+    }
+  }
+  return blobs, nil
+}
+
 func (self *SimpleBlobStore) GetBlobs(prefix string) (channel <-chan Blob, err error) {
   ch := make(chan Blob)
   go self.getBlobs(prefix, ch)
@@ -91,16 +156,27 @@ func (self *SimpleBlobStore) GetBlobs(prefix string) (channel <-chan Blob, err e
 }
 
 func (self *SimpleBlobStore) getBlobs(prefix string, channel chan Blob) {
-  // TODO: The sending on the channel might fail if the underlying
-  // connection is broken
+  // Do not hold the mutex while sending, because the receiver may store blobs
+  self.mutex.Lock()
+  blobs := []Blob{}
   for blobref, blob := range self.blobs {
     if strings.HasPrefix(blobref, prefix) {
-      channel <- Blob{Data: blob, BlobRef: blobref}
+      blobs = append(blobs, Blob{Data: blob, BlobRef: blobref})
     }
   }
+  self.mutex.Unlock()
+  // TODO: The sending on the channel might fail if the underlying
+  // connection is broken
+  for _, b := range blobs {
+    channel <- b
+  }
   close(channel)
 }
 
 func (self *SimpleBlobStore) AddListener(l BlobStoreListener) {
-  self.listeners = append(self.listeners, l)
+  self.listeners.add(l)
+}
+
+func (self *SimpleBlobStore) RemoveListener(l BlobStoreListener) {
+  self.listeners.remove(l)
 }
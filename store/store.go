@@ -1,17 +1,78 @@
 package store
 
+import (
+  "errors"
+)
+
 type BlobStore interface {
   StoreBlob(blob []byte, blobref string) (finalBlobRef string, err error)
+  // Listeners are informed about each blob in the order in which they have been added.
+  // A listener is only called once the previous listener has returned from HandleBlob.
   AddListener(listener BlobStoreListener)
+  // Removes a listener. Blobs stored afterwards are not passed to the listener.
+  // A blob which is being dispatched while the listener is removed may still reach it.
+  RemoveListener(listener BlobStoreListener)
   HashTree() HashTree
   GetBlob(blobref string) (blob []byte, err error)
   GetBlobs(prefix string) (channel <-chan Blob, err error)
+  // Retrieves several blobs at once. The keys of the result are blobrefs.
+  // Unknown blobs are missing in the result. Stores backed by a network or a disk
+  // can fetch all blobs in one round-trip.
+  GetBlobsByRef(blobrefs []string) (blobs map[string][]byte, err error)
+  // Checks which of the blobs are in the store.
+  // The result has one entry per requested blobref.
+  HasBlobs(blobrefs []string) []bool
+  // Checks whether the blob is in the store.
+  HasBlob(blobref string) bool
+  // Returns the blobrefs of all blobs in the store. The blobrefs are taken
+  // from a snapshot of the store when Enumerate is called. Blobs stored or deleted
+  // while the channel is being read do not affect the enumeration.
+  Enumerate() <-chan string
 }
 
+// A BlobStoreListener is informed about every blob added to the store.
+// The indexer and the grapher are listeners, but third parties can add
+// their own, for example to build a search index.
+// A listener which depends on the state of another listener, for example a search
+// index which reads the documents of the indexer, must be added after it.
+//
+// A listener answers each blob in one of the following ways. Returning nil means that the listener
+// accepted the blob. Returning ErrBlobRejected means that the listener has inspected
+// the blob and will never make use of it, for example because it failed validation.
+// Returning ErrBlobDeferred means that the listener cannot use the blob yet, for example because
+// its signer exceeded a rate limit, but may accept it when the blob is handled again.
+// A listener which merely observes blobs returns ErrBlobIgnored.
+// Any other error means that the listener failed on the blob. Such errors are logged.
+// The store aggregates the answers of all listeners: a blob is rejected if at least one
+// listener rejected it and all other listeners rejected or ignored it. A blob which has been
+// accepted or deferred by a listener, or on which a listener failed, must be kept.
 type BlobStoreListener interface {
+  // Called once for each new blob. An error is logged by the store.
   HandleBlob(blob []byte, blobref string) error
 }
 
+var (
+  // Returned by a listener from HandleBlob to signal that it rejected the blob for good.
+  // Stores which drop rejected blobs delete the blob once all listeners have handled it.
+  ErrBlobRejected = errors.New("Blob rejected by listener")
+  // Returned by a listener from HandleBlob to signal that it cannot use the blob yet.
+  ErrBlobDeferred = errors.New("Blob deferred by listener")
+  // Returned by a listener from HandleBlob to signal that it neither needs nor objects to the blob.
+  ErrBlobIgnored = errors.New("Blob ignored by listener")
+)
+
+// Implemented by blob stores which support removing blobs.
+// Deleting a blob does not inform the listeners.
+type BlobDeleter interface {
+  DeleteBlob(blobref string) error
+}
+
+// Implemented by blob stores which dispatch blobs to their listeners asynchronously.
+type IdleWaiter interface {
+  // Blocks until all stored blobs have been handled by the listeners.
+  WaitIdle()
+}
+
 type Blob struct {
   Data    []byte
   BlobRef string
@@ -0,0 +1,85 @@
+package lightwavetransformer
+
+import (
+  ot "lightwaveot"
+  grapher "lightwavegrapher"
+  "log"
+  "os"
+)
+
+// Transforms integer fields which are only changed by adding to them, for example counters.
+// Concurrent additions commute, hence two offline clients which increment the same counter
+// converge to the sum of both increments.
+type addTransformer struct {
+  grapher *grapher.Grapher
+}
+
+func NewAddTransformer(grapher *grapher.Grapher) grapher.Transformer {
+  t := &addTransformer{grapher: grapher}
+  grapher.AddTransformer(t)
+  return t
+}
+
+func decodeAddMutation(mutation grapher.MutationNode) (mut ot.Mutation, err os.Error) {
+  op, ok := mutation.Operation().([]byte)
+  if !ok {
+    return mut, os.NewError("Unknown operation")
+  }
+  if err = mut.Operation.UnmarshalJSON(op); err != nil {
+    return
+  }
+  if mut.Operation.Kind != ot.AddOp {
+    return mut, os.NewError("Operation is no addition")
+  }
+  mut.ID = mutation.BlobRef()
+  return
+}
+
+func (self *addTransformer) Kind() int {
+  return grapher.TransformationAdd
+}
+
+func (self *addTransformer) DataType() int {
+  return grapher.TypeInt64
+}
+
+// Interface towards the Grapher
+func (self *addTransformer) TransformClientMutation(mutation grapher.MutationNode, concurrent <-chan grapher.MutationNode) (err os.Error) {
+  return self.transform(mutation, concurrent, nil)
+}
+
+// Interface towards the Grapher
+func (self *addTransformer) TransformMutation(mutation grapher.MutationNode, rollback <-chan grapher.MutationNode, concurrent []string) (err os.Error) {
+  conc := make(map[string]bool)
+  for _, id := range concurrent {
+    conc[id] = true
+  }
+  return self.transform(mutation, rollback, conc)
+}
+
+// Transforms the mutation against the mutations read from the channel.
+// If 'concurrent' is not nil, only the mutations listed in it are considered.
+func (self *addTransformer) transform(mutation grapher.MutationNode, muts <-chan grapher.MutationNode, concurrent map[string]bool) (err os.Error) {
+  mut, err := decodeAddMutation(mutation)
+  // Drain the channel even after an error, such that the goroutine feeding it terminates
+  for m := range muts {
+    if err != nil || (concurrent != nil && !concurrent[m.BlobRef()]) {
+      continue
+    }
+    var other ot.Mutation
+    if other, err = decodeAddMutation(m); err != nil {
+      continue
+    }
+    _, mut, err = ot.Transform(other, mut)
+  }
+  if err != nil {
+    log.Printf("Err: Transforming addition %v: %v\n", mutation.BlobRef(), err)
+    return
+  }
+  bytes, err := mut.Operation.MarshalJSON()
+  if err != nil {
+    panic("Cannot serialize")
+  }
+  mutation.SetOperation(bytes)
+  return nil
+}
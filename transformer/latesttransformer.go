@@ -12,12 +12,14 @@ type latestTransformer struct {
 }
 
 type latestMutation struct {
+  BlobRef string
+  PermaBlobRef string
   Time int64
   Operation interface{}
 }
 
 type stringDummy struct {
-  Value string
+  Value string "op"
 }
 
 func NewLatestTransformer(grapher *grapher.Grapher) grapher.Transformer {
@@ -42,6 +44,8 @@ func decodeGenericMutation(mutation grapher.MutationNode) (mut latestMutation, e
   default:
     mut.Operation = mutation.Operation()
   }
+  mut.BlobRef = mutation.BlobRef()
+  mut.PermaBlobRef = mutation.PermaBlobRef()
   mut.Time = mutation.Time();
   return
 }
@@ -62,12 +66,21 @@ func (self *latestTransformer) TransformClientMutation(mutation grapher.Mutation
     return e
   }
 
-  // If any of these is later, then the mutation is transformed into the epsilon operation
+  // If any of these is later, then the mutation is transformed into the epsilon operation.
+  // The client mutation has the blobref "Z" and therefore looses a tie against all other mutations.
+  overridden := []grapher.MutationNode{}
   for m := range concurrent {
-    if m.Time() > mut.Time {
+    if isLater(m, mut) {
+      self.reportConflict(m, mutation, mut)
       mutation.SetOperation([]byte("null"));
       return
     }
+    if !isEpsilon(m) {
+      overridden = append(overridden, m)
+    }
+  }
+  for _, m := range overridden {
+    self.reportConflict(mutation, m, mut)
   }
   return
 }
@@ -84,15 +97,93 @@ func (self *latestTransformer) TransformMutation(mutation grapher.MutationNode,
   for _, id := range concurrent {
     conc[id] = true
   }  
+  overridden := []grapher.MutationNode{}
   for m := range rollback {
     // Skip those which are not concurrent
     if _, ok := conc[m.BlobRef()]; !ok {
       continue;
     }
-    if m.Time() > mut.Time {
+    if isLater(m, mut) {
+      self.reportConflict(m, mutation, mut)
       mutation.SetOperation([]byte("null"));
       return
     }
+    if !isEpsilon(m) {
+      overridden = append(overridden, m)
+    }
+  }
+  for _, m := range overridden {
+    self.reportConflict(mutation, m, mut)
   }
   return 
 }
+
+// Interface towards the Grapher. Implements grapher.Pruner such that a field can be read at a past frontier.
+// The value of the field is the one of the latest remaining mutation, hence the remaining mutations are not changed.
+// However, a remaining mutation which lost against a pruned one has been turned into the epsilon operation
+// and its value cannot be restored. In this case an error is returned.
+func (self *latestTransformer) PruneMutations(mutations []grapher.MutationNode, prune map[string]bool) (result []grapher.MutationNode, err os.Error) {
+  for _, m := range mutations {
+    if !prune[m.BlobRef()] {
+      result = append(result, m)
+    }
+  }
+  for _, m := range result {
+    if !isEpsilon(m) {
+      continue
+    }
+    // The mutation must have lost against a remaining mutation
+    mut := latestMutation{BlobRef: m.BlobRef(), PermaBlobRef: m.PermaBlobRef(), Time: m.Time()}
+    lost := false
+    for _, r := range result {
+      if !isEpsilon(r) && isLater(r, mut) {
+	lost = true
+	break
+      }
+    }
+    if !lost {
+      return nil, os.NewError("The value of mutation " + m.BlobRef() + " has been overridden by a pruned mutation")
+    }
+  }
+  return
+}
+
+// Returns true if the mutation 'm' wins against the decoded mutation 'mut'.
+// The mutation with the later timestamp wins. If both timestamps are equal, the larger blobref wins.
+// Thus all peers agree on the winner regardless of the order in which the mutations arrive.
+func isLater(m grapher.MutationNode, mut latestMutation) bool {
+  if m.Time() != mut.Time {
+    return m.Time() > mut.Time
+  }
+  return m.BlobRef() > mut.BlobRef
+}
+
+// Returns true if the mutation has been transformed into the epsilon operation before.
+// Overriding such a mutation is no conflict, because its value has never been applied.
+func isEpsilon(mutation grapher.MutationNode) bool {
+  op, ok := mutation.Operation().([]byte)
+  return ok && string(op) == "null"
+}
+
+// Reports that the value of 'loser' has been discarded or overridden by the value of 'winner'.
+// One of both is the mutation being transformed, which has already been decoded into 'mut'.
+func (self *latestTransformer) reportConflict(winner, loser grapher.MutationNode, mut latestMutation) {
+  c := &grapher.Conflict{PermaBlobRef: mut.PermaBlobRef, EntityBlobRef: winner.EntityBlobRef(), Field: winner.Field(), Winner: winner.BlobRef(), Loser: loser.BlobRef()}
+  for _, x := range []grapher.MutationNode{winner, loser} {
+    value := mut.Operation
+    if x.BlobRef() != mut.BlobRef {
+      m, err := decodeGenericMutation(x)
+      if err != nil {
+	log.Printf("Err: Decoding")
+	continue
+      }
+      value = m.Operation
+    }
+    if x == winner {
+      c.WinnerValue = value
+    } else {
+      c.LoserValue = value
+    }
+  }
+  self.grapher.ReportConflict(c)
+}
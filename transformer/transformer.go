@@ -123,6 +123,43 @@ func (self *transformer) TransformMutation(mutation grapher.MutationNode, rollba
   return nil  
 }
 
+// Interface towards the Grapher. Implements grapher.Pruner such that the text of a field can be read at a past frontier.
+// The remaining mutations are changed as if the pruned mutations had never been applied.
+func (self *transformer) PruneMutations(mutations []grapher.MutationNode, prune map[string]bool) (result []grapher.MutationNode, err os.Error) {
+  muts := make([]ot.StringMutation, 0, len(mutations))
+  // The IDs of the pruned mutations
+  ids := make(map[string]bool)
+  for _, m := range mutations {
+    mut, e := decodeMutation(m)
+    if e != nil {
+      return nil, e
+    }
+    if prune[m.BlobRef()] {
+      ids[mut.Id] = true
+    }
+    muts = append(muts, mut)
+  }
+  pmuts, err := ot.PruneStringMutationSeq(muts, ids)
+  if err != nil {
+    log.Printf("Prune Error: %v\n", err)
+    return nil, err
+  }
+  // The pruned sequence holds the remaining mutations in the same order
+  for _, m := range mutations {
+    if prune[m.BlobRef()] {
+      continue
+    }
+    bytes, e := ot.MarshalStringOperations(pmuts[0].Operations)
+    if e != nil {
+      return nil, e
+    }
+    pmuts = pmuts[1:]
+    m.SetOperation(bytes)
+    result = append(result, m)
+  }
+  return
+}
+
 // Transform two mutations
 func transform(m1 ot.StringMutation, m2 ot.StringMutation) (tm1 ot.StringMutation, tm2 ot.StringMutation, err os.Error) {
   tm1 = m1
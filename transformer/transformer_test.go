@@ -6,9 +6,16 @@ import (
   grapher "lightwavegrapher"
   "testing"
   "log"
-  "time"
+  "json"
 )
 
+var schema = &grapher.Schema{ FileSchemas: map[string]*grapher.FileSchema {
+    "application/x-test-file": &grapher.FileSchema{ EntitySchemas: map[string]*grapher.EntitySchema {
+	"application/x-test-entity": &grapher.EntitySchema { FieldSchemas: map[string]*grapher.FieldSchema {
+	    "text": &grapher.FieldSchema{ Type: grapher.TypeString, ElementType: grapher.TypeNone, Transformation: grapher.TransformationMerge },
+	    "title": &grapher.FieldSchema{ Type: grapher.TypeString, ElementType: grapher.TypeNone, Transformation: grapher.TransformationLatest },
+	    "count": &grapher.FieldSchema{ Type: grapher.TypeInt, ElementType: grapher.TypeNone, Transformation: grapher.TransformationAdd } } } } } } }
+
 type dummyAPI struct {
   t *testing.T
   text *ot.SimpleText
@@ -29,6 +36,9 @@ func (self *dummyAPI) Blob_Permission(perma grapher.PermaNode, perm grapher.Perm
 func (self *dummyAPI) Blob_Entity(perma grapher.PermaNode, entity grapher.EntityNode) {
 }
 
+func (self *dummyAPI) Blob_DeleteEntity(perma grapher.PermaNode, entity grapher.DelEntityNode) {
+}
+
 func (self *dummyAPI) Blob_Mutation(perma grapher.PermaNode, mutation grapher.MutationNode) {
   if mutation.Field() != "text" {
     self.t.Fatal("Expected 'text' as the field in all mutations")
@@ -62,17 +72,17 @@ func (self *dummyAPI) Blob_Mutation(perma grapher.PermaNode, mutation grapher.Mu
 func TestTransformer(t *testing.T) {
   s := store.NewSimpleBlobStore()
   sg := grapher.NewSimpleGraphStore()
-  grapher := grapher.NewGrapher("a@b", s, sg, nil)
+  grapher := grapher.NewGrapher("a@b", schema, s, sg, nil)
   s.AddListener(grapher)
   NewTransformer(grapher)
   api := &dummyAPI{t: t, text: ot.NewSimpleText("")}
   grapher.SetAPI(api)
   
-  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc"}`)
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "mimetype":"application/x-test-file"}`)
   blobref1 := store.NewBlobRef(blob1)
   blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "dep":[]}`)
   blobref1b := store.NewBlobRef(blob1b)
-  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "content":"", "dep":["` + blobref1b + `"]}`)
+  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype":"application/x-test-entity", "content":"", "dep":["` + blobref1b + `"]}`)
   blobref1c := store.NewBlobRef(blob1c)
   blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$t":["Hello World"]}, "entity":"` + blobref1c + `", "field":"text"}`)
   blobref2 := store.NewBlobRef(blob2)
@@ -88,9 +98,241 @@ func TestTransformer(t *testing.T) {
   s.StoreBlob(blob3, blobref3)  
   s.StoreBlob(blob4, blobref4)  
   
-  time.Sleep(1000000000 * 2)
+  grapher.WaitIdle()
 
   if api.text.String() != "Hello World??Olla!!" {
     t.Fatal("Wrong resulting text:" + api.text.String())
   }
-}
\ No newline at end of file
+}
+// A mutation created by a local client is transformed via TransformClientMutation against
+// the mutations which the client did not yet know when it applied the mutation optimistically.
+func TestTransformClientMutation(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := grapher.NewSimpleGraphStore()
+  g := grapher.NewGrapher("a@b", schema, s, sg, nil)
+  NewTransformer(g)
+  api := &dummyAPI{t: t, text: ot.NewSimpleText("")}
+  g.SetAPI(api)
+
+  perma, err := g.CreatePermaBlob("application/x-test-file")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = g.CreateKeepBlob(perma.BlobRef(), ""); err != nil {
+    t.Fatal(err)
+  }
+  entity, err := g.CreateEntityBlob(perma.BlobRef(), "application/x-test-entity", []byte(`""`))
+  if err != nil {
+    t.Fatal(err)
+  }
+  // The sequence number of the perma node after the entity has been applied
+  seq := entity.(grapher.OTNode).SequenceNumber() + 1
+  if _, err = g.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":["Hello World"]}`), seq); err != nil {
+    t.Fatal(err)
+  }
+  // Two clients edit the text concurrently. Both know "Hello World"
+  seq++
+  if _, err = g.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":[{"$s":5}, "!"]}`), seq); err != nil {
+    t.Fatal(err)
+  }
+  // The second client did not yet see the "!". Its insertion position must be shifted
+  if _, err = g.CreateMutationBlob(perma.BlobRef(), entity.BlobRef(), "text", []byte(`{"$t":[{"$s":11}, "?"]}`), seq); err != nil {
+    t.Fatal(err)
+  }
+  if api.text.String() != "Hello! World?" {
+    t.Fatal("Wrong resulting text:" + api.text.String())
+  }
+}
+
+// Records the value of the 'title' field
+type latestAPI struct {
+  dummyAPI
+  title string
+}
+
+func (self *latestAPI) Blob_Mutation(perma grapher.PermaNode, mutation grapher.MutationNode) {
+  op, ok := mutation.Operation().([]byte)
+  if !ok {
+    self.t.Fatal("Expected a JSON value")
+  }
+  // The mutation lost against a concurrent one
+  if string(op) == "null" {
+    return
+  }
+  if err := json.Unmarshal(op, &self.title); err != nil {
+    self.t.Fatal(err.String())
+  }
+}
+
+// Applies the blobs in the given order and returns the resulting title
+func applyLatest(t *testing.T, blobs [][]byte) string {
+  s := store.NewSimpleBlobStore()
+  sg := grapher.NewSimpleGraphStore()
+  g := grapher.NewGrapher("a@b", schema, s, sg, nil)
+  s.AddListener(g)
+  NewLatestTransformer(g)
+  api := &latestAPI{dummyAPI: dummyAPI{t: t}}
+  g.SetAPI(api)
+  for _, blob := range blobs {
+    s.StoreBlob(blob, store.NewBlobRef(blob))
+  }
+  g.WaitIdle()
+  return api.title
+}
+
+// Two concurrent edits of a last-writer-wins field resolve to the later one regardless of the arrival order
+func TestLatestTransformer(t *testing.T) {
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "mimetype":"application/x-test-file"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "dep":[]}`)
+  blobref1b := store.NewBlobRef(blob1b)
+  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype":"application/x-test-entity", "content":"", "dep":["` + blobref1b + `"]}`)
+  blobref1c := store.NewBlobRef(blob1c)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":"Later", "entity":"` + blobref1c + `", "field":"title", "t":2000}`)
+  blob3 := []byte(`{"type":"mutation", "signer":"x@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":"Earlier", "entity":"` + blobref1c + `", "field":"title", "t":1000}`)
+
+  if title := applyLatest(t, [][]byte{blob1, blob1b, blob1c, blob2, blob3}); title != "Later" {
+    t.Fatal("Wrong resulting title: " + title)
+  }
+  if title := applyLatest(t, [][]byte{blob1, blob1b, blob1c, blob3, blob2}); title != "Later" {
+    t.Fatal("Wrong resulting title: " + title)
+  }
+
+  // With equal timestamps the larger blobref wins
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":"One", "entity":"` + blobref1c + `", "field":"title", "t":1000}`)
+  blob5 := []byte(`{"type":"mutation", "signer":"x@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":"Two", "entity":"` + blobref1c + `", "field":"title", "t":1000}`)
+  winner := "One"
+  if store.NewBlobRef(blob5) > store.NewBlobRef(blob4) {
+    winner = "Two"
+  }
+  if title := applyLatest(t, [][]byte{blob1, blob1b, blob1c, blob4, blob5}); title != winner {
+    t.Fatal("Wrong resulting title: " + title)
+  }
+  if title := applyLatest(t, [][]byte{blob1, blob1b, blob1c, blob5, blob4}); title != winner {
+    t.Fatal("Wrong resulting title: " + title)
+  }
+}
+
+// Records the value of the 'count' field
+type addAPI struct {
+  dummyAPI
+  count interface{}
+}
+
+func (self *addAPI) Blob_Mutation(perma grapher.PermaNode, mutation grapher.MutationNode) {
+  var op ot.Operation
+  if err := op.UnmarshalJSON(mutation.Operation().([]byte)); err != nil {
+    self.t.Fatal(err.String())
+  }
+  count, err := ot.ExecuteOperation(self.count, op)
+  if err != nil {
+    self.t.Fatal(err.String())
+  }
+  self.count = count
+}
+
+// Two concurrent increments of a counter sum up regardless of the arrival order
+func TestAddTransformer(t *testing.T) {
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "mimetype":"application/x-test-file"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "dep":[]}`)
+  blobref1b := store.NewBlobRef(blob1b)
+  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype":"application/x-test-entity", "content":"", "dep":["` + blobref1b + `"]}`)
+  blobref1c := store.NewBlobRef(blob1c)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$n":3}, "entity":"` + blobref1c + `", "field":"count"}`)
+  blob3 := []byte(`{"type":"mutation", "signer":"x@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$n":5}, "entity":"` + blobref1c + `", "field":"count"}`)
+
+  for _, blobs := range [][][]byte{[][]byte{blob1, blob1b, blob1c, blob2, blob3}, [][]byte{blob1, blob1b, blob1c, blob3, blob2}} {
+    s := store.NewSimpleBlobStore()
+    sg := grapher.NewSimpleGraphStore()
+    g := grapher.NewGrapher("a@b", schema, s, sg, nil)
+    s.AddListener(g)
+    NewAddTransformer(g)
+    api := &addAPI{dummyAPI: dummyAPI{t: t}}
+    g.SetAPI(api)
+    for _, blob := range blobs {
+      s.StoreBlob(blob, store.NewBlobRef(blob))
+    }
+    g.WaitIdle()
+    if count, ok := api.count.(int64); !ok || count != 8 {
+      t.Fatalf("Wrong resulting count: %v", api.count)
+    }
+  }
+}
+
+// The text of a field at a past frontier leaves out the concurrent mutations which are not part of the frontier
+func TestPruneMutations(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := grapher.NewSimpleGraphStore()
+  g := grapher.NewGrapher("a@b", schema, s, sg, nil)
+  s.AddListener(g)
+  NewTransformer(g)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "mimetype":"application/x-test-file"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "dep":[]}`)
+  blobref1b := store.NewBlobRef(blob1b)
+  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype":"application/x-test-entity", "content":"", "dep":["` + blobref1b + `"]}`)
+  blobref1c := store.NewBlobRef(blob1c)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$t":["Hello World"]}, "entity":"` + blobref1c + `", "field":"text"}`)
+  blobref2 := store.NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"x@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$t":["Olla!!"]}, "entity":"` + blobref1c + `", "field":"text"}`)
+  blobref3 := store.NewBlobRef(blob3)
+  blob4 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref2 + `"], "op":{"$t":[{"$s":11}, "??"]}, "entity":"` + blobref1c + `", "field":"text"}`)
+  blobref4 := store.NewBlobRef(blob4)
+  for _, blob := range [][]byte{blob1, blob1b, blob1c, blob2, blob3, blob4} {
+    s.StoreBlob(blob, store.NewBlobRef(blob))
+  }
+  g.WaitIdle()
+
+  // The mutation of x@b has been applied before the last mutation of a@b and must be pruned
+  value, err := g.FieldValueAt(blobref1, blobref1c, "text", []string{blobref4})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if value != "Hello World??" {
+    t.Fatalf("Wrong text at the frontier: %v", value)
+  }
+  if value, err = g.FieldValueAt(blobref1, blobref1c, "text", []string{blobref3}); err != nil || value != "Olla!!" {
+    t.Fatalf("Wrong text at the frontier: %v %v", value, err)
+  }
+}
+
+// Pruning a last-writer-wins field keeps the remaining values unless they lost against a pruned mutation
+func TestPruneLatestMutations(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := grapher.NewSimpleGraphStore()
+  g := grapher.NewGrapher("a@b", schema, s, sg, nil)
+  s.AddListener(g)
+  pruner := NewLatestTransformer(g).(grapher.Pruner)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "mimetype":"application/x-test-file"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `", "dep":[]}`)
+  blobref1b := store.NewBlobRef(blob1b)
+  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype":"application/x-test-entity", "content":"", "dep":["` + blobref1b + `"]}`)
+  blobref1c := store.NewBlobRef(blob1c)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":"Later", "entity":"` + blobref1c + `", "field":"title", "t":2000}`)
+  blobref2 := store.NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"x@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":"Earlier", "entity":"` + blobref1c + `", "field":"title", "t":1000}`)
+  blobref3 := store.NewBlobRef(blob3)
+  for _, blob := range [][]byte{blob1, blob1b, blob1c, blob2, blob3} {
+    s.StoreBlob(blob, store.NewBlobRef(blob))
+  }
+  g.WaitIdle()
+
+  m2, _ := g.LookupMutation(blobref1, blobref2)
+  m3, _ := g.LookupMutation(blobref1, blobref3)
+  if m2 == nil || m3 == nil {
+    t.Fatal("Mutations have not been applied")
+  }
+  muts := []grapher.MutationNode{m2, m3}
+  result, err := pruner.PruneMutations(muts, map[string]bool{blobref3: true})
+  if err != nil || len(result) != 1 || result[0].BlobRef() != blobref2 {
+    t.Fatalf("Wrong result of pruning the losing mutation: %v %v", result, err)
+  }
+  // The value of the earlier mutation has been discarded when the later one won
+  if _, err = pruner.PruneMutations(muts, map[string]bool{blobref2: true}); err == nil {
+    t.Fatal("Expected an error when pruning the winning mutation")
+  }
+}